@@ -29,6 +29,7 @@ import (
 	"time"
 
 	"github.com/saba-futai/sudoku/internal/protocol"
+	"github.com/saba-futai/sudoku/pkg/control"
 	"github.com/saba-futai/sudoku/pkg/crypto"
 	"github.com/saba-futai/sudoku/pkg/dnsutil"
 	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
@@ -144,13 +145,7 @@ func establishBaseConn(ctx context.Context, cfg *ProtocolConfig, validate func(*
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
-	resolvedAddr, err := dnsutil.ResolveWithCache(ctx, cfg.ServerAddress)
-	if err != nil {
-		return nil, fmt.Errorf("resolve server address failed: %w", err)
-	}
-
-	var d net.Dialer
-	rawConn, err := d.DialContext(ctx, "tcp", resolvedAddr)
+	rawConn, err := dnsutil.DialContext(ctx, "tcp", cfg.ServerAddress)
 	if err != nil {
 		return nil, fmt.Errorf("dial tcp failed: %w", err)
 	}
@@ -162,10 +157,19 @@ func establishBaseConn(ctx context.Context, cfg *ProtocolConfig, validate func(*
 		}
 	}()
 
+	if cfg.TLS != nil {
+		tlsConn, err := cfg.TLS.Client(ctx, rawConn, cfg.ServerAddress)
+		if err != nil {
+			return nil, fmt.Errorf("tls handshake failed: %w", err)
+		}
+		rawConn = tlsConn
+	}
+
 	if !cfg.DisableHTTPMask {
-		if err := httpmask.WriteRandomRequestHeader(rawConn, cfg.ServerAddress); err != nil {
+		if err := cfg.HTTPMask.WriteRequest(rawConn, cfg.ServerAddress); err != nil {
 			return nil, fmt.Errorf("write http mask failed: %w", err)
 		}
+		rawConn = httpmask.NewResponseConn(rawConn)
 	}
 
 	table, tableID, err := pickClientTable(cfg)
@@ -187,12 +191,15 @@ func establishBaseConn(ctx context.Context, cfg *ProtocolConfig, validate func(*
 		return nil, fmt.Errorf("send handshake failed: %w", err)
 	}
 
-	if _, err := cConn.Write([]byte{downlinkMode(cfg)}); err != nil {
+	if _, err := cConn.Write([]byte{clientMode(cfg)}); err != nil {
 		cConn.Close()
 		return nil, fmt.Errorf("send downlink mode failed: %w", err)
 	}
 
 	success = true
+	if cfg.KeepAlive != nil {
+		return control.New(cConn, cfg.KeepAlive), nil
+	}
 	return cConn, nil
 }
 
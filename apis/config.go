@@ -22,7 +22,11 @@ package apis
 import (
 	"fmt"
 
+	"github.com/saba-futai/sudoku/pkg/control"
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+	"github.com/saba-futai/sudoku/pkg/obfs/shaping"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+	"github.com/saba-futai/sudoku/pkg/transport/tlswrap"
 )
 
 // ProtocolConfig 定义了 Sudoku 协议栈所需的所有参数
@@ -76,10 +80,19 @@ type ProtocolConfig struct {
 	// 必须 >= PaddingMin
 	PaddingMax int
 
+	// PaddingStrategy 填充率在连接生命周期内的变化方式，两种编码（纯 Sudoku 与带宽优化）都会使用
+	// 有效值: "fixed"（默认，建连时取定值）、"front"、"decay"、"random-walk"、"burst"，见 sudoku.PaddingStrategies
+	// 仅影响本端写出的数据，两端无需一致
+	PaddingStrategy string
+
 	// EnablePureDownlink 是否保持纯 Sudoku 下行
 	// false 时启用带宽优化的 6bit 拆分下行，要求 AEAD 启用
 	EnablePureDownlink bool
 
+	// EnablePackedUplink 客户端上行（含握手）也使用带宽优化的 6bit 拆分编码，要求 AEAD 启用
+	// 通过握手模式字节协商；服务端无需设置，会自动识别两种上行编码
+	EnablePackedUplink bool
+
 	// ============ 客户端特有字段 ============
 
 	// TargetAddress 客户端想要访问的最终目标地址 (仅客户端使用)
@@ -102,6 +115,24 @@ type ProtocolConfig struct {
 	// 如果为 true，客户端不发送伪装头，服务端也不检测伪装头
 	// 注意：服务端支持自动检测，即使此项为 false，也能处理不带伪装头的客户端（前提是首字节不匹配 POST）
 	DisableHTTPMask bool
+
+	// HTTPMask 可选，自定义伪装请求模板（客户端）与路径/请求头暗号（服务端）
+	// nil 时使用内置模板并接受任意伪装请求
+	// 服务端设置 RequirePath/RequireHeaders 后，未携带暗号或未伪装的连接按握手失败处理（交给回落）
+	HTTPMask *httpmask.Options
+
+	// TLS 可选，HTTP 伪装之下的 TLS 外层
+	// 客户端使用 ServerName/PinSHA256/ALPN/Fingerprint，服务端使用 CertFile/KeyFile（留空时自签名）
+	// 双方必须同时启用或同时关闭
+	TLS *tlswrap.Options
+
+	// Shaping 可选，按方向整形写入的报文大小（直方图分布、尾部合并、纯填充分段）
+	// 客户端使用 Uplink，服务端使用 Downlink；接收方无需任何设置
+	Shaping *shaping.Options
+
+	// KeepAlive 可选，在 AEAD 之上启用控制帧：心跳测 RTT、空闲掩护流量、连续未回应时判定对端失效
+	// 由客户端开启（握手模式字节中携带标志）；服务端总会应答，自身是否发心跳/掩护流量由本字段决定
+	KeepAlive *control.Options
 }
 
 // Validate 验证配置的有效性
@@ -139,14 +170,41 @@ func (c *ProtocolConfig) Validate() error {
 		return fmt.Errorf("PaddingMax (%d) must be >= PaddingMin (%d)", c.PaddingMax, c.PaddingMin)
 	}
 
+	if err := sudoku.ValidatePaddingStrategy(c.PaddingStrategy); err != nil {
+		return fmt.Errorf("invalid PaddingStrategy: %w", err)
+	}
+
 	if !c.EnablePureDownlink && c.AEADMethod == "none" {
 		return fmt.Errorf("bandwidth optimized downlink requires AEAD")
 	}
 
+	if c.EnablePackedUplink && c.AEADMethod == "none" {
+		return fmt.Errorf("bandwidth optimized uplink requires AEAD")
+	}
+
 	if c.HandshakeTimeoutSeconds < 0 {
 		return fmt.Errorf("HandshakeTimeoutSeconds must be >= 0, got %d", c.HandshakeTimeoutSeconds)
 	}
 
+	if err := c.HTTPMask.Validate(); err != nil {
+		return fmt.Errorf("invalid HTTPMask: %w", err)
+	}
+	if c.HTTPMask.Required() && c.DisableHTTPMask {
+		return fmt.Errorf("HTTPMask requirements need DisableHTTPMask=false")
+	}
+
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("invalid TLS: %w", err)
+	}
+
+	if err := c.Shaping.Validate(); err != nil {
+		return fmt.Errorf("invalid Shaping: %w", err)
+	}
+
+	if err := c.KeepAlive.Validate(); err != nil {
+		return fmt.Errorf("invalid KeepAlive: %w", err)
+	}
+
 	return nil
 }
 
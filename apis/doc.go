@@ -10,6 +10,8 @@
 //     the decrypted tunnel plus the requested target address (TCP mode).
 //   - ServerHandshakeFlexible: server-side helper that upgrades connections and lets callers
 //     detect UoT or read the target address themselves.
+//   - HTTPHandler: an http.Handler mounted on a ServeMux path that hijacks mask requests and
+//     upgrades them, so an existing net/http site and the tunnel share one process and port.
 //   - HandshakeError: wraps errors while preserving bytes already consumed so callers can
 //     gracefully fall back to raw TCP/HTTP handling if desired.
 //
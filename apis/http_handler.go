@@ -0,0 +1,172 @@
+/*
+Copyright (C) 2025 by ふたい <contact me via issue>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+In addition, no derivative work may use the name or imply association
+with this application without prior consent.
+*/
+package apis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/protocol"
+)
+
+// maxHandlerProbeBytes 请求体中用于识别 Sudoku 握手的最大字节数
+const maxHandlerProbeBytes = 64 * 1024
+
+// HTTPHandler 让现有的 net/http 服务器在同一端口上承载 Sudoku 隧道。
+//
+// 将其挂载到 http.ServeMux 的某个路径上（客户端用 HTTPMask 模板把伪装请求发往该路径）：
+//   - 带请求体的伪装请求（POST/PUT/PATCH）：先通过 Request.Body 读取开头的数据尝试识别握手，
+//     识别成功才劫持连接；否则把已读数据放回请求体，交给 Next 处理，真实请求不受影响。
+//   - WebSocket 形式的伪装请求：请求体为空无法预读，直接劫持连接；识别失败时回应 400 并关闭。
+//     因此挂载路径不要与真实的 WebSocket 接口重合。
+//   - 其余请求直接交给 Next；Next 为 nil 时回应 404。
+//
+// 握手成功后以隧道连接和目标地址调用 Serve，连接由 Serve 负责关闭。
+// Config 应事先通过 Validate 校验；其中的 TLS 字段不会被使用，TLS 由 http.Server 自身负责。
+type HTTPHandler struct {
+	Config *ProtocolConfig
+	Next   http.Handler
+	Serve  func(tunnel net.Conn, targetAddr string)
+
+	// ErrorLog 可选，记录劫持后的握手失败
+	ErrorLog func(err error)
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := h.Config
+	if cfg == nil || cfg.DisableHTTPMask || r.ProtoMajor != 1 {
+		h.next(w, r)
+		return
+	}
+	header := requestHeader(r)
+	if cfg.HTTPMask.Check(header) != nil {
+		h.next(w, r)
+		return
+	}
+
+	timeout := time.Duration(cfg.HandshakeTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	rc := http.NewResponseController(w)
+
+	var probe []byte
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && r.Header.Get("Sec-WebSocket-Key") != "":
+	case r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody:
+		rc.SetReadDeadline(time.Now().Add(timeout))
+		var ok bool
+		probe, ok = h.probeBody(r.Body)
+		rc.SetReadDeadline(time.Time{})
+		if !ok {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(probe), r.Body), r.Body}
+			h.next(w, r)
+			return
+		}
+	default:
+		h.next(w, r)
+		return
+	}
+
+	conn, brw, err := rc.Hijack()
+	if err != nil {
+		h.logf(fmt.Errorf("hijack failed: %w", err))
+		return
+	}
+	// 先重放从请求体读到的探测数据，再读 http.Server 缓冲的剩余数据
+	stream := &preBufferedConn{Conn: &bufferedConn{Conn: conn, r: brw.Reader}, buf: probe}
+	stream.SetReadDeadline(time.Now().Add(timeout))
+
+	tunnel, fail, err := upgradeServerConn(stream, bufio.NewReader(stream), header, true, cfg)
+	if err != nil {
+		if probe == nil {
+			io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		}
+		conn.Close()
+		h.logf(err)
+		return
+	}
+	targetAddr, _, _, err := protocol.ReadAddress(tunnel)
+	if err != nil {
+		tunnel.Close()
+		h.logf(fail(fmt.Errorf("read target address failed: %w", err)))
+		return
+	}
+	h.Serve(tunnel, targetAddr)
+}
+
+// probeBody 从请求体读取数据直到某张表的握手校验通过，或确定不是 Sudoku 握手
+func (h *HTTPHandler) probeBody(body io.Reader) ([]byte, bool) {
+	tables := h.Config.tableCandidates()
+	probe := make([]byte, 0, 4096)
+	tmp := make([]byte, 4096)
+	for len(probe) < maxHandlerProbeBytes {
+		n, readErr := body.Read(tmp)
+		probe = append(probe, tmp[:n]...)
+
+		needMore := false
+		for _, table := range tables {
+			_, err := probeHandshakeBytes(probe, h.Config, table)
+			if err == nil {
+				return probe, true
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				needMore = true
+			}
+		}
+		if !needMore || readErr != nil {
+			return probe, false
+		}
+	}
+	return probe, false
+}
+
+func (h *HTTPHandler) next(w http.ResponseWriter, r *http.Request) {
+	if h.Next == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.Next.ServeHTTP(w, r)
+}
+
+func (h *HTTPHandler) logf(err error) {
+	if h.ErrorLog != nil {
+		h.ErrorLog(err)
+	}
+}
+
+// requestHeader 还原请求头，供 HTTPMask.Check 与 HandshakeError 使用
+func requestHeader(r *http.Request) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/%d.%d\r\nHost: %s\r\n", r.Method, r.RequestURI, r.ProtoMajor, r.ProtoMinor, r.Host)
+	r.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
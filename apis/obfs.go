@@ -4,12 +4,22 @@ import (
 	"io"
 	"net"
 
+	"github.com/saba-futai/sudoku/pkg/obfs/shaping"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
 )
 
 const (
 	downlinkModePure   byte = 0x01
 	downlinkModePacked byte = 0x02
+
+	// modeFlagControl 表示客户端在 AEAD 之上启用了控制帧（心跳、掩护流量）
+	modeFlagControl byte = 0x80
+	// modeFlagPackedUplink 表示客户端上行（含握手）使用带宽优化编码，服务端通过探测识别
+	modeFlagPackedUplink byte = 0x40
+	// modeFlagMaskResponse 表示客户端发送了伪装请求并会剥离服务端的响应头；旧客户端不置位
+	modeFlagMaskResponse byte = 0x20
+
+	modeFlags = modeFlagControl | modeFlagPackedUplink | modeFlagMaskResponse
 )
 
 type directionalConn struct {
@@ -50,12 +60,43 @@ func downlinkMode(cfg *ProtocolConfig) byte {
 	return downlinkModePacked
 }
 
+// clientMode 为客户端发送的模式字节：下行模式加上选项标志
+func clientMode(cfg *ProtocolConfig) byte {
+	mode := downlinkMode(cfg)
+	if cfg.KeepAlive != nil {
+		mode |= modeFlagControl
+	}
+	if cfg.EnablePackedUplink {
+		mode |= modeFlagPackedUplink
+	}
+	if !cfg.DisableHTTPMask {
+		mode |= modeFlagMaskResponse
+	}
+	return mode
+}
+
 func buildClientObfsConn(raw net.Conn, cfg *ProtocolConfig, table *sudoku.Table) net.Conn {
-	base := sudoku.NewConn(raw, table, cfg.PaddingMin, cfg.PaddingMax, false)
+	if cfg.Shaping != nil {
+		raw = shaping.Wrap(raw, cfg.Shaping.Uplink, table.FillerBytes())
+	}
+	if cfg.EnablePackedUplink {
+		uplink := newPackedConn(raw, cfg, table)
+		var reader io.Reader = newPackedConn(raw, cfg, table)
+		if cfg.EnablePureDownlink {
+			reader = newSudokuConn(raw, cfg, table, false)
+		}
+		return &directionalConn{
+			Conn:    raw,
+			reader:  reader,
+			writer:  uplink,
+			closers: []func() error{uplink.Flush},
+		}
+	}
+	base := newSudokuConn(raw, cfg, table, false)
 	if cfg.EnablePureDownlink {
 		return base
 	}
-	packed := sudoku.NewPackedConn(raw, table, cfg.PaddingMin, cfg.PaddingMax)
+	packed := newPackedConn(raw, cfg, table)
 	return &directionalConn{
 		Conn:   raw,
 		reader: packed,
@@ -63,12 +104,33 @@ func buildClientObfsConn(raw net.Conn, cfg *ProtocolConfig, table *sudoku.Table)
 	}
 }
 
-func buildServerObfsConn(raw net.Conn, cfg *ProtocolConfig, table *sudoku.Table, record bool) (*sudoku.Conn, net.Conn) {
-	uplink := sudoku.NewConn(raw, table, cfg.PaddingMin, cfg.PaddingMax, record)
+// buildServerObfsConn 按探测到的上行编码构建服务端混淆层；带宽优化上行时不录制，第一个返回值为 nil
+func buildServerObfsConn(raw net.Conn, cfg *ProtocolConfig, table *sudoku.Table, packedUplink, record bool) (*sudoku.Conn, net.Conn) {
+	if cfg.Shaping != nil {
+		raw = shaping.Wrap(raw, cfg.Shaping.Downlink, table.FillerBytes())
+	}
+	if packedUplink {
+		uplink := newPackedConn(raw, cfg, table)
+		if cfg.EnablePureDownlink {
+			return nil, &directionalConn{
+				Conn:   raw,
+				reader: uplink,
+				writer: newSudokuConn(raw, cfg, table, false),
+			}
+		}
+		packed := newPackedConn(raw, cfg, table)
+		return nil, &directionalConn{
+			Conn:    raw,
+			reader:  uplink,
+			writer:  packed,
+			closers: []func() error{packed.Flush},
+		}
+	}
+	uplink := newSudokuConn(raw, cfg, table, record)
 	if cfg.EnablePureDownlink {
 		return uplink, uplink
 	}
-	packed := sudoku.NewPackedConn(raw, table, cfg.PaddingMin, cfg.PaddingMax)
+	packed := newPackedConn(raw, cfg, table)
 	return uplink, &directionalConn{
 		Conn:    raw,
 		reader:  uplink,
@@ -76,3 +138,20 @@ func buildServerObfsConn(raw net.Conn, cfg *ProtocolConfig, table *sudoku.Table,
 		closers: []func() error{packed.Flush},
 	}
 }
+
+// newSudokuConn / newPackedConn 按 PaddingStrategy 设置填充策略（Validate 已校验名称）
+func newSudokuConn(raw net.Conn, cfg *ProtocolConfig, table *sudoku.Table, record bool) *sudoku.Conn {
+	c := sudoku.NewConn(raw, table, cfg.PaddingMin, cfg.PaddingMax, record)
+	if cfg.PaddingStrategy != "" {
+		_ = c.SetPaddingStrategy(cfg.PaddingStrategy)
+	}
+	return c
+}
+
+func newPackedConn(raw net.Conn, cfg *ProtocolConfig, table *sudoku.Table) *sudoku.PackedConn {
+	c := sudoku.NewPackedConn(raw, table, cfg.PaddingMin, cfg.PaddingMax)
+	if cfg.PaddingStrategy != "" {
+		_ = c.SetPaddingStrategy(cfg.PaddingStrategy)
+	}
+	return c
+}
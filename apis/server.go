@@ -22,6 +22,7 @@ package apis
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -30,9 +31,11 @@ import (
 	"time"
 
 	"github.com/saba-futai/sudoku/internal/protocol"
+	"github.com/saba-futai/sudoku/pkg/control"
 	"github.com/saba-futai/sudoku/pkg/crypto"
 	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+	"github.com/saba-futai/sudoku/pkg/transport/tlswrap"
 )
 
 // bufferedConn 这是一个内部辅助结构，用于将 bufio 多读的数据传递给后续层
@@ -82,9 +85,26 @@ func drainBuffered(r *bufio.Reader) ([]byte, error) {
 	return out, err
 }
 
-func probeHandshakeBytes(probe []byte, cfg *ProtocolConfig, table *sudoku.Table) error {
+// probeHandshakeBytes 依次按纯 Sudoku 与带宽优化两种上行编码校验握手，返回客户端是否使用带宽优化上行。
+// 两者都不匹配时优先返回 EOF 类错误，使调用方继续读取
+func probeHandshakeBytes(probe []byte, cfg *ProtocolConfig, table *sudoku.Table) (bool, error) {
+	pureErr := probeHandshakeWith(probe, cfg, table, false)
+	if pureErr == nil {
+		return false, nil
+	}
+	packedErr := probeHandshakeWith(probe, cfg, table, true)
+	if packedErr == nil {
+		return true, nil
+	}
+	if errors.Is(pureErr, io.EOF) || errors.Is(pureErr, io.ErrUnexpectedEOF) {
+		return false, pureErr
+	}
+	return false, packedErr
+}
+
+func probeHandshakeWith(probe []byte, cfg *ProtocolConfig, table *sudoku.Table, packedUplink bool) error {
 	rc := &readOnlyConn{Reader: bytes.NewReader(probe)}
-	_, obfsConn := buildServerObfsConn(rc, cfg, table, false)
+	_, obfsConn := buildServerObfsConn(rc, cfg, table, packedUplink, false)
 	cConn, err := crypto.NewAEADConn(obfsConn, cfg.Key, cfg.AEADMethod)
 	if err != nil {
 		return err
@@ -104,50 +124,45 @@ func probeHandshakeBytes(probe []byte, cfg *ProtocolConfig, table *sudoku.Table)
 	if _, err := io.ReadFull(cConn, modeBuf); err != nil {
 		return err
 	}
-	if modeBuf[0] != downlinkMode(cfg) {
-		return fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0], downlinkMode(cfg))
+	if modeBuf[0]&^modeFlags != downlinkMode(cfg) {
+		return fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0]&^modeFlags, downlinkMode(cfg))
+	}
+	if (modeBuf[0]&modeFlagPackedUplink != 0) != packedUplink {
+		return fmt.Errorf("uplink mode mismatch")
 	}
 	return nil
 }
 
-func selectTableByProbe(r *bufio.Reader, cfg *ProtocolConfig, tables []*sudoku.Table) (*sudoku.Table, []byte, error) {
+// selectTableByProbe 读取数据直到握手能以某张表与某种上行编码解出，返回二者及已读数据
+func selectTableByProbe(r *bufio.Reader, cfg *ProtocolConfig, tables []*sudoku.Table) (*sudoku.Table, bool, []byte, error) {
 	const (
 		maxProbeBytes = 64 * 1024
 		readChunk     = 4 * 1024
 	)
 	if len(tables) == 0 {
-		return nil, nil, fmt.Errorf("no table candidates")
+		return nil, false, nil, fmt.Errorf("no table candidates")
 	}
 	if len(tables) > 255 {
-		return nil, nil, fmt.Errorf("too many table candidates: %d", len(tables))
+		return nil, false, nil, fmt.Errorf("too many table candidates: %d", len(tables))
 	}
 
 	probe, err := drainBuffered(r)
 	if err != nil {
-		return nil, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
+		return nil, false, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
 	}
 
 	tmp := make([]byte, readChunk)
 	for {
-		if len(tables) == 1 {
-			tail, err := drainBuffered(r)
-			if err != nil {
-				return nil, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
-			}
-			probe = append(probe, tail...)
-			return tables[0], probe, nil
-		}
-
 		needMore := false
 		for _, table := range tables {
-			err := probeHandshakeBytes(probe, cfg, table)
+			packedUplink, err := probeHandshakeBytes(probe, cfg, table)
 			if err == nil {
 				tail, err := drainBuffered(r)
 				if err != nil {
-					return nil, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
+					return nil, false, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
 				}
 				probe = append(probe, tail...)
-				return table, probe, nil
+				return table, packedUplink, probe, nil
 			}
 			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 				needMore = true
@@ -155,10 +170,10 @@ func selectTableByProbe(r *bufio.Reader, cfg *ProtocolConfig, tables []*sudoku.T
 		}
 
 		if !needMore {
-			return nil, probe, fmt.Errorf("handshake table selection failed")
+			return nil, false, probe, fmt.Errorf("handshake table selection failed")
 		}
 		if len(probe) >= maxProbeBytes {
-			return nil, probe, fmt.Errorf("handshake probe exceeded %d bytes", maxProbeBytes)
+			return nil, false, probe, fmt.Errorf("handshake probe exceeded %d bytes", maxProbeBytes)
 		}
 
 		n, err := r.Read(tmp)
@@ -166,7 +181,7 @@ func selectTableByProbe(r *bufio.Reader, cfg *ProtocolConfig, tables []*sudoku.T
 			probe = append(probe, tmp[:n]...)
 		}
 		if err != nil {
-			return nil, probe, fmt.Errorf("handshake probe read failed: %w", err)
+			return nil, false, probe, fmt.Errorf("handshake probe read failed: %w", err)
 		}
 	}
 }
@@ -221,6 +236,22 @@ func ServerHandshakeFlexible(rawConn net.Conn, cfg *ProtocolConfig) (net.Conn, f
 	return serverHandshakeCore(rawConn, cfg)
 }
 
+// acceptTLS 执行 TLS 服务端握手；对方根本不是 TLS 客户端时返回带已读数据的 HandshakeError
+func acceptTLS(rawConn net.Conn, opts *tlswrap.Options, deadline time.Time) (net.Conn, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	tlsConn, err := opts.Server(ctx, rawConn)
+	if err != nil {
+		var notTLS *tlswrap.NotTLSError
+		if errors.As(err, &notTLS) {
+			return nil, &HandshakeError{Err: err, RawConn: rawConn, ReadData: notTLS.Recorded}
+		}
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
 func serverHandshakeCore(rawConn net.Conn, cfg *ProtocolConfig) (net.Conn, func(error) error, error) {
 	if cfg == nil {
 		return nil, nil, fmt.Errorf("config is required")
@@ -230,6 +261,16 @@ func serverHandshakeCore(rawConn net.Conn, cfg *ProtocolConfig) (net.Conn, func(
 	}
 
 	deadline := time.Now().Add(time.Duration(cfg.HandshakeTimeoutSeconds) * time.Second)
+
+	// TLS 外层：在伪装检测之前解开，之后的回落数据都经由 TLS 连接
+	if cfg.TLS != nil {
+		tlsConn, err := acceptTLS(rawConn, cfg.TLS, deadline)
+		if err != nil {
+			return nil, nil, err
+		}
+		rawConn = tlsConn
+	}
+
 	rawConn.SetReadDeadline(deadline)
 
 	bufReader := bufio.NewReader(rawConn)
@@ -242,22 +283,42 @@ func serverHandshakeCore(rawConn net.Conn, cfg *ProtocolConfig) (net.Conn, func(
 		}
 	}
 
+	if !shouldConsumeMask && cfg.HTTPMask.Required() {
+		rawConn.SetReadDeadline(time.Time{})
+		buffered, _ := drainBuffered(bufReader)
+		return nil, nil, &HandshakeError{
+			Err:      fmt.Errorf("http mask required"),
+			RawConn:  rawConn,
+			ReadData: buffered,
+		}
+	}
+
 	if shouldConsumeMask {
 		var err error
 		httpHeaderData, err = httpmask.ConsumeHeader(bufReader)
+		if err == nil {
+			err = cfg.HTTPMask.Check(httpHeaderData)
+		}
 		if err != nil {
 			rawConn.SetReadDeadline(time.Time{})
+			buffered, _ := drainBuffered(bufReader)
 			return nil, nil, &HandshakeError{
 				Err:            fmt.Errorf("invalid http header: %w", err),
 				RawConn:        rawConn,
 				HTTPHeaderData: httpHeaderData,
-				ReadData:       nil,
+				ReadData:       buffered,
 			}
 		}
 	}
 
+	return upgradeServerConn(rawConn, bufReader, httpHeaderData, shouldConsumeMask, cfg)
+}
+
+// upgradeServerConn 在伪装层之后完成 Sudoku 混淆、AEAD 与握手；respond 为 true 时最后回应伪装请求。
+// bufReader 持有 rawConn 上尚未处理的数据，rawConn 的读超时由调用方设置。
+func upgradeServerConn(rawConn net.Conn, bufReader *bufio.Reader, httpHeaderData []byte, respond bool, cfg *ProtocolConfig) (net.Conn, func(error) error, error) {
 	tables := cfg.tableCandidates()
-	selectedTable, preRead, err := selectTableByProbe(bufReader, cfg, tables)
+	selectedTable, packedUplink, preRead, err := selectTableByProbe(bufReader, cfg, tables)
 	if err != nil {
 		rawConn.SetReadDeadline(time.Time{})
 		return nil, nil, &HandshakeError{
@@ -270,11 +331,15 @@ func serverHandshakeCore(rawConn net.Conn, cfg *ProtocolConfig) (net.Conn, func(
 
 	baseConn := &preBufferedConn{Conn: rawConn, buf: preRead}
 	bConn := &bufferedConn{Conn: baseConn, r: bufio.NewReader(baseConn)}
-	sConn, obfsConn := buildServerObfsConn(bConn, cfg, selectedTable, true)
+	sConn, obfsConn := buildServerObfsConn(bConn, cfg, selectedTable, packedUplink, true)
 
 	fail := func(originalErr error) error {
 		rawConn.SetReadDeadline(time.Time{})
-		badData := sConn.GetBufferedAndRecorded()
+		// 带宽优化上行不录制；握手已在探测阶段通过，preRead 即为已读数据
+		badData := preRead
+		if sConn != nil {
+			badData = sConn.GetBufferedAndRecorded()
+		}
 		return &HandshakeError{
 			Err:            originalErr,
 			RawConn:        rawConn,
@@ -301,18 +366,33 @@ func serverHandshakeCore(rawConn net.Conn, cfg *ProtocolConfig) (net.Conn, func(
 		return nil, nil, fail(fmt.Errorf("timestamp skew/replay detected: server_time=%d client_time=%d", now, ts))
 	}
 
-	sConn.StopRecording()
+	if sConn != nil {
+		sConn.StopRecording()
+	}
 
 	modeBuf := []byte{0}
 	if _, err := io.ReadFull(cConn, modeBuf); err != nil {
 		cConn.Close()
 		return nil, nil, fail(fmt.Errorf("read downlink mode failed: %w", err))
 	}
-	if modeBuf[0] != downlinkMode(cfg) {
+	if modeBuf[0]&^modeFlags != downlinkMode(cfg) {
 		cConn.Close()
-		return nil, nil, fail(fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0], downlinkMode(cfg)))
+		return nil, nil, fail(fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0]&^modeFlags, downlinkMode(cfg)))
 	}
 
 	rawConn.SetReadDeadline(time.Time{})
+
+	// 回应伪装请求：WebSocket 升级回 101，其余回 200；旧客户端不置位，不回应
+	if respond && modeBuf[0]&modeFlagMaskResponse != 0 {
+		if err := httpmask.WriteResponseHeader(rawConn, httpHeaderData); err != nil {
+			cConn.Close()
+			return nil, nil, fmt.Errorf("write http mask response failed: %w", err)
+		}
+	}
+
+	// 客户端开启控制帧时总是应答心跳；本端的心跳与掩护流量由 cfg.KeepAlive 决定
+	if modeBuf[0]&modeFlagControl != 0 {
+		return control.New(cConn, cfg.KeepAlive), fail, nil
+	}
 	return cConn, fail, nil
 }
@@ -15,7 +15,7 @@ func DialUDPOverTCP(ctx context.Context, cfg *ProtocolConfig) (net.Conn, error)
 	if err != nil {
 		return nil, err
 	}
-	if err := tunnel.WriteUoTPreface(conn); err != nil {
+	if err := tunnel.WriteUoTPreface(conn, tunnel.UoTVersion1); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("write uot preface: %w", err)
 	}
@@ -4,8 +4,14 @@ go 1.24.7
 
 require (
 	filippo.io/edwards25519 v1.1.0
+	github.com/refraction-networking/utls v1.8.2
 	golang.org/x/crypto v0.45.0
+	golang.org/x/net v0.47.0
+	golang.org/x/sys v0.38.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.38.0 // indirect
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+)
@@ -0,0 +1,197 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/tunnel"
+	"github.com/saba-futai/sudoku/pkg/dnsutil"
+)
+
+const (
+	defaultAutoDirectTimeout = 3 * time.Second
+	defaultAutoCacheTTL      = 30 * time.Minute
+	maxAutoCacheEntries      = 4096
+)
+
+// globalAutoRouter 保存 auto 模式的探测参数与按域名缓存的结果，由 RunClient 按配置替换
+var globalAutoRouter = newAutoRouter(nil)
+
+// autoRouter 对规则未覆盖的目标先尝试直连，连接失败或被重置后回退到隧道。
+// 直连的结论只在真正收到响应后才缓存；回退的结论在缓存期内直接走隧道。
+// 首包已发出但迟迟没有响应时，只有可安全重放的首包（TLS ClientHello、无请求体的
+// GET/HEAD/OPTIONS）才回退并缓存；其余首包可能已被源站处理，重放会导致请求执行两次。
+type autoRouter struct {
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]autoEntry
+}
+
+type autoEntry struct {
+	proxy   bool
+	expires time.Time
+}
+
+func newAutoRouter(cfg *config.AutoConfig) *autoRouter {
+	r := &autoRouter{
+		timeout: defaultAutoDirectTimeout,
+		ttl:     defaultAutoCacheTTL,
+		entries: make(map[string]autoEntry),
+	}
+	if cfg != nil && cfg.DirectTimeout > 0 {
+		r.timeout = time.Duration(cfg.DirectTimeout) * time.Millisecond
+	}
+	if cfg != nil && cfg.CacheTTL > 0 {
+		r.ttl = time.Duration(cfg.CacheTTL) * time.Second
+	}
+	return r
+}
+
+func (r *autoRouter) lookup(host string) (proxy bool, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[host]
+	if !ok {
+		return false, false
+	}
+	if time.Now().After(e.expires) {
+		delete(r.entries, host)
+		return false, false
+	}
+	return e.proxy, true
+}
+
+func (r *autoRouter) remember(host string, proxy bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) >= maxAutoCacheEntries {
+		for k, e := range r.entries {
+			if now.After(e.expires) {
+				delete(r.entries, k)
+			}
+		}
+		if len(r.entries) >= maxAutoCacheEntries {
+			return
+		}
+	}
+	r.entries[host] = autoEntry{proxy: proxy, expires: now.Add(r.ttl)}
+}
+
+// dial 在拿不到客户端首包时使用（如 HTTP 转发），只能以直连能否建立来判断
+func (r *autoRouter) dial(destAddrStr, host string, dialer tunnel.Dialer) (net.Conn, bool) {
+	if proxy, ok := r.lookup(host); ok {
+		return dialRouted(destAddrStr, proxy, dialer)
+	}
+	conn, err := dialDirect(destAddrStr, r.timeout)
+	if err == nil {
+		log.Printf("[Auto] %s -> DIRECT", destAddrStr)
+		return conn, true
+	}
+	log.Printf("[Auto] %s -> PROXY (direct: %v)", destAddrStr, err)
+	r.remember(host, true)
+	return dialRouted(destAddrStr, true, dialer)
+}
+
+// dialProbe 把客户端首包经直连发出并等待首个响应；确定直连不可用（连接失败、
+// RST、收到响应前 EOF）时改走隧道并重放首包。超时无响应时，首包可安全重放则同样
+// 回退并缓存（黑洞式封锁只吞包不重置）；否则保留直连且不缓存结论，以免非幂等请求
+// 被执行两次。
+// 返回值为之后用于转发的客户端连接与目标连接。
+func (r *autoRouter) dialProbe(client net.Conn, destAddrStr, host string, dialer tunnel.Dialer) (net.Conn, net.Conn, bool) {
+	if proxy, ok := r.lookup(host); ok {
+		targetConn, ok := dialRouted(destAddrStr, proxy, dialer)
+		return client, targetConn, ok
+	}
+
+	first, rest := takeFirstPacket(client)
+	if len(first) == 0 {
+		// 客户端没有先发言（如 SMTP/SSH），无法验证直连
+		targetConn, ok := r.dial(destAddrStr, host, dialer)
+		return rest, targetConn, ok
+	}
+
+	conn, err := dialDirect(destAddrStr, r.timeout)
+	if err == nil {
+		var resp []byte
+		if resp, err = probeDirect(conn, first, r.timeout); err == nil {
+			log.Printf("[Auto] %s -> DIRECT", destAddrStr)
+			r.remember(host, false)
+			return rest, &PeekConn{Conn: conn, peeked: resp}, true
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() && !replaySafe(first) {
+			log.Printf("[Auto] %s -> DIRECT (no response within %s, first packet already sent)", destAddrStr, r.timeout)
+			return rest, conn, true
+		}
+		conn.Close()
+	}
+
+	log.Printf("[Auto] %s -> PROXY (direct: %v)", destAddrStr, err)
+	r.remember(host, true)
+	targetConn, ok := dialRouted(destAddrStr, true, dialer)
+	return &PeekConn{Conn: rest, peeked: first}, targetConn, ok
+}
+
+// replaySafe 判断首包被源站收到两次是否无副作用：TLS ClientHello 尚未建立任何状态，
+// 不带请求体的 GET/HEAD/OPTIONS 按语义是幂等的。首包必须恰好是完整的请求头。
+func replaySafe(first []byte) bool {
+	if len(first) >= 6 && first[0] == 0x16 && first[1] == 0x03 && first[5] == 0x01 {
+		return true
+	}
+	br := bufio.NewReader(bytes.NewReader(first))
+	req, err := http.ReadRequest(br)
+	if err != nil || br.Buffered() != 0 {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+}
+
+// takeFirstPacket 取出客户端的首包：已被嗅探读取的数据直接复用，否则短暂等待一次读取。
+// 返回的连接不再包含首包数据。
+func takeFirstPacket(conn net.Conn) ([]byte, net.Conn) {
+	if pc, ok := conn.(*PeekConn); ok && len(pc.peeked) > 0 {
+		return pc.peeked, pc.Conn
+	}
+	buf := make([]byte, sniffMaxBytes)
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	n, _ := conn.Read(buf)
+	_ = conn.SetReadDeadline(time.Time{})
+	return buf[:n], conn
+}
+
+// probeDirect 发送首包并等待第一个响应字节；超时以 net.Error 返回，由调用方区分
+func probeDirect(conn net.Conn, first []byte, timeout time.Duration) ([]byte, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(first); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 32*1024)
+	n, err := conn.Read(buf)
+	if n > 0 {
+		return buf[:n], nil
+	}
+	return nil, err
+}
+
+func dialDirect(destAddrStr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dnsutil.DialContext(ctx, "tcp", destAddrStr)
+}
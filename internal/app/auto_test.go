@@ -0,0 +1,302 @@
+package app
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+)
+
+// socks5Connect 经 handleMixedConn 建立 SOCKS5 CONNECT 并返回客户端连接
+func socks5Connect(t *testing.T, cfg *config.Config, dialer *MockDialer, target *net.TCPAddr) net.Conn {
+	t.Helper()
+	client, proxy := net.Pipe()
+	go handleMixedConn(proxy, cfg, nil, nil, dialer)
+
+	client.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	io.ReadFull(client, reply)
+	req := []byte{0x05, 0x01, 0x00, 0x01}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	client.Write(req)
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("connect reply: %v %x", err, reply)
+	}
+	return client
+}
+
+func TestAutoModeFallsBackOnReset(t *testing.T) {
+	old := globalAutoRouter
+	globalAutoRouter = newAutoRouter(&config.AutoConfig{DirectTimeout: 500})
+	defer func() { globalAutoRouter = old }()
+
+	// 直连目标：建立连接后立即以 RST 关闭，模拟被干扰的站点
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			buf := make([]byte, 16)
+			c.Read(buf)
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		}
+	}()
+
+	var proxied atomic.Int32
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		proxied.Add(1)
+		up, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "hello" {
+				return
+			}
+			remote.Write([]byte("via-proxy"))
+		}()
+		return up, nil
+	}}
+	cfg := &config.Config{ProxyMode: "auto"}
+	target := ln.Addr().(*net.TCPAddr)
+
+	for i := 0; i < 2; i++ {
+		client := socks5Connect(t, cfg, dialer, target)
+		client.Write([]byte("hello"))
+		buf := make([]byte, 9)
+		client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "via-proxy" {
+			t.Fatalf("round %d: got %q, %v", i, buf, err)
+		}
+		client.Close()
+	}
+	if proxied.Load() != 2 {
+		t.Fatalf("expected 2 proxied dials, got %d", proxied.Load())
+	}
+	// 第二次命中缓存，不再尝试直连
+	if accepted.Load() != 1 {
+		t.Fatalf("expected 1 direct attempt, got %d", accepted.Load())
+	}
+}
+
+func TestAutoModePrefersDirect(t *testing.T) {
+	old := globalAutoRouter
+	globalAutoRouter = newAutoRouter(&config.AutoConfig{DirectTimeout: 500})
+	defer func() { globalAutoRouter = old }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		t.Errorf("unexpected proxy dial to %s", dest)
+		return nil, io.EOF
+	}}
+	target := ln.Addr().(*net.TCPAddr)
+	client := socks5Connect(t, &config.Config{ProxyMode: "auto"}, dialer, target)
+	defer client.Close()
+
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q %v", buf, err)
+	}
+	if proxy, ok := globalAutoRouter.lookup("127.0.0.1"); !ok || proxy {
+		t.Fatalf("direct result not cached: proxy=%v ok=%v", proxy, ok)
+	}
+}
+
+func TestAutoRouterDialFallsBackOnRefused(t *testing.T) {
+	r := newAutoRouter(&config.AutoConfig{DirectTimeout: 500})
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	called := false
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		called = true
+		c, _ := net.Pipe()
+		return c, nil
+	}}
+	conn, ok := r.dial(addr, "127.0.0.1", dialer)
+	if !ok || !called {
+		t.Fatalf("expected proxy fallback, ok=%v called=%v", ok, called)
+	}
+	conn.Close()
+	if proxy, ok := r.lookup("127.0.0.1"); !ok || !proxy {
+		t.Fatalf("fallback not cached")
+	}
+}
+
+func TestAutoModeKeepsDirectOnSilentTimeout(t *testing.T) {
+	old := globalAutoRouter
+	globalAutoRouter = newAutoRouter(&config.AutoConfig{DirectTimeout: 200})
+	defer func() { globalAutoRouter = old }()
+
+	// 源站收到请求后很久才响应（慢接口或非幂等 POST）
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 4)
+		io.ReadFull(c, buf)
+		time.Sleep(500 * time.Millisecond)
+		c.Write([]byte("slow"))
+	}()
+
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		t.Errorf("request replayed through the tunnel to %s", dest)
+		return nil, io.EOF
+	}}
+	target := ln.Addr().(*net.TCPAddr)
+	client := socks5Connect(t, &config.Config{ProxyMode: "auto"}, dialer, target)
+	defer client.Close()
+
+	client.Write([]byte("POST"))
+	buf := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "slow" {
+		t.Fatalf("slow direct response: %q %v", buf, err)
+	}
+	if _, ok := globalAutoRouter.lookup("127.0.0.1"); ok {
+		t.Fatalf("a silent timeout must not be cached")
+	}
+}
+
+func TestAutoModeFallsBackOnSilentReplaySafeRequest(t *testing.T) {
+	old := globalAutoRouter
+	globalAutoRouter = newAutoRouter(&config.AutoConfig{DirectTimeout: 200})
+	defer func() { globalAutoRouter = old }()
+
+	// 黑洞式封锁：连接可以建立，但请求发出后永远没有响应
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			io.Copy(io.Discard, c)
+			c.Close()
+		}
+	}()
+
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	var proxied atomic.Int32
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		proxied.Add(1)
+		up, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			buf := make([]byte, len(request))
+			if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != request {
+				return
+			}
+			remote.Write([]byte("via-proxy"))
+		}()
+		return up, nil
+	}}
+	target := ln.Addr().(*net.TCPAddr)
+
+	for i := 0; i < 2; i++ {
+		client := socks5Connect(t, &config.Config{ProxyMode: "auto"}, dialer, target)
+		client.Write([]byte(request))
+		buf := make([]byte, 9)
+		client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "via-proxy" {
+			t.Fatalf("round %d: got %q, %v", i, buf, err)
+		}
+		client.Close()
+	}
+	if proxied.Load() != 2 || accepted.Load() != 1 {
+		t.Fatalf("expected one direct attempt and two proxied dials, got %d/%d", accepted.Load(), proxied.Load())
+	}
+	if proxy, ok := globalAutoRouter.lookup("127.0.0.1"); !ok || !proxy {
+		t.Fatalf("timeout fallback not cached")
+	}
+}
+
+func TestReplaySafe(t *testing.T) {
+	cases := []struct {
+		first string
+		want  bool
+	}{
+		{"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", true},
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"HEAD / HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\nhi", false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nHost: a\r\n", false},
+		{"POST", false},
+		{"\x17\x03\x03\x00\x10", false},
+	}
+	for _, c := range cases {
+		if got := replaySafe([]byte(c.first)); got != c.want {
+			t.Errorf("replaySafe(%q) = %v, want %v", c.first, got, c.want)
+		}
+	}
+}
+
+func TestAutoModeCachedVerdictRepliesAfterDial(t *testing.T) {
+	old := globalAutoRouter
+	globalAutoRouter = newAutoRouter(nil)
+	defer func() { globalAutoRouter = old }()
+	globalAutoRouter.remember("127.0.0.1", true)
+
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		return nil, io.ErrUnexpectedEOF
+	}}
+	client, proxy := net.Pipe()
+	defer client.Close()
+	go handleMixedConn(proxy, &config.Config{ProxyMode: "auto"}, nil, nil, dialer)
+
+	client.Write([]byte{0x05, 0x01, 0x00})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+	reply := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x04 {
+		t.Fatalf("expected the dial failure to be reported: %v %x", err, reply)
+	}
+}
@@ -105,6 +105,38 @@ func buildTablesFromConfig(cfg *config.Config) ([]*sudoku.Table, error) {
 	return tableSet.Candidates(), nil
 }
 
+// buildBalancedDialer 为 servers 中的每个 profile 建立独立的 key/tables/AEAD/HTTP mask。
+// 未单独设置 key 或表布局的 profile 复用顶层已派生的私钥与表。
+func buildBalancedDialer(cfg *config.Config, tables []*sudoku.Table, privateKey []byte) (*tunnel.BalancedDialer, error) {
+	serverCfgs := cfg.ServerConfigs()
+	members := make([]*tunnel.ServerMember, 0, len(serverCfgs))
+	for i, sc := range serverCfgs {
+		profile := cfg.Servers[i]
+		memberKey := privateKey
+		memberTables := tables
+		if profile.Key != "" {
+			pk, _, err := normalizeClientKey(sc)
+			if err != nil {
+				return nil, fmt.Errorf("server %s: %w", sc.ServerAddress, err)
+			}
+			memberKey = pk
+		}
+		if profile.Key != "" || profile.ASCII != "" || profile.CustomTable != "" || len(profile.CustomTables) > 0 {
+			var err error
+			memberTables, err = buildTablesFromConfig(sc)
+			if err != nil {
+				return nil, fmt.Errorf("server %s: build table(s): %w", sc.ServerAddress, err)
+			}
+		}
+		members = append(members, tunnel.NewServerMember(profile.Name, tunnel.BaseDialer{
+			Config:     sc,
+			Tables:     memberTables,
+			PrivateKey: memberKey,
+		}))
+	}
+	return tunnel.NewBalancedDialer(members, cfg.Balancer.Policy)
+}
+
 func RunClient(cfg *config.Config, tables []*sudoku.Table) {
 	// 1. Initialize Dialer
 	var dialer tunnel.Dialer
@@ -125,29 +157,82 @@ func RunClient(cfg *config.Config, tables []*sudoku.Table) {
 		}
 	}
 
-	baseDialer := tunnel.BaseDialer{
-		Config:     cfg,
-		Tables:     tables,
-		PrivateKey: privateKeyBytes,
+	if err := configureResolver(cfg); err != nil {
+		log.Fatalf("Failed to configure resolver: %v", err)
 	}
 
-	dialer = &tunnel.StandardDialer{
-		BaseDialer: baseDialer,
+	if len(cfg.Servers) > 0 {
+		cfg.Balancer = cfg.Balancer.WithDefaults()
+		balanced, err := buildBalancedDialer(cfg, tables, privateKeyBytes)
+		if err != nil {
+			log.Fatalf("Failed to init servers: %v", err)
+		}
+		interval := time.Duration(cfg.Balancer.HealthCheckInterval) * time.Second
+		timeout := time.Duration(cfg.Balancer.HealthCheckTimeout) * time.Second
+		go balanced.RunHealthCheck(context.Background(), interval, timeout)
+		dialer = balanced
+	} else {
+		baseDialer := tunnel.BaseDialer{
+			Config:     cfg,
+			Tables:     tables,
+			PrivateKey: privateKeyBytes,
+		}
+
+		dialer = &tunnel.StandardDialer{
+			BaseDialer: baseDialer,
+		}
 	}
 
 	// 2. 初始化 GeoIP/PAC 管理器
 	var geoMgr *geodata.Manager
-	if cfg.ProxyMode == "pac" {
+	if cfg.ProxyMode == "pac" || (cfg.ProxyMode == "auto" && len(cfg.RuleURLs) > 0) {
 		geoMgr = geodata.GetInstance(cfg.RuleURLs)
 	}
+	if cfg.ProxyMode == "auto" {
+		globalAutoRouter = newAutoRouter(cfg.Auto)
+	}
+
+	// 3. 内置 DNS (可选)
+	if cfg.DNS != nil {
+		dnsSrv, err := newDNSServer(cfg, geoMgr, dialer)
+		if err != nil {
+			log.Fatalf("Failed to init DNS server: %v", err)
+		}
+		globalFakeIP = dnsSrv.fakeIP
+		if dnsSrv.remote != nil {
+			pacLookupIP = dnsSrv.lookupIPv4
+		}
+		go func() {
+			if err := dnsSrv.ListenAndServe(); err != nil {
+				log.Printf("[DNS] %v", err)
+			}
+		}()
+	}
 
-	// 3. 监听本地端口
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.LocalPort))
+	// 4. 监听本地端口
+	acl, err := newInboundACL(cfg.Inbound)
+	if err != nil {
+		log.Fatalf("Failed to init inbound: %v", err)
+	}
+	localACL = acl
+	listenIP := ""
+	if cfg.Inbound != nil {
+		listenIP = cfg.Inbound.ListenIP
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(listenIP, fmt.Sprint(cfg.LocalPort)))
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Client (Mixed) on :%d -> %s | Mode: %s | Rules: %d",
-		cfg.LocalPort, cfg.ServerAddress, cfg.ProxyMode, len(cfg.RuleURLs))
+	serverDesc := cfg.ServerAddress
+	if len(cfg.Servers) > 0 {
+		serverDesc = fmt.Sprintf("%d servers (%s)", len(cfg.Servers), cfg.Balancer.Policy)
+	}
+	log.Printf("Client (Mixed) on %s -> %s | Mode: %s | Rules: %d | Auth: %v",
+		l.Addr(), serverDesc, cfg.ProxyMode, len(cfg.RuleURLs), acl.authRequired())
+
+	if err := startTransparentProxies(cfg, geoMgr, dialer); err != nil {
+		log.Fatalf("Failed to start transparent proxy: %v", err)
+	}
 
 	var primaryTable *sudoku.Table
 	if len(tables) > 0 {
@@ -158,6 +243,11 @@ func RunClient(cfg *config.Config, tables []*sudoku.Table) {
 		if err != nil {
 			continue
 		}
+		if !acl.allowSource(c.RemoteAddr()) {
+			log.Printf("[Inbound] Rejected connection from %s", c.RemoteAddr())
+			c.Close()
+			continue
+		}
 		go handleMixedConn(c, cfg, primaryTable, geoMgr, dialer)
 	}
 }
@@ -200,7 +290,9 @@ func handleClientSocks5(conn net.Conn, cfg *config.Config, table *sudoku.Table,
 	if _, err := io.ReadFull(conn, buf[:nMethods]); err != nil {
 		return
 	}
-	conn.Write([]byte{0x05, 0x00})
+	if !socks5Authenticate(conn, buf[:nMethods]) {
+		return
+	}
 
 	// 2. 读取请求
 	header := make([]byte, 3)
@@ -212,12 +304,16 @@ func handleClientSocks5(conn net.Conn, cfg *config.Config, table *sudoku.Table,
 	switch header[1] {
 	case 0x01:
 		// CONNECT
+	case 0x02:
+		// BIND
+		handleSocks5Bind(conn, dialer)
+		return
 	case 0x03:
 		// UDP Associate
 		handleSocks5UDPAssociate(conn, cfg, dialer)
 		return
 	default:
-		// 不支持 Bind 或其他命令
+		// 不支持的命令
 		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 		return
 	}
@@ -228,7 +324,16 @@ func handleClientSocks5(conn net.Conn, cfg *config.Config, table *sudoku.Table,
 	}
 
 	// 3. 路由与连接
-	targetConn, success := dialTarget(destAddrStr, destIP, cfg, geoMgr, dialer)
+	plan := planConnect(destAddrStr, destIP, cfg, geoMgr)
+	if plan.firstPacket {
+		// 客户端收到应答后才发送首包，只能先应答再嗅探/探测
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		if clientConn, targetConn, ok := dialWithFirstPacket(conn, plan, cfg, geoMgr, dialer); ok {
+			pipeConn(clientConn, targetConn)
+		}
+		return
+	}
+	targetConn, success := plan.dial(dialer)
 	if !success {
 		// SOCKS5 Error
 		conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
@@ -242,9 +347,54 @@ func handleClientSocks5(conn net.Conn, cfg *config.Config, table *sudoku.Table,
 	pipeConn(conn, targetConn)
 }
 
-func handleSocks5UDPAssociate(ctrl net.Conn, cfg *config.Config, dialer tunnel.Dialer) {
-	uotDialer, ok := dialer.(tunnel.UoTDialer)
+// handleSocks5Bind 经隧道请求服务端监听，依次转发两次应答后开始转发数据
+func handleSocks5Bind(conn net.Conn, dialer tunnel.Dialer) {
+	expected, _, expectedIP, err := protocol.ReadAddress(conn)
+	if err != nil {
+		return
+	}
+	expected, _ = restoreFakeIPTarget(expected, expectedIP)
+
+	bindDialer, ok := dialer.(tunnel.BindDialer)
 	if !ok {
+		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	tConn, err := bindDialer.DialBind(expected)
+	if err != nil {
+		log.Printf("[SOCKS5][Bind] Dial failed: %v", err)
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	// 第一次应答为服务端监听地址，第二次为入站连接的来源地址
+	for i := 0; i < 2; i++ {
+		rep, addr, err := tunnel.ReadBindReply(tConn)
+		if err != nil {
+			log.Printf("[SOCKS5][Bind] Read reply failed: %v", err)
+			conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			tConn.Close()
+			return
+		}
+		reply := &bytes.Buffer{}
+		reply.Write([]byte{0x05, rep, 0x00})
+		if err := protocol.WriteAddress(reply, addr); err != nil {
+			tConn.Close()
+			return
+		}
+		if _, err := conn.Write(reply.Bytes()); err != nil || rep != tunnel.BindRepSuccess {
+			tConn.Close()
+			return
+		}
+	}
+
+	pipeConn(conn, tConn)
+}
+
+func handleSocks5UDPAssociate(ctrl net.Conn, cfg *config.Config, dialer tunnel.Dialer) {
+	_, uotOK := dialer.(tunnel.UoTDialer)
+	_, packetOK := dialer.(tunnel.PacketDialer)
+	if !uotOK && !(packetOK && cfg.Transport == "udp") {
 		ctrl.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 		return
 	}
@@ -255,8 +405,9 @@ func handleSocks5UDPAssociate(ctrl net.Conn, cfg *config.Config, dialer tunnel.D
 		return
 	}
 
-	uotConn, err := uotDialer.DialUDPOverTCP()
+	remote, via, err := dialUDPRelay(cfg, dialer)
 	if err != nil {
+		log.Printf("[SOCKS5][UDP] Dial relay failed: %v", err)
 		udpConn.Close()
 		ctrl.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 		return
@@ -265,15 +416,38 @@ func handleSocks5UDPAssociate(ctrl net.Conn, cfg *config.Config, dialer tunnel.D
 	reply := buildUDPAssociateReply(udpConn)
 	if _, err := ctrl.Write(reply); err != nil {
 		udpConn.Close()
-		uotConn.Close()
+		remote.Close()
 		return
 	}
 
-	log.Printf("[SOCKS5][UDP] Associate ready on %s -> %s", udpConn.LocalAddr().String(), cfg.ServerAddress)
-	session := newUoTClientSession(ctrl, udpConn, uotConn)
+	log.Printf("[SOCKS5][UDP] Associate ready on %s -> %s (%s)", udpConn.LocalAddr().String(), cfg.ServerAddress, via)
+	session := newUDPClientSession(ctrl, udpConn, remote, newUDPSniffer(cfg))
 	session.run()
 }
 
+// dialUDPRelay 在 transport=udp 时使用原生 UDP 传输，否则经 UoT 承载（优先复用 v2 多路隧道）
+func dialUDPRelay(cfg *config.Config, dialer tunnel.Dialer) (tunnel.DatagramConn, string, error) {
+	if cfg.Transport == "udp" {
+		if packetDialer, ok := dialer.(tunnel.PacketDialer); ok {
+			dc, err := packetDialer.DialPacket()
+			return dc, "udp", err
+		}
+	}
+	if sessionDialer, ok := dialer.(tunnel.UoTSessionDialer); ok {
+		dc, err := sessionDialer.DialUoTSession()
+		return dc, "uot", err
+	}
+	uotDialer, ok := dialer.(tunnel.UoTDialer)
+	if !ok {
+		return nil, "", fmt.Errorf("dialer does not support udp")
+	}
+	conn, err := uotDialer.DialUDPOverTCP()
+	if err != nil {
+		return nil, "", err
+	}
+	return tunnel.NewUoTDatagramConn(conn), "uot", nil
+}
+
 func buildUDPAssociateReply(udpConn *net.UDPConn) []byte {
 	addr := udpConn.LocalAddr().(*net.UDPAddr)
 	host := addr.IP
@@ -298,27 +472,35 @@ func buildUDPAssociateReply(udpConn *net.UDPConn) []byte {
 	return buf.Bytes()
 }
 
-type uotClientSession struct {
+type udpClientSession struct {
 	ctrlConn  net.Conn
 	udpConn   *net.UDPConn
-	uotConn   net.Conn
+	remote    tunnel.DatagramConn
 	closeOnce sync.Once
 	closed    chan struct{}
 
+	sniffer *udpSniffer
+
 	clientAddrMu sync.RWMutex
-	clientAddr   *net.UDPAddr
+	clientAddr   *net.UDPAddr            // 最近一次发包的客户端地址
+	replyTo      map[string]*net.UDPAddr // 目标地址 -> 最近发往该目标的客户端地址
+	fragPacket   int                     // 客户端使用分片时观察到的最大包长，回包按此分片
 }
 
-func newUoTClientSession(ctrl net.Conn, udpConn *net.UDPConn, uotConn net.Conn) *uotClientSession {
-	return &uotClientSession{
+// maxUDPReplyRoutes bounds the per-destination reply routes of one association.
+const maxUDPReplyRoutes = 1024
+
+func newUDPClientSession(ctrl net.Conn, udpConn *net.UDPConn, remote tunnel.DatagramConn, sniffer *udpSniffer) *udpClientSession {
+	return &udpClientSession{
 		ctrlConn: ctrl,
 		udpConn:  udpConn,
-		uotConn:  uotConn,
+		remote:   remote,
+		sniffer:  sniffer,
 		closed:   make(chan struct{}),
 	}
 }
 
-func (s *uotClientSession) run() {
+func (s *udpClientSession) run() {
 	var wg sync.WaitGroup
 	wg.Add(3)
 	go func() {
@@ -337,77 +519,108 @@ func (s *uotClientSession) run() {
 	s.close()
 }
 
-func (s *uotClientSession) close() {
+func (s *udpClientSession) close() {
 	s.closeOnce.Do(func() {
 		close(s.closed)
 		s.udpConn.Close()
-		s.uotConn.Close()
+		s.remote.Close()
 		s.ctrlConn.Close()
 	})
 }
 
-func (s *uotClientSession) consumeControl() {
+func (s *udpClientSession) consumeControl() {
 	io.Copy(io.Discard, s.ctrlConn)
 	s.close()
 }
 
-func (s *uotClientSession) pipeClientToServer() {
+func (s *udpClientSession) pipeClientToServer() {
 	buf := make([]byte, 65535)
+	reasm := newSocks5Reassembler()
 	for {
 		n, addr, err := s.udpConn.ReadFromUDP(buf)
 		if err != nil {
 			s.close()
 			return
 		}
-		destAddr, payload, err := decodeSocks5UDPRequest(buf[:n])
+		frag, destAddr, payload, err := decodeSocks5UDPRequest(buf[:n])
 		if err != nil {
 			continue
 		}
-		s.setClientAddr(addr)
+		destAddr, payload, ok := reasm.add(frag, destAddr, payload, n, time.Now())
+		if !ok {
+			continue
+		}
+		destAddr, _ = restoreFakeIPTarget(destAddr, nil)
+		if reasm.maxPacket > 0 {
+			s.setFragPacket(reasm.maxPacket)
+		}
 
-		if err := tunnel.WriteUoTDatagram(s.uotConn, destAddr, payload); err != nil {
-			s.close()
-			return
+		destAddr, packets := s.sniffer.outbound(destAddr, payload)
+		s.setClientAddr(destAddr, addr)
+		for _, p := range packets {
+			if err := s.remote.WriteDatagram(destAddr, p); err != nil {
+				s.close()
+				return
+			}
 		}
 	}
 }
 
-func (s *uotClientSession) pipeServerToClient() {
+func (s *udpClientSession) pipeServerToClient() {
 	for {
-		addrStr, payload, err := tunnel.ReadUoTDatagram(s.uotConn)
+		addrStr, payload, err := s.remote.ReadDatagram()
 		if err != nil {
 			s.close()
 			return
 		}
 
-		clientAddr := s.getClientAddr()
+		clientAddr, fragPacket := s.getClientAddr(addrStr)
 		if clientAddr == nil {
 			continue
 		}
 
-		resp := buildUDPResponsePacket(addrStr, payload)
-		if resp == nil {
-			continue
-		}
-		if _, err := s.udpConn.WriteToUDP(resp, clientAddr); err != nil {
-			s.close()
-			return
+		for _, resp := range buildUDPResponsePackets(fakeIPSourceAddr(s.sniffer.inbound(addrStr)), payload, fragPacket) {
+			if _, err := s.udpConn.WriteToUDP(resp, clientAddr); err != nil {
+				s.close()
+				return
+			}
 		}
 	}
 }
 
-func (s *uotClientSession) setClientAddr(addr *net.UDPAddr) {
+// setClientAddr records addr as the client socket talking to dest. Replies from
+// dest go back to it, so several local sockets (or a rebound source port) can
+// share one association.
+func (s *udpClientSession) setClientAddr(dest string, addr *net.UDPAddr) {
 	s.clientAddrMu.Lock()
 	defer s.clientAddrMu.Unlock()
-	if s.clientAddr == nil {
-		s.clientAddr = addr
+	s.clientAddr = addr
+	if s.replyTo == nil {
+		s.replyTo = make(map[string]*net.UDPAddr)
 	}
+	if _, ok := s.replyTo[dest]; !ok && len(s.replyTo) >= maxUDPReplyRoutes {
+		for k := range s.replyTo {
+			delete(s.replyTo, k)
+			break
+		}
+	}
+	s.replyTo[dest] = addr
+}
+
+func (s *udpClientSession) setFragPacket(n int) {
+	s.clientAddrMu.Lock()
+	defer s.clientAddrMu.Unlock()
+	s.fragPacket = n
 }
 
-func (s *uotClientSession) getClientAddr() *net.UDPAddr {
+// getClientAddr returns where replies from src go, falling back to the latest sender.
+func (s *udpClientSession) getClientAddr(src string) (*net.UDPAddr, int) {
 	s.clientAddrMu.RLock()
 	defer s.clientAddrMu.RUnlock()
-	return s.clientAddr
+	if addr, ok := s.replyTo[src]; ok {
+		return addr, s.fragPacket
+	}
+	return s.clientAddr, s.fragPacket
 }
 
 // ==== SOCKS4 Handler ====
@@ -434,7 +647,13 @@ func handleClientSocks4(conn net.Conn, cfg *config.Config, table *sudoku.Table,
 	ipBytes := buf[4:8]
 
 	// Read UserID
-	if _, err := readString(conn); err != nil {
+	userID, err := readString(conn)
+	if err != nil {
+		return
+	}
+	if !localACL.checkUser(userID) {
+		// SOCKS4 Error (93 = userid mismatch)
+		conn.Write([]byte{0x00, 0x5D, 0, 0, 0, 0, 0, 0})
 		return
 	}
 
@@ -455,7 +674,15 @@ func handleClientSocks4(conn net.Conn, cfg *config.Config, table *sudoku.Table,
 	}
 
 	// Route & Connect
-	targetConn, success := dialTarget(destAddrStr, destIP, cfg, geoMgr, dialer)
+	plan := planConnect(destAddrStr, destIP, cfg, geoMgr)
+	if plan.firstPacket {
+		conn.Write([]byte{0x00, 0x5A, 0, 0, 0, 0, 0, 0})
+		if clientConn, targetConn, ok := dialWithFirstPacket(conn, plan, cfg, geoMgr, dialer); ok {
+			pipeConn(clientConn, targetConn)
+		}
+		return
+	}
+	targetConn, success := plan.dial(dialer)
 	if !success {
 		// SOCKS4 Error (91 = request rejected)
 		conn.Write([]byte{0x00, 0x5B, 0, 0, 0, 0, 0, 0})
@@ -483,34 +710,22 @@ func readString(r io.Reader) (string, error) {
 	return string(buf), nil
 }
 
-func decodeSocks5UDPRequest(pkt []byte) (string, []byte, error) {
+// decodeSocks5UDPRequest 解析 SOCKS5 UDP 请求头，返回 FRAG 字段供重组使用
+func decodeSocks5UDPRequest(pkt []byte) (byte, string, []byte, error) {
 	if len(pkt) < 4 {
-		return "", nil, fmt.Errorf("packet too short")
-	}
-	if pkt[2] != 0x00 {
-		return "", nil, fmt.Errorf("frag not supported")
+		return 0, "", nil, fmt.Errorf("packet too short")
 	}
 
 	reader := bytes.NewReader(pkt[3:])
 	addrStr, _, _, err := protocol.ReadAddress(reader)
 	if err != nil {
-		return "", nil, err
+		return 0, "", nil, err
 	}
 	payload := make([]byte, reader.Len())
 	if _, err := io.ReadFull(reader, payload); err != nil {
-		return "", nil, err
-	}
-	return addrStr, payload, nil
-}
-
-func buildUDPResponsePacket(addr string, payload []byte) []byte {
-	buf := &bytes.Buffer{}
-	buf.Write([]byte{0x00, 0x00, 0x00}) // RSV RSV FRAG(=0)
-	if err := protocol.WriteAddress(buf, addr); err != nil {
-		return nil
+		return 0, "", nil, err
 	}
-	buf.Write(payload)
-	return buf.Bytes()
+	return pkt[2], addrStr, payload, nil
 }
 
 // ==== HTTP Handler ====
@@ -518,66 +733,204 @@ func buildUDPResponsePacket(addr string, payload []byte) []byte {
 func handleHTTP(conn net.Conn, cfg *config.Config, table *sudoku.Table, geoMgr *geodata.Manager, dialer tunnel.Dialer) {
 	defer conn.Close()
 
-	req, err := http.ReadRequest(bufio.NewReader(conn))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
 	if err != nil {
 		return
 	}
-
-	host := req.Host
-	// 如果不带端口，默认补全
-	if !strings.Contains(host, ":") {
-		if req.Method == http.MethodConnect {
-			host += ":443"
-		} else {
-			host += ":80"
-		}
+	if req.Method != http.MethodConnect {
+		serveHTTPForward(conn, br, req, cfg, geoMgr, dialer)
+		return
+	}
+	if !authorizeHTTP(conn, req) {
+		return
 	}
 
 	// 解析 IP (为了路由决策)
+	host := httpTargetAddr(req, "443")
 	hostName, _, _ := net.SplitHostPort(host)
 	destIP := net.ParseIP(hostName)
 
 	// 路由决策与连接
-	targetConn, success := dialTarget(host, destIP, cfg, geoMgr, dialer)
+	plan := planConnect(host, destIP, cfg, geoMgr)
+	if plan.firstPacket {
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		clientConn := &PeekConn{Conn: conn, peeked: drainBuffered(br)}
+		if sniffedConn, targetConn, ok := dialWithFirstPacket(clientConn, plan, cfg, geoMgr, dialer); ok {
+			pipeConn(sniffedConn, targetConn)
+		}
+		return
+	}
+	targetConn, success := plan.dial(dialer)
 	if !success {
 		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
 		return
 	}
 
-	if req.Method == http.MethodConnect {
-		// HTTPS Tunnel: 建立连接后回复 200 OK，然后纯透传
-		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-		pipeConn(conn, targetConn)
-	} else {
-		req.RequestURI = ""
-		// 如果是绝对路径转换为相对路径
-		if req.URL.Scheme != "" {
-			req.URL.Scheme = ""
-			req.URL.Host = ""
-		}
+	// HTTPS Tunnel: 建立连接后回复 200 OK，然后纯透传（含已被缓冲的数据）
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	pipeConn(&PeekConn{Conn: conn, peeked: drainBuffered(br)}, targetConn)
+}
 
-		if err := req.Write(targetConn); err != nil {
-			targetConn.Close()
-			return
-		}
-		pipeConn(conn, targetConn)
+// ==== Common Logic  ====
+
+// restoreFakeIPTarget 将 fake-ip 目标还原为 domain:port，便于按域名路由并交给服务端解析
+func restoreFakeIPTarget(destAddrStr string, destIP net.IP) (string, net.IP) {
+	if globalFakeIP == nil {
+		return destAddrStr, destIP
+	}
+	host, port, err := net.SplitHostPort(destAddrStr)
+	if err != nil {
+		return destAddrStr, destIP
+	}
+	ip := destIP
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+	if domain, ok := globalFakeIP.Domain(ip); ok {
+		return net.JoinHostPort(domain, port), nil
 	}
+	return destAddrStr, destIP
 }
 
-// ==== Common Logic  ====
+// fakeIPSourceAddr 把 UDP 回包中的域名来源地址换回客户端看到的 fake-ip
+func fakeIPSourceAddr(addr string) string {
+	if globalFakeIP == nil {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip, ok := globalFakeIP.IPFor(host); ok {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return addr
+}
 
 func dialTarget(destAddrStr string, destIP net.IP, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) (net.Conn, bool) {
+	destAddrStr, destIP = restoreFakeIPTarget(destAddrStr, destIP)
+	if globalFakeIP.Contains(destIP) {
+		// 映射已被回收：此时无法得知真实目标
+		log.Printf("[FakeIP] %s -> unknown mapping", destAddrStr)
+		return nil, false
+	}
+	return dialRoute(destAddrStr, routeTarget(destAddrStr, destIP, cfg, geoMgr), dialer)
+}
+
+func dialRoute(destAddrStr string, r route, dialer tunnel.Dialer) (net.Conn, bool) {
+	if r == routeAuto {
+		return globalAutoRouter.dial(destAddrStr, routeHost(destAddrStr), dialer)
+	}
+	return dialRouted(destAddrStr, r == routeProxy, dialer)
+}
+
+// connectPlan 是 CONNECT 类请求的拨号计划：fake-ip 已还原；无需嗅探时路由已判定
+type connectPlan struct {
+	addr        string
+	ip          net.IP
+	route       route
+	routed      bool // 需嗅探时要等拿到首包后再判定路由
+	lost        bool // fake-ip 映射已被回收，无法得知真实目标
+	firstPacket bool // 拨号前需先应答客户端以读取首包（嗅探，或 auto 模式下未缓存结论的目标）
+}
+
+// planConnect 判定目标去向，并决定是否需要先应答客户端
+func planConnect(destAddrStr string, destIP net.IP, cfg *config.Config, geoMgr *geodata.Manager) connectPlan {
+	addr, ip := restoreFakeIPTarget(destAddrStr, destIP)
+	p := connectPlan{addr: addr, ip: ip}
+	if globalFakeIP.Contains(ip) {
+		log.Printf("[FakeIP] %s -> unknown mapping", addr)
+		p.lost = true
+		return p
+	}
+	if shouldSniff(cfg, ip) {
+		p.firstPacket = true
+		return p
+	}
+	p.route, p.routed = routeTarget(addr, ip, cfg, geoMgr), true
+	if p.route == routeAuto {
+		_, cached := globalAutoRouter.lookup(routeHost(addr))
+		p.firstPacket = !cached
+	}
+	return p
+}
+
+// dial 按已判定的路由拨号，用于无需首包的请求
+func (p connectPlan) dial(dialer tunnel.Dialer) (net.Conn, bool) {
+	if p.lost {
+		return nil, false
+	}
+	return dialRoute(p.addr, p.route, dialer)
+}
+
+// dialWithFirstPacket 用于已先应答客户端的场景：可读取客户端首包用于嗅探域名
+// 与 auto 模式的直连探测。返回之后用于转发的客户端连接（会重放已读取的数据）与目标连接。
+// 客户端此时已收到成功应答，拨号失败无法再以协议错误码告知，只能记录日志并关闭连接。
+func dialWithFirstPacket(conn net.Conn, p connectPlan, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) (net.Conn, net.Conn, bool) {
+	clientConn, targetConn, ok := dialAfterReply(conn, p, cfg, geoMgr, dialer)
+	if !ok {
+		log.Printf("[Client] %s: dial failed after the early success reply, closing client connection", p.addr)
+	}
+	return clientConn, targetConn, ok
+}
+
+func dialAfterReply(conn net.Conn, p connectPlan, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) (net.Conn, net.Conn, bool) {
+	destAddrStr, routeAddr, r := p.addr, p.addr, p.route
+	if !p.routed {
+		var domain string
+		if domain, conn = sniffStream(conn); domain != "" {
+			_, port, _ := net.SplitHostPort(destAddrStr)
+			routeAddr = net.JoinHostPort(domain, port)
+			log.Printf("[Sniff] %s -> %s", destAddrStr, routeAddr)
+			if cfg.Sniff.OverrideDestination {
+				destAddrStr = routeAddr
+			}
+		}
+		r = routeTarget(routeAddr, p.ip, cfg, geoMgr)
+	}
+
+	switch r {
+	case routeAuto:
+		return globalAutoRouter.dialProbe(conn, destAddrStr, routeHost(routeAddr), dialer)
+	default:
+		targetConn, ok := dialRouted(destAddrStr, r == routeProxy, dialer)
+		return conn, targetConn, ok
+	}
+}
+
+func routeHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+type route int
+
+const (
+	routeProxy route = iota
+	routeDirect
+	routeAuto // 规则未覆盖，由 autoRouter 探测直连
+)
+
+// routeTarget 按代理模式与规则判定目标的去向
+func routeTarget(destAddrStr string, destIP net.IP, cfg *config.Config, geoMgr *geodata.Manager) route {
 	shouldProxy := true
 
 	if cfg.ProxyMode == "global" {
 		shouldProxy = true
 	} else if cfg.ProxyMode == "direct" {
 		shouldProxy = false
-	} else if cfg.ProxyMode == "pac" {
+	} else if cfg.ProxyMode == "pac" || (cfg.ProxyMode == "auto" && geoMgr != nil) {
 		// 1. 检查域名或已知 IP 是否在 CN 列表
-		if geoMgr.IsCN(destAddrStr, destIP) {
+		if rule, ok := geoMgr.Match(destAddrStr, destIP); ok {
 			shouldProxy = false
-			log.Printf("[PAC] %s -> DIRECT (Rule Match)", destAddrStr)
+			if rule.Type != 0 {
+				log.Printf("[PAC] %s -> DIRECT (%s)", destAddrStr, rule)
+			} else {
+				log.Printf("[PAC] %s -> DIRECT (Rule Match)", destAddrStr)
+			}
 		} else {
 			// 2. 如果没有匹配且 destIP 未知 (是域名)，尝试解析 IP 再检查
 			if destIP == nil {
@@ -594,7 +947,7 @@ func dialTarget(destAddrStr string, destIP net.IP, cfg *config.Config, geoMgr *g
 				} else {
 					// Real Lookup
 					ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-					ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+					ips, err := pacLookupIP(ctx, host)
 					cancel()
 
 					if err == nil && len(ips) > 0 {
@@ -616,6 +969,17 @@ func dialTarget(destAddrStr string, destIP net.IP, cfg *config.Config, geoMgr *g
 		}
 	}
 
+	if !shouldProxy {
+		return routeDirect
+	}
+	if cfg.ProxyMode == "auto" {
+		return routeAuto
+	}
+	return routeProxy
+}
+
+// dialRouted 经隧道或直连拨号
+func dialRouted(destAddrStr string, shouldProxy bool, dialer tunnel.Dialer) (net.Conn, bool) {
 	if shouldProxy {
 		conn, err := dialer.Dial(destAddrStr)
 		if err != nil {
@@ -625,7 +989,7 @@ func dialTarget(destAddrStr string, destIP net.IP, cfg *config.Config, geoMgr *g
 		return conn, true
 	} else {
 		// 直连模式
-		dConn, err := net.DialTimeout("tcp", destAddrStr, 5*time.Second)
+		dConn, err := dialDirect(destAddrStr, 5*time.Second)
 		if err != nil {
 			log.Printf("[Direct] Dial Failed: %v", err)
 			return nil, false
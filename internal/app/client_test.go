@@ -168,3 +168,54 @@ func TestHandleMixedConn_HTTP(t *testing.T) {
 		t.Errorf("HTTP target mismatch: got %q, want %q", target, expectedTarget)
 	}
 }
+
+// echoDatagramConn returns every datagram written to it as a reply from the same address.
+type echoDatagramConn struct{ ch chan [2]string }
+
+func (e *echoDatagramConn) WriteDatagram(addr string, payload []byte) error {
+	e.ch <- [2]string{addr, string(payload)}
+	return nil
+}
+
+func (e *echoDatagramConn) ReadDatagram() (string, []byte, error) {
+	d, ok := <-e.ch
+	if !ok {
+		return "", nil, net.ErrClosed
+	}
+	return d[0], []byte(d[1]), nil
+}
+
+func (e *echoDatagramConn) Close() error { return nil }
+
+func TestUDPAssociateRepliesReachTheSendingSocket(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctrl, peer := net.Pipe()
+	defer peer.Close()
+	s := newUDPClientSession(ctrl, relay, &echoDatagramConn{ch: make(chan [2]string, 4)}, nil)
+	go s.run()
+	defer s.close()
+
+	// 同一关联上的两个本地套接字各自收到发往自己目标的回包
+	for _, target := range []string{"1.1.1.1:53", "2.2.2.2:53"} {
+		c, err := net.DialUDP("udp", nil, relay.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+		c.Write(buildUDPResponsePackets(target, []byte("q"), 0)[0])
+
+		buf := make([]byte, 512)
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: no reply on the sending socket: %v", target, err)
+		}
+		_, addr, payload, err := decodeSocks5UDPRequest(buf[:n])
+		if err != nil || addr != target || string(payload) != "q" {
+			t.Fatalf("unexpected reply %q %q %v", addr, payload, err)
+		}
+	}
+}
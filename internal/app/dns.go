@@ -0,0 +1,503 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/tunnel"
+	"github.com/saba-futai/sudoku/pkg/dnsutil"
+	"github.com/saba-futai/sudoku/pkg/geodata"
+)
+
+const (
+	dnsQueryTimeout = 5 * time.Second
+	fakeIPTTL       = 1
+	directAnswerTTL = 60
+	maxDNSMessage   = 65535
+)
+
+// globalFakeIP 在启用 fake-ip 时由 RunClient 设置，dialTarget 用它把合成地址还原为域名
+var globalFakeIP *dnsutil.FakeIPPool
+
+// pacLookupIP 是 PAC 模式下解析域名 IPv4 的方式；配置内置 DNS 后改为经隧道查询，避免泄漏到本地 ISP
+var pacLookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	ips, err := dnsutil.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return filterIPFamily(ips, "ip4"), nil
+}
+
+// configureResolver 按配置替换 dnsutil 的默认解析器
+func configureResolver(cfg *config.Config) error {
+	if cfg.Resolver == nil {
+		return nil
+	}
+	return dnsutil.Configure(dnsutil.Options{
+		Upstreams:   cfg.Resolver.Upstreams,
+		MinTTL:      time.Duration(cfg.Resolver.MinTTL) * time.Second,
+		MaxTTL:      time.Duration(cfg.Resolver.MaxTTL) * time.Second,
+		NegativeTTL: time.Duration(cfg.Resolver.NegativeTTL) * time.Second,
+	})
+}
+
+func filterIPFamily(ips []net.IP, network string) []net.IP {
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (network == "ip4") {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// dnsServer 是客户端内置 DNS 监听器：代理域名经 UoT 隧道查询远端上游，直连域名本地解析。
+type dnsServer struct {
+	cfg    *config.Config
+	geoMgr *geodata.Manager
+	remote *uotDNSExchanger
+	fakeIP *dnsutil.FakeIPPool
+}
+
+func newDNSServer(cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) (*dnsServer, error) {
+	if cfg.DNS == nil {
+		return nil, fmt.Errorf("dns is not configured")
+	}
+	s := &dnsServer{cfg: cfg, geoMgr: geoMgr}
+	if uotDialer, ok := dialer.(tunnel.UoTDialer); ok {
+		s.remote = &uotDNSExchanger{dialer: uotDialer, server: cfg.DNS.RemoteServer}
+	}
+	if cfg.DNS.FakeIP {
+		pool, err := dnsutil.NewFakeIPPool(cfg.DNS.FakeIPRange)
+		if err != nil {
+			return nil, err
+		}
+		s.fakeIP = pool
+	}
+	return s, nil
+}
+
+// ListenAndServe 同时在 UDP 与 TCP 上提供服务，任一监听失败即返回错误
+func (s *dnsServer) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.cfg.DNS.Listen)
+	if err != nil {
+		return fmt.Errorf("listen dns udp: %w", err)
+	}
+	l, err := net.Listen("tcp", s.cfg.DNS.Listen)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("listen dns tcp: %w", err)
+	}
+	log.Printf("[DNS] Listening on %s (remote: %s, fake-ip: %v)", s.cfg.DNS.Listen, s.cfg.DNS.RemoteServer, s.fakeIP != nil)
+	go s.serveTCP(l)
+	s.serveUDP(pc)
+	return nil
+}
+
+func (s *dnsServer) serveUDP(pc net.PacketConn) {
+	defer pc.Close()
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := s.handle(query)
+			if err != nil {
+				log.Printf("[DNS] %v", err)
+				return
+			}
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(l net.Listener) {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleTCPConn(c)
+	}
+}
+
+func (s *dnsServer) handleTCPConn(c net.Conn) {
+	defer c.Close()
+	for {
+		c.SetReadDeadline(time.Now().Add(30 * time.Second))
+		query, err := readTCPDNSMessage(c)
+		if err != nil {
+			return
+		}
+		resp, err := s.handle(query)
+		if err != nil {
+			log.Printf("[DNS] %v", err)
+			return
+		}
+		if err := writeTCPDNSMessage(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle 处理一条 DNS 查询报文并返回应答报文
+func (s *dnsServer) handle(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("parse query: %w", err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, fmt.Errorf("parse question: %w", err)
+	}
+	domain := strings.TrimSuffix(q.Name.String(), ".")
+
+	if s.fakeIP != nil && q.Class == dnsmessage.ClassINET {
+		switch q.Type {
+		case dnsmessage.TypeA:
+			return buildDNSAnswer(header, q, []net.IP{s.fakeIP.Lookup(domain)}, fakeIPTTL)
+		case dnsmessage.TypeAAAA:
+			// 只分配 IPv4 fake-ip，AAAA 返回空应答让客户端回落到 A 记录
+			return buildDNSAnswer(header, q, nil, fakeIPTTL)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+	defer cancel()
+
+	if s.shouldProxyDomain(domain) && s.remote != nil {
+		return s.remote.Exchange(ctx, query)
+	}
+	return s.exchangeDirect(ctx, query, header, q, domain)
+}
+
+func (s *dnsServer) shouldProxyDomain(domain string) bool {
+	switch s.cfg.ProxyMode {
+	case "direct":
+		return false
+	case "pac", "auto":
+		if s.geoMgr == nil {
+			return true
+		}
+		_, hit := s.geoMgr.Match(domain, nil)
+		return !hit
+	default:
+		return true
+	}
+}
+
+func (s *dnsServer) exchangeDirect(ctx context.Context, query []byte, header dnsmessage.Header, q dnsmessage.Question, domain string) ([]byte, error) {
+	if s.cfg.DNS.DirectServer != "" {
+		return exchangeUDP(ctx, s.cfg.DNS.DirectServer, query)
+	}
+
+	var network string
+	switch q.Type {
+	case dnsmessage.TypeA:
+		network = "ip4"
+	case dnsmessage.TypeAAAA:
+		network = "ip6"
+	default:
+		// 系统解析器只能回答地址记录，其它类型仍经隧道查询
+		if s.remote != nil {
+			return s.remote.Exchange(ctx, query)
+		}
+		return buildDNSError(header, q, dnsmessage.RCodeNotImplemented)
+	}
+
+	ips, err := dnsutil.LookupIP(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return buildDNSError(header, q, dnsmessage.RCodeNameError)
+		}
+		return buildDNSError(header, q, dnsmessage.RCodeServerFailure)
+	}
+	return buildDNSAnswer(header, q, filterIPFamily(ips, network), directAnswerTTL)
+}
+
+// lookupIPv4 经隧道向远端上游查询 A 记录，供 PAC 判定使用
+func (s *dnsServer) lookupIPv4(ctx context.Context, host string) ([]net.IP, error) {
+	if s.remote == nil {
+		return pacLookupIP(ctx, host)
+	}
+	ips, _, err := dnsutil.NewExchangeUpstream(s.remote.Exchange).LookupIP(ctx, "ip4", host)
+	return ips, err
+}
+
+func buildDNSAnswer(reqHeader dnsmessage.Header, q dnsmessage.Question, ips []net.IP, ttl uint32) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 reqHeader.ID,
+		Response:           true,
+		RecursionDesired:   reqHeader.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var r dnsmessage.AResource
+			copy(r.A[:], ip4)
+			if err := b.AResource(rh, r); err != nil {
+				return nil, err
+			}
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			var r dnsmessage.AAAAResource
+			copy(r.AAAA[:], ip.To16())
+			if err := b.AAAAResource(rh, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
+
+func buildDNSError(reqHeader dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 reqHeader.ID,
+		Response:           true,
+		RecursionDesired:   reqHeader.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+func exchangeUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessage)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func readTCPDNSMessage(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxDNSMessage {
+		return fmt.Errorf("dns message too large: %d", len(msg))
+	}
+	out := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(out, uint16(len(msg)))
+	copy(out[2:], msg)
+	_, err := w.Write(out)
+	return err
+}
+
+// uotDNSExchanger 复用一条 UoT 隧道向远端 DNS 上游发送查询，
+// 通过改写报文 ID 区分并发请求，隧道断开后在下次查询时重建。
+type uotDNSExchanger struct {
+	dialer tunnel.UoTDialer
+	server string
+
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	tun     *uotDNSTunnel
+	dialing *uotDNSDial // in-progress dial shared by concurrent queries
+}
+
+// uotDNSTunnel is one UoT tunnel and the queries waiting on it. nextID and
+// pending are guarded by the exchanger's mu; pending is nil once the tunnel is gone.
+type uotDNSTunnel struct {
+	conn    net.Conn
+	nextID  uint16
+	pending map[uint16]chan []byte
+	closed  chan struct{}
+}
+
+type uotDNSDial struct {
+	done chan struct{}
+	err  error
+}
+
+var errDNSTunnelClosed = errors.New("dns tunnel closed")
+
+func (e *uotDNSExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, fmt.Errorf("dns query too short")
+	}
+	origID := binary.BigEndian.Uint16(query[:2])
+
+	t, err := e.connect()
+	if err != nil {
+		return nil, err
+	}
+	id, ch, err := e.register(t)
+	if err != nil {
+		return nil, err
+	}
+	defer e.unregister(t, id)
+
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg[:2], id)
+
+	e.writeMu.Lock()
+	err = tunnel.WriteUoTDatagram(t.conn, e.server, msg)
+	e.writeMu.Unlock()
+	if err != nil {
+		e.reset(t)
+		return nil, fmt.Errorf("send dns query via tunnel: %w", err)
+	}
+
+	select {
+	case resp := <-ch:
+		binary.BigEndian.PutUint16(resp[:2], origID)
+		return resp, nil
+	case <-t.closed:
+		return nil, fmt.Errorf("dns query via tunnel: %w", errDNSTunnelClosed)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("dns query via tunnel: %w", ctx.Err())
+	}
+}
+
+// connect returns the current tunnel, dialing one outside the lock if needed.
+// Concurrent callers share a single dial.
+func (e *uotDNSExchanger) connect() (*uotDNSTunnel, error) {
+	e.mu.Lock()
+	for e.tun == nil && e.dialing != nil {
+		d := e.dialing
+		e.mu.Unlock()
+		<-d.done
+		if d.err != nil {
+			return nil, d.err
+		}
+		e.mu.Lock()
+	}
+	if t := e.tun; t != nil {
+		e.mu.Unlock()
+		return t, nil
+	}
+	d := &uotDNSDial{done: make(chan struct{})}
+	e.dialing = d
+	e.mu.Unlock()
+
+	conn, err := e.dialer.DialUDPOverTCP()
+
+	e.mu.Lock()
+	e.dialing = nil
+	var t *uotDNSTunnel
+	if err != nil {
+		d.err = fmt.Errorf("dial uot for dns: %w", err)
+	} else {
+		t = &uotDNSTunnel{conn: conn, pending: make(map[uint16]chan []byte), closed: make(chan struct{})}
+		e.tun = t
+		go e.readLoop(t)
+	}
+	e.mu.Unlock()
+	close(d.done)
+	return t, d.err
+}
+
+func (e *uotDNSExchanger) register(t *uotDNSTunnel) (uint16, chan []byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if t.pending == nil {
+		return 0, nil, errDNSTunnelClosed
+	}
+	for i := 0; i < 1<<16; i++ {
+		t.nextID++
+		if _, busy := t.pending[t.nextID]; !busy {
+			ch := make(chan []byte, 1)
+			t.pending[t.nextID] = ch
+			return t.nextID, ch, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("too many in-flight dns queries")
+}
+
+func (e *uotDNSExchanger) unregister(t *uotDNSTunnel, id uint16) {
+	e.mu.Lock()
+	delete(t.pending, id)
+	e.mu.Unlock()
+}
+
+// reset drops t and fails every query still waiting on it.
+func (e *uotDNSExchanger) reset(t *uotDNSTunnel) {
+	e.mu.Lock()
+	if e.tun == t {
+		e.tun = nil
+	}
+	if t.pending != nil {
+		t.pending = nil
+		close(t.closed)
+	}
+	e.mu.Unlock()
+	t.conn.Close()
+}
+
+func (e *uotDNSExchanger) readLoop(t *uotDNSTunnel) {
+	defer e.reset(t)
+	for {
+		_, payload, err := tunnel.ReadUoTDatagram(t.conn)
+		if err != nil {
+			return
+		}
+		if len(payload) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(payload[:2])
+		e.mu.Lock()
+		ch, ok := t.pending[id]
+		if ok {
+			delete(t.pending, id)
+		}
+		e.mu.Unlock()
+		if ok {
+			ch <- payload
+		}
+	}
+}
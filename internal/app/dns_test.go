@@ -0,0 +1,205 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/tunnel"
+	"github.com/saba-futai/sudoku/pkg/dnsutil"
+)
+
+// mockUoTDialer answers every DNS query carried over UoT with a fixed A record.
+type mockUoTDialer struct {
+	MockDialer
+	answer net.IP
+	seen   chan string
+}
+
+func (m *mockUoTDialer) DialUDPOverTCP() (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		for {
+			addr, query, err := tunnel.ReadUoTDatagram(server)
+			if err != nil {
+				return
+			}
+			m.seen <- addr
+			var p dnsmessage.Parser
+			header, err := p.Start(query)
+			if err != nil {
+				return
+			}
+			q, err := p.Question()
+			if err != nil {
+				return
+			}
+			resp, err := buildDNSAnswer(header, q, []net.IP{m.answer}, 300)
+			if err != nil {
+				return
+			}
+			if err := tunnel.WriteUoTDatagram(server, addr, resp); err != nil {
+				return
+			}
+		}
+	}()
+	return client, nil
+}
+
+func buildTestQuery(t *testing.T, id uint16, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDNSServer_RemoteViaTunnel(t *testing.T) {
+	cfg := &config.Config{
+		ProxyMode: "global",
+		DNS:       &config.DNSConfig{RemoteServer: "8.8.8.8:53"},
+	}
+	dialer := &mockUoTDialer{answer: net.ParseIP("93.184.216.34"), seen: make(chan string, 4)}
+	srv, err := newDNSServer(cfg, nil, dialer)
+	if err != nil {
+		t.Fatalf("new dns server: %v", err)
+	}
+
+	resp, err := srv.handle(buildTestQuery(t, 0x1234, "example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if got := <-dialer.seen; got != "8.8.8.8:53" {
+		t.Fatalf("query sent to %s", got)
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	if header.ID != 0x1234 {
+		t.Fatalf("response id not restored: %#x", header.ID)
+	}
+	ips, _, err := dnsutil.ParseAnswer(resp, 0x1234, dnsmessage.TypeA)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(dialer.answer) {
+		t.Fatalf("unexpected answer: %v %v", ips, err)
+	}
+
+	ips, err = srv.lookupIPv4(t.Context(), "example.org")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(dialer.answer) {
+		t.Fatalf("lookupIPv4 via tunnel: %v %v", ips, err)
+	}
+}
+
+func TestDNSServer_FakeIP(t *testing.T) {
+	cfg := &config.Config{
+		ProxyMode: "global",
+		DNS:       &config.DNSConfig{RemoteServer: "8.8.8.8:53", FakeIP: true, FakeIPRange: "198.18.0.0/15"},
+	}
+	srv, err := newDNSServer(cfg, nil, &MockDialer{})
+	if err != nil {
+		t.Fatalf("new dns server: %v", err)
+	}
+
+	resp, err := srv.handle(buildTestQuery(t, 1, "video.example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	ips, _, err := dnsutil.ParseAnswer(resp, 1, dnsmessage.TypeA)
+	if err != nil || len(ips) != 1 || !srv.fakeIP.Contains(ips[0]) {
+		t.Fatalf("expected fake ip, got %v %v", ips, err)
+	}
+
+	prev := globalFakeIP
+	globalFakeIP = srv.fakeIP
+	defer func() { globalFakeIP = prev }()
+
+	addr, ip := restoreFakeIPTarget(net.JoinHostPort(ips[0].String(), "443"), ips[0])
+	if addr != "video.example.com:443" || ip != nil {
+		t.Fatalf("fake ip not restored: %s %v", addr, ip)
+	}
+	if got := fakeIPSourceAddr("video.example.com:443"); got != net.JoinHostPort(ips[0].String(), "443") {
+		t.Fatalf("reply source not mapped back: %s", got)
+	}
+
+	resp, err = srv.handle(buildTestQuery(t, 2, "video.example.com.", dnsmessage.TypeAAAA))
+	if err != nil {
+		t.Fatalf("handle aaaa: %v", err)
+	}
+	if _, _, err := dnsutil.ParseAnswer(resp, 2, dnsmessage.TypeAAAA); err == nil {
+		t.Fatalf("expected empty AAAA answer in fake-ip mode")
+	}
+}
+
+// scriptedUoTDialer hands out the queued tunnel factories in order.
+type scriptedUoTDialer struct {
+	MockDialer
+	dials chan func() (net.Conn, error)
+}
+
+func (s *scriptedUoTDialer) DialUDPOverTCP() (net.Conn, error) { return (<-s.dials)() }
+
+func TestUoTDNSExchanger_TunnelLossFailsPendingAndRedialsOutsideLock(t *testing.T) {
+	answering := &mockUoTDialer{answer: net.ParseIP("93.184.216.34"), seen: make(chan string, 4)}
+	dialer := &scriptedUoTDialer{dials: make(chan func() (net.Conn, error), 2)}
+	// 第一条隧道读到查询后直接断开，不作应答
+	dialer.dials <- func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			tunnel.ReadUoTDatagram(server)
+			server.Close()
+		}()
+		return client, nil
+	}
+	e := &uotDNSExchanger{dialer: dialer, server: "8.8.8.8:53"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := e.Exchange(ctx, buildTestQuery(t, 1, "example.com.", dnsmessage.TypeA)); !errors.Is(err, errDNSTunnelClosed) {
+		t.Fatalf("expected the lost tunnel to fail the query, got %v", err)
+	}
+
+	release := make(chan struct{})
+	dialer.dials <- func() (net.Conn, error) {
+		<-release
+		return answering.DialUDPOverTCP()
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.Exchange(ctx, buildTestQuery(t, 2, "example.com.", dnsmessage.TypeA))
+		done <- err
+	}()
+	for {
+		e.mu.Lock()
+		dialing := e.dialing != nil
+		e.mu.Unlock()
+		if dialing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// 重拨期间不持有锁
+	if !e.mu.TryLock() {
+		t.Fatalf("exchanger locked during dial")
+	}
+	e.mu.Unlock()
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("query after redial: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/tunnel"
+	"github.com/saba-futai/sudoku/pkg/geodata"
+)
+
+// hopByHopHeaders 仅对单跳有效的头部 (RFC 7230 §6.1)，转发前后均需移除
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop 删除逐跳头部以及 Connection 中列出的头部
+func removeHopByHop(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// httpTargetAddr 返回请求的目标 host:port，缺省端口取 defaultPort
+func httpTargetAddr(req *http.Request, defaultPort string) string {
+	host := req.Host
+	if req.URL != nil && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+// authorizeHTTP 校验代理认证，失败时回复 407
+func authorizeHTTP(conn net.Conn, req *http.Request) bool {
+	if localACL.checkBasic(req.Header.Get("Proxy-Authorization")) {
+		return true
+	}
+	conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"sudoku\"\r\nContent-Length: 0\r\n\r\n"))
+	return false
+}
+
+// httpUpstream 为某个 host 复用的上游连接
+type httpUpstream struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// serveHTTPForward 作为普通 HTTP 正向代理循环处理同一客户端连接上的请求：
+// 每个请求按自身 Host 路由，移除逐跳头部，并按 host 复用上游连接。
+func serveHTTPForward(conn net.Conn, br *bufio.Reader, req *http.Request, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) {
+	upstreams := make(map[string]*httpUpstream)
+	defer func() {
+		for _, up := range upstreams {
+			up.conn.Close()
+		}
+	}()
+
+	for {
+		if !authorizeHTTP(conn, req) {
+			return
+		}
+		clientClose := req.Close || strings.EqualFold(req.Header.Get("Proxy-Connection"), "close")
+		upgrade := req.Header.Get("Upgrade")
+
+		host := httpTargetAddr(req, "80")
+		removeHopByHop(req.Header)
+		if upgrade != "" {
+			// WebSocket 等协议升级需要保留 Upgrade 协商头
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", upgrade)
+		}
+		req.RequestURI = ""
+		req.URL.Scheme = ""
+		req.URL.Host = ""
+		req.Close = false
+
+		resp, up, ok := roundTripUpstream(upstreams, host, req, cfg, geoMgr, dialer)
+		if !ok {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+
+		if upgrade != "" && resp.StatusCode == http.StatusSwitchingProtocols {
+			delete(upstreams, host)
+			if err := resp.Write(conn); err != nil {
+				up.conn.Close()
+				return
+			}
+			pipeConn(&PeekConn{Conn: conn, peeked: drainBuffered(br)}, &PeekConn{Conn: up.conn, peeked: drainBuffered(up.br)})
+			return
+		}
+
+		upstreamClose := resp.Close
+		removeHopByHop(resp.Header)
+		resp.Close = clientClose || upstreamClose
+		err := resp.Write(conn)
+		resp.Body.Close()
+		if upstreamClose || err != nil {
+			up.conn.Close()
+			delete(upstreams, host)
+		}
+		if err != nil || resp.Close {
+			return
+		}
+
+		if req, err = http.ReadRequest(br); err != nil {
+			return
+		}
+	}
+}
+
+// roundTripUpstream 发送请求并读取响应；复用的连接若已被上游关闭，对无 body 的请求重拨一次
+func roundTripUpstream(upstreams map[string]*httpUpstream, host string, req *http.Request, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) (*http.Response, *httpUpstream, bool) {
+	for attempt := 0; attempt < 2; attempt++ {
+		up, reused := upstreams[host]
+		if !reused {
+			hostName, _, _ := net.SplitHostPort(host)
+			targetConn, success := dialTarget(host, net.ParseIP(hostName), cfg, geoMgr, dialer)
+			if !success {
+				return nil, nil, false
+			}
+			up = &httpUpstream{conn: targetConn, br: bufio.NewReader(targetConn)}
+			upstreams[host] = up
+		}
+
+		err := req.Write(up.conn)
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.ReadResponse(up.br, req)
+		}
+		if err == nil {
+			return resp, up, true
+		}
+
+		up.conn.Close()
+		delete(upstreams, host)
+		if !reused || (req.Body != nil && req.Body != http.NoBody) {
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
+
+// drainBuffered 取出 bufio.Reader 中已缓冲的数据
+func drainBuffered(br *bufio.Reader) []byte {
+	n := br.Buffered()
+	if n == 0 {
+		return nil
+	}
+	buf, _ := br.Peek(n)
+	return append([]byte(nil), buf...)
+}
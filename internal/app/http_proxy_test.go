@@ -0,0 +1,83 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/saba-futai/sudoku/internal/config"
+)
+
+func TestHTTPForwardProxyKeepAlive(t *testing.T) {
+	var mu sync.Mutex
+	leaked := []string{}
+	newOrigin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, h := range []string{"Proxy-Connection", "Proxy-Authorization", "X-Hop"} {
+				if r.Header.Get(h) != "" {
+					mu.Lock()
+					leaked = append(leaked, name+":"+h)
+					mu.Unlock()
+				}
+			}
+			w.Header().Set("Keep-Alive", "timeout=5")
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+	}
+	a, b := newOrigin("a"), newOrigin("b")
+	defer a.Close()
+	defer b.Close()
+
+	dials := map[string]int{}
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		mu.Lock()
+		dials[dest]++
+		mu.Unlock()
+		return net.Dial("tcp", dest)
+	}}
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+	go handleMixedConn(proxy, &config.Config{ProxyMode: "global"}, nil, nil, dialer)
+
+	hostA := strings.TrimPrefix(a.URL, "http://")
+	hostB := strings.TrimPrefix(b.URL, "http://")
+	br := bufio.NewReader(client)
+	for _, tc := range []struct{ host, path, want string }{
+		{hostA, "/one", "a /one"},
+		{hostB, "/two", "b /two"},
+		{hostA, "/three", "a /three"},
+	} {
+		req := fmt.Sprintf("GET http://%s%s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\nProxy-Authorization: Basic eDp5\r\nConnection: X-Hop\r\nX-Hop: 1\r\n\r\n", tc.host, tc.path, tc.host)
+		if _, err := client.Write([]byte(req)); err != nil {
+			t.Fatalf("write request: %v", err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response for %s: %v", tc.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tc.want {
+			t.Fatalf("got %q, want %q", body, tc.want)
+		}
+		if resp.Header.Get("Keep-Alive") != "" {
+			t.Fatalf("hop-by-hop response header leaked to client")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) != 0 {
+		t.Fatalf("hop-by-hop headers reached origin: %v", leaked)
+	}
+	if dials[hostA] != 1 || dials[hostB] != 1 {
+		t.Fatalf("upstream connections not reused per host: %v", dials)
+	}
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/saba-futai/sudoku/internal/config"
+)
+
+// localACL 为客户端本地入口的访问控制，nil 表示不限制
+var localACL *inboundACL
+
+// inboundACL 校验本地混合代理的来源地址与用户凭据
+type inboundACL struct {
+	nets  []*net.IPNet
+	users map[string]string
+}
+
+func newInboundACL(cfg *config.InboundConfig) (*inboundACL, error) {
+	if cfg == nil || (len(cfg.AllowCIDRs) == 0 && len(cfg.Users) == 0) {
+		return nil, nil
+	}
+	acl := &inboundACL{users: make(map[string]string, len(cfg.Users))}
+	for _, cidr := range cfg.AllowCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_cidrs entry %q: %w", cidr, err)
+		}
+		acl.nets = append(acl.nets, n)
+	}
+	for _, u := range cfg.Users {
+		acl.users[u.Username] = u.Password
+	}
+	return acl, nil
+}
+
+// allowSource 检查来源 IP 是否在白名单内；未配置白名单时全部放行
+func (a *inboundACL) allowSource(addr net.Addr) bool {
+	if a == nil || len(a.nets) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range a.nets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *inboundACL) authRequired() bool {
+	return a != nil && len(a.users) > 0
+}
+
+// check 校验用户名与密码；不要求认证时总是通过
+func (a *inboundACL) check(user, pass string) bool {
+	if !a.authRequired() {
+		return true
+	}
+	want, ok := a.users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+}
+
+// checkUser 用于 SOCKS4：协议只有 userid，仅校验用户名
+func (a *inboundACL) checkUser(user string) bool {
+	if !a.authRequired() {
+		return true
+	}
+	_, ok := a.users[user]
+	return ok
+}
+
+// checkBasic 校验 HTTP Proxy-Authorization: Basic 头
+func (a *inboundACL) checkBasic(header string) bool {
+	if !a.authRequired() {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(raw), ":")
+	return ok && a.check(user, pass)
+}
+
+// socks5Authenticate 完成 SOCKS5 方法协商，需要认证时执行 RFC 1929 用户名密码子协商
+func socks5Authenticate(conn net.Conn, methods []byte) bool {
+	if !localACL.authRequired() {
+		_, err := conn.Write([]byte{0x05, 0x00})
+		return err == nil
+	}
+	offered := false
+	for _, m := range methods {
+		if m == 0x02 {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{0x05, 0xFF})
+		return false
+	}
+	if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+		return false
+	}
+
+	// VER(1)=0x01 | ULEN(1) | UNAME | PLEN(1) | PASSWD
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 0x01 {
+		return false
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return false
+	}
+	pass := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return false
+	}
+	if !localACL.check(string(user), string(pass)) {
+		conn.Write([]byte{0x01, 0x01})
+		return false
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return err == nil
+}
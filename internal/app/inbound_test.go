@@ -0,0 +1,129 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"testing"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+)
+
+func withTestACL(t *testing.T, cfg *config.InboundConfig) {
+	t.Helper()
+	acl, err := newInboundACL(cfg)
+	if err != nil {
+		t.Fatalf("acl: %v", err)
+	}
+	prev := localACL
+	localACL = acl
+	t.Cleanup(func() { localACL = prev })
+}
+
+func captureDialer(target *string) *MockDialer {
+	return &MockDialer{
+		DialFunc: func(destAddrStr string) (net.Conn, error) {
+			*target = destAddrStr
+			return NewMockConn(nil), nil
+		},
+	}
+}
+
+func TestInboundSocks5Auth(t *testing.T) {
+	withTestACL(t, &config.InboundConfig{Users: []config.ProxyUser{{Username: "alice", Password: "secret"}}})
+	cfg := &config.Config{ProxyMode: "global"}
+	table := sudoku.NewTable("key", "prefer_entropy")
+
+	request := []byte{0x05, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0, 80}
+	cases := []struct {
+		name     string
+		input    []byte
+		wantResp []byte
+		dialed   bool
+	}{
+		{
+			name:     "no auth offered",
+			input:    []byte{0x05, 0x01, 0x00},
+			wantResp: []byte{0x05, 0xFF},
+		},
+		{
+			name:     "wrong password",
+			input:    append([]byte{0x05, 0x01, 0x02, 0x01, 5, 'a', 'l', 'i', 'c', 'e', 3, 'b', 'a', 'd'}, request...),
+			wantResp: []byte{0x05, 0x02, 0x01, 0x01},
+		},
+		{
+			name:     "valid credentials",
+			input:    append([]byte{0x05, 0x01, 0x02, 0x01, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'}, request...),
+			wantResp: []byte{0x05, 0x02, 0x01, 0x00},
+			dialed:   true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var target string
+			conn := NewMockConn(tc.input)
+			handleMixedConn(conn, cfg, table, nil, captureDialer(&target))
+			if resp := conn.WriteBuf.Bytes(); !bytes.HasPrefix(resp, tc.wantResp) {
+				t.Fatalf("response %v, want prefix %v", resp, tc.wantResp)
+			}
+			if (target != "") != tc.dialed {
+				t.Fatalf("dialed=%q, want dialed=%v", target, tc.dialed)
+			}
+		})
+	}
+}
+
+func TestInboundSocks4UserID(t *testing.T) {
+	withTestACL(t, &config.InboundConfig{Users: []config.ProxyUser{{Username: "alice"}}})
+	cfg := &config.Config{ProxyMode: "global"}
+
+	for _, user := range []string{"alice", "mallory"} {
+		var target string
+		input := append([]byte{0x04, 0x01, 0, 80, 1, 2, 3, 4}, append([]byte(user), 0)...)
+		conn := NewMockConn(input)
+		handleMixedConn(conn, cfg, nil, nil, captureDialer(&target))
+		resp := conn.WriteBuf.Bytes()
+		if user == "alice" && (target == "" || resp[1] != 0x5A) {
+			t.Fatalf("alice rejected: %v", resp)
+		}
+		if user == "mallory" && (target != "" || resp[1] != 0x5D) {
+			t.Fatalf("mallory accepted: %v", resp)
+		}
+	}
+}
+
+func TestInboundHTTPBasicAuth(t *testing.T) {
+	withTestACL(t, &config.InboundConfig{Users: []config.ProxyUser{{Username: "alice", Password: "secret"}}})
+	cfg := &config.Config{ProxyMode: "global"}
+
+	var target string
+	conn := NewMockConn([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	handleMixedConn(conn, cfg, nil, nil, captureDialer(&target))
+	if !bytes.HasPrefix(conn.WriteBuf.Bytes(), []byte("HTTP/1.1 407")) || target != "" {
+		t.Fatalf("unauthenticated request not rejected: %q", conn.WriteBuf.String())
+	}
+
+	cred := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	conn = NewMockConn([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic " + cred + "\r\n\r\n"))
+	handleMixedConn(conn, cfg, nil, nil, captureDialer(&target))
+	if !bytes.HasPrefix(conn.WriteBuf.Bytes(), []byte("HTTP/1.1 200")) || target != "example.com:443" {
+		t.Fatalf("authenticated request failed: %q", conn.WriteBuf.String())
+	}
+}
+
+func TestInboundAllowSource(t *testing.T) {
+	acl, err := newInboundACL(&config.InboundConfig{AllowCIDRs: []string{"127.0.0.0/8", "192.168.1.0/24"}})
+	if err != nil {
+		t.Fatalf("acl: %v", err)
+	}
+	for ip, want := range map[string]bool{"127.0.0.1": true, "192.168.1.20": true, "10.0.0.1": false} {
+		if got := acl.allowSource(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}); got != want {
+			t.Errorf("allowSource(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	var none *inboundACL
+	if !none.allowSource(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) {
+		t.Errorf("nil acl should allow everything")
+	}
+}
@@ -2,6 +2,8 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,10 +14,16 @@ import (
 	"github.com/saba-futai/sudoku/internal/handler"
 	"github.com/saba-futai/sudoku/internal/protocol"
 	"github.com/saba-futai/sudoku/internal/tunnel"
+	"github.com/saba-futai/sudoku/pkg/dnsutil"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+	"github.com/saba-futai/sudoku/pkg/transport/tlswrap"
 )
 
 func RunServer(cfg *config.Config, tables []*sudoku.Table) {
+	if err := configureResolver(cfg); err != nil {
+		log.Fatalf("Failed to configure resolver: %v", err)
+	}
+
 	// 1. 监听 TCP 端口
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.LocalPort))
 	if err != nil {
@@ -23,6 +31,32 @@ func RunServer(cfg *config.Config, tables []*sudoku.Table) {
 	}
 	log.Printf("Server on :%d (Fallback: %s)", cfg.LocalPort, cfg.FallbackAddr)
 
+	if cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.ServerConfig()
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		log.Printf("Server TLS enabled, certificate sha256 (pin_sha256): %s", tlswrap.CertificateSHA256(tlsCfg))
+	}
+
+	// 2. 原生 UDP 传输 (可选)，与 TCP 共用端口
+	if cfg.Transport == "udp" {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: cfg.LocalPort})
+		if err != nil {
+			log.Fatal(err)
+		}
+		udpSrv, err := tunnel.NewUDPServer(udpConn, cfg, tables)
+		if err != nil {
+			log.Fatalf("Failed to init UDP transport: %v", err)
+		}
+		log.Printf("Server UDP transport on :%d", cfg.LocalPort)
+		go func() {
+			if err := udpSrv.Serve(); err != nil {
+				log.Printf("[Server][UDP] %v", err)
+			}
+		}()
+	}
+
 	for {
 		c, err := l.Accept()
 		if err != nil {
@@ -36,9 +70,15 @@ func handleServerConn(rawConn net.Conn, cfg *config.Config, tables []*sudoku.Tab
 	// Use Tunnel Abstraction for Handshake and Upgrade
 	tunnelConn, err := tunnel.HandshakeAndUpgradeWithTables(rawConn, cfg, tables)
 	if err != nil {
-		if suspErr, ok := err.(*tunnel.SuspiciousError); ok {
+		if errors.Is(err, tunnel.ErrUplinkServed) {
+			rawConn.Close()
+		} else if suspErr, ok := err.(*tunnel.SuspiciousError); ok {
 			log.Printf("[Security] Suspicious connection: %v", suspErr.Err)
-			handler.HandleSuspicious(suspErr.Conn, rawConn, cfg)
+			fallbackConn := rawConn
+			if suspErr.Raw != nil {
+				fallbackConn = suspErr.Raw
+			}
+			handler.HandleSuspicious(suspErr.Conn, fallbackConn, cfg)
 		} else {
 			log.Printf("[Server] Handshake failed: %v", err)
 			rawConn.Close()
@@ -58,12 +98,17 @@ func handleServerConn(rawConn net.Conn, cfg *config.Config, tables []*sudoku.Tab
 	}
 
 	if firstByte[0] == tunnel.UoTMagicByte {
-		if err := tunnel.HandleUoTServer(tunnelConn); err != nil {
+		if err := tunnel.HandleUoTServerWithOptions(tunnelConn, tunnel.NATOptionsFromConfig(cfg)); err != nil {
 			log.Printf("[Server][UoT] session ended: %v", err)
 		}
 		return
 	}
 
+	if firstByte[0] == tunnel.BindMagicByte {
+		handleServerBind(tunnelConn, rawConn, cfg)
+		return
+	}
+
 	// 非 UoT：将预读的字节放回流中以兼容旧协议
 	prefixedConn := tunnel.NewPreBufferedConn(tunnelConn, firstByte)
 
@@ -76,7 +121,9 @@ func handleServerConn(rawConn net.Conn, cfg *config.Config, tables []*sudoku.Tab
 
 	log.Printf("[Server] Connecting to %s", destAddrStr)
 
-	target, err := net.DialTimeout("tcp", destAddrStr, 10*time.Second)
+	dialCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	target, err := dnsutil.DialContext(dialCtx, "tcp", destAddrStr)
+	cancel()
 	if err != nil {
 		log.Printf("[Server] Connect target failed: %v", err)
 		return
@@ -87,3 +134,77 @@ func handleServerConn(rawConn net.Conn, cfg *config.Config, tables []*sudoku.Tab
 	// ==========================================
 	pipeConn(prefixedConn, target)
 }
+
+// handleServerBind 处理 SOCKS5 BIND：开启监听、回报地址，并把第一个入站连接接回隧道
+func handleServerBind(conn, rawConn net.Conn, cfg *config.Config) {
+	defer conn.Close()
+
+	expected, _, expectedIP, err := protocol.ReadAddress(conn)
+	if err != nil {
+		log.Printf("[Server][Bind] Failed to read address: %v", err)
+		return
+	}
+	if cfg.Bind == nil || !cfg.Bind.Enabled {
+		log.Printf("[Server][Bind] Rejected bind for %s: disabled by policy", expected)
+		tunnel.WriteBindReply(conn, tunnel.BindRepNotAllowed, "0.0.0.0:0")
+		return
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(cfg.Bind.ListenIP)})
+	if err != nil {
+		log.Printf("[Server][Bind] Listen failed: %v", err)
+		tunnel.WriteBindReply(conn, tunnel.BindRepFailure, "0.0.0.0:0")
+		return
+	}
+	defer ln.Close()
+
+	// 告知客户端的地址：优先 advertise_ip，其次监听地址，最后取客户端连入的本机地址
+	announceIP := net.ParseIP(cfg.Bind.AdvertiseIP)
+	if announceIP == nil {
+		announceIP = ln.Addr().(*net.TCPAddr).IP
+	}
+	if announceIP.IsUnspecified() {
+		if local, ok := rawConn.LocalAddr().(*net.TCPAddr); ok {
+			announceIP = local.IP
+		}
+	}
+	announce := net.JoinHostPort(announceIP.String(), fmt.Sprint(ln.Addr().(*net.TCPAddr).Port))
+	if err := tunnel.WriteBindReply(conn, tunnel.BindRepSuccess, announce); err != nil {
+		return
+	}
+	log.Printf("[Server][Bind] Listening on %s for %s", announce, expected)
+
+	timeout := 60 * time.Second
+	if cfg.Bind.AcceptTimeout > 0 {
+		timeout = time.Duration(cfg.Bind.AcceptTimeout) * time.Second
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+
+	var peer *net.TCPConn
+	for peer == nil {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			rep := tunnel.BindRepFailure
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				rep = tunnel.BindRepTimeout
+			}
+			log.Printf("[Server][Bind] Accept failed: %v", err)
+			tunnel.WriteBindReply(conn, rep, "0.0.0.0:0")
+			return
+		}
+		// RFC 1928：DST.ADDR 为具体 IP 时只接受来自该地址的连接
+		if expectedIP != nil && !expectedIP.IsUnspecified() && !c.RemoteAddr().(*net.TCPAddr).IP.Equal(expectedIP) {
+			log.Printf("[Server][Bind] Dropped unexpected peer %s", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		peer = c
+	}
+	ln.Close()
+
+	if err := tunnel.WriteBindReply(conn, tunnel.BindRepSuccess, peer.RemoteAddr().String()); err != nil {
+		peer.Close()
+		return
+	}
+	pipeConn(conn, peer)
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/sniff"
+)
+
+const (
+	sniffTimeout  = 300 * time.Millisecond // 等待客户端首包的时间；服务端先发言的协议不应被拖慢太久
+	sniffMaxBytes = 16 * 1024
+	maxQUICFlows  = 256 // 每个 UDP 会话同时嗅探/改写的目的地址上限
+)
+
+// shouldSniff 仅对真实 IP 目标嗅探；域名与 fake-ip 已经能按域名路由
+func shouldSniff(cfg *config.Config, destIP net.IP) bool {
+	return cfg.Sniff != nil && cfg.Sniff.Enabled && destIP != nil && !globalFakeIP.Contains(destIP)
+}
+
+// sniffStream 读取客户端首包提取 TLS SNI 或 HTTP Host。
+// 返回的连接会先重放已读取的数据，不丢失任何字节。
+func sniffStream(conn net.Conn) (string, net.Conn) {
+	buf := make([]byte, 0, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for len(buf) < sniffMaxBytes {
+		if len(buf) == cap(buf) {
+			buf = append(buf, make([]byte, cap(buf))...)[:len(buf)]
+		}
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		domain, serr := sniff.Stream(buf)
+		if serr == nil {
+			return domain, &PeekConn{Conn: conn, peeked: buf}
+		}
+		if serr != sniff.ErrIncomplete || err != nil {
+			break
+		}
+	}
+	return "", &PeekConn{Conn: conn, peeked: buf}
+}
+
+// udpSniffer 在 override_destination 时嗅探发往 IP:443 的 QUIC Initial，
+// 把该目的地址改写为 domain:443 交给服务端解析，并把回包来源换回原 IP。
+// nil 表示未启用，所有方法都原样放行。
+type udpSniffer struct {
+	mu      sync.Mutex
+	flows   map[string]*quicFlow // key: 客户端看到的 ip:port
+	reverse map[string]string    // domain:port -> ip:port
+}
+
+type quicFlow struct {
+	sniffer sniff.QUICSniffer
+	pending [][]byte
+	done    bool
+	target  string
+}
+
+func newUDPSniffer(cfg *config.Config) *udpSniffer {
+	if cfg.Sniff == nil || !cfg.Sniff.Enabled || !cfg.Sniff.OverrideDestination {
+		return nil
+	}
+	return &udpSniffer{flows: make(map[string]*quicFlow), reverse: make(map[string]string)}
+}
+
+// outbound 返回应发往 target 的数据包；嗅探未结束时暂存并返回空列表
+func (u *udpSniffer) outbound(addr string, payload []byte) (string, [][]byte) {
+	if u == nil {
+		return addr, [][]byte{payload}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != "443" || net.ParseIP(host) == nil || globalFakeIP.Contains(net.ParseIP(host)) {
+		return addr, [][]byte{payload}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f := u.flows[addr]
+	if f == nil {
+		if len(u.flows) >= maxQUICFlows {
+			return addr, [][]byte{payload}
+		}
+		f = &quicFlow{target: addr}
+		u.flows[addr] = f
+	}
+	if f.done {
+		return f.target, [][]byte{payload}
+	}
+
+	f.pending = append(f.pending, payload)
+	domain, err := f.sniffer.Add(payload)
+	if errors.Is(err, sniff.ErrIncomplete) {
+		return "", nil
+	}
+	f.done = true
+	if err == nil {
+		f.target = net.JoinHostPort(domain, port)
+		u.reverse[f.target] = addr
+		log.Printf("[Sniff][QUIC] %s -> %s", addr, f.target)
+	}
+	pending := f.pending
+	f.pending = nil
+	return f.target, pending
+}
+
+// inbound 把服务端回包的来源地址换回客户端最初发送的 IP 地址
+func (u *udpSniffer) inbound(addr string) string {
+	if u == nil {
+		return addr
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if orig, ok := u.reverse[addr]; ok {
+		return orig
+	}
+	return addr
+}
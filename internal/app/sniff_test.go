@@ -0,0 +1,128 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+)
+
+func TestSocks5SniffHTTPHost(t *testing.T) {
+	request := "GET /index HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	for _, override := range []bool{true, false} {
+		dialed := make(chan string, 1)
+		received := make(chan string, 1)
+		dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+			dialed <- dest
+			up, remote := net.Pipe()
+			go func() {
+				buf := make([]byte, len(request))
+				io.ReadFull(remote, buf)
+				received <- string(buf)
+				remote.Close()
+			}()
+			return up, nil
+		}}
+		cfg := &config.Config{ProxyMode: "global", Sniff: &config.SniffConfig{Enabled: true, OverrideDestination: override}}
+
+		client, proxy := net.Pipe()
+		go handleMixedConn(proxy, cfg, nil, nil, dialer)
+
+		client.Write([]byte{0x05, 0x01, 0x00})
+		reply := make([]byte, 2)
+		io.ReadFull(client, reply)
+		client.Write([]byte{0x05, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0, 80})
+		reply = make([]byte, 10)
+		if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x00 {
+			t.Fatalf("connect reply: %v %x", err, reply)
+		}
+		client.Write([]byte(request))
+
+		want := "1.2.3.4:80"
+		if override {
+			want = "example.com:80"
+		}
+		select {
+		case dest := <-dialed:
+			if dest != want {
+				t.Fatalf("override=%v: dialed %q, want %q", override, dest, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("override=%v: no dial", override)
+		}
+		if got := <-received; got != request {
+			t.Fatalf("sniffed bytes not replayed: %q", got)
+		}
+		client.Close()
+	}
+}
+
+func TestSocks5SniffDialFailureClosesClient(t *testing.T) {
+	dialer := &MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		return nil, io.ErrUnexpectedEOF
+	}}
+	cfg := &config.Config{ProxyMode: "global", Sniff: &config.SniffConfig{Enabled: true}}
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+	go handleMixedConn(proxy, cfg, nil, nil, dialer)
+
+	client.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	io.ReadFull(client, reply)
+	client.Write([]byte{0x05, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0, 80})
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("expected the early success reply: %v %x", err, reply)
+	}
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	// 拨号失败后只能关闭连接
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestSniffStreamServerFirst(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	start := time.Now()
+	domain, conn := sniffStream(proxy)
+	if domain != "" {
+		t.Fatalf("unexpected domain %q", domain)
+	}
+	if time.Since(start) > 2*sniffTimeout {
+		t.Fatalf("sniff took too long")
+	}
+
+	// 超时后连接仍可正常使用
+	go client.Write([]byte("late"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "late" {
+		t.Fatalf("read after sniff: %q %v", buf, err)
+	}
+}
+
+func TestUDPSnifferPassThrough(t *testing.T) {
+	u := newUDPSniffer(&config.Config{Sniff: &config.SniffConfig{Enabled: true, OverrideDestination: true}})
+
+	if addr, pkts := u.outbound("1.1.1.1:53", []byte("dns")); addr != "1.1.1.1:53" || len(pkts) != 1 {
+		t.Fatalf("non-443 packet altered: %s %d", addr, len(pkts))
+	}
+	// 非 QUIC 的 443 流量放弃嗅探并原样发送
+	if addr, pkts := u.outbound("1.1.1.1:443", []byte{0x40, 1, 2, 3}); addr != "1.1.1.1:443" || len(pkts) != 1 {
+		t.Fatalf("non-quic packet altered: %s %d", addr, len(pkts))
+	}
+	if addr, pkts := u.outbound("1.1.1.1:443", []byte{0xc0}); addr != "1.1.1.1:443" || len(pkts) != 1 {
+		t.Fatalf("flow not marked done: %s %d", addr, len(pkts))
+	}
+
+	var disabled *udpSniffer
+	if addr, pkts := disabled.outbound("1.1.1.1:443", []byte{0xc0}); addr != "1.1.1.1:443" || len(pkts) != 1 {
+		t.Fatalf("nil sniffer altered packet")
+	}
+}
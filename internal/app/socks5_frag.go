@@ -0,0 +1,112 @@
+package app
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/protocol"
+)
+
+// RFC 1928 §7: FRAG 的低 7 位为分片序号（从 1 开始），最高位标记最后一片。
+const (
+	socks5FragEnd       = 0x80
+	socks5FragPosMask   = 0x7F
+	socks5FragTimeout   = 5 * time.Second // RFC 要求重组计时器不少于 5 秒
+	socks5MaxReassembly = 65507           // IPv4 UDP 载荷上限，低于 UoT 单帧上限
+	socks5MinFragPacket = 512
+)
+
+// socks5Reassembler 按 RFC 1928 重组单个 UDP 关联上的分片请求。
+// 只维护一个重组队列：收到 FRAG=0 的独立包、序号不连续或计时器到期时丢弃队列。
+type socks5Reassembler struct {
+	timeout time.Duration
+	maxSize int
+
+	addr     string
+	lastPos  byte
+	parts    [][]byte
+	size     int
+	deadline time.Time
+
+	// 客户端发送过的最大分片包长度，用于回包分片；0 表示客户端未使用分片
+	maxPacket int
+}
+
+func newSocks5Reassembler() *socks5Reassembler {
+	return &socks5Reassembler{timeout: socks5FragTimeout, maxSize: socks5MaxReassembly}
+}
+
+func (r *socks5Reassembler) reset() {
+	r.addr = ""
+	r.lastPos = 0
+	r.parts = nil
+	r.size = 0
+}
+
+// add feeds one decoded request; it returns the full datagram once complete.
+func (r *socks5Reassembler) add(frag byte, addr string, payload []byte, pktLen int, now time.Time) (string, []byte, bool) {
+	if frag == 0 {
+		r.reset()
+		return addr, payload, true
+	}
+	if pktLen > r.maxPacket {
+		r.maxPacket = pktLen
+	}
+
+	pos := frag & socks5FragPosMask
+	if r.parts != nil && (now.After(r.deadline) || pos != r.lastPos+1 || addr != r.addr) {
+		r.reset()
+	}
+	if r.parts == nil {
+		if pos != 1 {
+			return "", nil, false
+		}
+		r.addr = addr
+		r.deadline = now.Add(r.timeout)
+	}
+	if r.size+len(payload) > r.maxSize {
+		r.reset()
+		return "", nil, false
+	}
+
+	r.parts = append(r.parts, payload)
+	r.size += len(payload)
+	r.lastPos = pos
+	if frag&socks5FragEnd == 0 {
+		return "", nil, false
+	}
+
+	full := bytes.Join(r.parts, nil)
+	r.reset()
+	return addr, full, true
+}
+
+// buildUDPResponsePackets 构造回包；maxPacket>0 且回包超过该长度时按 RFC 1928 分片
+func buildUDPResponsePackets(addr string, payload []byte, maxPacket int) [][]byte {
+	hdr := &bytes.Buffer{}
+	hdr.Write([]byte{0x00, 0x00, 0x00}) // RSV RSV FRAG
+	if err := protocol.WriteAddress(hdr, addr); err != nil {
+		return nil
+	}
+	if maxPacket <= 0 || hdr.Len()+len(payload) <= maxPacket {
+		return [][]byte{append(hdr.Bytes(), payload...)}
+	}
+	chunk := max(maxPacket, socks5MinFragPacket) - hdr.Len()
+	count := (len(payload) + chunk - 1) / chunk
+	if count > socks5FragPosMask {
+		// 序号放不下，整包发送交给 IP 层分片
+		return [][]byte{append(hdr.Bytes(), payload...)}
+	}
+
+	packets := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		part := payload[i*chunk : min((i+1)*chunk, len(payload))]
+		pkt := append([]byte(nil), hdr.Bytes()...)
+		pkt[2] = byte(i + 1)
+		if i == count-1 {
+			pkt[2] |= socks5FragEnd
+		}
+		packets = append(packets, append(pkt, part...))
+	}
+	return packets
+}
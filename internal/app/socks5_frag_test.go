@@ -0,0 +1,85 @@
+package app
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSocks5Reassembler(t *testing.T) {
+	now := time.Now()
+	r := newSocks5Reassembler()
+
+	if addr, p, ok := r.add(0, "1.1.1.1:53", []byte("whole"), 20, now); !ok || addr != "1.1.1.1:53" || string(p) != "whole" {
+		t.Fatalf("standalone datagram not passed through")
+	}
+	if r.maxPacket != 0 {
+		t.Fatalf("standalone datagram should not enable fragmentation")
+	}
+
+	r.add(1, "1.1.1.1:53", []byte("ab"), 600, now)
+	r.add(2, "1.1.1.1:53", []byte("cd"), 600, now)
+	addr, p, ok := r.add(3|socks5FragEnd, "1.1.1.1:53", []byte("e"), 300, now)
+	if !ok || addr != "1.1.1.1:53" || string(p) != "abcde" {
+		t.Fatalf("reassembly failed: %v %q", ok, p)
+	}
+	if r.maxPacket != 600 {
+		t.Fatalf("maxPacket = %d", r.maxPacket)
+	}
+
+	// A gap abandons the queue.
+	r.add(1, "1.1.1.1:53", []byte("a"), 600, now)
+	if _, _, ok := r.add(3|socks5FragEnd, "1.1.1.1:53", []byte("c"), 600, now); ok {
+		t.Fatalf("datagram with a missing fragment delivered")
+	}
+
+	// The reassembly timer expires.
+	r.add(1, "1.1.1.1:53", []byte("a"), 600, now)
+	if _, _, ok := r.add(2|socks5FragEnd, "1.1.1.1:53", []byte("b"), 600, now.Add(socks5FragTimeout+time.Second)); ok {
+		t.Fatalf("expired queue delivered")
+	}
+
+	// A standalone datagram discards a pending queue.
+	r.add(1, "1.1.1.1:53", []byte("a"), 600, now)
+	r.add(0, "1.1.1.1:53", []byte("x"), 20, now)
+	if _, _, ok := r.add(2|socks5FragEnd, "1.1.1.1:53", []byte("b"), 600, now); ok {
+		t.Fatalf("queue survived a standalone datagram")
+	}
+
+	// Oversized reassembly is dropped.
+	r.maxSize = 4
+	r.add(1, "1.1.1.1:53", []byte("abc"), 600, now)
+	if _, _, ok := r.add(2|socks5FragEnd, "1.1.1.1:53", []byte("de"), 600, now); ok {
+		t.Fatalf("oversized datagram delivered")
+	}
+}
+
+func TestBuildUDPResponsePacketsFragments(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 200)
+
+	if pkts := buildUDPResponsePackets("8.8.8.8:53", payload, 0); len(pkts) != 1 || pkts[0][2] != 0 {
+		t.Fatalf("unexpected fragmentation without client support")
+	}
+
+	pkts := buildUDPResponsePackets("8.8.8.8:53", payload, 600)
+	if len(pkts) < 2 {
+		t.Fatalf("expected fragments, got %d", len(pkts))
+	}
+	r := newSocks5Reassembler()
+	var got []byte
+	for i, pkt := range pkts {
+		if len(pkt) > 600 {
+			t.Fatalf("fragment %d too large: %d", i, len(pkt))
+		}
+		frag, addr, part, err := decodeSocks5UDPRequest(pkt)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if _, full, ok := r.add(frag, addr, part, len(pkt), time.Now()); ok {
+			got = full
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("fragments do not reassemble to the original payload")
+	}
+}
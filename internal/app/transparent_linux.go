@@ -0,0 +1,491 @@
+//go:build linux
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/tunnel"
+	"github.com/saba-futai/sudoku/pkg/geodata"
+)
+
+const (
+	tproxyUDPIdleTimeout = 2 * time.Minute
+	// tproxyUDPQueueLen 是每个会话在隧道就绪前后可排队的数据报数
+	tproxyUDPQueueLen = 64
+
+	// ip6tSoOriginalDst 即 linux/netfilter_ipv6/ip6_tables.h 中的 IP6T_SO_ORIGINAL_DST
+	ip6tSoOriginalDst = 80
+)
+
+// startTransparentProxies 启动 redir (REDIRECT) 与 tproxy (TPROXY) 入口
+func startTransparentProxies(cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) error {
+	listenIP := ""
+	if cfg.Inbound != nil {
+		listenIP = cfg.Inbound.ListenIP
+	}
+
+	if cfg.RedirPort > 0 {
+		l, err := net.Listen("tcp", net.JoinHostPort(listenIP, fmt.Sprint(cfg.RedirPort)))
+		if err != nil {
+			return fmt.Errorf("redir listen: %w", err)
+		}
+		log.Printf("Client (Redir) on %s", l.Addr())
+		go serveRedir(l, cfg, geoMgr, dialer)
+	}
+
+	if cfg.TProxyPort > 0 {
+		addr := net.JoinHostPort(listenIP, fmt.Sprint(cfg.TProxyPort))
+		l, err := transparentListenConfig(false).Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("tproxy tcp listen: %w", err)
+		}
+		pc, err := transparentListenConfig(true).ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("tproxy udp listen: %w", err)
+		}
+		log.Printf("Client (TProxy) on %s (tcp+udp)", addr)
+		go serveTProxyTCP(l, cfg, geoMgr, dialer)
+		go newTProxyUDP(pc.(*net.UDPConn), cfg, dialer).serve()
+	}
+	return nil
+}
+
+// transparentListenConfig 设置 IP_TRANSPARENT；recvOrigDst 用于 UDP 接收原始目的地址
+func transparentListenConfig(recvOrigDst bool) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		return controlTransparent(c, recvOrigDst)
+	}}
+}
+
+func controlTransparent(c syscall.RawConn, recvOrigDst bool) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); serr != nil {
+			return
+		}
+		// IPv6 选项仅对 AF_INET6 socket 有效，失败时忽略
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		if recvOrigDst {
+			// 回包 socket 需绑定到原始目的地址，可能与入口端口重合
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+				return
+			}
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); serr != nil {
+				return
+			}
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func serveRedir(l net.Listener, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			continue
+		}
+		if !localACL.allowSource(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		go func() {
+			dst, err := originalDst(c.(*net.TCPConn))
+			if err != nil {
+				log.Printf("[Redir] %s: original destination unavailable: %v", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+			handleTransparentTCP(c, dst, cfg, geoMgr, dialer)
+		}()
+	}
+}
+
+func serveTProxyTCP(l net.Listener, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			continue
+		}
+		if !localACL.allowSource(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		// TPROXY 下本地地址即原始目的地址
+		go handleTransparentTCP(c, c.LocalAddr().(*net.TCPAddr), cfg, geoMgr, dialer)
+	}
+}
+
+// handleTransparentTCP 与混合代理共用 dialTarget 的路由与拨号
+func handleTransparentTCP(c net.Conn, dst *net.TCPAddr, cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) {
+	if isLocalListener(dst, cfg) {
+		// 未经重定向直接连到了入口端口，转发会形成环路
+		c.Close()
+		return
+	}
+	ip := dst.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	var targetConn net.Conn
+	ok := false
+	plan := planConnect(dst.String(), ip, cfg, geoMgr)
+	if plan.firstPacket {
+		c, targetConn, ok = dialWithFirstPacket(c, plan, cfg, geoMgr, dialer)
+	} else {
+		targetConn, ok = plan.dial(dialer)
+	}
+	if !ok {
+		c.Close()
+		return
+	}
+	pipeConn(c, targetConn)
+}
+
+func isLocalListener(dst *net.TCPAddr, cfg *config.Config) bool {
+	if dst.Port != cfg.RedirPort && dst.Port != cfg.TProxyPort && dst.Port != cfg.LocalPort {
+		return false
+	}
+	if dst.IP.IsLoopback() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// originalDst 读取 REDIRECT 前的目的地址 (SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST)
+func originalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := c.LocalAddr().(*net.TCPAddr)
+	isV6 := local != nil && local.IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if isV6 {
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+			return
+		}
+		// 返回的 sockaddr_in 放在 Multiaddr 中：family(2) | port(2) | addr(4)
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			serr = err
+			return
+		}
+		b := mreq.Multiaddr
+		addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, serr
+}
+
+// parseOrigDst 从控制消息中取出 IP_ORIGDSTADDR / IPV6_ORIGDSTADDR
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// sockaddr_in: family(2) | port(2) | addr(4)
+			return &net.UDPAddr{
+				IP:   net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]),
+				Port: int(m.Data[2])<<8 | int(m.Data[3]),
+			}, nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// sockaddr_in6: family(2) | port(2) | flowinfo(4) | addr(16)
+			return &net.UDPAddr{
+				IP:   append(net.IP(nil), m.Data[8:24]...),
+				Port: int(m.Data[2])<<8 | int(m.Data[3]),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("original destination not found")
+}
+
+// tproxyUDP 按客户端源地址维护 UDP 会话，经隧道转发 (与 SOCKS5 UDP 相同)
+type tproxyUDP struct {
+	conn   *net.UDPConn
+	cfg    *config.Config
+	dialer tunnel.Dialer
+
+	mu       sync.Mutex
+	sessions map[string]*tproxyUDPSession
+}
+
+func newTProxyUDP(conn *net.UDPConn, cfg *config.Config, dialer tunnel.Dialer) *tproxyUDP {
+	return &tproxyUDP{conn: conn, cfg: cfg, dialer: dialer, sessions: make(map[string]*tproxyUDPSession)}
+}
+
+func (t *tproxyUDP) serve() error {
+	go t.expireLoop()
+	buf := make([]byte, 65535)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := t.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return err
+		}
+		dst, err := parseOrigDst(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		if ip4 := dst.IP.To4(); ip4 != nil {
+			dst.IP = ip4
+		}
+		s := t.session(src)
+		select {
+		case s.out <- tproxyUDPPacket{dst: dst, payload: append([]byte(nil), buf[:n]...)}:
+		default:
+			// 隧道尚在握手或发送跟不上时丢包，与真实 UDP 一致
+		}
+	}
+}
+
+// session 返回 src 的会话；新会话立即登记，拨号在会话自己的协程里进行，不阻塞读循环
+func (t *tproxyUDP) session(src *net.UDPAddr) *tproxyUDPSession {
+	key := src.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.sessions[key]; ok {
+		s.touch()
+		return s
+	}
+	s := &tproxyUDPSession{
+		client:     src,
+		sniffer:    newUDPSniffer(t.cfg),
+		out:        make(chan tproxyUDPPacket, tproxyUDPQueueLen),
+		done:       make(chan struct{}),
+		targets:    make(map[string]*net.UDPAddr),
+		replyConns: make(map[string]*net.UDPConn),
+	}
+	s.touch()
+	t.sessions[key] = s
+	go t.run(s)
+	return s
+}
+
+// run 拨通隧道后按序转发该会话排队的数据报
+func (t *tproxyUDP) run(s *tproxyUDPSession) {
+	defer t.remove(s)
+	remote, _, err := dialUDPRelay(t.cfg, t.dialer)
+	if err != nil {
+		log.Printf("[TProxy][UDP] Dial relay failed: %v", err)
+		return
+	}
+	if !s.setRemote(remote) {
+		remote.Close()
+		return
+	}
+	go func() {
+		s.relayReplies()
+		t.remove(s)
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case p := <-s.out:
+			target, _ := restoreFakeIPTarget(p.dst.String(), p.dst.IP)
+			target, packets := s.sniffer.outbound(target, p.payload)
+			if len(packets) == 0 {
+				continue
+			}
+			s.remember(target, p.dst)
+			for _, pkt := range packets {
+				if err := remote.WriteDatagram(target, pkt); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *tproxyUDP) remove(s *tproxyUDPSession) {
+	t.mu.Lock()
+	if t.sessions[s.client.String()] == s {
+		delete(t.sessions, s.client.String())
+	}
+	t.mu.Unlock()
+	s.close()
+}
+
+func (t *tproxyUDP) expireLoop() {
+	ticker := time.NewTicker(tproxyUDPIdleTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		var idle []*tproxyUDPSession
+		t.mu.Lock()
+		for _, s := range t.sessions {
+			if s.idleSince() > tproxyUDPIdleTimeout {
+				idle = append(idle, s)
+			}
+		}
+		t.mu.Unlock()
+		for _, s := range idle {
+			t.remove(s)
+		}
+	}
+}
+
+type tproxyUDPPacket struct {
+	dst     *net.UDPAddr
+	payload []byte
+}
+
+type tproxyUDPSession struct {
+	client  *net.UDPAddr
+	sniffer *udpSniffer // QUIC 目标改写；replySource 经 targets 映射回原地址；仅由 run 使用
+	out     chan tproxyUDPPacket
+	done    chan struct{}
+
+	mu         sync.Mutex
+	remote     tunnel.DatagramConn // 拨号完成前为 nil
+	lastActive time.Time
+	targets    map[string]*net.UDPAddr // 隧道中的目标 -> 客户端看到的原始目的地址
+	replyConns map[string]*net.UDPConn // 以原始目的地址为源回包的透明 socket
+	closeOnce  sync.Once
+}
+
+// setRemote 发布拨通的隧道；会话已关闭时返回 false
+func (s *tproxyUDPSession) setRemote(remote tunnel.DatagramConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.remote = remote
+	return true
+}
+
+func (s *tproxyUDPSession) touch() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *tproxyUDPSession) idleSince() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive)
+}
+
+func (s *tproxyUDPSession) remember(target string, dst *net.UDPAddr) {
+	s.mu.Lock()
+	s.targets[target] = dst
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *tproxyUDPSession) relayReplies() {
+	for {
+		addr, payload, err := s.remote.ReadDatagram()
+		if err != nil {
+			return
+		}
+		from, err := s.replySource(addr)
+		if err != nil {
+			continue
+		}
+		rc, err := s.replyConn(from)
+		if err != nil {
+			log.Printf("[TProxy][UDP] Reply socket for %s: %v", from, err)
+			continue
+		}
+		rc.WriteToUDP(payload, s.client)
+		s.touch()
+	}
+}
+
+func (s *tproxyUDPSession) replySource(addr string) (*net.UDPAddr, error) {
+	s.mu.Lock()
+	dst, ok := s.targets[addr]
+	s.mu.Unlock()
+	if ok {
+		return dst, nil
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+// replyConn 绑定到远端地址的透明 socket，使回包的源地址与客户端的目的地址一致
+func (s *tproxyUDPSession) replyConn(from *net.UDPAddr) (*net.UDPConn, error) {
+	key := from.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rc, ok := s.replyConns[key]; ok {
+		return rc, nil
+	}
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+				return
+			}
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp", key)
+	if err != nil {
+		return nil, err
+	}
+	rc := pc.(*net.UDPConn)
+	s.replyConns[key] = rc
+	return rc, nil
+}
+
+func (s *tproxyUDPSession) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		if s.remote != nil {
+			s.remote.Close()
+		}
+		for _, rc := range s.replyConns {
+			rc.Close()
+		}
+		s.mu.Unlock()
+	})
+}
@@ -0,0 +1,274 @@
+//go:build linux
+
+package app
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/tunnel"
+)
+
+const netnsEnv = "SUDOKU_TEST_NETNS"
+
+// inNetNS re-runs the current test inside a fresh network namespace.
+// It returns true in the child, where the test body should run.
+func inNetNS(t *testing.T, setup ...[]string) bool {
+	t.Helper()
+	if os.Getenv(netnsEnv) == "1" {
+		for _, args := range append([][]string{{"ip", "link", "set", "lo", "up"}}, setup...) {
+			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				t.Skipf("%v: %v %s", args, err, out)
+			}
+		}
+		return true
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare not available")
+	}
+	cmd := exec.Command("unshare", "-n", os.Args[0], "-test.run", "^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	switch {
+	case strings.Contains(string(out), "--- SKIP: "+t.Name()):
+		t.Skipf("skipped in namespace:\n%s", out)
+	case err != nil || !strings.Contains(string(out), "--- PASS: "+t.Name()):
+		t.Fatalf("namespace run failed: %v\n%s", err, out)
+	}
+	return false
+}
+
+// echoDatagrams answers every datagram with "echo:" + payload from the same address.
+type echoDatagrams struct {
+	ch     chan [2]string
+	closed chan struct{}
+}
+
+func (e *echoDatagrams) WriteDatagram(addr string, payload []byte) error {
+	e.ch <- [2]string{addr, "echo:" + string(payload)}
+	return nil
+}
+
+func (e *echoDatagrams) ReadDatagram() (string, []byte, error) {
+	select {
+	case d := <-e.ch:
+		return d[0], []byte(d[1]), nil
+	case <-e.closed:
+		return "", nil, io.EOF
+	}
+}
+
+func (e *echoDatagrams) Close() error {
+	select {
+	case <-e.closed:
+	default:
+		close(e.closed)
+	}
+	return nil
+}
+
+type transparentTestDialer struct {
+	MockDialer
+	udpTargets chan string
+}
+
+func (d *transparentTestDialer) DialUDPOverTCP() (net.Conn, error) {
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (d *transparentTestDialer) DialUoTSession() (tunnel.DatagramConn, error) {
+	return &echoDatagrams{ch: make(chan [2]string, 8), closed: make(chan struct{})}, nil
+}
+
+// tcpEchoDialer records the target and echoes everything written to the returned conn.
+func tcpEchoDialer(targets chan<- string) *transparentTestDialer {
+	return &transparentTestDialer{MockDialer: MockDialer{DialFunc: func(dest string) (net.Conn, error) {
+		targets <- dest
+		a, b := net.Pipe()
+		go func() {
+			io.Copy(b, b)
+			b.Close()
+		}()
+		return a, nil
+	}}}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func expectTCPEcho(t *testing.T, addr string, targets <-chan string) {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q %v", buf, err)
+	}
+	select {
+	case got := <-targets:
+		if got != addr {
+			t.Fatalf("routed to %s, want %s", got, addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("dialer not used")
+	}
+}
+
+func TestTProxyTCPAndUDP(t *testing.T) {
+	// Addresses in 10.9.9.0/24 are local but unassigned, so connections to them
+	// reach the transparent listener with the original destination as local address.
+	if !inNetNS(t, []string{"ip", "route", "add", "local", "10.9.9.0/24", "dev", "lo"}) {
+		return
+	}
+	port := freePort(t)
+	targets := make(chan string, 4)
+	cfg := &config.Config{ProxyMode: "global", TProxyPort: port}
+	if err := startTransparentProxies(cfg, nil, tcpEchoDialer(targets)); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	orig := net.JoinHostPort("10.9.9.9", strconv.Itoa(port))
+	expectTCPEcho(t, orig, targets)
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer c.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: port}
+	if _, err := c.WriteToUDP([]byte("hi"), dst); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := c.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("udp reply: %v", err)
+	}
+	if string(buf[:n]) != "echo:hi" || from.String() != dst.String() {
+		t.Fatalf("got %q from %s, want echo:hi from %s", buf[:n], from, dst)
+	}
+}
+
+func TestRedirTCP(t *testing.T) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("iptables not available")
+	}
+	if !inNetNS(t, []string{"ip", "route", "add", "local", "10.9.8.0/24", "dev", "lo"}) {
+		return
+	}
+	port := freePort(t)
+	out, err := exec.Command("iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "10.9.8.7", "--dport", "80",
+		"-j", "REDIRECT", "--to-ports", strconv.Itoa(port)).CombinedOutput()
+	if err != nil {
+		t.Skipf("iptables: %v %s", err, out)
+	}
+
+	targets := make(chan string, 4)
+	cfg := &config.Config{ProxyMode: "global", RedirPort: port}
+	if err := startTransparentProxies(cfg, nil, tcpEchoDialer(targets)); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	expectTCPEcho(t, "10.9.8.7:80", targets)
+}
+
+// sentDatagrams records outgoing datagrams and never answers.
+type sentDatagrams struct {
+	sent   chan [2]string
+	closed chan struct{}
+}
+
+func (r *sentDatagrams) WriteDatagram(addr string, payload []byte) error {
+	r.sent <- [2]string{addr, string(payload)}
+	return nil
+}
+
+func (r *sentDatagrams) ReadDatagram() (string, []byte, error) {
+	<-r.closed
+	return "", nil, io.EOF
+}
+
+func (r *sentDatagrams) Close() error {
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	return nil
+}
+
+// slowUoTDialer blocks DialUoTSession until release is closed.
+type slowUoTDialer struct {
+	MockDialer
+	release chan struct{}
+	remote  *sentDatagrams
+}
+
+func (d *slowUoTDialer) DialUoTSession() (tunnel.DatagramConn, error) {
+	<-d.release
+	return d.remote, nil
+}
+
+func TestTProxyUDPSessionDialDoesNotBlock(t *testing.T) {
+	dialer := &slowUoTDialer{
+		release: make(chan struct{}),
+		remote:  &sentDatagrams{sent: make(chan [2]string, 8), closed: make(chan struct{})},
+	}
+	tp := newTProxyUDP(nil, &config.Config{}, dialer)
+
+	created := make(chan *tproxyUDPSession, 1)
+	go func() { created <- tp.session(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}) }()
+	var s *tproxyUDPSession
+	select {
+	case s = <-created:
+	case <-time.After(time.Second):
+		t.Fatalf("session creation waited for the tunnel dial")
+	}
+	defer tp.remove(s)
+
+	// 其他客户端的会话同样不受影响
+	done := make(chan struct{})
+	go func() {
+		tp.session(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 5000})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("second session blocked behind the first dial")
+	}
+
+	// 握手期间排队的数据报在隧道就绪后发出
+	s.out <- tproxyUDPPacket{dst: &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}, payload: []byte("q")}
+	close(dialer.release)
+	select {
+	case d := <-dialer.remote.sent:
+		if d[0] != "1.1.1.1:53" || d[1] != "q" {
+			t.Fatalf("unexpected datagram %v", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("queued datagram not forwarded")
+	}
+}
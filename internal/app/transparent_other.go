@@ -0,0 +1,19 @@
+//go:build !linux
+
+package app
+
+import (
+	"fmt"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/tunnel"
+	"github.com/saba-futai/sudoku/pkg/geodata"
+)
+
+// startTransparentProxies 透明代理依赖 Linux 的 SO_ORIGINAL_DST / IP_TRANSPARENT
+func startTransparentProxies(cfg *config.Config, geoMgr *geodata.Manager, dialer tunnel.Dialer) error {
+	if cfg.RedirPort > 0 || cfg.TProxyPort > 0 {
+		return fmt.Errorf("transparent proxy (redir/tproxy) is only supported on Linux")
+	}
+	return nil
+}
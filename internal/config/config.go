@@ -1,22 +1,228 @@
 // internal/config/config.go
 package config
 
+import (
+	"github.com/saba-futai/sudoku/pkg/control"
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+	"github.com/saba-futai/sudoku/pkg/obfs/shaping"
+	"github.com/saba-futai/sudoku/pkg/transport/tlswrap"
+)
+
 type Config struct {
-	Mode               string   `json:"mode"`      // "client" or "server"
-	Transport          string   `json:"transport"` // "tcp" or "udp"
-	LocalPort          int      `json:"local_port"`
-	ServerAddress      string   `json:"server_address"`
-	FallbackAddr       string   `json:"fallback_address"`
-	Key                string   `json:"key"`
-	AEAD               string   `json:"aead"`              // "aes-128-gcm", "chacha20-poly1305", "none"
-	SuspiciousAction   string   `json:"suspicious_action"` // "fallback" or "silent"
-	PaddingMin         int      `json:"padding_min"`
-	PaddingMax         int      `json:"padding_max"`
-	RuleURLs           []string `json:"rule_urls"`            // 留空则使用默认，支持 "global", "direct" 关键字
-	ProxyMode          string   `json:"proxy_mode"`           // 运行时状态，非JSON字段，由Load解析逻辑填充
-	ASCII              string   `json:"ascii"`                // "prefer_entropy" (默认): 低熵, "prefer_ascii": 纯ASCII字符，高熵
-	CustomTable        string   `json:"custom_table"`         // 可选，定义 X/P/V 布局，如 "xpxvvpvv"
-	CustomTables       []string `json:"custom_tables"`        // 可选，多套 X/P/V 布局轮换
-	EnablePureDownlink bool     `json:"enable_pure_downlink"` // 启用纯 Sudoku 下行；false 时使用带宽优化下行编码
-	DisableHTTPMask    bool     `json:"disable_http_mask"`
+	Mode               string            `json:"mode"`      // "client" or "server"
+	Transport          string            `json:"transport"` // "tcp" or "udp"
+	LocalPort          int               `json:"local_port"`
+	ServerAddress      string            `json:"server_address"`
+	FallbackAddr       string            `json:"fallback_address"`
+	Key                string            `json:"key"`
+	AEAD               string            `json:"aead"`              // "aes-128-gcm", "chacha20-poly1305", "none"
+	SuspiciousAction   string            `json:"suspicious_action"` // "fallback" or "silent"
+	PaddingMin         int               `json:"padding_min"`
+	PaddingMax         int               `json:"padding_max"`
+	PaddingStrategy    string            `json:"padding_strategy,omitempty"` // 填充率随连接变化的方式："fixed"（默认）、"front"、"decay"、"random-walk"、"burst"
+	RuleURLs           []string          `json:"rule_urls"`                  // 留空则使用默认，支持 "global", "direct", "auto" 关键字
+	ProxyMode          string            `json:"proxy_mode"`                 // 运行时状态，非JSON字段，由Load解析逻辑填充
+	ASCII              string            `json:"ascii"`                      // "prefer_entropy" (默认): 低熵, "prefer_ascii": 纯ASCII字符，高熵
+	CustomTable        string            `json:"custom_table"`               // 可选，定义 X/P/V 布局，如 "xpxvvpvv"
+	CustomTables       []string          `json:"custom_tables"`              // 可选，多套 X/P/V 布局轮换
+	EnablePureDownlink bool              `json:"enable_pure_downlink"`       // 启用纯 Sudoku 下行；false 时使用带宽优化下行编码
+	EnablePackedUplink bool              `json:"enable_packed_uplink"`       // 客户端：上行也使用带宽优化编码（需 AEAD）；服务端自动识别
+	DisableHTTPMask    bool              `json:"disable_http_mask"`
+	HTTPMask           *httpmask.Options `json:"http_mask,omitempty"`   // 可选，自定义伪装请求模板；服务端可要求路径/请求头暗号
+	DNS                *DNSConfig        `json:"dns,omitempty"`         // 可选，客户端内置 DNS 服务
+	Resolver           *ResolverConfig   `json:"resolver,omitempty"`    // 可选，服务器地址与 PAC 判定使用的解析器
+	Servers            []ServerProfile   `json:"servers,omitempty"`     // 可选，多服务器；非空时忽略 server_address
+	Balancer           *BalancerConfig   `json:"balancer,omitempty"`    // 可选，多服务器的选择策略与健康检查
+	UDPNAT             *UDPNATConfig     `json:"udp_nat,omitempty"`     // 可选，服务端 UDP 转发的 NAT 行为
+	Bind               *BindConfig       `json:"bind,omitempty"`        // 可选，服务端 SOCKS5 BIND 策略，缺省禁用
+	Inbound            *InboundConfig    `json:"inbound,omitempty"`     // 可选，客户端本地混合代理入口的访问控制
+	RedirPort          int               `json:"redir_port,omitempty"`  // 可选，Linux REDIRECT 透明代理端口 (TCP)
+	TProxyPort         int               `json:"tproxy_port,omitempty"` // 可选，Linux TPROXY 透明代理端口 (TCP+UDP)
+	Sniff              *SniffConfig      `json:"sniff,omitempty"`       // 可选，对 IP 目标嗅探 TLS SNI / HTTP Host / QUIC SNI
+	Auto               *AutoConfig       `json:"auto,omitempty"`        // 可选，proxy_mode=auto 的直连探测参数
+	WebSocket          *WebSocketConfig  `json:"websocket,omitempty"`   // 可选，真实 WebSocket 传输，可经 CDN / 反向代理转发
+	HTTPStream         *HTTPStreamConfig `json:"http_stream,omitempty"` // 可选，HTTP 分离传输：上行 POST、下行流式 GET
+	TLS                *tlswrap.Options  `json:"tls,omitempty"`         // 可选，HTTP 伪装之下的 TLS 外层
+	Shaping            *shaping.Options  `json:"shaping,omitempty"`     // 可选，按方向把写入整形为目标报文大小分布；客户端用 uplink，服务端用 downlink
+	KeepAlive          *control.Options  `json:"keepalive,omitempty"`   // 可选，隧道内控制帧：心跳测 RTT、空闲掩护流量、对端失效检测；由客户端开启
+}
+
+// HTTPStreamConfig HTTP/1.1 分离传输：上行拆成有界的 POST，下行是一个长期的流式 GET 响应，
+// 两者用会话令牌关联，可穿过会缓冲请求体的企业代理 / CDN。服务端只处理该路径的请求。
+type HTTPStreamConfig struct {
+	Path    string `json:"path"`               // 请求路径，如 "/api/stream"；不能与伪装请求使用的路径重合
+	Host    string `json:"host,omitempty"`     // 客户端：Host 头，默认 server_address
+	MaxPost int    `json:"max_post,omitempty"` // 客户端：单个 POST 的最大字节数，默认 65536，最大 1048576
+}
+
+// WebSocketConfig 真实 WebSocket 传输：客户端完成标准升级握手后，Sudoku/AEAD 数据放在帧内传输。
+// 服务端只对该路径的升级请求启用，其余请求仍按 HTTP 伪装处理。
+type WebSocketConfig struct {
+	Path string `json:"path"`           // 升级请求路径，如 "/tunnel"；不能与伪装请求使用的路径重合
+	Host string `json:"host,omitempty"` // 客户端：Host 头，默认 server_address（经 CDN 时填站点域名）
+	Text bool   `json:"text,omitempty"` // 使用文本帧而非二进制帧，要求 ascii=prefer_ascii
+}
+
+// AutoConfig auto 模式：规则未覆盖的目标先尝试直连，失败、被重置或超时后改走隧道
+type AutoConfig struct {
+	DirectTimeout int `json:"direct_timeout,omitempty"` // 直连建立及等待首个响应的超时（毫秒），默认 3000
+	CacheTTL      int `json:"cache_ttl,omitempty"`      // 探测结果按域名缓存的时间（秒），默认 1800
+}
+
+// SniffConfig 客户端协议嗅探：目标为 IP 时从首包提取域名用于分流
+type SniffConfig struct {
+	Enabled             bool `json:"enabled"`
+	OverrideDestination bool `json:"override_destination"` // 同时把发往服务端的目标地址改写为嗅探到的域名
+}
+
+// InboundConfig 客户端本地混合代理入口的监听地址、认证与来源限制
+type InboundConfig struct {
+	ListenIP   string      `json:"listen_ip,omitempty"`   // 监听地址，默认所有地址；如 "127.0.0.1"
+	Users      []ProxyUser `json:"users,omitempty"`       // 非空时要求 SOCKS5/HTTP 用户名密码或 SOCKS4 userid
+	AllowCIDRs []string    `json:"allow_cidrs,omitempty"` // 非空时仅接受这些网段的来源
+}
+
+// ProxyUser 本地代理用户；SOCKS4 仅校验用户名
+type ProxyUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// BindConfig 服务端 SOCKS5 BIND 策略
+type BindConfig struct {
+	Enabled       bool   `json:"enabled"`
+	ListenIP      string `json:"listen_ip,omitempty"`      // 监听地址，默认所有地址
+	AdvertiseIP   string `json:"advertise_ip,omitempty"`   // 告知客户端的地址，默认取客户端连入的本机地址
+	AcceptTimeout int    `json:"accept_timeout,omitempty"` // 等待入站连接的超时（秒），默认 60
+}
+
+// UDPNATConfig 服务端 UDP 转发 (UoT / 原生 UDP) 的 NAT 行为
+type UDPNATConfig struct {
+	Filtering       string `json:"filtering"`                  // "endpoint-independent" (默认) 或 "address-dependent"
+	IdleTimeout     int    `json:"idle_timeout,omitempty"`     // 单个目的地址的空闲超时（秒），默认 120
+	MaxDestinations int    `json:"max_destinations,omitempty"` // 每个会话的目的地址上限，默认 512，超出时淘汰最久未用者
+}
+
+// ServerProfile 描述一个上游服务器；留空的字段继承顶层配置
+type ServerProfile struct {
+	Name               string            `json:"name,omitempty"`
+	ServerAddress      string            `json:"server_address"`
+	Key                string            `json:"key,omitempty"`
+	AEAD               string            `json:"aead,omitempty"`
+	ASCII              string            `json:"ascii,omitempty"`
+	CustomTable        string            `json:"custom_table,omitempty"`
+	CustomTables       []string          `json:"custom_tables,omitempty"`
+	PaddingMin         *int              `json:"padding_min,omitempty"`
+	PaddingMax         *int              `json:"padding_max,omitempty"`
+	PaddingStrategy    string            `json:"padding_strategy,omitempty"`
+	EnablePureDownlink *bool             `json:"enable_pure_downlink,omitempty"`
+	EnablePackedUplink *bool             `json:"enable_packed_uplink,omitempty"`
+	DisableHTTPMask    *bool             `json:"disable_http_mask,omitempty"`
+	WebSocket          *WebSocketConfig  `json:"websocket,omitempty"`
+	HTTPStream         *HTTPStreamConfig `json:"http_stream,omitempty"`
+	TLS                *tlswrap.Options  `json:"tls,omitempty"`
+	Shaping            *shaping.Options  `json:"shaping,omitempty"`
+	KeepAlive          *control.Options  `json:"keepalive,omitempty"`
+}
+
+// BalancerConfig 配置多服务器选择
+type BalancerConfig struct {
+	Policy              string `json:"policy"`                          // "failover" (默认), "round-robin", "least-latency", "consistent-hash"
+	HealthCheckInterval int    `json:"health_check_interval,omitempty"` // 握手探测间隔（秒），默认 30
+	HealthCheckTimeout  int    `json:"health_check_timeout,omitempty"`  // 单次探测超时（秒），默认 5
+}
+
+// WithDefaults 返回填充了默认值的副本；b 为 nil 时返回全默认配置
+func (b *BalancerConfig) WithDefaults() *BalancerConfig {
+	out := BalancerConfig{}
+	if b != nil {
+		out = *b
+	}
+	if out.Policy == "" {
+		out.Policy = "failover"
+	}
+	if out.HealthCheckInterval <= 0 {
+		out.HealthCheckInterval = 30
+	}
+	if out.HealthCheckTimeout <= 0 {
+		out.HealthCheckTimeout = 5
+	}
+	return &out
+}
+
+// ServerConfigs 展开 servers 列表，每项为继承了顶层设置的独立配置。
+// 未配置 servers 时返回只含自身的列表。
+func (c *Config) ServerConfigs() []*Config {
+	if len(c.Servers) == 0 {
+		return []*Config{c}
+	}
+	out := make([]*Config, 0, len(c.Servers))
+	for _, p := range c.Servers {
+		sc := *c
+		sc.Servers = nil
+		sc.ServerAddress = p.ServerAddress
+		if p.Key != "" {
+			sc.Key = p.Key
+		}
+		if p.AEAD != "" {
+			sc.AEAD = p.AEAD
+		}
+		if p.ASCII != "" {
+			sc.ASCII = p.ASCII
+		}
+		if p.CustomTable != "" || len(p.CustomTables) > 0 {
+			sc.CustomTable = p.CustomTable
+			sc.CustomTables = p.CustomTables
+		}
+		if p.PaddingMin != nil {
+			sc.PaddingMin = *p.PaddingMin
+		}
+		if p.PaddingMax != nil {
+			sc.PaddingMax = *p.PaddingMax
+		}
+		if p.PaddingStrategy != "" {
+			sc.PaddingStrategy = p.PaddingStrategy
+		}
+		if p.EnablePureDownlink != nil {
+			sc.EnablePureDownlink = *p.EnablePureDownlink
+		}
+		if p.EnablePackedUplink != nil {
+			sc.EnablePackedUplink = *p.EnablePackedUplink
+		}
+		if p.DisableHTTPMask != nil {
+			sc.DisableHTTPMask = *p.DisableHTTPMask
+		}
+		if p.WebSocket != nil || p.HTTPStream != nil {
+			sc.WebSocket = p.WebSocket
+			sc.HTTPStream = p.HTTPStream
+		}
+		if p.TLS != nil {
+			sc.TLS = p.TLS
+		}
+		if p.Shaping != nil {
+			sc.Shaping = p.Shaping
+		}
+		if p.KeepAlive != nil {
+			sc.KeepAlive = p.KeepAlive
+		}
+		out = append(out, &sc)
+	}
+	return out
+}
+
+// ResolverConfig 配置 pkg/dnsutil 的上游与缓存策略
+type ResolverConfig struct {
+	Upstreams   []string `json:"upstreams"`              // 依次尝试："system"、"8.8.8.8"、"tls://1.1.1.1"、"https://dns.google/dns-query"
+	MinTTL      int      `json:"min_ttl,omitempty"`      // 记录 TTL 下限（秒）
+	MaxTTL      int      `json:"max_ttl,omitempty"`      // 记录 TTL 上限（秒）
+	NegativeTTL int      `json:"negative_ttl,omitempty"` // 解析失败的缓存时间（秒）
+}
+
+// DNSConfig 描述客户端内置 DNS 监听器
+type DNSConfig struct {
+	Listen       string `json:"listen"`                  // UDP/TCP 监听地址，如 "127.0.0.1:1053"
+	RemoteServer string `json:"remote_server"`           // 代理域名经隧道 (UoT) 查询的上游，如 "8.8.8.8:53"
+	DirectServer string `json:"direct_server,omitempty"` // 直连域名使用的本地上游；留空则使用系统解析
+	FakeIP       bool   `json:"fake_ip"`                 // 启用 fake-ip，A 记录返回合成地址
+	FakeIPRange  string `json:"fake_ip_range,omitempty"` // fake-ip 地址段，默认 198.18.0.0/15
 }
@@ -4,7 +4,12 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"strings"
+
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+	"github.com/saba-futai/sudoku/pkg/transport/httpstream"
 )
 
 func Load(path string) (*Config, error) {
@@ -21,24 +26,131 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
-	if cfg.Transport == "" {
+	switch cfg.Transport {
+	case "":
 		cfg.Transport = "tcp"
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("unsupported transport: %s", cfg.Transport)
 	}
 
 	if cfg.ASCII == "" {
 		cfg.ASCII = "prefer_entropy"
 	}
 
+	if cfg.DNS != nil {
+		if cfg.DNS.Listen == "" {
+			cfg.DNS.Listen = "127.0.0.1:1053"
+		}
+		if cfg.DNS.RemoteServer == "" {
+			cfg.DNS.RemoteServer = "8.8.8.8:53"
+		}
+		if cfg.DNS.FakeIPRange == "" {
+			cfg.DNS.FakeIPRange = "198.18.0.0/15"
+		}
+	}
+
 	if !cfg.EnablePureDownlink && cfg.AEAD == "none" {
 		return nil, fmt.Errorf("enable_pure_downlink=false requires AEAD to be enabled")
 	}
+	if cfg.EnablePackedUplink && cfg.AEAD == "none" {
+		return nil, fmt.Errorf("enable_packed_uplink requires AEAD to be enabled")
+	}
+
+	if cfg.UDPNAT != nil {
+		switch cfg.UDPNAT.Filtering {
+		case "", "endpoint-independent", "address-dependent":
+		default:
+			return nil, fmt.Errorf("unsupported udp_nat.filtering: %s", cfg.UDPNAT.Filtering)
+		}
+	}
+
+	if err := cfg.HTTPMask.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid http_mask: %w", err)
+	}
+	if cfg.HTTPMask.Required() && cfg.DisableHTTPMask {
+		return nil, fmt.Errorf("http_mask.require_* needs the http mask enabled")
+	}
+
+	if cfg.Bind != nil {
+		for name, ip := range map[string]string{"listen_ip": cfg.Bind.ListenIP, "advertise_ip": cfg.Bind.AdvertiseIP} {
+			if ip != "" && net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("invalid bind.%s: %s", name, ip)
+			}
+		}
+	}
+
+	if cfg.Inbound != nil {
+		if cfg.Inbound.ListenIP != "" && net.ParseIP(cfg.Inbound.ListenIP) == nil {
+			return nil, fmt.Errorf("invalid inbound.listen_ip: %s", cfg.Inbound.ListenIP)
+		}
+		for _, cidr := range cfg.Inbound.AllowCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, fmt.Errorf("invalid inbound.allow_cidrs entry %q: %w", cidr, err)
+			}
+		}
+		for i, u := range cfg.Inbound.Users {
+			if u.Username == "" || len(u.Username) > 255 || len(u.Password) > 255 {
+				return nil, fmt.Errorf("inbound.users[%d]: username must be 1-255 bytes and password at most 255", i)
+			}
+		}
+	}
+
+	if cfg.Transport == "udp" && cfg.AEAD == "none" {
+		return nil, fmt.Errorf("transport=udp requires AEAD to be enabled")
+	}
+
+	for i, sc := range cfg.ServerConfigs() {
+		if len(cfg.Servers) > 0 && sc.ServerAddress == "" {
+			return nil, fmt.Errorf("servers[%d]: server_address is required", i)
+		}
+		if !sc.EnablePureDownlink && sc.AEAD == "none" {
+			return nil, fmt.Errorf("servers[%d]: enable_pure_downlink=false requires AEAD to be enabled", i)
+		}
+		if sc.EnablePackedUplink && sc.AEAD == "none" {
+			return nil, fmt.Errorf("servers[%d]: enable_packed_uplink requires AEAD to be enabled", i)
+		}
+		if cfg.Transport == "udp" && sc.AEAD == "none" {
+			return nil, fmt.Errorf("servers[%d]: transport=udp requires AEAD to be enabled", i)
+		}
+		if err := sudoku.ValidatePaddingStrategy(sc.PaddingStrategy); err != nil {
+			return nil, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		if err := validateWebSocket(sc); err != nil {
+			return nil, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		if err := validateHTTPStream(sc); err != nil {
+			return nil, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		if err := sc.TLS.Validate(); err != nil {
+			return nil, fmt.Errorf("servers[%d]: invalid tls: %w", i, err)
+		}
+		if err := sc.Shaping.Validate(); err != nil {
+			return nil, fmt.Errorf("servers[%d]: invalid shaping: %w", i, err)
+		}
+		if err := sc.KeepAlive.Validate(); err != nil {
+			return nil, fmt.Errorf("servers[%d]: invalid keepalive: %w", i, err)
+		}
+	}
+
+	if len(cfg.Servers) > 0 {
+		cfg.Balancer = cfg.Balancer.WithDefaults()
+	}
 
 	// 处理 ProxyMode 和 默认规则
 	// 如果用户显式设置了 rule_urls 为 ["global"] 或 ["direct"]，则覆盖模式
 	if len(cfg.RuleURLs) > 0 && (cfg.RuleURLs[0] == "global" || cfg.RuleURLs[0] == "direct") {
 		cfg.ProxyMode = cfg.RuleURLs[0]
 		cfg.RuleURLs = nil
-	} else if len(cfg.RuleURLs) > 0 {
+	} else if len(cfg.RuleURLs) > 0 && cfg.RuleURLs[0] == "auto" {
+		// ["auto", 规则...]：规则命中的走直连，其余先探测直连
+		cfg.ProxyMode = "auto"
+		cfg.RuleURLs = cfg.RuleURLs[1:]
+		if len(cfg.RuleURLs) == 0 {
+			cfg.RuleURLs = nil
+		}
+	} else if len(cfg.RuleURLs) > 0 && cfg.ProxyMode != "auto" {
+		// 显式 proxy_mode=auto 时 rule_urls 仍作为直连规则，不切换为 pac
 		cfg.ProxyMode = "pac"
 	} else {
 		if cfg.ProxyMode == "" {
@@ -48,3 +160,66 @@ func Load(path string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// validateWebSocket 检查 websocket 路径不会被误认为普通伪装请求、暗号请求头能随升级请求发送，且文本帧只承载 ASCII 数据
+func validateWebSocket(cfg *Config) error {
+	ws := cfg.WebSocket
+	if ws == nil {
+		return nil
+	}
+	if !strings.HasPrefix(ws.Path, "/") || strings.ContainsAny(ws.Path, " ?\r\n") {
+		return fmt.Errorf("websocket.path must be an absolute path without query, got %q", ws.Path)
+	}
+	if strings.ContainsAny(ws.Host, " \r\n") {
+		return fmt.Errorf("invalid websocket.host %q", ws.Host)
+	}
+	if cfg.HTTPMask.UsesPath(ws.Path) {
+		return fmt.Errorf("websocket.path %s is also used by the http mask", ws.Path)
+	}
+	// 升级请求代替 require_path，但要带上暗号请求头；握手自身写入的请求头无法作为暗号
+	if cfg.HTTPMask != nil {
+		for name := range cfg.HTTPMask.RequireHeaders {
+			switch strings.ToLower(name) {
+			case "host", "upgrade", "connection", "sec-websocket-key", "sec-websocket-version":
+				return fmt.Errorf("http_mask.require_headers %s cannot be sent on a websocket upgrade", name)
+			}
+		}
+	}
+	if ws.Text && cfg.ASCII != "prefer_ascii" {
+		return fmt.Errorf("websocket.text requires ascii=prefer_ascii")
+	}
+	return nil
+}
+
+// validateHTTPStream 检查分离传输的路径，且不与 websocket 同时启用
+func validateHTTPStream(cfg *Config) error {
+	hs := cfg.HTTPStream
+	if hs == nil {
+		return nil
+	}
+	if cfg.WebSocket != nil && cfg.Mode == "client" {
+		return fmt.Errorf("websocket and http_stream cannot both be used by a client")
+	}
+	if !strings.HasPrefix(hs.Path, "/") || strings.ContainsAny(hs.Path, " ?\r\n") {
+		return fmt.Errorf("http_stream.path must be an absolute path without query, got %q", hs.Path)
+	}
+	if strings.ContainsAny(hs.Host, " \r\n") {
+		return fmt.Errorf("invalid http_stream.host %q", hs.Host)
+	}
+	if cfg.HTTPMask.UsesPath(hs.Path) || (cfg.WebSocket != nil && cfg.WebSocket.Path == hs.Path) {
+		return fmt.Errorf("http_stream.path %s is already used by the http mask or websocket", hs.Path)
+	}
+	// 暗号请求头随每个 GET/POST 发送，不能与传输自身写入的请求头重名
+	if cfg.HTTPMask != nil {
+		for name := range cfg.HTTPMask.RequireHeaders {
+			switch strings.ToLower(name) {
+			case "host", "user-agent", "accept", "cache-control", "connection", "content-type", "content-length":
+				return fmt.Errorf("http_mask.require_headers %s cannot be sent on http_stream requests", name)
+			}
+		}
+	}
+	if hs.MaxPost < 0 || hs.MaxPost > httpstream.MaxPostLimit {
+		return fmt.Errorf("http_stream.max_post must be between 0 and %d", httpstream.MaxPostLimit)
+	}
+	return nil
+}
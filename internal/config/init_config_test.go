@@ -60,4 +60,212 @@ func TestLoadRejectsPackedWithoutAEAD(t *testing.T) {
 	if _, err := Load(path); err == nil {
 		t.Fatalf("expected error when packed downlink used without AEAD")
 	}
+
+	if _, err := loadConfigJSON(t, `, "enable_packed_uplink": true`); err == nil {
+		t.Fatalf("expected error when packed uplink used without AEAD")
+	}
+}
+
+func TestLoadServerProfiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "cfg.json")
+
+	data := `{
+		"mode": "client",
+		"local_port": 8080,
+		"key": "k",
+		"aead": "chacha20-poly1305",
+		"rule_urls": ["global"],
+		"servers": [
+			{"name": "a", "server_address": "1.1.1.1:443"},
+			{"server_address": "2.2.2.2:443", "key": "k2", "aead": "none", "disable_http_mask": true}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if cfg.Balancer == nil || cfg.Balancer.Policy != "failover" || cfg.Balancer.HealthCheckInterval != 30 {
+		t.Fatalf("balancer defaults not applied: %+v", cfg.Balancer)
+	}
+
+	servers := cfg.ServerConfigs()
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 server configs, got %d", len(servers))
+	}
+	if servers[0].ServerAddress != "1.1.1.1:443" || servers[0].Key != "k" || servers[0].AEAD != "chacha20-poly1305" {
+		t.Fatalf("first profile did not inherit top-level settings: %+v", servers[0])
+	}
+	if servers[1].Key != "k2" || servers[1].AEAD != "none" || !servers[1].DisableHTTPMask || servers[1].ASCII != "prefer_entropy" {
+		t.Fatalf("second profile overrides not applied: %+v", servers[1])
+	}
+	if cfg.Key != "k" || cfg.DisableHTTPMask {
+		t.Fatalf("top-level config mutated")
+	}
+}
+
+func TestLoadAutoMode(t *testing.T) {
+	tmpDir := t.TempDir()
+	cases := []struct {
+		body  string
+		rules int
+	}{
+		{`"rule_urls": ["auto", "https://example.com/cn.txt"]`, 1},
+		{`"rule_urls": ["auto"]`, 0},
+		{`"proxy_mode": "auto", "rule_urls": ["https://example.com/cn.txt"]`, 1},
+	}
+	for i, c := range cases {
+		path := filepath.Join(tmpDir, "cfg.json")
+		data := `{"mode": "client", "local_port": 8080, "server_address": "1.1.1.1:443", "key": "k", "aead": "none", ` + c.body + `}`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("case %d: Load error: %v", i, err)
+		}
+		if cfg.ProxyMode != "auto" || len(cfg.RuleURLs) != c.rules {
+			t.Fatalf("case %d: mode=%s urls=%v", i, cfg.ProxyMode, cfg.RuleURLs)
+		}
+	}
+}
+
+// loadConfigJSON loads a minimal client config with extra appended to its fields.
+func loadConfigJSON(t *testing.T, extra string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cfg.json")
+	data := `{"mode": "client", "local_port": 1080, "server_address": "1.1.1.1:443", "key": "k", "aead": "none"` + extra + `}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	return Load(path)
+}
+
+func TestLoadHTTPMaskValidation(t *testing.T) {
+	cfg, err := loadConfigJSON(t, `, "http_mask": {"templates": [{"method": "GET", "paths": ["/feed"], "weight": 2}], "require_path": "/feed"}`)
+	if err != nil {
+		t.Fatalf("valid http_mask rejected: %v", err)
+	}
+	if len(cfg.HTTPMask.Templates) != 1 || cfg.HTTPMask.Templates[0].Weight != 2 || !cfg.HTTPMask.Required() {
+		t.Fatalf("http_mask not parsed: %+v", cfg.HTTPMask)
+	}
+	if _, err := loadConfigJSON(t, `, "http_mask": {"templates": [{"method": "BREW", "paths": ["/feed"]}]}`); err == nil {
+		t.Fatalf("expected error for unsupported method")
+	}
+}
+
+func TestLoadWebSocketValidation(t *testing.T) {
+	cfg, err := loadConfigJSON(t, `, "ascii": "prefer_ascii", "websocket": {"path": "/tunnel", "host": "cdn.example.com", "text": true}`)
+	if err != nil {
+		t.Fatalf("valid websocket rejected: %v", err)
+	}
+	if cfg.WebSocket == nil || cfg.WebSocket.Host != "cdn.example.com" || !cfg.WebSocket.Text {
+		t.Fatalf("websocket not parsed: %+v", cfg.WebSocket)
+	}
+	if _, err := loadConfigJSON(t, `, "websocket": {"path": "/tunnel"}, "http_mask": {"require_path": "/feed", "require_headers": {"X-Token": "s"}}`); err != nil {
+		t.Fatalf("websocket with a mask secret rejected: %v", err)
+	}
+
+	for _, bad := range []string{
+		`, "websocket": {"path": "tunnel"}`,
+		`, "websocket": {"path": "/ws"}`,                   // 内置伪装路径
+		`, "websocket": {"path": "/tunnel", "text": true}`, // 文本帧需要 ASCII 布局
+		`, "servers": [{"server_address": "2.2.2.2:443", "websocket": {"path": "/ws"}}]`,
+		`, "websocket": {"path": "/tunnel"}, "http_mask": {"require_headers": {"Sec-WebSocket-Key": "x"}}`, // 每次握手随机生成
+	} {
+		if _, err := loadConfigJSON(t, bad); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadHTTPStreamValidation(t *testing.T) {
+	cfg, err := loadConfigJSON(t, `, "http_stream": {"path": "/api/stream", "max_post": 8192}`)
+	if err != nil {
+		t.Fatalf("valid http_stream rejected: %v", err)
+	}
+	if cfg.HTTPStream == nil || cfg.HTTPStream.MaxPost != 8192 {
+		t.Fatalf("http_stream not parsed: %+v", cfg.HTTPStream)
+	}
+	for _, bad := range []string{
+		`, "http_stream": {"path": "/session"}`, // 内置伪装路径
+		`, "http_stream": {"path": "/api/stream"}, "websocket": {"path": "/tunnel"}`,
+		`, "http_stream": {"path": "/api/stream", "max_post": -1}`,
+		`, "http_stream": {"path": "/api/stream", "max_post": 2097152}`,
+		`, "http_stream": {"path": "/api/stream"}, "http_mask": {"require_headers": {"User-Agent": "x"}}`, // 每个会话随机生成
+	} {
+		if _, err := loadConfigJSON(t, bad); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadTLSValidation(t *testing.T) {
+	cfg, err := loadConfigJSON(t, `, "tls": {"server_name": "cdn.example.com", "alpn": ["h2"], "fingerprint": "chrome"}`)
+	if err != nil {
+		t.Fatalf("valid tls rejected: %v", err)
+	}
+	if cfg.TLS.ServerName != "cdn.example.com" || len(cfg.TLS.ALPN) != 1 {
+		t.Fatalf("tls not parsed: %+v", cfg.TLS)
+	}
+	for _, bad := range []string{
+		`, "tls": {"fingerprint": "ie6"}`,
+		`, "tls": {"pin_sha256": "zz"}`,
+		`, "tls": {"cert_file": "a.pem"}`,
+	} {
+		if _, err := loadConfigJSON(t, bad); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadShapingValidation(t *testing.T) {
+	cfg, err := loadConfigJSON(t, `, "shaping": {"uplink": {"profile": "web-browsing", "coalesce_ms": 5}, "downlink": {"buckets": [{"min": 1200, "max": 1400, "weight": 1}], "cover": 0.1}}`)
+	if err != nil {
+		t.Fatalf("valid shaping rejected: %v", err)
+	}
+	if cfg.Shaping.Uplink.CoalesceMs != 5 || len(cfg.Shaping.Downlink.Buckets) != 1 {
+		t.Fatalf("shaping not parsed: %+v", cfg.Shaping)
+	}
+	for _, bad := range []string{
+		`, "shaping": {"uplink": {"profile": "dial-up"}}`,
+		`, "shaping": {"downlink": {"buckets": [{"min": 0, "max": 10, "weight": 1}]}}`,
+		`, "shaping": {"uplink": {"profile": "video-stream", "cover": 2}}`,
+	} {
+		if _, err := loadConfigJSON(t, bad); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadKeepAliveValidation(t *testing.T) {
+	cfg, err := loadConfigJSON(t, `, "keepalive": {"interval": 10000, "max_missed": 4, "cover": {"idle_ms": 3000, "max_size": 1024}}`)
+	if err != nil {
+		t.Fatalf("valid keepalive rejected: %v", err)
+	}
+	if cfg.KeepAlive.MaxMissed != 4 || cfg.KeepAlive.Cover.IdleMs != 3000 {
+		t.Fatalf("keepalive not parsed: %+v", cfg.KeepAlive)
+	}
+	for _, bad := range []string{`{"interval": 20}`, `{"max_missed": -1}`, `{"cover": {"min_gap_ms": 9000}}`} {
+		if _, err := loadConfigJSON(t, `, "keepalive": `+bad); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadPaddingStrategy(t *testing.T) {
+	cfg, err := loadConfigJSON(t, `, "padding_strategy": "decay"`)
+	if err != nil {
+		t.Fatalf("valid strategy rejected: %v", err)
+	}
+	if cfg.PaddingStrategy != "decay" {
+		t.Fatalf("padding_strategy not parsed: %q", cfg.PaddingStrategy)
+	}
+	if _, err := loadConfigJSON(t, `, "padding_strategy": "sawtooth"`); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
 }
@@ -19,6 +19,7 @@ type shortLinkPayload struct {
 	AEAD           string `json:"e,omitempty"` // AEAD method
 	MixPort        int    `json:"m,omitempty"` // local mixed proxy port
 	PackedDownlink bool   `json:"x,omitempty"` // bandwidth-optimized downlink (non-pure Sudoku)
+	PackedUplink   bool   `json:"u,omitempty"` // bandwidth-optimized uplink
 	CustomTable    string `json:"t,omitempty"` // optional custom byte layout
 }
 
@@ -49,6 +50,7 @@ func BuildShortLinkFromConfig(cfg *Config, advertiseHost string) (string, error)
 	}
 
 	payload.PackedDownlink = !cfg.EnablePureDownlink
+	payload.PackedUplink = cfg.EnablePackedUplink
 	payload.CustomTable = cfg.CustomTable
 
 	payload.ASCII = encodeASCII(cfg.ASCII)
@@ -108,6 +110,7 @@ func BuildConfigFromShortLink(link string) (*Config, error) {
 	}
 
 	cfg.EnablePureDownlink = !payload.PackedDownlink
+	cfg.EnablePackedUplink = payload.PackedUplink
 
 	cfg.ASCII = decodeASCII(payload.ASCII)
 	if cfg.AEAD == "" {
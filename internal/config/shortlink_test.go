@@ -16,6 +16,7 @@ func TestShortLinkRoundTrip_Client(t *testing.T) {
 		ASCII:              "prefer_ascii",
 		CustomTable:        "xpxvvpvv",
 		EnablePureDownlink: false,
+		EnablePackedUplink: true,
 	}
 
 	link, err := BuildShortLinkFromConfig(cfg, "")
@@ -49,6 +50,9 @@ func TestShortLinkRoundTrip_Client(t *testing.T) {
 	if decoded.EnablePureDownlink != cfg.EnablePureDownlink {
 		t.Fatalf("downlink mode mismatch")
 	}
+	if !decoded.EnablePackedUplink {
+		t.Fatalf("packed uplink flag lost")
+	}
 	if decoded.ASCII != "prefer_ascii" {
 		t.Fatalf("ascii mismatch, got %s", decoded.ASCII)
 	}
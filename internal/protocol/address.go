@@ -35,7 +35,7 @@ func ReadAddress(r io.Reader) (string, byte, net.IP, error) {
 		if _, err := io.ReadFull(r, buf[:4]); err != nil {
 			return "", 0, nil, err
 		}
-		ip = net.IP(buf[:4])
+		ip = net.IP(append([]byte(nil), buf[:4]...))
 		host = ip.String()
 	case AddrTypeDomain:
 		if _, err := io.ReadFull(r, buf[:1]); err != nil {
@@ -50,7 +50,7 @@ func ReadAddress(r io.Reader) (string, byte, net.IP, error) {
 		if _, err := io.ReadFull(r, buf[:16]); err != nil {
 			return "", 0, nil, err
 		}
-		ip = net.IP(buf[:16])
+		ip = net.IP(append([]byte(nil), buf[:16]...))
 		host = fmt.Sprintf("[%s]", ip.String())
 	default:
 		return "", 0, nil, fmt.Errorf("unknown address type: %d", addrType)
@@ -26,6 +26,10 @@ func TestWriteReadAddress_IPv4(t *testing.T) {
 	if ip == nil {
 		t.Fatalf("ip should not be nil for ipv4")
 	}
+	// The returned IP must not alias the buffer the port is read into.
+	if ip.String() != "1.2.3.4" {
+		t.Fatalf("ip mismatch, got %s", ip)
+	}
 }
 
 func TestWriteReadAddress_Domain(t *testing.T) {
@@ -0,0 +1,268 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer policies.
+const (
+	PolicyFailover       = "failover"
+	PolicyRoundRobin     = "round-robin"
+	PolicyLeastLatency   = "least-latency"
+	PolicyConsistentHash = "consistent-hash"
+)
+
+// ServerMember is one upstream server of a BalancedDialer.
+type ServerMember struct {
+	Name string
+	BaseDialer
+
+	healthy atomic.Bool
+	latency atomic.Int64 // 最近一次成功握手耗时 (ns)，0 表示未知
+}
+
+// NewServerMember wraps a BaseDialer; members start healthy.
+func NewServerMember(name string, base BaseDialer) *ServerMember {
+	if name == "" {
+		name = base.Config.ServerAddress
+	}
+	m := &ServerMember{Name: name, BaseDialer: base}
+	m.healthy.Store(true)
+	return m
+}
+
+// Healthy reports whether the last dial or health check succeeded.
+func (m *ServerMember) Healthy() bool { return m.healthy.Load() }
+
+// Latency returns the last measured handshake time (0 if unknown).
+func (m *ServerMember) Latency() time.Duration { return time.Duration(m.latency.Load()) }
+
+func (m *ServerMember) markResult(start time.Time, err error) {
+	if err != nil {
+		if m.healthy.Swap(false) {
+			log.Printf("[Balancer] %s marked unhealthy: %v", m.Name, err)
+		}
+		return
+	}
+	m.latency.Store(int64(time.Since(start)))
+	if !m.healthy.Swap(true) {
+		log.Printf("[Balancer] %s recovered", m.Name)
+	}
+}
+
+// BalancedDialer implements Dialer and UoTDialer over several server profiles.
+//
+// Candidates are ordered by the policy; unhealthy members are tried only after
+// every healthy one failed, so a fully blocked pool still gets a chance to recover.
+type BalancedDialer struct {
+	Members []*ServerMember
+	Policy  string
+
+	rr  uint32
+	mux uotMux
+}
+
+// NewBalancedDialer validates the policy and builds the dialer.
+func NewBalancedDialer(members []*ServerMember, policy string) (*BalancedDialer, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no server configured")
+	}
+	switch policy {
+	case "":
+		policy = PolicyFailover
+	case PolicyFailover, PolicyRoundRobin, PolicyLeastLatency, PolicyConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown balancer policy: %s", policy)
+	}
+	return &BalancedDialer{Members: members, Policy: policy}, nil
+}
+
+// Dial connects to destAddrStr through the first server that accepts the handshake.
+func (d *BalancedDialer) Dial(destAddrStr string) (net.Conn, error) {
+	return d.try(destAddrStr, func(m *ServerMember) (net.Conn, error) {
+		return (&StandardDialer{BaseDialer: m.BaseDialer}).Dial(destAddrStr)
+	})
+}
+
+// DialUDPOverTCP establishes a UoT tunnel on the first available server.
+func (d *BalancedDialer) DialUDPOverTCP() (net.Conn, error) {
+	return d.try("", func(m *ServerMember) (net.Conn, error) {
+		return m.dialUoT()
+	})
+}
+
+// DialUoTSession opens a UDP association on a UoT v2 tunnel shared by all associations,
+// falling back to a dedicated v1 tunnel when the chosen server predates v2.
+func (d *BalancedDialer) DialUoTSession() (DatagramConn, error) {
+	return d.mux.dial(d.dialUoTMux, d.DialUDPOverTCP)
+}
+
+func (d *BalancedDialer) dialUoTMux() (net.Conn, error) {
+	var lastErr error
+	for _, m := range d.candidates("") {
+		start := time.Now()
+		conn, err := m.dialUoTMux()
+		if errors.Is(err, errUoTV2Unsupported) {
+			// The server is up, it only speaks v1.
+			m.markResult(start, nil)
+			return nil, err
+		}
+		m.markResult(start, err)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", m.Name, err)
+	}
+	return nil, lastErr
+}
+
+// DialPacket opens a native UDP session on the first candidate server.
+// UDP has no handshake, so failures here are local and do not affect health.
+func (d *BalancedDialer) DialPacket() (DatagramConn, error) {
+	var lastErr error
+	for _, m := range d.candidates("") {
+		dc, err := m.dialPacket()
+		if err == nil {
+			return dc, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", m.Name, err)
+	}
+	return nil, lastErr
+}
+
+func (d *BalancedDialer) try(destAddrStr string, dial func(*ServerMember) (net.Conn, error)) (net.Conn, error) {
+	var lastErr error
+	for _, m := range d.candidates(destAddrStr) {
+		start := time.Now()
+		conn, err := dial(m)
+		m.markResult(start, err)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", m.Name, err)
+	}
+	return nil, lastErr
+}
+
+// candidates returns members in the order they should be tried for destAddrStr.
+func (d *BalancedDialer) candidates(destAddrStr string) []*ServerMember {
+	var healthy, unhealthy []*ServerMember
+	for _, m := range d.Members {
+		if m.Healthy() {
+			healthy = append(healthy, m)
+		} else {
+			unhealthy = append(unhealthy, m)
+		}
+	}
+
+	switch d.Policy {
+	case PolicyRoundRobin:
+		if n := len(healthy); n > 1 {
+			off := int(atomic.AddUint32(&d.rr, 1)-1) % n
+			healthy = append(healthy[off:], healthy[:off]...)
+		}
+	case PolicyLeastLatency:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			li, lj := healthy[i].Latency(), healthy[j].Latency()
+			// Unmeasured members sort last.
+			if li == 0 || lj == 0 {
+				return lj == 0 && li != 0
+			}
+			return li < lj
+		})
+	case PolicyConsistentHash:
+		key := hashKey(destAddrStr)
+		sortByRendezvous(healthy, key)
+		sortByRendezvous(unhealthy, key)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// hashKey strips the port so every connection to a host lands on the same server.
+func hashKey(destAddrStr string) string {
+	if host, _, err := net.SplitHostPort(destAddrStr); err == nil {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(destAddrStr)
+}
+
+// sortByRendezvous orders members by highest-random-weight for key, so removing
+// a member only moves the targets that were mapped to it.
+func sortByRendezvous(members []*ServerMember, key string) {
+	score := func(m *ServerMember) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(m.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		return h.Sum64()
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return score(members[i]) > score(members[j])
+	})
+}
+
+// RunHealthCheck probes every member with a full handshake each interval until ctx is done.
+func (d *BalancedDialer) RunHealthCheck(ctx context.Context, interval, timeout time.Duration) {
+	d.checkAll(timeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.checkAll(timeout)
+		}
+	}
+}
+
+func (d *BalancedDialer) checkAll(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, m := range d.Members {
+		wg.Add(1)
+		go func(m *ServerMember) {
+			defer wg.Done()
+			m.markResult(m.probe(timeout))
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probe performs a handshake and opens an empty UoT session, which the server
+// ends as soon as the probe closes it.
+func (m *ServerMember) probe(timeout time.Duration) (time.Time, error) {
+	start := time.Now()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := m.dialUoT()
+		ch <- result{conn, err}
+	}()
+	select {
+	case res := <-ch:
+		if res.conn != nil {
+			res.conn.Close()
+		}
+		return start, res.err
+	case <-time.After(timeout):
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return start, fmt.Errorf("health check timeout after %s", timeout)
+	}
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/protocol"
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+)
+
+func newTestMembers(names ...string) []*ServerMember {
+	var members []*ServerMember
+	for _, name := range names {
+		members = append(members, NewServerMember(name, BaseDialer{Config: &config.Config{ServerAddress: name}}))
+	}
+	return members
+}
+
+func memberNames(members []*ServerMember) []string {
+	var out []string
+	for _, m := range members {
+		out = append(out, m.Name)
+	}
+	return out
+}
+
+func TestBalancedDialer_Failover(t *testing.T) {
+	members := newTestMembers("a", "b", "c")
+	d, err := NewBalancedDialer(members, PolicyFailover)
+	if err != nil {
+		t.Fatalf("new dialer: %v", err)
+	}
+	members[0].healthy.Store(false)
+
+	got := memberNames(d.candidates("example.com:443"))
+	want := []string{"b", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBalancedDialer_RoundRobin(t *testing.T) {
+	d, _ := NewBalancedDialer(newTestMembers("a", "b", "c"), PolicyRoundRobin)
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		firsts = append(firsts, d.candidates("x:1")[0].Name)
+	}
+	want := []string{"a", "b", "c", "a"}
+	for i := range want {
+		if firsts[i] != want[i] {
+			t.Fatalf("got %v, want %v", firsts, want)
+		}
+	}
+}
+
+func TestBalancedDialer_LeastLatency(t *testing.T) {
+	members := newTestMembers("a", "b", "c")
+	members[0].latency.Store(int64(80 * time.Millisecond))
+	members[2].latency.Store(int64(20 * time.Millisecond))
+	d, _ := NewBalancedDialer(members, PolicyLeastLatency)
+
+	got := memberNames(d.candidates("x:1"))
+	want := []string{"c", "a", "b"} // b is unmeasured
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBalancedDialer_ConsistentHash(t *testing.T) {
+	members := newTestMembers("a", "b", "c", "d")
+	d, _ := NewBalancedDialer(members, PolicyConsistentHash)
+
+	// Same host on different ports maps to the same server.
+	first := d.candidates("video.example.com:443")[0]
+	if again := d.candidates("video.example.com:80")[0]; again != first {
+		t.Fatalf("host moved between ports: %s vs %s", first.Name, again.Name)
+	}
+
+	// Removing an unrelated server keeps the mapping; removing the owner moves it.
+	for _, m := range members {
+		if m != first {
+			m.healthy.Store(false)
+			if got := d.candidates("video.example.com:443")[0]; got != first {
+				t.Fatalf("mapping changed after %s went down", m.Name)
+			}
+			m.healthy.Store(true)
+		}
+	}
+	first.healthy.Store(false)
+	if got := d.candidates("video.example.com:443")[0]; got == first {
+		t.Fatalf("unhealthy owner still preferred")
+	}
+}
+
+func TestBalancedDialer_UnknownPolicy(t *testing.T) {
+	if _, err := NewBalancedDialer(newTestMembers("a"), "random"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+func TestBalancedDialer_FailsOverAndRecovers(t *testing.T) {
+	cfg := &config.Config{
+		Key:                "balancer-key",
+		AEAD:               "chacha20-poly1305",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		DisableHTTPMask:    true,
+	}
+	table := sudoku.NewTable(cfg.Key, cfg.ASCII)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				sConn, err := HandshakeAndUpgrade(c, cfg, table)
+				if err != nil {
+					return
+				}
+				if _, _, _, err := protocol.ReadAddress(sConn); err != nil {
+					return
+				}
+				io.Copy(sConn, sConn)
+			}(c)
+		}
+	}()
+
+	// A closed port stands in for a blocked server.
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	memberCfg := func(addr string) *config.Config {
+		c := *cfg
+		c.ServerAddress = addr
+		return &c
+	}
+	members := []*ServerMember{
+		NewServerMember("dead", BaseDialer{Config: memberCfg(deadAddr), Tables: []*sudoku.Table{table}}),
+		NewServerMember("live", BaseDialer{Config: memberCfg(listener.Addr().String()), Tables: []*sudoku.Table{table}}),
+	}
+	d, _ := NewBalancedDialer(members, PolicyFailover)
+
+	conn, err := d.Dial("example.com:80")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if members[0].Healthy() {
+		t.Fatalf("dead server should be marked unhealthy")
+	}
+
+	msg := []byte("ping")
+	conn.Write(msg)
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo failed: %v %q", err, buf)
+	}
+
+	// Health check keeps the dead member out and measures the live one.
+	d.checkAll(time.Second)
+	if members[0].Healthy() || !members[1].Healthy() || members[1].Latency() == 0 {
+		t.Fatalf("unexpected health state: dead=%v live=%v latency=%v",
+			members[0].Healthy(), members[1].Healthy(), members[1].Latency())
+	}
+
+	// Once the server comes back the next check restores it.
+	members[0].Config = memberCfg(listener.Addr().String())
+	d.checkAll(time.Second)
+	if !members[0].Healthy() {
+		t.Fatalf("recovered server should be healthy again")
+	}
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/saba-futai/sudoku/internal/protocol"
+)
+
+// BindMagicByte marks a Sudoku tunnel connection that carries a SOCKS5 BIND request.
+//
+// Client -> server: BindMagicByte | expected peer address.
+// Server -> client: up to two replies, each rep(1) | address, where rep is a SOCKS5
+// reply code. The first carries the listening address, the second the accepted peer;
+// after a successful second reply the tunnel is piped to the peer.
+const BindMagicByte byte = 0xED
+
+// SOCKS5 reply codes used in BIND replies.
+const (
+	BindRepSuccess    byte = 0x00
+	BindRepFailure    byte = 0x01
+	BindRepNotAllowed byte = 0x02
+	BindRepTimeout    byte = 0x06
+)
+
+// BindDialer asks the server to accept one inbound connection on the client's behalf.
+type BindDialer interface {
+	DialBind(expectedPeer string) (net.Conn, error)
+}
+
+// WriteBindReply sends one BIND reply over the tunnel.
+func WriteBindReply(w io.Writer, rep byte, addr string) error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(rep)
+	if err := protocol.WriteAddress(buf, addr); err != nil {
+		return fmt.Errorf("encode address: %w", err)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadBindReply parses one BIND reply from the tunnel.
+func ReadBindReply(r io.Reader) (byte, string, error) {
+	rep := []byte{0}
+	if _, err := io.ReadFull(r, rep); err != nil {
+		return 0, "", err
+	}
+	addr, _, _, err := protocol.ReadAddress(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return rep[0], addr, nil
+}
+
+func (d *BaseDialer) dialBind(expectedPeer string) (net.Conn, error) {
+	conn, err := d.dialBase()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte(BindMagicByte)
+	if err := protocol.WriteAddress(buf, expectedPeer); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write address failed: %w", err)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("bind request failed: %w", err)
+	}
+	return conn, nil
+}
+
+// DialBind sends a BIND request; the caller reads the replies with ReadBindReply.
+func (d *StandardDialer) DialBind(expectedPeer string) (net.Conn, error) {
+	return d.dialBind(expectedPeer)
+}
+
+// DialBind sends a BIND request through the first server that accepts the handshake.
+func (d *BalancedDialer) DialBind(expectedPeer string) (net.Conn, error) {
+	return d.try(expectedPeer, func(m *ServerMember) (net.Conn, error) {
+		return m.dialBind(expectedPeer)
+	})
+}
@@ -11,10 +11,13 @@ import (
 
 	"github.com/saba-futai/sudoku/internal/config"
 	"github.com/saba-futai/sudoku/internal/protocol"
+	"github.com/saba-futai/sudoku/pkg/control"
 	"github.com/saba-futai/sudoku/pkg/crypto"
 	"github.com/saba-futai/sudoku/pkg/dnsutil"
 	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+	"github.com/saba-futai/sudoku/pkg/transport/httpstream"
+	"github.com/saba-futai/sudoku/pkg/transport/websocket"
 )
 
 // Dialer abstracts the logic for establishing a connection to the server.
@@ -45,28 +48,78 @@ func (d *BaseDialer) pickTable() (byte, *sudoku.Table, error) {
 	return byte(idx), d.Tables[idx], nil
 }
 
-func (d *BaseDialer) dialBase() (net.Conn, error) {
-	// Resolve server address with DNS concurrency and optimistic cache.
-	resolveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// dialServer opens a TCP connection to the server, racing all resolved addresses
+// (RFC 8305), and runs the TLS client handshake when the TLS layer is enabled.
+func (d *BaseDialer) dialServer() (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-
-	serverAddr, err := dnsutil.ResolveWithCache(resolveCtx, d.Config.ServerAddress)
+	conn, err := dnsutil.DialContext(dialCtx, "tcp", d.Config.ServerAddress)
+	if err != nil || d.Config.TLS == nil {
+		return conn, err
+	}
+	tlsConn, err := d.Config.TLS.Client(dialCtx, conn, d.Config.ServerAddress)
 	if err != nil {
-		return nil, fmt.Errorf("resolve server address failed: %w", err)
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
 	}
+	return tlsConn, nil
+}
 
+// maskSecretHeaders returns the require_headers secret that requests on a
+// transport's own path carry in place of the HTTP mask.
+func (d *BaseDialer) maskSecretHeaders() map[string]string {
+	if d.Config.HTTPMask == nil {
+		return nil
+	}
+	return d.Config.HTTPMask.RequireHeaders
+}
+
+func (d *BaseDialer) dialBase() (net.Conn, error) {
 	// 1. Establish base TCP connection
-	rawRemote, err := net.DialTimeout("tcp", serverAddr, 5*time.Second)
+	rawRemote, err := d.dialServer()
 	if err != nil {
 		return nil, fmt.Errorf("dial server failed: %w", err)
 	}
 
-	// 2. Send HTTP mask
-	if !d.Config.DisableHTTPMask {
-		if err := httpmask.WriteRandomRequestHeader(rawRemote, d.Config.ServerAddress); err != nil {
+	// 2. Send HTTP mask, or upgrade to a real WebSocket carrying the tunnel in frames
+	if ws := d.Config.WebSocket; ws != nil {
+		host := ws.Host
+		if host == "" {
+			host = d.Config.ServerAddress
+		}
+		rawRemote.SetDeadline(time.Now().Add(HandshakeTimeout))
+		wsConn, err := websocket.Client(rawRemote, websocket.Options{Host: host, Path: ws.Path, Text: ws.Text, Headers: d.maskSecretHeaders()})
+		rawRemote.SetDeadline(time.Time{})
+		if err != nil {
+			rawRemote.Close()
+			return nil, fmt.Errorf("websocket upgrade failed: %w", err)
+		}
+		rawRemote = wsConn
+	} else if hs := d.Config.HTTPStream; hs != nil {
+		host := hs.Host
+		if host == "" {
+			host = d.Config.ServerAddress
+		}
+		rawRemote.SetDeadline(time.Now().Add(HandshakeTimeout))
+		stream, err := httpstream.Client(rawRemote, httpstream.ClientOptions{
+			Host:    host,
+			Path:    hs.Path,
+			MaxPost: hs.MaxPost,
+			Dial:    d.dialServer,
+			Headers: d.maskSecretHeaders(),
+		})
+		rawRemote.SetDeadline(time.Time{})
+		if err != nil {
+			rawRemote.Close()
+			return nil, fmt.Errorf("http stream setup failed: %w", err)
+		}
+		rawRemote = stream
+	} else if !d.Config.DisableHTTPMask {
+		if err := d.Config.HTTPMask.WriteRequest(rawRemote, d.Config.ServerAddress); err != nil {
 			rawRemote.Close()
 			return nil, fmt.Errorf("write http mask failed: %w", err)
 		}
+		rawRemote = httpmask.NewResponseConn(rawRemote)
 	}
 
 	tableID, table, err := d.pickTable()
@@ -82,6 +135,9 @@ func ClientHandshake(conn net.Conn, cfg *config.Config, table *sudoku.Table, tab
 	if !cfg.EnablePureDownlink && cfg.AEAD == "none" {
 		return nil, fmt.Errorf("enable_pure_downlink=false requires AEAD")
 	}
+	if cfg.EnablePackedUplink && cfg.AEAD == "none" {
+		return nil, fmt.Errorf("enable_packed_uplink requires AEAD")
+	}
 
 	// 3. Sudoku encapsulation
 	obfsConn := buildObfsConnForClient(conn, table, cfg)
@@ -114,12 +170,16 @@ func ClientHandshake(conn net.Conn, cfg *config.Config, table *sudoku.Table, tab
 		return nil, fmt.Errorf("handshake failed: %w", err)
 	}
 
-	modeByte := []byte{downlinkModeByte(cfg)}
+	modeByte := []byte{clientModeByte(cfg)}
 	if _, err := cConn.Write(modeByte); err != nil {
 		cConn.Close()
 		return nil, fmt.Errorf("write downlink mode failed: %w", err)
 	}
 
+	// 6. In-band control frames
+	if cfg.KeepAlive != nil {
+		return control.New(cConn, cfg.KeepAlive), nil
+	}
 	return cConn, nil
 }
 
@@ -128,7 +188,7 @@ func (d *BaseDialer) dialUoT() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := WriteUoTPreface(conn); err != nil {
+	if err := WriteUoTPreface(conn, UoTVersion1); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("uot preface failed: %w", err)
 	}
@@ -138,6 +198,8 @@ func (d *BaseDialer) dialUoT() (net.Conn, error) {
 // StandardDialer implements Dialer for standard Sudoku mode.
 type StandardDialer struct {
 	BaseDialer
+
+	mux uotMux
 }
 
 func (d *StandardDialer) Dial(destAddrStr string) (net.Conn, error) {
@@ -5,12 +5,26 @@ import (
 	"net"
 
 	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/obfs/shaping"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
 )
 
 const (
 	DownlinkModePure   byte = 0x01
 	DownlinkModePacked byte = 0x02
+
+	// ModeFlagControl is set in the mode byte when the client frames the
+	// stream with in-band control frames (keepalive, cover traffic).
+	ModeFlagControl byte = 0x80
+	// ModeFlagPackedUplink is set when the client encodes the uplink, handshake
+	// included, with the packed encoding. The server detects it by probing.
+	ModeFlagPackedUplink byte = 0x40
+	// ModeFlagMaskResponse is set when the client sent the HTTP mask request and
+	// strips the server's response header. Older clients leave it clear and are
+	// answered with tunnel data straight away.
+	ModeFlagMaskResponse byte = 0x20
+
+	modeFlags = ModeFlagControl | ModeFlagPackedUplink | ModeFlagMaskResponse
 )
 
 type directionalConn struct {
@@ -60,23 +74,81 @@ func downlinkModeByte(cfg *config.Config) byte {
 	return DownlinkModePacked
 }
 
-// buildObfsConnForClient builds the obfuscation layer for client side, keeping Sudoku on uplink.
+// clientModeByte is the mode byte sent by the client: the downlink mode plus option flags.
+func clientModeByte(cfg *config.Config) byte {
+	mode := downlinkModeByte(cfg)
+	if cfg.KeepAlive != nil {
+		mode |= ModeFlagControl
+	}
+	if cfg.EnablePackedUplink {
+		mode |= ModeFlagPackedUplink
+	}
+	if !cfg.DisableHTTPMask && cfg.WebSocket == nil && cfg.HTTPStream == nil {
+		mode |= ModeFlagMaskResponse
+	}
+	return mode
+}
+
+// buildObfsConnForClient builds the obfuscation layer for client side. The uplink
+// uses Sudoku, or the packed encoding when enable_packed_uplink is set.
 func buildObfsConnForClient(raw net.Conn, table *sudoku.Table, cfg *config.Config) net.Conn {
-	baseSudoku := sudoku.NewConn(raw, table, cfg.PaddingMin, cfg.PaddingMax, false)
+	if cfg.Shaping != nil {
+		raw = shaping.Wrap(raw, cfg.Shaping.Uplink, table.FillerBytes())
+	}
+	if cfg.EnablePackedUplink {
+		uplink := newPackedConn(raw, table, cfg)
+		if cfg.EnablePureDownlink {
+			return newDirectionalConn(raw, newSudokuConn(raw, table, cfg, false), uplink, uplink.Flush)
+		}
+		return newDirectionalConn(raw, newPackedConn(raw, table, cfg), uplink, uplink.Flush)
+	}
+	baseSudoku := newSudokuConn(raw, table, cfg, false)
 	if cfg.EnablePureDownlink {
 		return baseSudoku
 	}
-	packed := sudoku.NewPackedConn(raw, table, cfg.PaddingMin, cfg.PaddingMax)
+	packed := newPackedConn(raw, table, cfg)
 	return newDirectionalConn(raw, packed, baseSudoku)
 }
 
-// buildObfsConnForServer builds the obfuscation layer for server side, keeping Sudoku on uplink.
-// It returns the reader Sudoku connection (for fallback recording) and the composed net.Conn.
-func buildObfsConnForServer(raw net.Conn, table *sudoku.Table, cfg *config.Config, record bool) (*sudoku.Conn, net.Conn) {
-	uplinkSudoku := sudoku.NewConn(raw, table, cfg.PaddingMin, cfg.PaddingMax, record)
+// buildObfsConnForServer builds the obfuscation layer for server side; packedUplink
+// is the uplink encoding detected from the client's handshake.
+// It returns the reader Sudoku connection (for fallback recording; nil for a packed
+// uplink, which is only chosen after the handshake has been probed) and the composed net.Conn.
+// Write shaping, when configured, sits beneath the codecs so filler bytes are skipped by the peer.
+func buildObfsConnForServer(raw net.Conn, table *sudoku.Table, cfg *config.Config, packedUplink, record bool) (*sudoku.Conn, net.Conn) {
+	if cfg.Shaping != nil {
+		raw = shaping.Wrap(raw, cfg.Shaping.Downlink, table.FillerBytes())
+	}
+	if packedUplink {
+		uplink := newPackedConn(raw, table, cfg)
+		if cfg.EnablePureDownlink {
+			return nil, newDirectionalConn(raw, uplink, newSudokuConn(raw, table, cfg, false))
+		}
+		packed := newPackedConn(raw, table, cfg)
+		return nil, newDirectionalConn(raw, uplink, packed, packed.Flush)
+	}
+	uplinkSudoku := newSudokuConn(raw, table, cfg, record)
 	if cfg.EnablePureDownlink {
 		return uplinkSudoku, uplinkSudoku
 	}
-	packed := sudoku.NewPackedConn(raw, table, cfg.PaddingMin, cfg.PaddingMax)
+	packed := newPackedConn(raw, table, cfg)
 	return uplinkSudoku, newDirectionalConn(raw, uplinkSudoku, packed, packed.Flush)
 }
+
+// newSudokuConn and newPackedConn apply the configured padding strategy,
+// which has already been validated when the config was loaded.
+func newSudokuConn(raw net.Conn, table *sudoku.Table, cfg *config.Config, record bool) *sudoku.Conn {
+	c := sudoku.NewConn(raw, table, cfg.PaddingMin, cfg.PaddingMax, record)
+	if cfg.PaddingStrategy != "" {
+		_ = c.SetPaddingStrategy(cfg.PaddingStrategy)
+	}
+	return c
+}
+
+func newPackedConn(raw net.Conn, table *sudoku.Table, cfg *config.Config) *sudoku.PackedConn {
+	c := sudoku.NewPackedConn(raw, table, cfg.PaddingMin, cfg.PaddingMax)
+	if cfg.PaddingStrategy != "" {
+		_ = c.SetPaddingStrategy(cfg.PaddingStrategy)
+	}
+	return c
+}
@@ -3,6 +3,7 @@ package tunnel
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -12,15 +13,26 @@ import (
 	"time"
 
 	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/control"
 	"github.com/saba-futai/sudoku/pkg/crypto"
 	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+	"github.com/saba-futai/sudoku/pkg/transport/httpstream"
+	"github.com/saba-futai/sudoku/pkg/transport/tlswrap"
+	"github.com/saba-futai/sudoku/pkg/transport/websocket"
 )
 
 const (
 	HandshakeTimeout = 5 * time.Second
 )
 
+// ErrUplinkServed reports a connection that only carried uplink POSTs of an
+// HTTP split stream; it has been fully served and needs no further handling.
+var ErrUplinkServed = httpstream.ErrUplinkServed
+
+// streamSessions 关联 HTTP 分离传输的下行 GET 与上行 POST
+var streamSessions = httpstream.NewServer()
+
 var (
 	// bufferPool for general IO operations
 	bufferPool = sync.Pool{
@@ -101,6 +113,7 @@ func (bc *BufferedConn) GetBufferedAndRecorded() []byte {
 type SuspiciousError struct {
 	Err  error
 	Conn net.Conn // The connection at the state where error occurred (for fallback/logging)
+	Raw  net.Conn // Connection the fallback should relay; nil means the accepted connection
 }
 
 func (e *SuspiciousError) Error() string {
@@ -149,9 +162,27 @@ func (c *readOnlyConn) SetDeadline(time.Time) error      { return nil }
 func (c *readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
 func (c *readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
 
-func probeHandshakeBytes(probe []byte, cfg *config.Config, table *sudoku.Table) error {
+// probeHandshakeBytes checks probe against table with both uplink encodings and
+// reports whether the client uses the packed uplink. When neither matches, an
+// io.EOF-class error from either attempt is preferred so the caller reads more.
+func probeHandshakeBytes(probe []byte, cfg *config.Config, table *sudoku.Table) (bool, error) {
+	pureErr := probeHandshakeWith(probe, cfg, table, false)
+	if pureErr == nil {
+		return false, nil
+	}
+	packedErr := probeHandshakeWith(probe, cfg, table, true)
+	if packedErr == nil {
+		return true, nil
+	}
+	if errors.Is(pureErr, io.EOF) || errors.Is(pureErr, io.ErrUnexpectedEOF) {
+		return false, pureErr
+	}
+	return false, packedErr
+}
+
+func probeHandshakeWith(probe []byte, cfg *config.Config, table *sudoku.Table, packedUplink bool) error {
 	rc := &readOnlyConn{Reader: bytes.NewReader(probe)}
-	_, obfsConn := buildObfsConnForServer(rc, table, cfg, false)
+	_, obfsConn := buildObfsConnForServer(rc, table, cfg, packedUplink, false)
 	cConn, err := crypto.NewAEADConn(obfsConn, cfg.Key, cfg.AEAD)
 	if err != nil {
 		return err
@@ -170,8 +201,11 @@ func probeHandshakeBytes(probe []byte, cfg *config.Config, table *sudoku.Table)
 	if _, err := io.ReadFull(cConn, modeBuf); err != nil {
 		return err
 	}
-	if modeBuf[0] != downlinkModeByte(cfg) {
-		return fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0], downlinkModeByte(cfg))
+	if modeBuf[0]&^modeFlags != downlinkModeByte(cfg) {
+		return fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0]&^modeFlags, downlinkModeByte(cfg))
+	}
+	if (modeBuf[0]&ModeFlagPackedUplink != 0) != packedUplink {
+		return fmt.Errorf("uplink mode mismatch")
 	}
 	return nil
 }
@@ -186,44 +220,37 @@ func drainBuffered(r *bufio.Reader) ([]byte, error) {
 	return out, err
 }
 
-func selectTableByProbe(r *bufio.Reader, cfg *config.Config, tables []*sudoku.Table) (*sudoku.Table, []byte, error) {
+// selectTableByProbe reads until the handshake decodes with one of the tables and
+// one of the uplink encodings, and returns both together with the bytes read.
+func selectTableByProbe(r *bufio.Reader, cfg *config.Config, tables []*sudoku.Table) (*sudoku.Table, bool, []byte, error) {
 	const (
 		maxProbeBytes = 64 * 1024
 		readChunk     = 4 * 1024
 	)
 	if len(tables) == 0 {
-		return nil, nil, fmt.Errorf("no table candidates")
+		return nil, false, nil, fmt.Errorf("no table candidates")
 	}
 	if len(tables) > 255 {
-		return nil, nil, fmt.Errorf("too many table candidates: %d", len(tables))
+		return nil, false, nil, fmt.Errorf("too many table candidates: %d", len(tables))
 	}
 
 	probe, err := drainBuffered(r)
 	if err != nil {
-		return nil, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
+		return nil, false, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
 	}
 
 	tmp := make([]byte, readChunk)
 	for {
-		if len(tables) == 1 {
-			tail, err := drainBuffered(r)
-			if err != nil {
-				return nil, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
-			}
-			probe = append(probe, tail...)
-			return tables[0], probe, nil
-		}
-
 		needMore := false
 		for _, table := range tables {
-			err := probeHandshakeBytes(probe, cfg, table)
+			packedUplink, err := probeHandshakeBytes(probe, cfg, table)
 			if err == nil {
 				tail, err := drainBuffered(r)
 				if err != nil {
-					return nil, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
+					return nil, false, nil, fmt.Errorf("drain buffered bytes failed: %w", err)
 				}
 				probe = append(probe, tail...)
-				return table, probe, nil
+				return table, packedUplink, probe, nil
 			}
 			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 				needMore = true
@@ -231,10 +258,10 @@ func selectTableByProbe(r *bufio.Reader, cfg *config.Config, tables []*sudoku.Ta
 		}
 
 		if !needMore {
-			return nil, probe, fmt.Errorf("handshake table selection failed")
+			return nil, false, probe, fmt.Errorf("handshake table selection failed")
 		}
 		if len(probe) >= maxProbeBytes {
-			return nil, probe, fmt.Errorf("handshake probe exceeded %d bytes", maxProbeBytes)
+			return nil, false, probe, fmt.Errorf("handshake probe exceeded %d bytes", maxProbeBytes)
 		}
 
 		n, err := r.Read(tmp)
@@ -242,7 +269,7 @@ func selectTableByProbe(r *bufio.Reader, cfg *config.Config, tables []*sudoku.Ta
 			probe = append(probe, tmp[:n]...)
 		}
 		if err != nil {
-			return nil, probe, fmt.Errorf("handshake probe read failed: %w", err)
+			return nil, false, probe, fmt.Errorf("handshake probe read failed: %w", err)
 		}
 	}
 }
@@ -250,6 +277,41 @@ func selectTableByProbe(r *bufio.Reader, cfg *config.Config, tables []*sudoku.Ta
 // HandshakeAndUpgradeWithTables performs the handshake by probing one of multiple tables.
 // This enables per-connection table rotation without adding a plaintext table selector.
 func HandshakeAndUpgradeWithTables(rawConn net.Conn, cfg *config.Config, tables []*sudoku.Table) (net.Conn, error) {
+	if cfg.TLS == nil {
+		return handshakeAndUpgrade(rawConn, cfg, tables)
+	}
+
+	// TLS 外层：先解开 TLS，再做伪装检测；回落流量也经由 TLS 连接
+	tlsConn, err := acceptTLS(rawConn, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := handshakeAndUpgrade(tlsConn, cfg, tables)
+	var se *SuspiciousError
+	if errors.As(err, &se) {
+		se.Raw = tlsConn
+	}
+	return conn, err
+}
+
+// acceptTLS runs the server TLS handshake. A client that does not speak TLS at
+// all (e.g. a plain HTTP probe) is reported as suspicious with the bytes it sent.
+func acceptTLS(rawConn net.Conn, opts *tlswrap.Options) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+
+	tlsConn, err := opts.Server(ctx, rawConn)
+	if err != nil {
+		var notTLS *tlswrap.NotTLSError
+		if errors.As(err, &notTLS) {
+			return nil, &SuspiciousError{Err: err, Conn: &recordedConn{Conn: rawConn, recorded: notTLS.Recorded}}
+		}
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+func handshakeAndUpgrade(rawConn net.Conn, cfg *config.Config, tables []*sudoku.Table) (net.Conn, error) {
 	// 0. HTTP Header Check
 	bufReader := bufio.NewReader(rawConn)
 	rawConn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
@@ -257,16 +319,36 @@ func HandshakeAndUpgradeWithTables(rawConn net.Conn, cfg *config.Config, tables
 	shouldConsumeMask := false
 	var httpHeaderData []byte
 
-	if !cfg.DisableHTTPMask {
+	if !cfg.DisableHTTPMask || cfg.WebSocket != nil || cfg.HTTPStream != nil {
 		peekBytes, _ := bufReader.Peek(4) // Ignore error; if peek fails, let subsequent read handle it.
 		if httpmask.LooksLikeHTTPRequestStart(peekBytes) {
 			shouldConsumeMask = true
 		}
 	}
 
+	if !shouldConsumeMask && cfg.HTTPMask.Required() {
+		// 要求暗号时不接受未伪装的连接
+		rawConn.SetReadDeadline(time.Time{})
+		badConn := &BufferedConn{Conn: rawConn, r: bufReader, recorder: new(bytes.Buffer)}
+		return nil, &SuspiciousError{Err: fmt.Errorf("http mask required"), Conn: badConn}
+	}
+
 	if shouldConsumeMask {
 		consumed, err := httpmask.ConsumeHeader(bufReader)
 		httpHeaderData = consumed
+		isWebSocket, isStream := false, false
+		if err == nil {
+			if ws := cfg.WebSocket; ws != nil {
+				_, isWebSocket = websocket.IsUpgrade(consumed, ws.Path)
+			}
+			isStream = cfg.HTTPStream != nil && httpstream.Match(consumed, cfg.HTTPStream.Path)
+			// WebSocket 与分离传输有自己的路径，代替 require_path；暗号请求头仍然必须携带
+			if isWebSocket || isStream {
+				err = cfg.HTTPMask.CheckHeaders(consumed)
+			} else {
+				err = cfg.HTTPMask.Check(consumed)
+			}
+		}
 		if err != nil {
 			rawConn.SetReadDeadline(time.Time{})
 			// Return rawConn wrapped in BufferedConn so caller can handle fallback.
@@ -281,15 +363,88 @@ func HandshakeAndUpgradeWithTables(rawConn net.Conn, cfg *config.Config, tables
 			}
 			return nil, &SuspiciousError{Err: fmt.Errorf("invalid http header: %w", err), Conn: badConn}
 		}
+
+		// 真实 WebSocket 传输：立即完成升级，之后的数据都在帧内
+		if isWebSocket {
+			wsConn, err := websocket.Server(rawConn, bufReader, consumed, cfg.WebSocket.Text)
+			if err != nil {
+				rawConn.SetReadDeadline(time.Time{})
+				return nil, fmt.Errorf("websocket upgrade failed: %w", err)
+			}
+			return upgradeTransport(wsConn, httpHeaderData, cfg, tables)
+		}
+
+		// HTTP 分离传输：GET 打开下行流，POST 连接只负责把上行数据送入对应会话
+		if isStream {
+			rawConn.SetReadDeadline(time.Time{})
+			return upgradeStream(rawConn, bufReader, consumed, cfg, tables)
+		}
+	}
+
+	return upgradeSudoku(rawConn, bufReader, httpHeaderData, shouldConsumeMask, cfg, tables)
+}
+
+// upgradeTransport runs the tunnel layers over a transport that has already
+// answered the HTTP request. Falling back to a web server is no longer possible
+// at that point, so suspicious handshakes become plain errors.
+func upgradeTransport(conn net.Conn, httpHeaderData []byte, cfg *config.Config, tables []*sudoku.Table) (net.Conn, error) {
+	tunnelConn, err := upgradeSudoku(conn, bufio.NewReader(conn), httpHeaderData, false, cfg, tables)
+	var se *SuspiciousError
+	if errors.As(err, &se) {
+		conn.Close()
+		return nil, fmt.Errorf("tunnel handshake failed: %w", se.Err)
+	}
+	return tunnelConn, err
+}
+
+// upgradeStream runs the tunnel layers over an HTTP split stream. The downlink
+// GET is answered only after the handshake checks out; until then nothing has
+// been sent, so malformed requests, POSTs for unknown sessions and failed
+// handshakes still go to the fallback with the request header replayed.
+func upgradeStream(rawConn net.Conn, bufReader *bufio.Reader, header []byte, cfg *config.Config, tables []*sudoku.Table) (net.Conn, error) {
+	fallback := func(err error, conn net.Conn) error {
+		recorder := new(bytes.Buffer)
+		recorder.Write(header)
+		return &SuspiciousError{Err: err, Conn: &BufferedConn{Conn: conn, r: bufReader, recorder: recorder}}
 	}
 
+	stream, err := streamSessions.Serve(rawConn, header, bufReader)
+	if errors.Is(err, httpstream.ErrBadRequest) || errors.Is(err, httpstream.ErrNoSession) {
+		return nil, fallback(err, rawConn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	tunnelConn, err := upgradeSudoku(stream, bufio.NewReader(stream), header, false, cfg, tables)
+	if err == nil {
+		if err = httpstream.Accept(stream); err == nil {
+			return tunnelConn, nil
+		}
+		tunnelConn.Close()
+		return nil, err
+	}
+	var se *SuspiciousError
+	if errors.As(err, &se) {
+		if down, ok := httpstream.Reject(stream); ok {
+			return nil, fallback(fmt.Errorf("tunnel handshake failed: %w", se.Err), down)
+		}
+	}
+	stream.Close()
+	return nil, err
+}
+
+// upgradeSudoku runs the Sudoku, AEAD and handshake layers over rawConn, whose
+// unread bytes are in bufReader. respond answers the consumed mask request afterwards.
+func upgradeSudoku(rawConn net.Conn, bufReader *bufio.Reader, httpHeaderData []byte, respond bool, cfg *config.Config, tables []*sudoku.Table) (net.Conn, error) {
 	// 1. Sudoku Layer
 	if !cfg.EnablePureDownlink && cfg.AEAD == "none" {
 		rawConn.SetReadDeadline(time.Time{})
 		return nil, fmt.Errorf("enable_pure_downlink=false requires AEAD")
 	}
 
-	selectedTable, preRead, err := selectTableByProbe(bufReader, cfg, tables)
+	selectedTable, packedUplink, preRead, err := selectTableByProbe(bufReader, cfg, tables)
 	rawConn.SetReadDeadline(time.Time{})
 	if err != nil {
 		combined := make([]byte, 0, len(httpHeaderData)+len(preRead))
@@ -299,7 +454,15 @@ func HandshakeAndUpgradeWithTables(rawConn net.Conn, cfg *config.Config, tables
 	}
 
 	baseConn := NewPreBufferedConn(rawConn, preRead)
-	sConn, obfsConn := buildObfsConnForServer(baseConn, selectedTable, cfg, true)
+	sConn, obfsConn := buildObfsConnForServer(baseConn, selectedTable, cfg, packedUplink, true)
+	suspicious := func(err error) error {
+		if sConn == nil {
+			// 带宽优化上行不录制；握手已在探测阶段通过，preRead 即为全部已读数据
+			recorded := append(append([]byte(nil), httpHeaderData...), preRead...)
+			return &SuspiciousError{Err: err, Conn: &recordedConn{Conn: rawConn, recorded: recorded}}
+		}
+		return &SuspiciousError{Err: err, Conn: &prefixedRecorderConn{Conn: sConn, prefix: httpHeaderData}}
+	}
 
 	// 2. Crypto Layer
 	cConn, err := crypto.NewAEADConn(obfsConn, cfg.Key, cfg.AEAD)
@@ -313,27 +476,41 @@ func HandshakeAndUpgradeWithTables(rawConn net.Conn, cfg *config.Config, tables
 	_, err = io.ReadFull(cConn, handshakeBuf)
 	if err != nil {
 		rawConn.SetReadDeadline(time.Time{})
-		return nil, &SuspiciousError{Err: fmt.Errorf("handshake read failed: %w", err), Conn: &prefixedRecorderConn{Conn: sConn, prefix: httpHeaderData}}
+		return nil, suspicious(fmt.Errorf("handshake read failed: %w", err))
 	}
 
 	ts := int64(binary.BigEndian.Uint64(handshakeBuf[:8]))
 	if abs(time.Now().Unix()-ts) > 60 {
 		rawConn.SetReadDeadline(time.Time{})
-		return nil, &SuspiciousError{Err: fmt.Errorf("time skew/replay"), Conn: &prefixedRecorderConn{Conn: sConn, prefix: httpHeaderData}}
+		return nil, suspicious(fmt.Errorf("time skew/replay"))
 	}
 
-	// 4. Downlink mode negotiation
+	// 4. Mode negotiation: downlink mode plus flags (uplink encoding, control frames)
 	modeBuf := make([]byte, 1)
 	if _, err := io.ReadFull(cConn, modeBuf); err != nil {
 		rawConn.SetReadDeadline(time.Time{})
-		return nil, &SuspiciousError{Err: fmt.Errorf("read downlink mode failed: %w", err), Conn: &prefixedRecorderConn{Conn: sConn, prefix: httpHeaderData}}
+		return nil, suspicious(fmt.Errorf("read downlink mode failed: %w", err))
 	}
 	rawConn.SetReadDeadline(time.Time{})
-	if modeBuf[0] != downlinkModeByte(cfg) {
-		return nil, &SuspiciousError{Err: fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0], downlinkModeByte(cfg)), Conn: &prefixedRecorderConn{Conn: sConn, prefix: httpHeaderData}}
+	if modeBuf[0]&^modeFlags != downlinkModeByte(cfg) {
+		return nil, suspicious(fmt.Errorf("downlink mode mismatch: client=%d server=%d", modeBuf[0]&^modeFlags, downlinkModeByte(cfg)))
+	}
+
+	if sConn != nil {
+		sConn.StopRecording()
 	}
 
-	sConn.StopRecording()
+	// 5. 回应伪装请求，避免出现只有请求没有响应的 HTTP 会话；旧客户端不会剥离响应，不置位时不回应
+	if respond && modeBuf[0]&ModeFlagMaskResponse != 0 {
+		if err := httpmask.WriteResponseHeader(rawConn, httpHeaderData); err != nil {
+			return nil, fmt.Errorf("write http mask response failed: %w", err)
+		}
+	}
+
+	// 6. 客户端开启控制帧时，服务端总是应答心跳；自身的心跳与掩护流量由本端 keepalive 决定
+	if modeBuf[0]&ModeFlagControl != 0 {
+		return control.New(cConn, cfg.KeepAlive), nil
+	}
 	return cConn, nil
 }
 
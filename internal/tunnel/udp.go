@@ -0,0 +1,501 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/protocol"
+	"github.com/saba-futai/sudoku/pkg/crypto"
+	"github.com/saba-futai/sudoku/pkg/dnsutil"
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+)
+
+// Native UDP transport (transport = "udp").
+//
+// Every datagram is self-contained:
+//
+//	wire      = sudoku(nonce || AEAD(plaintext))
+//	plaintext = session(8) | seq(8) | unix time(8) | padLen(2) | SOCKS addr | payload | padding
+//
+// The session ID is chosen by the client; seq is per direction and checked against a
+// sliding window, and the timestamp bounds how long a captured packet stays replayable.
+const (
+	udpHeaderLen      = 26
+	udpMaxPadding     = 64
+	udpMaxDatagram    = 65507
+	udpTimeSkew       = 60 * time.Second
+	udpSessionIdle    = 2 * time.Minute // must exceed udpTimeSkew so replays hit a live window
+	maxUDPSessions    = 4096
+	udpReplayWindowSz = 64
+)
+
+var (
+	errUDPPacketInvalid  = errors.New("invalid udp packet")
+	errUDPPacketTooLarge = errors.New("udp payload too large after encoding")
+)
+
+// DatagramConn carries addressed UDP payloads between the client and the server.
+type DatagramConn interface {
+	WriteDatagram(addr string, payload []byte) error
+	ReadDatagram() (addr string, payload []byte, err error)
+	Close() error
+}
+
+// PacketDialer opens sessions on the native UDP transport.
+type PacketDialer interface {
+	DialPacket() (DatagramConn, error)
+}
+
+// NewUoTDatagramConn adapts an established UoT stream to DatagramConn.
+func NewUoTDatagramConn(conn net.Conn) DatagramConn {
+	return &uotDatagramConn{Conn: conn}
+}
+
+type uotDatagramConn struct {
+	net.Conn
+}
+
+func (c *uotDatagramConn) WriteDatagram(addr string, payload []byte) error {
+	return WriteUoTDatagram(c.Conn, addr, payload)
+}
+
+func (c *uotDatagramConn) ReadDatagram() (string, []byte, error) {
+	return ReadUoTDatagram(c.Conn)
+}
+
+type udpPacket struct {
+	session uint64
+	seq     uint64
+	addr    string
+	payload []byte
+}
+
+func sealUDPPacket(aead cipher.AEAD, codec *sudoku.PacketCodec, pkt udpPacket) ([]byte, error) {
+	addrBuf := &bytes.Buffer{}
+	if err := protocol.WriteAddress(addrBuf, pkt.addr); err != nil {
+		return nil, fmt.Errorf("encode address: %w", err)
+	}
+
+	var rnd [1]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return nil, err
+	}
+	padLen := int(rnd[0]) % (udpMaxPadding + 1)
+
+	plainLen := udpHeaderLen + addrBuf.Len() + len(pkt.payload) + padLen
+	buf := make([]byte, aead.NonceSize(), aead.NonceSize()+plainLen+aead.Overhead())
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	nonce := buf[:aead.NonceSize()]
+
+	plain := make([]byte, udpHeaderLen, plainLen)
+	binary.BigEndian.PutUint64(plain[0:8], pkt.session)
+	binary.BigEndian.PutUint64(plain[8:16], pkt.seq)
+	binary.BigEndian.PutUint64(plain[16:24], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(plain[24:26], uint16(padLen))
+	plain = append(plain, addrBuf.Bytes()...)
+	plain = append(plain, pkt.payload...)
+	pad := make([]byte, padLen)
+	rand.Read(pad)
+	plain = append(plain, pad...)
+
+	sealed := aead.Seal(buf, nonce, plain, nil)
+	wire := codec.Encode(nil, sealed)
+	if len(wire) > udpMaxDatagram {
+		return nil, errUDPPacketTooLarge
+	}
+	return wire, nil
+}
+
+func openUDPPacket(aead cipher.AEAD, codec *sudoku.PacketCodec, wire []byte) (udpPacket, error) {
+	sealed, err := codec.Decode(nil, wire)
+	if err != nil {
+		return udpPacket{}, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return udpPacket{}, errUDPPacketInvalid
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return udpPacket{}, errUDPPacketInvalid
+	}
+	if len(plain) < udpHeaderLen {
+		return udpPacket{}, errUDPPacketInvalid
+	}
+
+	ts := int64(binary.BigEndian.Uint64(plain[16:24]))
+	if abs(time.Now().Unix()-ts) > int64(udpTimeSkew/time.Second) {
+		return udpPacket{}, fmt.Errorf("time skew/replay")
+	}
+	padLen := int(binary.BigEndian.Uint16(plain[24:26]))
+
+	r := bytes.NewReader(plain[udpHeaderLen:])
+	addr, _, _, err := protocol.ReadAddress(r)
+	if err != nil {
+		return udpPacket{}, errUDPPacketInvalid
+	}
+	rest := plain[len(plain)-r.Len():]
+	if padLen > len(rest) {
+		return udpPacket{}, errUDPPacketInvalid
+	}
+
+	return udpPacket{
+		session: binary.BigEndian.Uint64(plain[0:8]),
+		seq:     binary.BigEndian.Uint64(plain[8:16]),
+		addr:    addr,
+		payload: rest[:len(rest)-padLen],
+	}, nil
+}
+
+// replayWindow is a sliding bitmap over the highest sequence number seen.
+type replayWindow struct {
+	mu     sync.Mutex
+	max    uint64
+	bitmap uint64
+	seen   bool
+}
+
+// accept records seq and reports whether it is new.
+func (w *replayWindow) accept(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.seen {
+		w.seen = true
+		w.max = seq
+		w.bitmap = 1
+		return true
+	}
+	if seq > w.max {
+		shift := seq - w.max
+		if shift >= udpReplayWindowSz {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.max = seq
+		return true
+	}
+	diff := w.max - seq
+	if diff >= udpReplayWindowSz {
+		return false
+	}
+	mask := uint64(1) << diff
+	if w.bitmap&mask != 0 {
+		return false
+	}
+	w.bitmap |= mask
+	return true
+}
+
+// ==== Client ====
+
+type udpClientConn struct {
+	conn    *net.UDPConn
+	aead    cipher.AEAD
+	up      *sudoku.PacketCodec
+	down    *sudoku.PacketCodec
+	session uint64
+	seq     atomic.Uint64
+	window  replayWindow
+}
+
+func (d *BaseDialer) dialPacket() (DatagramConn, error) {
+	aead, err := crypto.NewAEAD(d.Config.Key, d.Config.AEAD)
+	if err != nil {
+		return nil, fmt.Errorf("crypto setup failed: %w", err)
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("udp transport requires AEAD")
+	}
+
+	resolveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	serverAddr, err := dnsutil.ResolveWithCache(resolveCtx, d.Config.ServerAddress)
+	if err != nil {
+		return nil, fmt.Errorf("resolve server address failed: %w", err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial server failed: %w", err)
+	}
+
+	_, table, err := d.pickTable()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var sid [8]byte
+	if _, err := rand.Read(sid[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &udpClientConn{
+		conn:    conn,
+		aead:    aead,
+		up:      sudoku.NewPacketCodec(table, d.Config.PaddingMin, d.Config.PaddingMax, false),
+		down:    sudoku.NewPacketCodec(table, d.Config.PaddingMin, d.Config.PaddingMax, !d.Config.EnablePureDownlink),
+		session: binary.BigEndian.Uint64(sid[:]),
+	}, nil
+}
+
+func (c *udpClientConn) WriteDatagram(addr string, payload []byte) error {
+	wire, err := sealUDPPacket(c.aead, c.up, udpPacket{
+		session: c.session,
+		seq:     c.seq.Add(1),
+		addr:    addr,
+		payload: payload,
+	})
+	if errors.Is(err, errUDPPacketTooLarge) {
+		// Like an oversized datagram on a real link: drop it, keep the session.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(wire)
+	return err
+}
+
+func (c *udpClientConn) ReadDatagram() (string, []byte, error) {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", nil, err
+		}
+		pkt, err := openUDPPacket(c.aead, c.down, buf[:n])
+		if err != nil || pkt.session != c.session || !c.window.accept(pkt.seq) {
+			continue
+		}
+		return pkt.addr, pkt.payload, nil
+	}
+}
+
+func (c *udpClientConn) Close() error {
+	return c.conn.Close()
+}
+
+// DialPacket opens a native UDP session to the server.
+func (d *StandardDialer) DialPacket() (DatagramConn, error) {
+	return d.dialPacket()
+}
+
+// ==== Server ====
+
+type udpServerSession struct {
+	id      uint64
+	down    *sudoku.PacketCodec
+	nat     *udpNAT
+	window  replayWindow
+	sendSeq atomic.Uint64
+	active  atomic.Int64 // unix nano
+
+	addrMu     sync.RWMutex
+	clientAddr *net.UDPAddr
+}
+
+func (s *udpServerSession) setClientAddr(addr *net.UDPAddr) {
+	s.addrMu.Lock()
+	s.clientAddr = addr
+	s.addrMu.Unlock()
+}
+
+func (s *udpServerSession) getClientAddr() *net.UDPAddr {
+	s.addrMu.RLock()
+	defer s.addrMu.RUnlock()
+	return s.clientAddr
+}
+
+// UDPServer terminates the native UDP transport and relays to targets.
+type UDPServer struct {
+	conn *net.UDPConn
+	cfg  *config.Config
+	aead cipher.AEAD
+
+	tables []*sudoku.Table
+	up     []*sudoku.PacketCodec
+
+	natOpts UDPNATOptions
+
+	mu       sync.Mutex
+	sessions map[uint64]*udpServerSession
+	closed   chan struct{}
+}
+
+// NewUDPServer prepares a server on an already bound UDP socket.
+func NewUDPServer(conn *net.UDPConn, cfg *config.Config, tables []*sudoku.Table) (*UDPServer, error) {
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no table configured")
+	}
+	aead, err := crypto.NewAEAD(cfg.Key, cfg.AEAD)
+	if err != nil {
+		return nil, fmt.Errorf("crypto setup failed: %w", err)
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("udp transport requires AEAD")
+	}
+	s := &UDPServer{
+		conn:     conn,
+		cfg:      cfg,
+		aead:     aead,
+		tables:   tables,
+		natOpts:  NATOptionsFromConfig(cfg),
+		sessions: make(map[uint64]*udpServerSession),
+		closed:   make(chan struct{}),
+	}
+	for _, t := range tables {
+		s.up = append(s.up, sudoku.NewPacketCodec(t, cfg.PaddingMin, cfg.PaddingMax, false))
+	}
+	return s, nil
+}
+
+// Serve reads datagrams until the socket is closed.
+func (s *UDPServer) Serve() error {
+	go s.expireLoop()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.handle(buf[:n], from)
+	}
+}
+
+// Close stops the server and all sessions.
+func (s *UDPServer) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil
+	default:
+		close(s.closed)
+	}
+	for id, sess := range s.sessions {
+		sess.nat.Close()
+		delete(s.sessions, id)
+	}
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+func (s *UDPServer) handle(wire []byte, from *net.UDPAddr) {
+	var (
+		pkt     udpPacket
+		tableID = -1
+		err     error
+	)
+	for i, codec := range s.up {
+		if pkt, err = openUDPPacket(s.aead, codec, wire); err == nil {
+			tableID = i
+			break
+		}
+	}
+	if tableID < 0 {
+		// Unauthenticated datagrams are dropped silently; UDP has no fallback.
+		return
+	}
+
+	sess, err := s.session(pkt.session, tableID)
+	if err != nil {
+		log.Printf("[Server][UDP] %v", err)
+		return
+	}
+	if !sess.window.accept(pkt.seq) {
+		return
+	}
+	sess.setClientAddr(from)
+	sess.active.Store(time.Now().UnixNano())
+
+	sess.nat.WriteTo(pkt.addr, pkt.payload)
+}
+
+func (s *UDPServer) session(id uint64, tableID int) (*udpServerSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		return sess, nil
+	}
+	if len(s.sessions) >= maxUDPSessions {
+		return nil, fmt.Errorf("session table full (%d)", maxUDPSessions)
+	}
+	nat, err := newUDPNAT(s.natOpts)
+	if err != nil {
+		return nil, fmt.Errorf("session nat: %w", err)
+	}
+	sess := &udpServerSession{
+		id:   id,
+		down: sudoku.NewPacketCodec(s.tables[tableID], s.cfg.PaddingMin, s.cfg.PaddingMax, !s.cfg.EnablePureDownlink),
+		nat:  nat,
+	}
+	sess.active.Store(time.Now().UnixNano())
+	s.sessions[id] = sess
+	go s.relayReplies(sess)
+	return sess, nil
+}
+
+func (s *UDPServer) relayReplies(sess *udpServerSession) {
+	sess.nat.serve(func(addr string, payload []byte) error {
+		clientAddr := sess.getClientAddr()
+		if clientAddr == nil {
+			return nil
+		}
+		wire, err := sealUDPPacket(s.aead, sess.down, udpPacket{
+			session: sess.id,
+			seq:     sess.sendSeq.Add(1),
+			addr:    addr,
+			payload: payload,
+		})
+		if err != nil {
+			return nil
+		}
+		sess.active.Store(time.Now().UnixNano())
+		s.conn.WriteToUDP(wire, clientAddr)
+		return nil
+	})
+}
+
+func (s *UDPServer) expireLoop() {
+	ticker := time.NewTicker(udpSessionIdle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.expire(now)
+		}
+	}
+}
+
+func (s *UDPServer) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if now.Sub(time.Unix(0, sess.active.Load())) > udpSessionIdle {
+			sess.nat.Close()
+			delete(s.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/dnsutil"
+)
+
+// NAT filtering behaviours (RFC 4787 §5).
+const (
+	// NATFilterEndpointIndependent accepts replies from any source (full cone).
+	NATFilterEndpointIndependent = "endpoint-independent"
+	// NATFilterAddressDependent only accepts replies from IPs the session has sent to.
+	NATFilterAddressDependent = "address-dependent"
+)
+
+// UDPNATOptions controls how the server relays a client's UDP session.
+type UDPNATOptions struct {
+	Filtering       string
+	IdleTimeout     time.Duration // per destination
+	MaxDestinations int           // per session; the least recently used one is evicted
+}
+
+// DefaultUDPNATOptions follows RFC 4787: endpoint-independent filtering and a 2 minute timer.
+func DefaultUDPNATOptions() UDPNATOptions {
+	return UDPNATOptions{
+		Filtering:       NATFilterEndpointIndependent,
+		IdleTimeout:     2 * time.Minute,
+		MaxDestinations: 512,
+	}
+}
+
+// NATOptionsFromConfig applies cfg.UDPNAT on top of the defaults.
+func NATOptionsFromConfig(cfg *config.Config) UDPNATOptions {
+	opts := DefaultUDPNATOptions()
+	if cfg == nil || cfg.UDPNAT == nil {
+		return opts
+	}
+	if cfg.UDPNAT.Filtering != "" {
+		opts.Filtering = cfg.UDPNAT.Filtering
+	}
+	if cfg.UDPNAT.IdleTimeout > 0 {
+		opts.IdleTimeout = time.Duration(cfg.UDPNAT.IdleTimeout) * time.Second
+	}
+	if cfg.UDPNAT.MaxDestinations > 0 {
+		opts.MaxDestinations = cfg.UDPNAT.MaxDestinations
+	}
+	return opts
+}
+
+// natDest is one destination the session has sent to.
+type natDest struct {
+	target   string // address as requested by the client (may be a domain)
+	addr     *net.UDPAddr
+	lastUsed time.Time
+}
+
+const (
+	// natPendingPackets bounds the datagrams queued behind DNS resolution per session.
+	natPendingPackets = 256
+	// natResolveConcurrency bounds the destination lookups running at once per session.
+	natResolveConcurrency = 8
+)
+
+// udpNAT maps one client UDP session onto a single outbound socket.
+type udpNAT struct {
+	opts UDPNATOptions
+	conn net.PacketConn
+
+	// 需要解析的目标在独立协程中并发解析，慢速 DNS 既不阻塞调用方的读循环，也不阻塞其他目标
+	resolve func(ctx context.Context, addr string) (string, error)
+	lookups chan struct{} // semaphore for concurrent lookups
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu        sync.Mutex
+	dests     map[string]*natDest // key: target
+	byAddr    map[string]*natDest // key: resolved ip:port
+	byIP      map[string]int      // active destinations per IP, for address-dependent filtering
+	resolving map[string][][]byte // datagrams waiting on each lookup in flight
+	queued    int                 // datagrams held in resolving
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newUDPNAT(opts UDPNATOptions) (*udpNAT, error) {
+	switch opts.Filtering {
+	case NATFilterEndpointIndependent, NATFilterAddressDependent:
+	default:
+		return nil, fmt.Errorf("unknown udp filtering: %s", opts.Filtering)
+	}
+	conn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, fmt.Errorf("listen udp: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &udpNAT{
+		opts:      opts,
+		conn:      conn,
+		resolve:   dnsutil.ResolveWithCache,
+		lookups:   make(chan struct{}, natResolveConcurrency),
+		ctx:       ctx,
+		cancel:    cancel,
+		dests:     make(map[string]*natDest),
+		byAddr:    make(map[string]*natDest),
+		byIP:      make(map[string]int),
+		resolving: make(map[string][][]byte),
+		closed:    make(chan struct{}),
+	}
+	go n.expireLoop()
+	return n, nil
+}
+
+// WriteTo sends payload to target. Known destinations are written immediately;
+// the others are queued for resolution and never block the caller.
+func (n *udpNAT) WriteTo(target string, payload []byte) error {
+	if addr, ok := n.cached(target); ok {
+		_, err := n.conn.WriteTo(payload, addr)
+		return err
+	}
+	select {
+	case <-n.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	n.mu.Lock()
+	if n.queued >= natPendingPackets {
+		// 队列已满：与拥塞链路一样丢弃该数据报
+		n.mu.Unlock()
+		return nil
+	}
+	n.queued++
+	waiting, inFlight := n.resolving[target]
+	n.resolving[target] = append(waiting, append([]byte(nil), payload...))
+	n.mu.Unlock()
+	if !inFlight {
+		go n.resolveTarget(target)
+	}
+	return nil
+}
+
+// resolveTarget resolves target and sends the datagrams queued behind it.
+func (n *udpNAT) resolveTarget(target string) {
+	var addr *net.UDPAddr
+	var err error
+	select {
+	case n.lookups <- struct{}{}:
+		addr, err = n.destination(target)
+		<-n.lookups
+	case <-n.closed:
+		err = net.ErrClosed
+	}
+
+	n.mu.Lock()
+	waiting := n.resolving[target]
+	delete(n.resolving, target)
+	n.queued -= len(waiting)
+	n.mu.Unlock()
+	if err != nil {
+		// An unresolvable destination only loses its own datagrams.
+		return
+	}
+	for _, payload := range waiting {
+		n.conn.WriteTo(payload, addr)
+	}
+}
+
+func (n *udpNAT) cached(target string) (*net.UDPAddr, bool) {
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if d, ok := n.dests[target]; ok && now.Sub(d.lastUsed) < n.opts.IdleTimeout {
+		d.lastUsed = now
+		return d.addr, true
+	}
+	return nil, false
+}
+
+func (n *udpNAT) destination(target string) (*net.UDPAddr, error) {
+	if addr, ok := n.cached(target); ok {
+		return addr, nil
+	}
+	now := time.Now()
+
+	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	resolved, err := n.resolve(ctx, target)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if old, ok := n.dests[target]; ok {
+		n.removeLocked(old)
+	}
+	if n.opts.MaxDestinations > 0 && len(n.dests) >= n.opts.MaxDestinations {
+		n.evictOldestLocked()
+	}
+	d := &natDest{target: target, addr: addr, lastUsed: now}
+	n.dests[target] = d
+	n.byAddr[addr.String()] = d
+	n.byIP[addr.IP.String()]++
+	return addr, nil
+}
+
+func (n *udpNAT) removeLocked(d *natDest) {
+	delete(n.dests, d.target)
+	key := d.addr.String()
+	if n.byAddr[key] == d {
+		delete(n.byAddr, key)
+	}
+	ip := d.addr.IP.String()
+	if n.byIP[ip]--; n.byIP[ip] <= 0 {
+		delete(n.byIP, ip)
+	}
+}
+
+func (n *udpNAT) evictOldestLocked() {
+	var oldest *natDest
+	for _, d := range n.dests {
+		if oldest == nil || d.lastUsed.Before(oldest.lastUsed) {
+			oldest = d
+		}
+	}
+	if oldest != nil {
+		n.removeLocked(oldest)
+	}
+}
+
+// serve relays replies to onReply until the NAT is closed or onReply fails.
+// Replies are reported with the address the client originally asked for.
+func (n *udpNAT) serve(onReply func(addr string, payload []byte) error) error {
+	buf := make([]byte, maxUoTPayload)
+	for {
+		nr, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		udpFrom, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		replyAddr, ok := n.accept(udpFrom)
+		if !ok {
+			continue
+		}
+		if err := onReply(replyAddr, buf[:nr]); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *udpNAT) accept(from *net.UDPAddr) (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.opts.Filtering == NATFilterAddressDependent && n.byIP[from.IP.String()] == 0 {
+		return "", false
+	}
+	if d, ok := n.byAddr[from.String()]; ok {
+		d.lastUsed = time.Now()
+		return d.target, true
+	}
+	return from.String(), true
+}
+
+func (n *udpNAT) expireLoop() {
+	interval := n.opts.IdleTimeout / 2
+	if interval <= 0 || interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			for _, d := range n.dests {
+				if now.Sub(d.lastUsed) >= n.opts.IdleTimeout {
+					n.removeLocked(d)
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *udpNAT) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		n.cancel()
+		err = n.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type natReply struct {
+	addr    string
+	payload string
+}
+
+func startTestNAT(t *testing.T, opts UDPNATOptions) (*udpNAT, <-chan natReply) {
+	t.Helper()
+	n, err := newUDPNAT(opts)
+	if err != nil {
+		t.Fatalf("new nat: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	replies := make(chan natReply, 16)
+	go n.serve(func(addr string, payload []byte) error {
+		replies <- natReply{addr: addr, payload: string(payload)}
+		return nil
+	})
+	return n, replies
+}
+
+func listenLoopbackUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// natAddr returns the loopback address of the NAT's outbound socket.
+func natAddr(n *udpNAT) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: n.conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+func expectReply(t *testing.T, replies <-chan natReply, want natReply) {
+	t.Helper()
+	select {
+	case got := <-replies:
+		if got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no reply, want %+v", want)
+	}
+}
+
+func expectNoReply(t *testing.T, replies <-chan natReply) {
+	t.Helper()
+	select {
+	case got := <-replies:
+		t.Fatalf("unexpected reply %+v", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestUDPNAT_Filtering(t *testing.T) {
+	for _, filtering := range []string{NATFilterEndpointIndependent, NATFilterAddressDependent} {
+		t.Run(filtering, func(t *testing.T) {
+			opts := DefaultUDPNATOptions()
+			opts.Filtering = filtering
+			n, replies := startTestNAT(t, opts)
+
+			peer := listenLoopbackUDP(t)
+			if err := n.WriteTo(peer.LocalAddr().String(), []byte("hi")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			buf := make([]byte, 16)
+			peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, _, err := peer.ReadFromUDP(buf); err != nil {
+				t.Fatalf("peer read: %v", err)
+			}
+			peer.WriteToUDP([]byte("from-peer"), natAddr(n))
+			expectReply(t, replies, natReply{addr: peer.LocalAddr().String(), payload: "from-peer"})
+
+			// A stranger on another IP: 127.0.0.2 is loopback on Linux but not a known destination.
+			stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+			if err != nil {
+				t.Skipf("127.0.0.2 unavailable: %v", err)
+			}
+			defer stranger.Close()
+			stranger.WriteToUDP([]byte("unsolicited"), natAddr(n))
+			if filtering == NATFilterEndpointIndependent {
+				expectReply(t, replies, natReply{addr: stranger.LocalAddr().String(), payload: "unsolicited"})
+			} else {
+				expectNoReply(t, replies)
+			}
+		})
+	}
+}
+
+func TestUDPNAT_ReportsOriginalDomain(t *testing.T) {
+	n, replies := startTestNAT(t, DefaultUDPNATOptions())
+	peer := listenLoopbackUDP(t)
+
+	target := fmt.Sprintf("localhost:%d", peer.LocalAddr().(*net.UDPAddr).Port)
+	if err := n.WriteTo(target, []byte("q")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 16)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := peer.ReadFromUDP(buf); err != nil {
+		t.Skipf("localhost does not resolve to 127.0.0.1 here: %v", err)
+	}
+	peer.WriteToUDP([]byte("a"), natAddr(n))
+	expectReply(t, replies, natReply{addr: target, payload: "a"})
+}
+
+func TestUDPNAT_ExpiryAndDestinationCap(t *testing.T) {
+	opts := UDPNATOptions{
+		Filtering:       NATFilterAddressDependent,
+		IdleTimeout:     600 * time.Millisecond,
+		MaxDestinations: 1,
+	}
+	n, replies := startTestNAT(t, opts)
+	a := listenLoopbackUDP(t)
+	b, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skipf("127.0.0.2 unavailable: %v", err)
+	}
+	defer b.Close()
+
+	// Sending to b evicts a (cap of one), so replies from a's IP are filtered.
+	// 解析是并发的，等 a 收到后再发往 b 以固定两者的先后
+	n.WriteTo(a.LocalAddr().String(), []byte("1"))
+	buf := make([]byte, 16)
+	a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := a.ReadFromUDP(buf); err != nil {
+		t.Fatalf("a read: %v", err)
+	}
+	n.WriteTo(b.LocalAddr().String(), []byte("2"))
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := b.ReadFromUDP(buf); err != nil {
+		t.Fatalf("b read: %v", err)
+	}
+	a.WriteToUDP([]byte("late"), natAddr(n))
+	expectNoReply(t, replies)
+	b.WriteToUDP([]byte("ok"), natAddr(n))
+	expectReply(t, replies, natReply{addr: b.LocalAddr().String(), payload: "ok"})
+
+	// After the idle timeout b is forgotten as well.
+	time.Sleep(time.Second)
+	b.WriteToUDP([]byte("expired"), natAddr(n))
+	expectNoReply(t, replies)
+}
+
+func TestUDPNAT_SlowResolutionDoesNotBlock(t *testing.T) {
+	n, _ := startTestNAT(t, DefaultUDPNATOptions())
+	release := make(chan struct{})
+	defer close(release)
+	n.resolve = func(ctx context.Context, addr string) (string, error) {
+		if addr == "slow.example:53" {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return "", ctx.Err()
+		}
+		return addr, nil
+	}
+	peer := listenLoopbackUDP(t)
+
+	// 未解析的目标进入队列，WriteTo 立即返回
+	done := make(chan struct{})
+	go func() {
+		n.WriteTo("slow.example:53", []byte("stuck"))
+		n.WriteTo(peer.LocalAddr().String(), []byte("queued"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("WriteTo blocked on DNS resolution")
+	}
+
+	// 已知目标不经过解析队列；其他目标的解析也不被慢速查询拖住
+	n.mu.Lock()
+	d := &natDest{target: "known", addr: peer.LocalAddr().(*net.UDPAddr), lastUsed: time.Now()}
+	n.dests[d.target] = d
+	n.mu.Unlock()
+	if err := n.WriteTo("known", []byte("direct")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := map[string]bool{}
+	buf := make([]byte, 16)
+	for len(got) < 2 {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		nr, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("stalled behind a slow lookup, got %v: %v", got, err)
+		}
+		got[string(buf[:nr])] = true
+	}
+	if !got["direct"] || !got["queued"] {
+		t.Fatalf("unexpected datagrams %v", got)
+	}
+}
@@ -14,7 +14,10 @@ import (
 const (
 	// UoTMagicByte marks a Sudoku tunnel connection that carries UDP-over-TCP traffic.
 	UoTMagicByte byte = 0xEE
-	uotVersion        = 0x01
+	// UoTVersion1 carries a single UDP association per tunnel.
+	UoTVersion1 byte = 0x01
+	// UoTVersion2 multiplexes many associations over one tunnel, see uot_mux.go.
+	UoTVersion2 byte = 0x02
 
 	maxUoTPayload = 64 * 1024
 )
@@ -25,38 +28,43 @@ type UoTDialer interface {
 	DialUDPOverTCP() (net.Conn, error)
 }
 
-// WriteUoTPreface writes the UDP-over-TCP marker and version.
-func WriteUoTPreface(w io.Writer) error {
-	_, err := w.Write([]byte{UoTMagicByte, uotVersion})
+// WriteUoTPreface writes the UDP-over-TCP marker and the requested frame version.
+// A v2 server acknowledges UoTVersion2 with the same two bytes. A v1 server never
+// acknowledges; the client falls back to v1 when the tunnel closes or the
+// acknowledgement does not arrive in time.
+func WriteUoTPreface(w io.Writer, version byte) error {
+	_, err := w.Write([]byte{UoTMagicByte, version})
 	return err
 }
 
 // WriteUoTDatagram sends a single UDP datagram frame over the reliable tunnel.
 func WriteUoTDatagram(w io.Writer, addr string, payload []byte) error {
+	frame, err := appendUoTDatagram(nil, addr, payload)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// appendUoTDatagram appends addrLen(2)|payloadLen(2)|addr|payload to dst.
+func appendUoTDatagram(dst []byte, addr string, payload []byte) ([]byte, error) {
 	addrBuf := &bytes.Buffer{}
 	if err := protocol.WriteAddress(addrBuf, addr); err != nil {
-		return fmt.Errorf("encode address: %w", err)
+		return nil, fmt.Errorf("encode address: %w", err)
 	}
 
 	if addrBuf.Len() > int(^uint16(0)) {
-		return fmt.Errorf("address too long: %d", addrBuf.Len())
+		return nil, fmt.Errorf("address too long: %d", addrBuf.Len())
 	}
 	if len(payload) > int(^uint16(0)) {
-		return fmt.Errorf("payload too large: %d", len(payload))
+		return nil, fmt.Errorf("payload too large: %d", len(payload))
 	}
 
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint16(header[:2], uint16(addrBuf.Len()))
-	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
-
-	if _, err := w.Write(header); err != nil {
-		return err
-	}
-	if _, err := w.Write(addrBuf.Bytes()); err != nil {
-		return err
-	}
-	_, err := w.Write(payload)
-	return err
+	dst = binary.BigEndian.AppendUint16(dst, uint16(addrBuf.Len()))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(payload)))
+	dst = append(dst, addrBuf.Bytes()...)
+	return append(dst, payload...), nil
 }
 
 // ReadUoTDatagram parses a single UDP datagram frame from the reliable tunnel.
@@ -96,19 +104,33 @@ func ReadUoTDatagram(r io.Reader) (string, []byte, error) {
 	return addr, payload, nil
 }
 
-// HandleUoTServer bridges UDP packets over the already-upgraded tunnel connection.
+// HandleUoTServer bridges UDP packets over the already-upgraded tunnel connection
+// using DefaultUDPNATOptions.
 func HandleUoTServer(conn net.Conn) error {
+	return HandleUoTServerWithOptions(conn, DefaultUDPNATOptions())
+}
+
+// HandleUoTServerWithOptions is HandleUoTServer with explicit NAT behaviour.
+func HandleUoTServerWithOptions(conn net.Conn, opts UDPNATOptions) error {
 	versionBuf := make([]byte, 1)
 	if _, err := io.ReadFull(conn, versionBuf); err != nil {
 		return fmt.Errorf("read uot version: %w", err)
 	}
-	if versionBuf[0] != uotVersion {
+	switch versionBuf[0] {
+	case UoTVersion1:
+	case UoTVersion2:
+		if err := WriteUoTPreface(conn, UoTVersion2); err != nil {
+			return fmt.Errorf("write uot ack: %w", err)
+		}
+		return handleUoTMuxServer(conn, opts)
+	default:
+		conn.Close()
 		return fmt.Errorf("unsupported uot version: %d", versionBuf[0])
 	}
 
-	pConn, err := net.ListenPacket("udp", "")
+	nat, err := newUDPNAT(opts)
 	if err != nil {
-		return fmt.Errorf("listen udp for uot: %w", err)
+		return fmt.Errorf("uot nat: %w", err)
 	}
 
 	errCh := make(chan error, 1)
@@ -117,24 +139,15 @@ func HandleUoTServer(conn net.Conn) error {
 	closeAll := func(err error) {
 		once.Do(func() {
 			_ = conn.Close()
-			_ = pConn.Close()
+			_ = nat.Close()
 			errCh <- err
 		})
 	}
 
 	go func() {
-		buf := make([]byte, maxUoTPayload)
-		for {
-			n, addr, err := pConn.ReadFrom(buf)
-			if err != nil {
-				closeAll(err)
-				return
-			}
-			if err := WriteUoTDatagram(conn, addr.String(), buf[:n]); err != nil {
-				closeAll(err)
-				return
-			}
-		}
+		closeAll(nat.serve(func(addr string, payload []byte) error {
+			return WriteUoTDatagram(conn, addr, payload)
+		}))
 	}()
 
 	go func() {
@@ -144,12 +157,7 @@ func HandleUoTServer(conn net.Conn) error {
 				closeAll(err)
 				return
 			}
-			udpAddr, err := net.ResolveUDPAddr("udp", addrStr)
-			if err != nil {
-				// Skip invalid destinations instead of failing the whole session.
-				continue
-			}
-			if _, err := pConn.WriteTo(payload, udpAddr); err != nil {
+			if err := nat.WriteTo(addrStr, payload); err != nil {
 				closeAll(err)
 				return
 			}
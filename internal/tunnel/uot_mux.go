@@ -0,0 +1,415 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UoT v2 frame: session(4)|type(1)|body. A data body is the v1 datagram frame
+// (addrLen|payloadLen|addr|payload); a close frame has no body.
+// Session IDs are chosen by the client; the server keeps one NAT per ID.
+const (
+	uotFrameData  byte = 0x00
+	uotFrameClose byte = 0x01
+
+	uotMuxHeaderLen   = 5
+	maxUoTMuxSessions = 256
+
+	uotAckTimeout   = 3 * time.Second  // a v2 server answers within one round trip
+	uotMuxLinger    = 30 * time.Second // keep an idle tunnel around for the next association
+	uotV1RetryAfter = 10 * time.Minute // how long to remember that a server only speaks v1
+	uotMuxQueueLen  = 64
+)
+
+var (
+	errUoTV2Unsupported = errors.New("server does not support uot v2")
+	errUoTMuxClosed     = errors.New("uot tunnel closed")
+)
+
+// UoTSessionDialer opens UDP associations that may share one multiplexed UoT tunnel.
+type UoTSessionDialer interface {
+	DialUoTSession() (DatagramConn, error)
+}
+
+func appendUoTMuxFrame(dst []byte, id uint32, typ byte, addr string, payload []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint32(dst, id)
+	dst = append(dst, typ)
+	if typ == uotFrameClose {
+		return dst, nil
+	}
+	return appendUoTDatagram(dst, addr, payload)
+}
+
+func readUoTMuxFrame(r io.Reader) (id uint32, typ byte, addr string, payload []byte, err error) {
+	var hdr [uotMuxHeaderLen]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	id = binary.BigEndian.Uint32(hdr[:4])
+	typ = hdr[4]
+	switch typ {
+	case uotFrameClose:
+	case uotFrameData:
+		addr, payload, err = ReadUoTDatagram(r)
+	default:
+		err = fmt.Errorf("unknown uot frame type: %d", typ)
+	}
+	return
+}
+
+// dialUoTMux opens a tunnel and negotiates UoT v2.
+func (d *BaseDialer) dialUoTMux() (net.Conn, error) {
+	conn, err := d.dialBase()
+	if err != nil {
+		return nil, err
+	}
+	if err := negotiateUoTMux(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// negotiateUoTMux sends the v2 preface and waits for the server's acknowledgement.
+// It returns errUoTV2Unsupported when the server closes the tunnel or stays
+// silent: a v1 server rejects the unknown version without closing the
+// connection, so no acknowledgement within uotAckTimeout also means v1.
+func negotiateUoTMux(conn net.Conn) error {
+	if err := WriteUoTPreface(conn, UoTVersion2); err != nil {
+		return fmt.Errorf("uot preface failed: %w", err)
+	}
+
+	ack := make([]byte, 2)
+	_ = conn.SetReadDeadline(time.Now().Add(uotAckTimeout))
+	_, err := io.ReadFull(conn, ack)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		var ne net.Error
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || (errors.As(err, &ne) && ne.Timeout()) {
+			return errUoTV2Unsupported
+		}
+		return fmt.Errorf("read uot ack: %w", err)
+	}
+	if ack[0] != UoTMagicByte || ack[1] != UoTVersion2 {
+		return fmt.Errorf("unexpected uot ack: %x", ack)
+	}
+	return nil
+}
+
+// DialUoTSession opens a UDP association on the dialer's shared UoT v2 tunnel,
+// falling back to a dedicated v1 tunnel when the server predates v2.
+func (d *StandardDialer) DialUoTSession() (DatagramConn, error) {
+	return d.mux.dial(d.dialUoTMux, d.dialUoT)
+}
+
+// uotMux shares one UoT v2 tunnel between the UDP associations of a dialer.
+// The zero value is ready to use.
+type uotMux struct {
+	mu      sync.Mutex
+	tunnel  *uotMuxTunnel
+	dialing *uotMuxDial // in-flight tunnel handshake shared by concurrent opens
+	nextID  uint32
+	v1Until time.Time
+}
+
+// uotMuxDial is the outcome of one tunnel handshake, published when done closes.
+type uotMuxDial struct {
+	done chan struct{}
+	err  error
+}
+
+type uotMuxTunnel struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	sessions map[uint32]*uotMuxSession // guarded by uotMux.mu
+	linger   *time.Timer
+}
+
+func (t *uotMuxTunnel) write(frame []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err := t.conn.Write(frame)
+	return err
+}
+
+func (m *uotMux) dial(dialV2, dialV1 func() (net.Conn, error)) (DatagramConn, error) {
+	dc, err := m.open(dialV2)
+	if !errors.Is(err, errUoTV2Unsupported) {
+		return dc, err
+	}
+	conn, err := dialV1()
+	if err != nil {
+		return nil, err
+	}
+	return NewUoTDatagramConn(conn), nil
+}
+
+func (m *uotMux) open(dialV2 func() (net.Conn, error)) (DatagramConn, error) {
+	if err := m.connect(dialV2); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.tunnel
+	if t == nil {
+		// 刚建立的隧道在发布后立即断开
+		return nil, errUoTMuxClosed
+	}
+	if len(t.sessions) >= maxUoTMuxSessions {
+		return nil, fmt.Errorf("too many uot sessions: %d", len(t.sessions))
+	}
+	if t.linger != nil {
+		t.linger.Stop()
+		t.linger = nil
+	}
+
+	m.nextID++
+	s := &uotMuxSession{
+		mux:  m,
+		t:    t,
+		id:   m.nextID,
+		recv: make(chan uotDatagram, uotMuxQueueLen),
+		done: make(chan struct{}),
+	}
+	t.sessions[s.id] = s
+	return s, nil
+}
+
+// connect makes sure a tunnel is up. The handshake runs without holding m.mu, so
+// associations on an existing tunnel are never queued behind it, and concurrent
+// callers share a single dial.
+func (m *uotMux) connect(dialV2 func() (net.Conn, error)) error {
+	m.mu.Lock()
+	if time.Now().Before(m.v1Until) {
+		m.mu.Unlock()
+		return errUoTV2Unsupported
+	}
+	if m.tunnel != nil {
+		m.mu.Unlock()
+		return nil
+	}
+	if d := m.dialing; d != nil {
+		m.mu.Unlock()
+		<-d.done
+		return d.err
+	}
+	d := &uotMuxDial{done: make(chan struct{})}
+	m.dialing = d
+	m.mu.Unlock()
+
+	conn, err := dialV2()
+
+	m.mu.Lock()
+	m.dialing = nil
+	if err != nil {
+		if errors.Is(err, errUoTV2Unsupported) {
+			m.v1Until = time.Now().Add(uotV1RetryAfter)
+		}
+	} else {
+		t := &uotMuxTunnel{conn: conn, sessions: make(map[uint32]*uotMuxSession)}
+		m.tunnel = t
+		go m.readLoop(t)
+	}
+	d.err = err
+	m.mu.Unlock()
+	close(d.done)
+	return err
+}
+
+func (m *uotMux) readLoop(t *uotMuxTunnel) {
+	for {
+		id, typ, addr, payload, err := readUoTMuxFrame(t.conn)
+		if err != nil {
+			m.drop(t, err)
+			return
+		}
+		m.mu.Lock()
+		s := t.sessions[id]
+		if s != nil && typ == uotFrameClose {
+			delete(t.sessions, id)
+		}
+		m.mu.Unlock()
+		if s == nil {
+			continue
+		}
+		if typ == uotFrameClose {
+			s.finish(io.EOF)
+			continue
+		}
+		select {
+		case s.recv <- uotDatagram{addr: addr, payload: payload}:
+		default:
+			// 与真实 UDP 一样，接收方跟不上时直接丢包
+		}
+	}
+}
+
+// drop tears down a broken tunnel and fails every session on it.
+func (m *uotMux) drop(t *uotMuxTunnel, err error) {
+	m.mu.Lock()
+	if m.tunnel == t {
+		m.tunnel = nil
+	}
+	sessions := t.sessions
+	t.sessions = make(map[uint32]*uotMuxSession)
+	m.mu.Unlock()
+
+	t.conn.Close()
+	for _, s := range sessions {
+		s.finish(err)
+	}
+}
+
+// release forgets a closed session and schedules the tunnel for closing once idle.
+func (m *uotMux) release(s *uotMuxSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := s.t
+	delete(t.sessions, s.id)
+	if len(t.sessions) > 0 || m.tunnel != t || t.linger != nil {
+		return
+	}
+	t.linger = time.AfterFunc(uotMuxLinger, func() {
+		m.mu.Lock()
+		idle := len(t.sessions) == 0 && m.tunnel == t
+		if idle {
+			m.tunnel = nil
+		}
+		m.mu.Unlock()
+		if idle {
+			t.conn.Close()
+		}
+	})
+}
+
+type uotDatagram struct {
+	addr    string
+	payload []byte
+}
+
+// uotMuxSession is one UDP association on a shared tunnel.
+type uotMuxSession struct {
+	mux  *uotMux
+	t    *uotMuxTunnel
+	id   uint32
+	recv chan uotDatagram
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func (s *uotMuxSession) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+func (s *uotMuxSession) WriteDatagram(addr string, payload []byte) error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+	frame, err := appendUoTMuxFrame(nil, s.id, uotFrameData, addr, payload)
+	if err != nil {
+		return err
+	}
+	return s.t.write(frame)
+}
+
+func (s *uotMuxSession) ReadDatagram() (string, []byte, error) {
+	select {
+	case d := <-s.recv:
+		return d.addr, d.payload, nil
+	case <-s.done:
+		return "", nil, s.err
+	}
+}
+
+func (s *uotMuxSession) Close() error {
+	closing := false
+	s.once.Do(func() {
+		closing = true
+		s.err = net.ErrClosed
+		close(s.done)
+	})
+	if !closing {
+		return nil
+	}
+	frame, _ := appendUoTMuxFrame(nil, s.id, uotFrameClose, "", nil)
+	_ = s.t.write(frame)
+	s.mux.release(s)
+	return nil
+}
+
+// handleUoTMuxServer serves a UoT v2 tunnel: one NAT per client session ID.
+func handleUoTMuxServer(conn net.Conn, opts UDPNATOptions) error {
+	t := &uotMuxTunnel{conn: conn}
+	sessions := make(map[uint32]*udpNAT)
+	defer func() {
+		conn.Close()
+		for _, nat := range sessions {
+			nat.Close()
+		}
+	}()
+
+	closeSession := func(id uint32) {
+		frame, _ := appendUoTMuxFrame(nil, id, uotFrameClose, "", nil)
+		_ = t.write(frame)
+	}
+
+	for {
+		id, typ, addr, payload, err := readUoTMuxFrame(conn)
+		if err != nil {
+			return err
+		}
+		nat := sessions[id]
+		if typ == uotFrameClose {
+			if nat != nil {
+				nat.Close()
+				delete(sessions, id)
+			}
+			continue
+		}
+
+		if nat == nil {
+			if len(sessions) >= maxUoTMuxSessions {
+				closeSession(id)
+				continue
+			}
+			if nat, err = newUDPNAT(opts); err != nil {
+				return fmt.Errorf("uot nat: %w", err)
+			}
+			sessions[id] = nat
+			go func(id uint32, nat *udpNAT) {
+				nat.serve(func(addr string, payload []byte) error {
+					frame, err := appendUoTMuxFrame(nil, id, uotFrameData, addr, payload)
+					if err != nil {
+						return nil
+					}
+					if err := t.write(frame); err != nil {
+						// 隧道已断，结束整个连接
+						conn.Close()
+						return err
+					}
+					return nil
+				})
+			}(id, nat)
+		}
+
+		// WriteTo 不做同步解析，单个关联的 DNS 查询不会阻塞整条隧道的读循环
+		if err := nat.WriteTo(addr, payload); err != nil {
+			nat.Close()
+			delete(sessions, id)
+			closeSession(id)
+		}
+	}
+}
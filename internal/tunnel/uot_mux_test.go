@@ -0,0 +1,238 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeUoTServer returns a dial func whose server side runs the real UoT handler,
+// after the magic byte has been consumed as the app server does.
+func pipeUoTServer(t *testing.T, dials *atomic.Int32, v1Only bool) func() (net.Conn, error) {
+	t.Helper()
+	return func() (net.Conn, error) {
+		dials.Add(1)
+		client, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		go func() {
+			hdr := make([]byte, 2)
+			if _, err := io.ReadFull(server, hdr); err != nil || hdr[0] != UoTMagicByte {
+				server.Close()
+				return
+			}
+			if v1Only && hdr[1] != UoTVersion1 {
+				// 旧版服务端拒绝未知版本后既不应答也不关闭连接
+				return
+			}
+			HandleUoTServer(NewPreBufferedConn(server, hdr[1:]))
+			server.Close()
+		}()
+		return client, nil
+	}
+}
+
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	echo := listenLoopbackUDP(t)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// Echo back the sender's port so sessions can tell their NAT sockets apart.
+			echo.WriteToUDP([]byte(string(buf[:n])+"@"+from.String()), from)
+		}
+	}()
+	return echo
+}
+
+func readDatagramTimeout(t *testing.T, dc DatagramConn) (string, string) {
+	t.Helper()
+	type result struct {
+		addr, payload string
+		err           error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		addr, payload, err := dc.ReadDatagram()
+		ch <- result{addr, string(payload), err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("read: %v", r.err)
+		}
+		return r.addr, r.payload
+	case <-time.After(2 * time.Second):
+		t.Fatalf("read timed out")
+	}
+	return "", ""
+}
+
+func TestUoTMux_SessionsShareTunnel(t *testing.T) {
+	echo := startUDPEcho(t)
+	target := echo.LocalAddr().String()
+
+	var dials atomic.Int32
+	dialV2 := pipeUoTServer(t, &dials, false)
+	dialV2Negotiated := func() (net.Conn, error) {
+		conn, err := dialV2()
+		if err != nil {
+			return nil, err
+		}
+		if err := negotiateUoTMux(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	dialV1 := func() (net.Conn, error) {
+		t.Fatalf("unexpected v1 fallback")
+		return nil, nil
+	}
+
+	var mux uotMux
+	a, err := mux.dial(dialV2Negotiated, dialV1)
+	if err != nil {
+		t.Fatalf("dial a: %v", err)
+	}
+	b, err := mux.dial(dialV2Negotiated, dialV1)
+	if err != nil {
+		t.Fatalf("dial b: %v", err)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("expected one shared tunnel, got %d", n)
+	}
+
+	a.WriteDatagram(target, []byte("a"))
+	addrA, gotA := readDatagramTimeout(t, a)
+	b.WriteDatagram(target, []byte("b"))
+	addrB, gotB := readDatagramTimeout(t, b)
+	if addrA != target || addrB != target {
+		t.Fatalf("unexpected reply addresses %s %s", addrA, addrB)
+	}
+	if gotA[:2] != "a@" || gotB[:2] != "b@" {
+		t.Fatalf("replies crossed sessions: %q %q", gotA, gotB)
+	}
+	if gotA[2:] == gotB[2:] {
+		t.Fatalf("sessions share one server socket: %s", gotA[2:])
+	}
+
+	// Closing one session leaves the other usable.
+	a.Close()
+	if err := a.WriteDatagram(target, []byte("x")); err == nil {
+		t.Fatalf("write on closed session succeeded")
+	}
+	b.WriteDatagram(target, []byte("b2"))
+	if _, got := readDatagramTimeout(t, b); got[:3] != "b2@" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	b.Close()
+}
+
+func TestUoTMux_FallsBackToV1(t *testing.T) {
+	echo := startUDPEcho(t)
+	target := echo.LocalAddr().String()
+
+	var v2Dials, v1Dials atomic.Int32
+	v2 := pipeUoTServer(t, &v2Dials, true)
+	v1 := pipeUoTServer(t, &v1Dials, true)
+	dialV2 := func() (net.Conn, error) {
+		conn, _ := v2()
+		if err := negotiateUoTMux(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	dialV1 := func() (net.Conn, error) {
+		conn, _ := v1()
+		if err := WriteUoTPreface(conn, UoTVersion1); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	var mux uotMux
+	for i := 0; i < 2; i++ {
+		dc, err := mux.dial(dialV2, dialV1)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		dc.WriteDatagram(target, []byte("v1"))
+		if _, got := readDatagramTimeout(t, dc); got[:3] != "v1@" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+		dc.Close()
+	}
+	// The v1-only answer is remembered instead of probed on every association.
+	if v2Dials.Load() != 1 || v1Dials.Load() != 2 {
+		t.Fatalf("dials: v2=%d v1=%d", v2Dials.Load(), v1Dials.Load())
+	}
+}
+
+func TestUoTMux_ConcurrentOpensShareOneDial(t *testing.T) {
+	var dials atomic.Int32
+	release := make(chan struct{})
+	dialV2 := func() (net.Conn, error) {
+		dials.Add(1)
+		<-release // 慢握手
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, server)
+		return client, nil
+	}
+
+	var mux uotMux
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			dc, err := mux.open(dialV2)
+			if err == nil {
+				dc.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	// 握手进行中不应持有 mux.mu
+	time.Sleep(50 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		mux.mu.Lock()
+		mux.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("mux lock held during the tunnel handshake")
+	}
+
+	close(release)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("open: %v", err)
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("expected one shared dial, got %d", n)
+	}
+}
+
+func TestUoTServer_ClosesOnUnknownVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte{0x09})
+	if err := HandleUoTServer(server); err == nil {
+		t.Fatalf("expected an error for an unknown version")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the tunnel to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,417 @@
+// Package control adds an in-band control channel between the application
+// stream and the AEAD layer. Every write is carried in a typed frame, which
+// lets the two ends exchange keepalive pings (with RTT measurement), send
+// randomized cover traffic while the tunnel is idle, and declare the peer dead
+// after a number of unanswered pings. Frames are only visible after decryption.
+package control
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPeerDead is returned once MaxMissed pings in a row went unanswered.
+var ErrPeerDead = errors.New("control: peer stopped answering keepalive pings")
+
+// ErrBadFrame is returned for an unknown frame type or a malformed control frame.
+var ErrBadFrame = errors.New("control: malformed frame")
+
+const (
+	frameData  byte = 0x00
+	framePing  byte = 0x01
+	framePong  byte = 0x02
+	frameCover byte = 0x03
+
+	headerSize = 3
+	maxPayload = 0xFFFF
+	pingSize   = 8
+
+	// maxBuffered 是后台读协程为应用暂存的数据上限，超过后暂停读取
+	maxBuffered = 64 * 1024
+)
+
+// Options configures the local side. The peer only needs the channel enabled;
+// pings are always answered and cover frames always discarded.
+type Options struct {
+	Interval  int    `json:"interval,omitempty"`   // ping 间隔（毫秒），默认 15000
+	MaxMissed int    `json:"max_missed,omitempty"` // 连续多少个 ping 未获回应即判定对端失效，默认 3
+	Cover     *Cover `json:"cover,omitempty"`      // 可选，空闲时发送随机掩护流量
+}
+
+// Cover configures idle cover traffic. Zero fields take the defaults.
+type Cover struct {
+	IdleMs   int `json:"idle_ms,omitempty"`    // 多久没有写出数据后视为空闲（毫秒），默认 2000
+	MinGapMs int `json:"min_gap_ms,omitempty"` // 掩护帧之间的最小间隔（毫秒），默认 500
+	MaxGapMs int `json:"max_gap_ms,omitempty"` // 掩护帧之间的最大间隔（毫秒），默认 3000
+	MinSize  int `json:"min_size,omitempty"`   // 单个掩护帧的最小字节数，默认 32
+	MaxSize  int `json:"max_size,omitempty"`   // 单个掩护帧的最大字节数，默认 512
+}
+
+// Validate checks the options. A nil receiver is valid (channel disabled).
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Interval < 0 || o.MaxMissed < 0 {
+		return fmt.Errorf("interval and max_missed must be >= 0")
+	}
+	if o.Interval > 0 && o.Interval < 100 {
+		return fmt.Errorf("interval must be at least 100ms")
+	}
+	if c := o.Cover; c != nil {
+		if c.IdleMs < 0 || c.MinGapMs < 0 || c.MaxGapMs < 0 || c.MinSize < 0 || c.MaxSize < 0 {
+			return fmt.Errorf("cover values must be >= 0")
+		}
+		d := o.withDefaults().Cover
+		if d.MaxGapMs < d.MinGapMs || d.MinGapMs == 0 {
+			return fmt.Errorf("cover gap must satisfy 0 < min_gap_ms <= max_gap_ms")
+		}
+		if d.MaxSize < d.MinSize || d.MaxSize > maxPayload {
+			return fmt.Errorf("cover size must satisfy min_size <= max_size <= %d", maxPayload)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns a copy with zero fields replaced by defaults.
+func (o *Options) withDefaults() Options {
+	out := Options{Interval: 15000, MaxMissed: 3}
+	if o == nil {
+		return out
+	}
+	if o.Interval > 0 {
+		out.Interval = o.Interval
+	}
+	if o.MaxMissed > 0 {
+		out.MaxMissed = o.MaxMissed
+	}
+	if o.Cover != nil {
+		c := Cover{IdleMs: 2000, MinGapMs: 500, MaxGapMs: 3000, MinSize: 32, MaxSize: 512}
+		if o.Cover.IdleMs > 0 {
+			c.IdleMs = o.Cover.IdleMs
+		}
+		if o.Cover.MinGapMs > 0 {
+			c.MinGapMs = o.Cover.MinGapMs
+		}
+		if o.Cover.MaxGapMs > 0 {
+			c.MaxGapMs = o.Cover.MaxGapMs
+		}
+		if o.Cover.MinSize > 0 {
+			c.MinSize = o.Cover.MinSize
+		}
+		if o.Cover.MaxSize > 0 {
+			c.MaxSize = o.Cover.MaxSize
+		}
+		out.Cover = &c
+	}
+	return out
+}
+
+// Conn frames the application stream and runs the control loop.
+type Conn struct {
+	net.Conn
+	opts  Options
+	start time.Time
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	// 后台读协程持续解析帧，控制帧即时处理，数据暂存在 rbuf 等待 Read；
+	// 这样应用暂停读取时 ping 依然能得到回应，pong 也能及时计入
+	rmu       sync.Mutex
+	rcond     *sync.Cond
+	rbuf      []byte
+	rerr      error
+	rdeadline time.Time
+	rtimer    *time.Timer
+	closed    bool
+	stalled   atomic.Bool // rbuf 已满，读协程在等应用取走数据
+
+	lastWrite   atomic.Int64 // 最近一次写出应用数据的时间（相对 start 的纳秒）
+	outstanding atomic.Int32 // 已发出但尚未得到回应的 ping 数
+	rtt         atomic.Int64
+	dead        atomic.Bool
+
+	pongs     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	rng       *rand.Rand
+}
+
+// New wraps c with the control channel. opts may be nil: the connection then
+// answers pings but sends neither pings nor cover traffic.
+func New(c net.Conn, opts *Options) *Conn {
+	var seedBytes [8]byte
+	if _, err := crypto_rand.Read(seedBytes[:]); err != nil {
+		binary.BigEndian.PutUint64(seedBytes[:], uint64(time.Now().UnixNano()))
+	}
+	cc := &Conn{
+		Conn:     c,
+		start:    time.Now(),
+		writeBuf: make([]byte, 0, 4096),
+		pongs:    make(chan []byte, 4),
+		done:     make(chan struct{}),
+		rng:      rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seedBytes[:])))),
+	}
+	cc.rcond = sync.NewCond(&cc.rmu)
+	if opts != nil {
+		cc.opts = opts.withDefaults()
+	}
+	go cc.readLoop()
+	go cc.run(opts != nil)
+	return cc
+}
+
+// RTT returns the most recent ping round-trip time, or 0 before the first pong.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+		if err := c.writeFrame(frameData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	c.lastWrite.Store(int64(time.Since(c.start)))
+	return written, nil
+}
+
+func (c *Conn) writeFrame(typ byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := append(c.writeBuf[:0], typ, byte(len(payload)>>8), byte(len(payload)))
+	buf = append(buf, payload...)
+	c.writeBuf = buf[:0]
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 || c.closed {
+		if c.closed {
+			return 0, c.readErr(net.ErrClosed)
+		}
+		if c.rerr != nil {
+			return 0, c.readErr(c.rerr)
+		}
+		if !c.rdeadline.IsZero() && !time.Now().Before(c.rdeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.rcond.Wait()
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[:copy(c.rbuf, c.rbuf[n:])]
+	c.rcond.Broadcast()
+	return n, nil
+}
+
+// SetReadDeadline applies to Read only; the background reader keeps running.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.rdeadline = t
+	if c.rtimer != nil {
+		c.rtimer.Stop()
+	}
+	if !t.IsZero() {
+		c.rtimer = time.AfterFunc(time.Until(t), func() {
+			c.rmu.Lock()
+			c.rcond.Broadcast()
+			c.rmu.Unlock()
+		})
+	}
+	c.rcond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// readLoop parses frames until the underlying connection fails.
+func (c *Conn) readLoop() {
+	err := c.readFrames()
+	c.rmu.Lock()
+	c.rerr = err
+	c.rcond.Broadcast()
+	c.rmu.Unlock()
+}
+
+func (c *Conn) readFrames() error {
+	var hdr [headerSize]byte
+	buf := make([]byte, 32*1024)
+	for {
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return err
+		}
+		// 收到任何字节都说明对端仍然存活
+		c.outstanding.Store(0)
+		typ := hdr[0]
+		size := int(binary.BigEndian.Uint16(hdr[1:]))
+		switch typ {
+		case frameData:
+			for size > 0 {
+				n, err := c.Conn.Read(buf[:min(size, len(buf))])
+				size -= n
+				if n > 0 {
+					c.outstanding.Store(0)
+					if !c.deliver(buf[:n]) {
+						return net.ErrClosed
+					}
+				}
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		case framePing, framePong:
+			if size != pingSize {
+				return ErrBadFrame
+			}
+		case frameCover:
+		default:
+			return ErrBadFrame
+		}
+		if _, err := io.ReadFull(c.Conn, buf[:size]); err != nil {
+			return err
+		}
+		c.outstanding.Store(0)
+		c.handleControl(typ, buf[:size])
+	}
+}
+
+// deliver hands data to Read, waiting while the application is behind.
+func (c *Conn) deliver(p []byte) bool {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) >= maxBuffered && !c.closed {
+		c.stalled.Store(true)
+		c.rcond.Wait()
+	}
+	c.stalled.Store(false)
+	if c.closed {
+		return false
+	}
+	c.rbuf = append(c.rbuf, p...)
+	c.rcond.Broadcast()
+	return true
+}
+
+func (c *Conn) handleControl(typ byte, payload []byte) {
+	switch typ {
+	case framePing:
+		// 回应交给控制协程发送，读协程不能被写阻塞
+		select {
+		case c.pongs <- append([]byte(nil), payload...):
+		default:
+		}
+	case framePong:
+		sent := time.Duration(binary.BigEndian.Uint64(payload))
+		if rtt := time.Since(c.start) - sent; rtt >= 0 {
+			c.rtt.Store(int64(rtt))
+		}
+	}
+}
+
+func (c *Conn) readErr(err error) error {
+	if err != nil && c.dead.Load() {
+		return ErrPeerDead
+	}
+	return err
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.rmu.Lock()
+		c.closed = true
+		c.rcond.Broadcast()
+		c.rmu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// run sends pings and cover frames and answers the peer's pings.
+func (c *Conn) run(active bool) {
+	var pingC <-chan time.Time
+	var coverC <-chan time.Time
+	var coverTimer *time.Timer
+	if active {
+		ticker := time.NewTicker(time.Duration(c.opts.Interval) * time.Millisecond)
+		defer ticker.Stop()
+		pingC = ticker.C
+		if c.opts.Cover != nil {
+			coverTimer = time.NewTimer(time.Duration(c.opts.Cover.IdleMs) * time.Millisecond)
+			defer coverTimer.Stop()
+			coverC = coverTimer.C
+		}
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case payload := <-c.pongs:
+			if c.writeFrame(framePong, payload) != nil {
+				return
+			}
+		case <-pingC:
+			if c.stalled.Load() {
+				// 应用没取走数据，对端的 pong 可能排在未读数据之后；数据还在到达，对端自然存活
+				c.outstanding.Store(0)
+			}
+			if int(c.outstanding.Load()) >= c.opts.MaxMissed {
+				c.dead.Store(true)
+				c.Close()
+				return
+			}
+			var payload [pingSize]byte
+			binary.BigEndian.PutUint64(payload[:], uint64(time.Since(c.start)))
+			c.outstanding.Add(1)
+			if c.writeFrame(framePing, payload[:]) != nil {
+				return
+			}
+		case <-coverC:
+			coverTimer.Reset(c.coverTick())
+		}
+	}
+}
+
+// coverTick sends one cover frame when the write side has been idle long
+// enough and returns the delay until the next check.
+func (c *Conn) coverTick() time.Duration {
+	cv := c.opts.Cover
+	idle := time.Duration(cv.IdleMs) * time.Millisecond
+	since := time.Since(c.start) - time.Duration(c.lastWrite.Load())
+	if since < idle {
+		return idle - since
+	}
+	size := cv.MinSize + c.rng.Intn(cv.MaxSize-cv.MinSize+1)
+	payload := make([]byte, size)
+	c.rng.Read(payload)
+	_ = c.writeFrame(frameCover, payload)
+	return time.Duration(cv.MinGapMs+c.rng.Intn(cv.MaxGapMs-cv.MinGapMs+1)) * time.Millisecond
+}
@@ -0,0 +1,175 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingConn counts bytes written to the underlying connection.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestValidate(t *testing.T) {
+	good := []*Options{nil, {}, {Interval: 5000, MaxMissed: 2}, {Cover: &Cover{}}, {Cover: &Cover{MinGapMs: 100, MaxGapMs: 200, MinSize: 1, MaxSize: 64}}}
+	for i, o := range good {
+		if err := o.Validate(); err != nil {
+			t.Errorf("good[%d]: %v", i, err)
+		}
+	}
+	bad := []*Options{{Interval: -1}, {Interval: 10}, {Cover: &Cover{MinGapMs: 5000}}, {Cover: &Cover{MinSize: 600}}, {Cover: &Cover{MaxSize: 70000}}}
+	for i, o := range bad {
+		if err := o.Validate(); err == nil {
+			t.Errorf("bad[%d]: expected error", i)
+		}
+	}
+}
+
+func TestDataAndPings(t *testing.T) {
+	a, b := net.Pipe()
+	client := New(a, &Options{Interval: 100})
+	server := New(b, nil)
+	defer client.Close()
+	defer server.Close()
+
+	payload := bytes.Repeat([]byte("control-data-"), 10000)
+	go func() {
+		client.Write(payload)
+	}()
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("data mismatch: %v", err)
+	}
+
+	// 控制帧由后台读协程处理，两端应用无需继续读取
+	deadline := time.Now().Add(3 * time.Second)
+	for client.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no RTT measured")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestIdleCoverTraffic(t *testing.T) {
+	a, b := net.Pipe()
+	counter := &countingConn{Conn: a}
+	client := New(counter, &Options{Cover: &Cover{IdleMs: 50, MinGapMs: 20, MaxGapMs: 40, MinSize: 16, MaxSize: 64}})
+	server := New(b, nil)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		time.Sleep(400 * time.Millisecond)
+		client.Write([]byte("after-idle"))
+	}()
+	buf := make([]byte, 64)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "after-idle" {
+		t.Fatalf("read = %q, %v", buf[:n], err)
+	}
+	// 掩护帧至少 16 字节负载加 3 字节头，数据帧只有 13 字节
+	if w := counter.written.Load(); w < 13+2*19 {
+		t.Fatalf("expected cover frames before data, only %d bytes written", w)
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	a, b := net.Pipe()
+	client := New(a, &Options{Interval: 100, MaxMissed: 2})
+	defer client.Close()
+	go io.Copy(io.Discard, b) // 对端只收不回
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 16))
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrPeerDead) {
+			t.Fatalf("read error = %v, want ErrPeerDead", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("dead peer not detected")
+	}
+}
+
+func TestMalformedFrame(t *testing.T) {
+	a, b := net.Pipe()
+	server := New(b, nil)
+	defer server.Close()
+	go a.Write([]byte{0x7F, 0x00, 0x01})
+	if _, err := server.Read(make([]byte, 8)); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("err = %v, want ErrBadFrame", err)
+	}
+	go a.Write([]byte{framePing, 0x00, 0x02, 0x00, 0x00})
+	if _, err := server.Read(make([]byte, 8)); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("err = %v, want ErrBadFrame", err)
+	}
+	a.Close()
+}
+
+func TestStalledReaderSurvives(t *testing.T) {
+	a, b := net.Pipe()
+	client := New(a, &Options{Interval: 100, MaxMissed: 2})
+	server := New(b, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// 空闲时应用不读，pong 仍由读协程处理
+	time.Sleep(300 * time.Millisecond)
+	if client.RTT() == 0 {
+		t.Fatalf("no RTT measured while the application was not reading")
+	}
+
+	// 服务端持续下发，超过读协程的暂存上限后只能阻塞在写上；两端的应用都暂停读取
+	payload := bytes.Repeat([]byte("backpressure-"), 3*maxBuffered/13)
+	go server.Write(payload)
+	time.Sleep(600 * time.Millisecond) // 远超 Interval×MaxMissed
+
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("read after stall: %v", err)
+	}
+	if _, err := client.Write([]byte("still-alive")); err != nil {
+		t.Fatalf("write after stall: %v", err)
+	}
+	buf := make([]byte, 16)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "still-alive" {
+		t.Fatalf("server read = %q, %v", buf[:n], err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	client := New(a, nil)
+	server := New(b, nil)
+	defer client.Close()
+	defer server.Close()
+
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var ne net.Error
+	if _, err := client.Read(make([]byte, 8)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+	// 超时后连接仍可继续使用
+	client.SetReadDeadline(time.Time{})
+	go server.Write([]byte("late"))
+	buf := make([]byte, 8)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("read = %q, %v", buf[:n], err)
+	}
+}
@@ -24,10 +24,27 @@ type AEADConn struct {
 }
 
 func NewAEADConn(c net.Conn, key string, method string) (*AEADConn, error) {
-	if method == "none" {
+	aead, err := NewAEAD(key, method)
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil {
 		return &AEADConn{Conn: c, aead: nil}, nil
 	}
 
+	return &AEADConn{
+		Conn:      c,
+		aead:      aead,
+		nonceSize: aead.NonceSize(),
+	}, nil
+}
+
+// NewAEAD derives the cipher used by AEADConn from key. It returns nil for method "none".
+func NewAEAD(key string, method string) (cipher.AEAD, error) {
+	if method == "none" {
+		return nil, nil
+	}
+
 	h := sha256.New()
 	h.Write([]byte(key))
 	keyBytes := h.Sum(nil)
@@ -47,12 +64,7 @@ func NewAEADConn(c net.Conn, key string, method string) (*AEADConn, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	return &AEADConn{
-		Conn:      c,
-		aead:      aead,
-		nonceSize: aead.NonceSize(),
-	}, nil
+	return aead, nil
 }
 
 func (cc *AEADConn) Write(p []byte) (int, error) {
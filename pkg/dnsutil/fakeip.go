@@ -0,0 +1,116 @@
+package dnsutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// FakeIPPool hands out synthetic IPv4 addresses for domains and maps them back.
+//
+// Addresses are allocated sequentially from the configured range (skipping the
+// network and broadcast addresses). Once the range is exhausted allocation wraps
+// around and the oldest mapping is recycled.
+type FakeIPPool struct {
+	mu       sync.Mutex
+	network  *net.IPNet
+	base     uint32
+	size     uint32
+	next     uint32
+	byDomain map[string]uint32
+	byIP     map[uint32]string
+}
+
+// NewFakeIPPool creates a pool for an IPv4 CIDR such as "198.18.0.0/15".
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake-ip range %q: %w", cidr, err)
+	}
+	ip4 := ipNet.IP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("fake-ip range must be IPv4: %s", cidr)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("fake-ip range too small: %s", cidr)
+	}
+	total := uint64(1) << uint(bits-ones)
+	return &FakeIPPool{
+		network:  ipNet,
+		base:     binary.BigEndian.Uint32(ip4),
+		size:     uint32(total - 2),
+		byDomain: make(map[string]uint32),
+		byIP:     make(map[uint32]string),
+	}, nil
+}
+
+// Lookup returns the fake IP bound to domain, allocating one if needed.
+func (p *FakeIPPool) Lookup(domain string) net.IP {
+	domain = normalizeDomain(domain)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if v, ok := p.byDomain[domain]; ok {
+		return uint32ToIP(v)
+	}
+
+	v := p.base + 1 + p.next
+	p.next = (p.next + 1) % p.size
+	if old, ok := p.byIP[v]; ok {
+		delete(p.byDomain, old)
+	}
+	p.byIP[v] = domain
+	p.byDomain[domain] = v
+	return uint32ToIP(v)
+}
+
+// Domain returns the domain bound to a fake IP.
+func (p *FakeIPPool) Domain(ip net.IP) (string, bool) {
+	if p == nil || !p.Contains(ip) {
+		return "", false
+	}
+	v := binary.BigEndian.Uint32(ip.To4())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domain, ok := p.byIP[v]
+	return domain, ok
+}
+
+// IPFor returns the fake IP already bound to domain without allocating a new one.
+func (p *FakeIPPool) IPFor(domain string) (net.IP, bool) {
+	if p == nil {
+		return nil, false
+	}
+	domain = normalizeDomain(domain)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.byDomain[domain]
+	if !ok {
+		return nil, false
+	}
+	return uint32ToIP(v), true
+}
+
+// Contains reports whether ip belongs to the fake range.
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	return ip.To4() != nil && p.network.Contains(ip)
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
@@ -0,0 +1,46 @@
+package dnsutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFakeIPPool_RoundTrip(t *testing.T) {
+	pool, err := NewFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+
+	ip1 := pool.Lookup("Example.com.")
+	if !ip1.Equal(net.ParseIP("198.18.0.1")) {
+		t.Fatalf("unexpected first ip: %s", ip1)
+	}
+	if again := pool.Lookup("example.com"); !again.Equal(ip1) {
+		t.Fatalf("mapping not stable: %s vs %s", again, ip1)
+	}
+	if domain, ok := pool.Domain(ip1); !ok || domain != "example.com" {
+		t.Fatalf("reverse lookup failed: %q %v", domain, ok)
+	}
+
+	// A /30 has two usable addresses; the third domain recycles the first slot.
+	pool.Lookup("b.com")
+	ip3 := pool.Lookup("c.com")
+	if !ip3.Equal(ip1) {
+		t.Fatalf("expected wrap-around to %s, got %s", ip1, ip3)
+	}
+	if _, ok := pool.IPFor("example.com"); ok {
+		t.Fatalf("recycled domain should be forgotten")
+	}
+	if pool.Contains(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("foreign ip reported as fake")
+	}
+}
+
+func TestFakeIPPool_RejectsInvalidRange(t *testing.T) {
+	if _, err := NewFakeIPPool("fd00::/64"); err == nil {
+		t.Fatalf("expected error for IPv6 range")
+	}
+	if _, err := NewFakeIPPool("10.0.0.1/32"); err == nil {
+		t.Fatalf("expected error for tiny range")
+	}
+}
@@ -0,0 +1,297 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// connectionAttemptDelay is the RFC 8305 "Connection Attempt Delay".
+	connectionAttemptDelay = 250 * time.Millisecond
+	// resolutionDelay is the RFC 8305 "Resolution Delay": how long an A answer waits
+	// for the AAAA answer before connection attempts start.
+	resolutionDelay = 50 * time.Millisecond
+	// failedAddrTTL is how long a failing address is pushed to the back of the queue.
+	failedAddrTTL = time.Minute
+)
+
+// failureCache remembers addresses that recently failed to connect.
+type failureCache struct {
+	mu     sync.Mutex
+	failed map[string]time.Time
+	ttl    time.Duration
+}
+
+func newFailureCache(ttl time.Duration) *failureCache {
+	return &failureCache{failed: make(map[string]time.Time), ttl: ttl}
+}
+
+func (c *failureCache) markFailed(addr string) {
+	c.mu.Lock()
+	c.failed[addr] = time.Now().Add(c.ttl)
+	c.mu.Unlock()
+}
+
+func (c *failureCache) markOK(addr string) {
+	c.mu.Lock()
+	delete(c.failed, addr)
+	c.mu.Unlock()
+}
+
+func (c *failureCache) isFailed(addr string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.failed[addr]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(c.failed, addr)
+		return false
+	}
+	return true
+}
+
+// happyDialer races connection attempts to every address of a host (RFC 8305).
+type happyDialer struct {
+	lookup          func(ctx context.Context, network, host string) ([]net.IP, error)
+	dial            func(ctx context.Context, network, addr string) (net.Conn, error)
+	attemptDelay    time.Duration
+	resolutionDelay time.Duration
+	failures        *failureCache
+}
+
+var defaultHappyDialer = &happyDialer{
+	lookup: LookupNetwork,
+	dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	},
+	attemptDelay:    connectionAttemptDelay,
+	resolutionDelay: resolutionDelay,
+	failures:        newFailureCache(failedAddrTTL),
+}
+
+// DialContext connects to addr (host:port) using every resolved address.
+//
+// A and AAAA are queried in parallel and attempts start on the first usable answer
+// (an A answer waits up to 50 ms for AAAA), so a blackholed query does not stall the
+// dial. Addresses are interleaved IPv6/IPv4 (IPv6 first) and attempted with a 250 ms
+// stagger; the first established connection wins and the others are cancelled.
+// Addresses that failed recently are tried last.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return defaultHappyDialer.DialContext(ctx, network, addr)
+}
+
+// familyAnswer is the lookup result of one address family.
+type familyAnswer struct {
+	network string
+	ips     []net.IP
+	err     error
+}
+
+func (d *happyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		conn, err := d.dial(ctx, network, addr)
+		d.record(addr, err)
+		return conn, err
+	}
+
+	lookupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	answers := make(chan familyAnswer, 2)
+	for _, family := range []string{"ip6", "ip4"} {
+		family := family
+		go func() {
+			ips, err := d.lookup(lookupCtx, family, host)
+			answers <- familyAnswer{network: family, ips: ips, err: err}
+		}()
+	}
+	return d.race(ctx, network, host, port, answers)
+}
+
+// sortTargets interleaves address families starting with IPv6 and moves recently
+// failed addresses to the end while keeping the resolver's order otherwise.
+func (d *happyDialer) sortTargets(ips []net.IP, port string) []string {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else if ip.To16() != nil {
+			v6 = append(v6, ip)
+		}
+	}
+
+	targets := make([]string, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			targets = append(targets, net.JoinHostPort(v6[i].String(), port))
+		}
+		if i < len(v4) {
+			targets = append(targets, net.JoinHostPort(v4[i].String(), port))
+		}
+	}
+
+	now := time.Now()
+	sort.SliceStable(targets, func(i, j int) bool {
+		return !d.failures.isFailed(targets[i], now) && d.failures.isFailed(targets[j], now)
+	})
+	return targets
+}
+
+func (d *happyDialer) record(addr string, err error) {
+	if err == nil {
+		d.failures.markOK(addr)
+		return
+	}
+	if !errors.Is(err, context.Canceled) {
+		d.failures.markFailed(addr)
+	}
+}
+
+// race consumes the two family answers and runs the staggered connection attempts.
+func (d *happyDialer) race(ctx context.Context, network, host, port string, answers <-chan familyAnswer) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 16)
+	pending := 0
+	drain := func() {
+		// Close any late winners in the background.
+		go func(n int) {
+			for i := 0; i < n; i++ {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}(pending)
+	}
+
+	var (
+		known    []net.IP
+		queue    []string
+		tried    = make(map[string]bool)
+		waiting  = 2   // outstanding family answers
+		started  bool  // attempts may begin
+		firstErr error // first dial error
+		dnsErr   error // first lookup error
+	)
+	start := func() bool {
+		if !started || len(queue) == 0 {
+			return false
+		}
+		addr := queue[0]
+		queue = queue[1:]
+		tried[addr] = true
+		pending++
+		go func() {
+			conn, err := d.dial(raceCtx, network, addr)
+			if raceCtx.Err() == nil || err == nil {
+				d.record(addr, err)
+			}
+			results <- result{conn: conn, err: err}
+		}()
+		return true
+	}
+
+	attempt := time.NewTimer(d.attemptDelay)
+	attempt.Stop()
+	defer attempt.Stop()
+	attemptIdle := true // the stagger timer fired with nothing left to start
+	kick := func() {
+		if start() {
+			resetTimer(attempt, d.attemptDelay)
+			attemptIdle = false
+		}
+	}
+	var resolveC <-chan time.Time
+
+	for {
+		if started && pending == 0 && len(queue) == 0 && waiting == 0 {
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			if dnsErr != nil {
+				return nil, dnsErr
+			}
+			return nil, fmt.Errorf("no usable address for %s", host)
+		}
+
+		select {
+		case ans := <-answers:
+			waiting--
+			if ans.err != nil || len(ans.ips) == 0 {
+				if dnsErr == nil && ans.err != nil {
+					dnsErr = ans.err
+				}
+			} else {
+				known = append(known, ans.ips...)
+				queue = queue[:0]
+				for _, addr := range d.sortTargets(known, port) {
+					if !tried[addr] {
+						queue = append(queue, addr)
+					}
+				}
+			}
+			if !started {
+				switch {
+				case waiting == 0, ans.network == "ip6" && len(ans.ips) > 0:
+					started = true
+				case len(ans.ips) > 0:
+					resolveC = time.After(d.resolutionDelay)
+				}
+			}
+			if pending == 0 || attemptIdle {
+				kick()
+			}
+		case <-resolveC:
+			resolveC = nil
+			started = true
+			if pending == 0 || attemptIdle {
+				kick()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				cancel()
+				drain()
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			// A failed attempt starts the next one immediately.
+			kick()
+		case <-attempt.C:
+			attemptIdle = true
+			kick()
+		case <-ctx.Done():
+			drain()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,219 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDialScript describes how each address behaves for the fake dialer.
+type fakeDialScript struct {
+	mu        sync.Mutex
+	attempts  []string
+	blackhole map[string]bool // hang until cancelled
+	refuse    map[string]bool // fail immediately
+}
+
+func (s *fakeDialScript) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	s.mu.Lock()
+	s.attempts = append(s.attempts, addr)
+	s.mu.Unlock()
+
+	switch {
+	case s.blackhole[addr]:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case s.refuse[addr]:
+		return nil, errors.New("connection refused")
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (s *fakeDialScript) tried() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.attempts...)
+}
+
+func newTestHappyDialer(script *fakeDialScript, ips ...string) *happyDialer {
+	var parsed []net.IP
+	for _, ip := range ips {
+		parsed = append(parsed, net.ParseIP(ip))
+	}
+	return &happyDialer{
+		lookup: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return filterFamily(parsed, network), nil
+		},
+		dial:            script.dial,
+		attemptDelay:    50 * time.Millisecond,
+		resolutionDelay: 50 * time.Millisecond,
+		failures:        newFailureCache(time.Minute),
+	}
+}
+
+func TestHappyDialer_InterleavesFamilies(t *testing.T) {
+	d := newTestHappyDialer(&fakeDialScript{}, "10.0.0.1", "10.0.0.2", "fd00::1", "fd00::2")
+	got := d.sortTargets([]net.IP{
+		net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"),
+		net.ParseIP("fd00::1"), net.ParseIP("fd00::2"),
+	}, "443")
+	want := []string{"[fd00::1]:443", "10.0.0.1:443", "[fd00::2]:443", "10.0.0.2:443"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHappyDialer_FallsBackFromBlackholedIPv6(t *testing.T) {
+	script := &fakeDialScript{blackhole: map[string]bool{"[fd00::1]:443": true}}
+	d := newTestHappyDialer(script, "fd00::1", "10.0.0.1")
+
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("fallback took too long: %v", elapsed)
+	}
+
+	// The blackholed address was cancelled, not failed, so it must not be remembered.
+	if d.failures.isFailed("[fd00::1]:443", time.Now()) {
+		t.Fatalf("cancelled attempt should not be marked as failed")
+	}
+}
+
+func TestHappyDialer_BlackholedAAAALookupDoesNotStall(t *testing.T) {
+	script := &fakeDialScript{}
+	d := newTestHappyDialer(script)
+	d.lookup = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if network == "ip6" {
+			<-ctx.Done() // AAAA 查询被黑洞
+			return nil, ctx.Err()
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("dial waited for the AAAA answer: %v", elapsed)
+	}
+}
+
+func TestHappyDialer_ResolutionDelayPrefersLateAAAA(t *testing.T) {
+	script := &fakeDialScript{}
+	d := newTestHappyDialer(script)
+	d.lookup = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if network == "ip6" {
+			time.Sleep(10 * time.Millisecond)
+			return []net.IP{net.ParseIP("fd00::1")}, nil
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+	if tried := script.tried(); len(tried) != 1 || tried[0] != "[fd00::1]:443" {
+		t.Fatalf("expected the AAAA answer within the resolution delay to go first, tried %v", tried)
+	}
+}
+
+func TestHappyDialer_LateFamilyJoinsRace(t *testing.T) {
+	script := &fakeDialScript{blackhole: map[string]bool{"10.0.0.1:443": true}}
+	d := newTestHappyDialer(script)
+	d.lookup = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if network == "ip6" {
+			time.Sleep(200 * time.Millisecond) // 晚于解析延迟与首个尝试间隔
+			return []net.IP{net.ParseIP("fd00::1")}, nil
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestHappyDialer_RefusedStartsNextImmediately(t *testing.T) {
+	script := &fakeDialScript{refuse: map[string]bool{"[fd00::1]:443": true}}
+	d := newTestHappyDialer(script, "fd00::1", "10.0.0.1")
+	d.attemptDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+
+	if !d.failures.isFailed("[fd00::1]:443", time.Now()) {
+		t.Fatalf("refused address should be remembered")
+	}
+
+	// The remembered failure is tried last on the next dial.
+	script.attempts = nil
+	conn, err = d.DialContext(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("second dial failed: %v", err)
+	}
+	conn.Close()
+	if tried := script.tried(); len(tried) != 1 || tried[0] != "10.0.0.1:443" {
+		t.Fatalf("expected healthy address first, tried %v", tried)
+	}
+}
+
+func TestHappyDialer_AllFail(t *testing.T) {
+	script := &fakeDialScript{refuse: map[string]bool{"[fd00::1]:443": true, "10.0.0.1:443": true}}
+	d := newTestHappyDialer(script, "fd00::1", "10.0.0.1")
+
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:443"); err == nil {
+		t.Fatalf("expected error when every address fails")
+	}
+	if len(script.tried()) != 2 {
+		t.Fatalf("expected both addresses to be tried, got %v", script.tried())
+	}
+}
+
+func TestDialContext_Loopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+}
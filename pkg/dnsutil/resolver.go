@@ -3,6 +3,7 @@ package dnsutil
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -13,34 +14,102 @@ import (
 type lookupIPFunc func(ctx context.Context, network, host string) ([]net.IP, error)
 
 type cacheEntry struct {
-	ip        net.IP
+	ips       []net.IP
+	err       error // non-nil for negative entries
 	expiresAt time.Time
 }
 
 type resolver struct {
-	mu       sync.RWMutex
-	cache    map[string]cacheEntry
-	ttl      time.Duration
-	lookupFn lookupIPFunc
+	mu    sync.RWMutex
+	cache map[string]cacheEntry
+
+	upstreams []Upstream
+
+	ttl         time.Duration // used when the upstream reports no TTL (system resolver)
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
 }
 
+// Options configures the package-level resolver.
+type Options struct {
+	// Upstreams are tried in order until one answers; see NewUpstream for the syntax.
+	// Empty means the system resolver.
+	Upstreams []string
+	// MinTTL / MaxTTL clamp record TTLs. Zero disables the respective bound.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long failed lookups are remembered. Zero uses the default.
+	NegativeTTL time.Duration
+}
+
+const (
+	defaultTTL         = 10 * time.Minute
+	defaultMinTTL      = 30 * time.Second
+	defaultMaxTTL      = time.Hour
+	defaultNegativeTTL = 30 * time.Second
+)
+
 func newResolver(ttl time.Duration, fn lookupIPFunc) *resolver {
 	if ttl <= 0 {
-		ttl = 10 * time.Minute
+		ttl = defaultTTL
 	}
-	if fn == nil {
-		fn = func(ctx context.Context, network, host string) ([]net.IP, error) {
-			return net.DefaultResolver.LookupIP(ctx, network, host)
-		}
+	var up Upstream = systemUpstream{}
+	if fn != nil {
+		up = funcUpstream(fn)
 	}
 	return &resolver{
-		cache:    make(map[string]cacheEntry),
-		ttl:      ttl,
-		lookupFn: fn,
+		cache:       make(map[string]cacheEntry),
+		upstreams:   []Upstream{up},
+		ttl:         ttl,
+		negativeTTL: defaultNegativeTTL,
 	}
 }
 
-var defaultResolver = newResolver(10*time.Minute, nil)
+var (
+	defaultResolverMu sync.RWMutex
+	defaultResolver   = newResolver(defaultTTL, nil)
+)
+
+func currentResolver() *resolver {
+	defaultResolverMu.RLock()
+	defer defaultResolverMu.RUnlock()
+	return defaultResolver
+}
+
+// Configure replaces the package-level resolver used by ResolveWithCache and LookupIP.
+func Configure(opts Options) error {
+	r := newResolver(defaultTTL, nil)
+	if len(opts.Upstreams) > 0 {
+		r.upstreams = r.upstreams[:0]
+		for _, spec := range opts.Upstreams {
+			up, err := NewUpstream(spec)
+			if err != nil {
+				return err
+			}
+			r.upstreams = append(r.upstreams, up)
+		}
+	}
+	r.minTTL = defaultMinTTL
+	if opts.MinTTL > 0 {
+		r.minTTL = opts.MinTTL
+	}
+	r.maxTTL = defaultMaxTTL
+	if opts.MaxTTL > 0 {
+		r.maxTTL = opts.MaxTTL
+	}
+	if r.maxTTL < r.minTTL {
+		return fmt.Errorf("max ttl (%s) is smaller than min ttl (%s)", r.maxTTL, r.minTTL)
+	}
+	if opts.NegativeTTL > 0 {
+		r.negativeTTL = opts.NegativeTTL
+	}
+
+	defaultResolverMu.Lock()
+	defaultResolver = r
+	defaultResolverMu.Unlock()
+	return nil
+}
 
 // ResolveWithCache resolves addr (host:port) into ip:port using
 // concurrent DNS lookups (IPv4/IPv6) and optimistic caching.
@@ -49,9 +118,21 @@ var defaultResolver = newResolver(10*time.Minute, nil)
 //   - If host is already an IP, returns addr directly.
 //   - If a fresh cache entry exists, returns it without DNS queries.
 //   - If cache is stale and DNS fails, falls back to stale IP (optimistic cache).
+//   - Failures without a stale entry are cached for a short negative TTL.
 //   - DNS lookups for IPv4/IPv6 are performed concurrently.
 func ResolveWithCache(ctx context.Context, addr string) (string, error) {
-	return defaultResolver.Resolve(ctx, addr)
+	return currentResolver().Resolve(ctx, addr)
+}
+
+// LookupIP returns every cached or freshly resolved A/AAAA address of host.
+func LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return currentResolver().LookupIP(ctx, host)
+}
+
+// LookupNetwork resolves only the "ip4" or "ip6" addresses of host, so callers can act
+// on whichever family answers first.
+func LookupNetwork(ctx context.Context, network, host string) ([]net.IP, error) {
+	return currentResolver().LookupNetwork(ctx, network, host)
 }
 
 // Resolve performs the actual resolution logic on a resolver instance.
@@ -65,122 +146,212 @@ func (r *resolver) Resolve(ctx context.Context, addr string) (string, error) {
 		return "", fmt.Errorf("invalid address %q: %w", addr, err)
 	}
 
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// LookupIP resolves host into all of its addresses, honouring the cache.
+func (r *resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
 	// If already an IP literal, no DNS is needed.
 	if ip := net.ParseIP(host); ip != nil {
-		return addr, nil
+		return []net.IP{ip}, nil
 	}
 
 	now := time.Now()
-	cachedIP, expired := r.lookup(host, now)
+	entry, ok := r.lookup(host)
 
-	// Fresh cache hit.
-	if cachedIP != nil && !expired {
-		return net.JoinHostPort(cachedIP.String(), port), nil
+	// Fresh cache hit (positive or negative).
+	if ok && now.Before(entry.expiresAt) {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return entry.ips, nil
 	}
 
 	// Need DNS resolution (cache miss or expired).
-	ips, err := r.lookupConcurrently(ctx, host)
+	ips, ttl, err := r.lookupConcurrently(ctx, host)
 	if err != nil {
-		// Optimistic caching: fall back to stale IP if present.
-		if cachedIP != nil {
-			return net.JoinHostPort(cachedIP.String(), port), nil
+		// Optimistic caching: fall back to stale IPs if present.
+		if ok && entry.err == nil && len(entry.ips) > 0 {
+			return entry.ips, nil
 		}
-		return "", fmt.Errorf("dns lookup failed for %s: %w", host, err)
+		err = fmt.Errorf("dns lookup failed for %s: %w", host, err)
+		if ctx.Err() == nil {
+			r.store(host, cacheEntry{err: err, expiresAt: now.Add(r.negativeTTL)})
+		}
+		return nil, err
 	}
 
-	// Choose the first IP and update cache.
-	selected := firstNonNilIP(ips)
-	if selected == nil {
-		if cachedIP != nil {
-			// Should be rare, but still honor optimistic cache.
-			return net.JoinHostPort(cachedIP.String(), port), nil
+	r.store(host, cacheEntry{ips: ips, expiresAt: now.Add(r.clampTTL(ttl))})
+	return ips, nil
+}
+
+// LookupNetwork resolves a single address family. A fresh dual-stack entry is reused;
+// otherwise the family is cached on its own key with the same TTL rules as LookupIP.
+func (r *resolver) LookupNetwork(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if (ip.To4() != nil) != (network == "ip4") {
+			return nil, errNoRecords
 		}
-		return "", fmt.Errorf("no usable ip found for host %s", host)
+		return []net.IP{ip}, nil
 	}
 
-	r.store(host, selected, now)
-	return net.JoinHostPort(selected.String(), port), nil
+	now := time.Now()
+	if entry, ok := r.lookup(host); ok && entry.err == nil && now.Before(entry.expiresAt) {
+		if ips := filterFamily(entry.ips, network); len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	key := network + "/" + host
+	entry, ok := r.lookup(key)
+	if ok && now.Before(entry.expiresAt) {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return entry.ips, nil
+	}
+
+	ips, ttl, err := r.lookupNetwork(ctx, network, host)
+	if err != nil {
+		if ok && entry.err == nil && len(entry.ips) > 0 {
+			return entry.ips, nil
+		}
+		err = fmt.Errorf("dns lookup failed for %s: %w", host, err)
+		if ctx.Err() == nil {
+			r.store(key, cacheEntry{err: err, expiresAt: now.Add(r.negativeTTL)})
+		}
+		return nil, err
+	}
+	r.store(key, cacheEntry{ips: ips, expiresAt: now.Add(r.clampTTL(ttl))})
+	return ips, nil
+}
+
+func filterFamily(ips []net.IP, network string) []net.IP {
+	var out []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (network == "ip4") {
+			out = append(out, ip)
+		}
+	}
+	return out
 }
 
-func (r *resolver) lookup(host string, now time.Time) (net.IP, bool) {
+func (r *resolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = r.ttl
+	}
+	if r.minTTL > 0 && ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	return ttl
+}
+
+func (r *resolver) lookup(host string) (cacheEntry, bool) {
 	r.mu.RLock()
 	entry, ok := r.cache[host]
 	r.mu.RUnlock()
-	if !ok {
-		return nil, false
-	}
-	if now.After(entry.expiresAt) {
-		return entry.ip, true
-	}
-	return entry.ip, false
+	return entry, ok
 }
 
-func (r *resolver) store(host string, ip net.IP, now time.Time) {
-	if ip == nil {
-		return
-	}
+func (r *resolver) store(host string, entry cacheEntry) {
 	r.mu.Lock()
-	r.cache[host] = cacheEntry{
-		ip:        append(net.IP(nil), ip...), // defensive copy
-		expiresAt: now.Add(r.ttl),
-	}
+	r.cache[host] = entry
 	r.mu.Unlock()
 }
 
-func (r *resolver) lookupConcurrently(ctx context.Context, host string) ([]net.IP, error) {
+func (r *resolver) lookupConcurrently(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
 	type result struct {
-		ips []net.IP
-		err error
+		network string
+		ips     []net.IP
+		ttl     time.Duration
+		err     error
 	}
 
 	networks := []string{"ip4", "ip6"}
 	ch := make(chan result, len(networks))
 
-	var wg sync.WaitGroup
 	for _, network := range networks {
 		network := network
-		wg.Add(1)
 		go func() {
-			defer wg.Done()
-			ips, err := r.lookupFn(ctx, network, host)
-			select {
-			case ch <- result{ips: ips, err: err}:
-			case <-ctx.Done():
-			}
+			ips, ttl, err := r.lookupNetwork(ctx, network, host)
+			ch <- result{network: network, ips: ips, ttl: ttl, err: err}
 		}()
 	}
 
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-
-	var allIPs []net.IP
+	var v4, v6 []net.IP
+	var minTTL time.Duration
 	var firstErr error
 
-	for res := range ch {
-		if res.err == nil && len(res.ips) > 0 {
-			allIPs = append(allIPs, res.ips...)
-		} else if res.err != nil && firstErr == nil {
-			firstErr = res.err
+	for range networks {
+		var res result
+		select {
+		case res = <-ch:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		if res.err != nil || len(res.ips) == 0 {
+			if res.err != nil && firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if res.network == "ip4" {
+			v4 = res.ips
+		} else {
+			v6 = res.ips
+		}
+		if res.ttl > 0 && (minTTL == 0 || res.ttl < minTTL) {
+			minTTL = res.ttl
+		}
+	}
+
+	// Keep a stable IPv4-first order so callers that only use the first
+	// address behave as before.
+	allIPs := make([]net.IP, 0, len(v4)+len(v6))
+	for _, family := range [][]net.IP{v4, v6} {
+		for _, ip := range family {
+			if ip != nil {
+				allIPs = append(allIPs, append(net.IP(nil), ip...)) // defensive copy
+			}
 		}
 	}
 
 	if len(allIPs) == 0 {
 		if firstErr == nil {
-			firstErr = fmt.Errorf("no ip records found")
+			firstErr = errNoRecords
 		}
-		return nil, firstErr
+		return nil, 0, firstErr
 	}
 
-	return allIPs, nil
+	return allIPs, minTTL, nil
 }
 
-func firstNonNilIP(ips []net.IP) net.IP {
-	for _, ip := range ips {
-		if ip != nil {
-			return ip
+func (r *resolver) lookupNetwork(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	var firstErr error
+	for _, up := range r.upstreams {
+		ips, ttl, err := up.LookupIP(ctx, network, host)
+		if err == nil && len(ips) > 0 {
+			return ips, ttl, nil
+		}
+		if err == nil {
+			err = errNoRecords
+		}
+		// An empty answer is authoritative enough; do not hammer the next upstream for it.
+		if errors.Is(err, errNoRecords) {
+			return nil, 0, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
 		}
 	}
-	return nil
+	return nil, 0, firstErr
 }
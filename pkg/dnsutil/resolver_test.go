@@ -112,3 +112,40 @@ func TestResolve_InvalidAddress(t *testing.T) {
 		t.Fatalf("expected error for invalid address")
 	}
 }
+
+func TestLookupNetwork_CachesPerFamily(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	r := newResolver(time.Minute, func(ctx context.Context, network, host string) ([]net.IP, error) {
+		mu.Lock()
+		calls[network]++
+		mu.Unlock()
+		if network == "ip6" {
+			return []net.IP{net.ParseIP("fd00::1")}, nil
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupNetwork(ctx, "ip4", "example.com")
+		if err != nil || len(ips) != 1 || ips[0].To4() == nil {
+			t.Fatalf("ip4 lookup: %v %v", ips, err)
+		}
+	}
+	if calls["ip4"] != 1 || calls["ip6"] != 0 {
+		t.Fatalf("expected a single A query, got %v", calls)
+	}
+
+	// A fresh dual-stack entry answers either family without new queries.
+	if _, err := r.LookupIP(ctx, "dual.example"); err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	ips, err := r.LookupNetwork(ctx, "ip6", "dual.example")
+	if err != nil || len(ips) != 1 || ips[0].To4() != nil {
+		t.Fatalf("ip6 from dual-stack entry: %v %v", ips, err)
+	}
+	if calls["ip6"] != 1 {
+		t.Fatalf("dual-stack entry not reused: %v", calls)
+	}
+}
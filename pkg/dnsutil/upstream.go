@@ -0,0 +1,303 @@
+package dnsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxMessageSize = 65535
+
+// Upstream answers address lookups for the resolver.
+type Upstream interface {
+	// LookupIP returns the addresses of host for network ("ip4" or "ip6") together with
+	// the smallest record TTL in the answer. A zero TTL means the upstream did not report one.
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
+}
+
+// ExchangeFunc sends a DNS query in wire format and returns the raw response.
+type ExchangeFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+// NewUpstream parses an upstream spec:
+//
+//	"system"                          net.DefaultResolver
+//	"8.8.8.8", "udp://8.8.8.8:53"     plain DNS over UDP (retried over TCP when truncated)
+//	"tcp://8.8.8.8:53"                plain DNS over TCP
+//	"tls://1.1.1.1", "tls://dns.google:853"      DNS over TLS (RFC 7858)
+//	"https://dns.google/dns-query"    DNS over HTTPS (RFC 8484)
+//
+// Host names inside DoT/DoH specs are bootstrapped with the system resolver.
+func NewUpstream(spec string) (Upstream, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "system" {
+		return systemUpstream{}, nil
+	}
+
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns upstream %q: %w", spec, err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		addr := withDefaultPort(u.Host, "53")
+		return NewExchangeUpstream(func(ctx context.Context, q []byte) ([]byte, error) {
+			resp, err := exchangeUDP(ctx, addr, q)
+			if err == nil && isTruncated(resp) {
+				return exchangeStream(ctx, "tcp", addr, nil, q)
+			}
+			return resp, err
+		}), nil
+	case "tcp":
+		addr := withDefaultPort(u.Host, "53")
+		return NewExchangeUpstream(func(ctx context.Context, q []byte) ([]byte, error) {
+			return exchangeStream(ctx, "tcp", addr, nil, q)
+		}), nil
+	case "tls":
+		addr := withDefaultPort(u.Host, "853")
+		tlsCfg := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		return NewExchangeUpstream(func(ctx context.Context, q []byte) ([]byte, error) {
+			return exchangeStream(ctx, "tcp", addr, tlsCfg, q)
+		}), nil
+	case "https":
+		client := &http.Client{Timeout: 10 * time.Second}
+		endpoint := u.String()
+		return NewExchangeUpstream(func(ctx context.Context, q []byte) ([]byte, error) {
+			return exchangeHTTPS(ctx, client, endpoint, q)
+		}), nil
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream scheme: %s", u.Scheme)
+	}
+}
+
+type systemUpstream struct{}
+
+func (systemUpstream) LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	return ips, 0, err
+}
+
+// funcUpstream adapts a plain lookup function (no TTL information).
+type funcUpstream lookupIPFunc
+
+func (f funcUpstream) LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	ips, err := f(ctx, network, host)
+	return ips, 0, err
+}
+
+type exchangeUpstream struct {
+	exchange ExchangeFunc
+}
+
+// NewExchangeUpstream builds an Upstream on top of any wire-format transport,
+// e.g. a DNS server reached through the tunnel.
+func NewExchangeUpstream(fn ExchangeFunc) Upstream {
+	return &exchangeUpstream{exchange: fn}
+}
+
+func (u *exchangeUpstream) LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	qtype := dnsmessage.TypeA
+	if network == "ip6" {
+		qtype = dnsmessage.TypeAAAA
+	}
+	query, id, err := buildQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := u.exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ParseAnswer(resp, id, qtype)
+}
+
+func buildQuery(host string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid dns name %q: %w", host, err)
+	}
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	return msg, id, err
+}
+
+// errNoRecords marks a successful response that carried no usable address.
+var errNoRecords = errors.New("no ip records found")
+
+// ParseAnswer extracts the qtype address records of a response to query id,
+// together with the smallest record TTL.
+func ParseAnswer(resp []byte, id uint16, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse dns response: %w", err)
+	}
+	if header.ID != id {
+		return nil, 0, fmt.Errorf("dns response id mismatch")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("dns response code: %s", header.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		ips    []net.IP
+		minTTL uint32
+	)
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if h.Type != qtype {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(append([]byte(nil), r.A[:]...)))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(append([]byte(nil), r.AAAA[:]...)))
+		}
+		if minTTL == 0 || h.TTL < minTTL {
+			minTTL = h.TTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, errNoRecords
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+func isTruncated(resp []byte) bool {
+	return len(resp) > 2 && resp[2]&0x02 != 0
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func exchangeStream(ctx context.Context, network, addr string, tlsCfg *tls.Config, query []byte) ([]byte, error) {
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	if tlsCfg != nil {
+		td := tls.Dialer{NetDialer: &d, Config: tlsCfg}
+		conn, err = td.DialContext(ctx, network, addr)
+	} else {
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	out := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(out, uint16(len(query)))
+	copy(out[2:], query)
+	if _, err := conn.Write(out); err != nil {
+		return nil, err
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func exchangeHTTPS(ctx context.Context, client *http.Client, endpoint string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
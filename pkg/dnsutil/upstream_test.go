@@ -0,0 +1,186 @@
+package dnsutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answerQuery builds a response with a single A or AAAA record for the query.
+func answerQuery(t *testing.T, query []byte, ttl uint32) []byte {
+	t.Helper()
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Fatalf("parse query: %v", err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Fatalf("parse question: %v", err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+	if q.Type == dnsmessage.TypeA {
+		b.AResource(rh, dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+		b.AResource(rh, dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}})
+	} else {
+		b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 15: 1}})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("build answer: %v", err)
+	}
+	return msg
+}
+
+func TestUpstream_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(answerQuery(t, buf[:n], 120), addr)
+		}
+	}()
+
+	up, err := NewUpstream(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("new upstream: %v", err)
+	}
+	ips, ttl, err := up.LookupIP(context.Background(), "ip4", "example.com")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if len(ips) != 2 || ttl != 120*time.Second {
+		t.Fatalf("unexpected answer: %v ttl=%s", ips, ttl)
+	}
+}
+
+func TestUpstream_DoH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad content type", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerQuery(t, query, 30))
+	}))
+	defer srv.Close()
+
+	up := NewExchangeUpstream(func(ctx context.Context, q []byte) ([]byte, error) {
+		return exchangeHTTPS(ctx, srv.Client(), srv.URL+"/dns-query", q)
+	})
+	ips, ttl, err := up.LookupIP(context.Background(), "ip6", "example.com")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if len(ips) != 1 || ips[0].To4() != nil || ttl != 30*time.Second {
+		t.Fatalf("unexpected answer: %v ttl=%s", ips, ttl)
+	}
+}
+
+func TestParseAnswer(t *testing.T) {
+	query, id, err := buildQuery("example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatalf("build query: %v", err)
+	}
+	resp := answerQuery(t, query, 60)
+
+	ips, ttl, err := ParseAnswer(resp, id, dnsmessage.TypeA)
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) || ttl != time.Minute {
+		t.Fatalf("unexpected answer: %v ttl=%s err=%v", ips, ttl, err)
+	}
+	if _, _, err := ParseAnswer(resp, id+1, dnsmessage.TypeA); err == nil {
+		t.Fatalf("expected id mismatch error")
+	}
+	// 只取所问类型的记录，A 应答按 AAAA 解析时视为无记录
+	if _, _, err := ParseAnswer(resp, id, dnsmessage.TypeAAAA); !errors.Is(err, errNoRecords) {
+		t.Fatalf("expected errNoRecords, got %v", err)
+	}
+	if _, _, err := ParseAnswer(resp[:5], id, dnsmessage.TypeA); err == nil {
+		t.Fatalf("expected error for truncated message")
+	}
+}
+
+func TestNewUpstream_Schemes(t *testing.T) {
+	for _, spec := range []string{"system", "8.8.8.8", "udp://[2001:4860:4860::8888]:53", "tcp://8.8.8.8", "tls://1.1.1.1", "https://dns.google/dns-query"} {
+		if _, err := NewUpstream(spec); err != nil {
+			t.Errorf("NewUpstream(%q): %v", spec, err)
+		}
+	}
+	if _, err := NewUpstream("quic://dns.adguard.com"); err == nil {
+		t.Errorf("expected error for unsupported scheme")
+	}
+}
+
+type stubUpstream struct {
+	calls int32
+	ttl   time.Duration
+	err   error
+}
+
+func (s *stubUpstream) LookupIP(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	if network == "ip4" {
+		return []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("1.0.0.1")}, s.ttl, nil
+	}
+	return []net.IP{net.ParseIP("2606:4700::1111")}, s.ttl, nil
+}
+
+func TestResolver_KeepsAllAddressesAndClampsTTL(t *testing.T) {
+	up := &stubUpstream{ttl: 5 * time.Second}
+	r := newResolver(time.Minute, nil)
+	r.upstreams = []Upstream{up}
+	r.minTTL = time.Minute
+	r.maxTTL = time.Hour
+
+	ips, err := r.LookupIP(context.Background(), "one.one.one.one")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if len(ips) != 3 || ips[0].To4() == nil || ips[2].To4() != nil {
+		t.Fatalf("expected v4 then v6 addresses, got %v", ips)
+	}
+
+	entry, _ := r.lookup("one.one.one.one")
+	if remaining := time.Until(entry.expiresAt); remaining < 50*time.Second {
+		t.Fatalf("ttl not clamped to minimum: %s", remaining)
+	}
+}
+
+func TestResolver_NegativeCache(t *testing.T) {
+	up := &stubUpstream{err: errors.New("servfail")}
+	r := newResolver(time.Minute, nil)
+	r.upstreams = []Upstream{up}
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.Resolve(context.Background(), "broken.example:443"); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	if calls := atomic.LoadInt32(&up.calls); calls != 2 {
+		t.Fatalf("expected one lookup per family before negative cache, got %d", calls)
+	}
+}
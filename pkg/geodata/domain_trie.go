@@ -0,0 +1,178 @@
+package geodata
+
+import "strings"
+
+// DomainRuleType identifies how a domain rule matches a host.
+type DomainRuleType uint8
+
+const (
+	DomainExact   DomainRuleType = iota + 1 // DOMAIN
+	DomainSuffix                            // DOMAIN-SUFFIX
+	DomainKeyword                           // DOMAIN-KEYWORD
+)
+
+func (t DomainRuleType) String() string {
+	switch t {
+	case DomainExact:
+		return "DOMAIN"
+	case DomainSuffix:
+		return "DOMAIN-SUFFIX"
+	case DomainKeyword:
+		return "DOMAIN-KEYWORD"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// DomainRule describes the rule that matched a lookup.
+type DomainRule struct {
+	Type  DomainRuleType
+	Value string
+}
+
+func (r DomainRule) String() string {
+	return r.Type.String() + "," + r.Value
+}
+
+// domainNode is one label in the reversed-label trie: "www.baidu.com" is
+// stored as com -> baidu -> www.
+type domainNode struct {
+	children map[string]*domainNode
+	exact    bool
+	suffix   bool
+}
+
+// DomainTrie matches hosts against DOMAIN / DOMAIN-SUFFIX / DOMAIN-KEYWORD rules.
+//
+// Lookups walk the host label by label from the right and index child maps with
+// substrings of the input, so a lower-case host without a trailing dot is matched
+// without any allocation. A DomainTrie is not safe for concurrent mutation; build it
+// once and publish it (Manager swaps whole tries under its lock).
+type DomainTrie struct {
+	root     domainNode
+	keywords []string
+
+	exactCount  int
+	suffixCount int
+}
+
+// NewDomainTrie returns an empty trie.
+func NewDomainTrie() *DomainTrie {
+	return &DomainTrie{}
+}
+
+// Insert adds a rule. Values are normalised to lower case; a leading "." or "+."
+// on suffix rules and a trailing "." on any domain are ignored.
+func (t *DomainTrie) Insert(typ DomainRuleType, value string) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return
+	}
+
+	if typ == DomainKeyword {
+		for _, kw := range t.keywords {
+			if kw == value {
+				return
+			}
+		}
+		t.keywords = append(t.keywords, value)
+		return
+	}
+
+	value = strings.TrimSuffix(value, ".")
+	if typ == DomainSuffix {
+		value = strings.TrimPrefix(value, "+")
+		value = strings.TrimPrefix(value, ".")
+	}
+	if value == "" {
+		return
+	}
+
+	node := &t.root
+	end := len(value)
+	for end > 0 {
+		start := strings.LastIndexByte(value[:end], '.') + 1
+		label := value[start:end]
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*domainNode)
+			}
+			child = &domainNode{}
+			node.children[label] = child
+		}
+		node = child
+		end = start - 1
+	}
+
+	switch typ {
+	case DomainExact:
+		if !node.exact {
+			node.exact = true
+			t.exactCount++
+		}
+	case DomainSuffix:
+		if !node.suffix {
+			node.suffix = true
+			t.suffixCount++
+		}
+	}
+}
+
+// Match reports the rule that matches host, if any.
+// Precedence: exact match, then the most specific suffix, then the first keyword.
+func (t *DomainTrie) Match(host string) (DomainRule, bool) {
+	if t == nil || host == "" {
+		return DomainRule{}, false
+	}
+	host = strings.TrimSuffix(host, ".")
+	if hasUpper(host) {
+		host = strings.ToLower(host)
+	}
+
+	var suffixStart = -1
+	node := &t.root
+	end := len(host)
+	for end > 0 {
+		start := strings.LastIndexByte(host[:end], '.') + 1
+		child, ok := node.children[host[start:end]]
+		if !ok {
+			break
+		}
+		node = child
+		if start == 0 && node.exact {
+			return DomainRule{Type: DomainExact, Value: host}, true
+		}
+		if node.suffix {
+			suffixStart = start
+		}
+		end = start - 1
+	}
+	if suffixStart >= 0 {
+		return DomainRule{Type: DomainSuffix, Value: host[suffixStart:]}, true
+	}
+
+	for _, kw := range t.keywords {
+		if strings.Contains(host, kw) {
+			return DomainRule{Type: DomainKeyword, Value: kw}, true
+		}
+	}
+	return DomainRule{}, false
+}
+
+// Counts returns the number of exact, suffix and keyword rules.
+func (t *DomainTrie) Counts() (exact, suffix, keyword int) {
+	if t == nil {
+		return 0, 0, 0
+	}
+	return t.exactCount, t.suffixCount, len(t.keywords)
+}
+
+func hasUpper(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 'A' && c <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package geodata
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDomainTrie_Match(t *testing.T) {
+	trie := NewDomainTrie()
+	trie.Insert(DomainExact, "example.com")
+	trie.Insert(DomainSuffix, "baidu.com")
+	trie.Insert(DomainSuffix, ".qq.com")
+	trie.Insert(DomainSuffix, "map.baidu.com")
+	trie.Insert(DomainKeyword, "taobao")
+
+	tests := []struct {
+		host string
+		want DomainRule
+		ok   bool
+	}{
+		{"example.com", DomainRule{DomainExact, "example.com"}, true},
+		{"Example.COM.", DomainRule{DomainExact, "example.com"}, true},
+		{"www.example.com", DomainRule{}, false},
+		{"baidu.com", DomainRule{DomainSuffix, "baidu.com"}, true},
+		{"www.baidu.com", DomainRule{DomainSuffix, "baidu.com"}, true},
+		{"a.map.baidu.com", DomainRule{DomainSuffix, "map.baidu.com"}, true},
+		{"notbaidu.com", DomainRule{}, false},
+		{"im.qq.com", DomainRule{DomainSuffix, "qq.com"}, true},
+		{"world.taobao.net", DomainRule{DomainKeyword, "taobao"}, true},
+		{"google.com", DomainRule{}, false},
+		{"", DomainRule{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := trie.Match(tt.host)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("Match(%q) = %v, %v; want %v, %v", tt.host, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	exact, suffix, keyword := trie.Counts()
+	if exact != 1 || suffix != 3 || keyword != 1 {
+		t.Fatalf("unexpected counts: %d %d %d", exact, suffix, keyword)
+	}
+}
+
+func TestDomainTrie_MatchDoesNotAllocate(t *testing.T) {
+	trie := NewDomainTrie()
+	trie.Insert(DomainSuffix, "baidu.com")
+	trie.Insert(DomainKeyword, "taobao")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		trie.Match("www.map.baidu.com")
+		trie.Match("img.taobao.net")
+		trie.Match("www.google.com")
+	})
+	if allocs != 0 {
+		t.Fatalf("expected zero allocations, got %v", allocs)
+	}
+}
+
+func TestManager_MatchHostPort(t *testing.T) {
+	m := &Manager{domains: NewDomainTrie()}
+	m.parseRule("DOMAIN-SUFFIX,baidu.com", &m.ipRanges, m.domains)
+	m.parseRule("IP-CIDR,1.2.3.0/24,no-resolve", &m.ipRanges, m.domains)
+
+	rule, ok := m.Match("www.baidu.com:443", nil)
+	if !ok || rule.Type != DomainSuffix || rule.Value != "baidu.com" {
+		t.Fatalf("domain with port not matched: %v %v", rule, ok)
+	}
+	if !m.IsCN("1.2.3.4:80", net.ParseIP("1.2.3.4")) {
+		t.Fatalf("ip rule not matched")
+	}
+	if m.IsCN("www.google.com:443", net.ParseIP("8.8.8.8")) {
+		t.Fatalf("unexpected match")
+	}
+}
+
+// legacySuffixMatch mirrors the map based matcher the trie replaced.
+func legacySuffixMatch(exact, suffix map[string]struct{}, domain string) bool {
+	if _, ok := exact[domain]; ok {
+		return true
+	}
+	parts := strings.Split(domain, ".")
+	for i := 0; i < len(parts); i++ {
+		if _, ok := suffix[strings.Join(parts[i:], ".")]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+const benchRuleCount = 100000
+
+func benchDomains() []string {
+	out := make([]string, 0, benchRuleCount)
+	for i := 0; i < benchRuleCount; i++ {
+		out = append(out, fmt.Sprintf("site%d.example%d.cn", i, i%97))
+	}
+	return out
+}
+
+var benchHosts = []string{
+	"img.cdn.site4242.example69.cn",
+	"www.google.com",
+	"a.b.c.d.e.site99999.example89.cn",
+	"static.github.io",
+}
+
+func BenchmarkDomainMatch_Map(b *testing.B) {
+	exact := make(map[string]struct{})
+	suffix := make(map[string]struct{})
+	for _, d := range benchDomains() {
+		suffix[d] = struct{}{}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		legacySuffixMatch(exact, suffix, benchHosts[i%len(benchHosts)])
+	}
+}
+
+func BenchmarkDomainMatch_Trie(b *testing.B) {
+	trie := NewDomainTrie()
+	for _, d := range benchDomains() {
+		trie.Insert(DomainSuffix, d)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Match(benchHosts[i%len(benchHosts)])
+	}
+}
@@ -35,11 +35,10 @@ type IPRange struct {
 }
 
 type Manager struct {
-	ipRanges     []IPRange
-	domainExact  map[string]struct{} // 精确匹配 DOMAIN
-	domainSuffix map[string]struct{} // 后缀匹配 DOMAIN-SUFFIX
-	mu           sync.RWMutex
-	urls         []string
+	ipRanges []IPRange
+	domains  *DomainTrie // DOMAIN / DOMAIN-SUFFIX / DOMAIN-KEYWORD
+	mu       sync.RWMutex
+	urls     []string
 }
 
 // RuleSet 用于解析 YAML 格式的 payload
@@ -54,9 +53,8 @@ var once sync.Once
 func GetInstance(urls []string) *Manager {
 	once.Do(func() {
 		instance = &Manager{
-			urls:         urls,
-			domainExact:  make(map[string]struct{}),
-			domainSuffix: make(map[string]struct{}),
+			urls:    urls,
+			domains: NewDomainTrie(),
 		}
 		go instance.Update()
 	})
@@ -67,11 +65,10 @@ func (m *Manager) Update() {
 	log.Printf("[GeoData] Updating rules from %d sources...", len(m.urls))
 
 	var tempRanges []IPRange
-	tempExact := make(map[string]struct{})
-	tempSuffix := make(map[string]struct{})
+	tempDomains := NewDomainTrie()
 
 	for _, u := range m.urls {
-		m.downloadAndParse(u, &tempRanges, tempExact, tempSuffix)
+		m.downloadAndParse(u, &tempRanges, tempDomains)
 	}
 
 	// 优化 IP 区间
@@ -79,15 +76,15 @@ func (m *Manager) Update() {
 
 	m.mu.Lock()
 	m.ipRanges = mergedIPs
-	m.domainExact = tempExact
-	m.domainSuffix = tempSuffix
+	m.domains = tempDomains
 	m.mu.Unlock()
 
-	log.Printf("[GeoData] Rules Updated: %d IP Ranges, %d Domains, %d Suffixes",
-		len(mergedIPs), len(tempExact), len(tempSuffix))
+	exact, suffix, keyword := tempDomains.Counts()
+	log.Printf("[GeoData] Rules Updated: %d IP Ranges, %d Domains, %d Suffixes, %d Keywords",
+		len(mergedIPs), exact, suffix, keyword)
 }
 
-func (m *Manager) downloadAndParse(url string, ipRanges *[]IPRange, exact, suffix map[string]struct{}) {
+func (m *Manager) downloadAndParse(url string, ipRanges *[]IPRange, domains *DomainTrie) {
 	client := http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Get(url)
 	if err != nil {
@@ -107,7 +104,7 @@ func (m *Manager) downloadAndParse(url string, ipRanges *[]IPRange, exact, suffi
 	var rs RuleSet
 	if err := yaml.Unmarshal(body, &rs); err == nil && len(rs.Payload) > 0 {
 		for _, rule := range rs.Payload {
-			m.parseRule(rule, ipRanges, exact, suffix)
+			m.parseRule(rule, ipRanges, domains)
 		}
 		return
 	}
@@ -120,7 +117,7 @@ func (m *Manager) downloadAndParse(url string, ipRanges *[]IPRange, exact, suffi
 		if err != nil && err != io.EOF {
 			break
 		}
-		m.parseRule(line, ipRanges, exact, suffix)
+		m.parseRule(line, ipRanges, domains)
 		if err == io.EOF {
 			break
 		}
@@ -128,7 +125,7 @@ func (m *Manager) downloadAndParse(url string, ipRanges *[]IPRange, exact, suffi
 }
 
 // parseRule 统一处理单行规则字符串
-func (m *Manager) parseRule(line string, ipRanges *[]IPRange, exact, suffix map[string]struct{}) {
+func (m *Manager) parseRule(line string, ipRanges *[]IPRange, domains *DomainTrie) {
 	line = strings.TrimSpace(line)
 	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
 		return
@@ -143,9 +140,11 @@ func (m *Manager) parseRule(line string, ipRanges *[]IPRange, exact, suffix map[
 
 		switch ruleType {
 		case "DOMAIN":
-			exact[ruleValue] = struct{}{}
+			domains.Insert(DomainExact, ruleValue)
 		case "DOMAIN-SUFFIX":
-			suffix[ruleValue] = struct{}{}
+			domains.Insert(DomainSuffix, ruleValue)
+		case "DOMAIN-KEYWORD":
+			domains.Insert(DomainKeyword, ruleValue)
 		case "IP-CIDR", "IP-CIDR6":
 			// 处理 IP-CIDR,1.2.3.4/24
 			parseIPLine(ruleValue, ipRanges)
@@ -178,34 +177,30 @@ func parseIPLine(line string, list *[]IPRange) {
 }
 
 // IsCN 检查目标是否匹配 CN 规则 (域名优先，其次 IP)
-// host 可以是域名或 IP 字符串
+// host 可以是域名、IP 字符串或 host:port
 func (m *Manager) IsCN(host string, ip net.IP) bool {
+	_, ok := m.Match(host, ip)
+	return ok
+}
+
+// Match 与 IsCN 相同，但同时返回命中的规则，便于日志与调试。
+// 局域网地址返回 Type 为 0 的空规则；IP 规则命中时 Rule.Type 同样为 0。
+func (m *Manager) Match(host string, ip net.IP) (DomainRule, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	// 0. Check if it's a local network address - always treat as "CN" (local)
 	if m.isLocalNetwork(ip) {
-		return true
+		return DomainRule{}, true
 	}
 
 	// 1. Domain matching
-	if ip == nil || (len(host) > 0 && host != ip.String()) {
-		// This is a domain
-		domain := strings.TrimSuffix(host, ".") // Remove trailing dot
-
-		// Exact match
-		if _, ok := m.domainExact[domain]; ok {
-			return true
-		}
-
-		// Suffix matching
-		// Strategy: Check level by level. E.g., www.baidu.com -> check www.baidu.com, baidu.com, com
-		parts := strings.Split(domain, ".")
-		for i := 0; i < len(parts); i++ {
-			suffix := strings.Join(parts[i:], ".")
-			if _, ok := m.domainSuffix[suffix]; ok {
-				return true
-			}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host != "" && !looksLikeIPLiteral(host) {
+		if rule, ok := m.domains.Match(host); ok {
+			return rule, true
 		}
 	}
 
@@ -213,7 +208,7 @@ func (m *Manager) IsCN(host string, ip net.IP) bool {
 	if ip != nil {
 		ip4 := ip.To4()
 		if ip4 == nil {
-			return false // IPv6 not supported for direct connection rules, default proxy
+			return DomainRule{}, false // IPv6 not supported for direct connection rules, default proxy
 		}
 		val := ipToUint32(ip4)
 
@@ -222,11 +217,25 @@ func (m *Manager) IsCN(host string, ip net.IP) bool {
 		})
 
 		if idx < len(m.ipRanges) && m.ipRanges[idx].Start <= val {
-			return true
+			return DomainRule{}, true
 		}
 	}
 
-	return false
+	return DomainRule{}, false
+}
+
+// looksLikeIPLiteral is a cheap, allocation-free stand-in for net.ParseIP(host) != nil
+// that is good enough to keep IP literals out of domain matching.
+func looksLikeIPLiteral(host string) bool {
+	if strings.IndexByte(host, ':') >= 0 {
+		return true
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c != '.' && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
 }
 
 func ipToUint32(ip net.IP) uint32 {
@@ -105,6 +105,13 @@ func trimPortForHost(host string) string {
 	return host
 }
 
+// RandomUserAgent returns one of the browser User-Agent strings used by the mask.
+func RandomUserAgent() string {
+	r := rngPool.Get().(*rand.Rand)
+	defer rngPool.Put(r)
+	return userAgents[r.Intn(len(userAgents))]
+}
+
 func appendCommonHeaders(buf []byte, host string, r *rand.Rand) []byte {
 	ua := userAgents[r.Intn(len(userAgents))]
 	accept := accepts[r.Intn(len(accepts))]
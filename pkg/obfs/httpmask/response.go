@@ -0,0 +1,155 @@
+package httpmask
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 6455 §1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const maxResponseHeader = 4096
+
+var (
+	serverNames = []string{
+		"nginx",
+		"nginx/1.24.0",
+		"cloudflare",
+		"Apache",
+		"openresty",
+	}
+	responseContentTypes = []string{
+		"application/octet-stream",
+		"application/json",
+		"text/plain; charset=utf-8",
+	}
+
+	responsePrefix = []byte("HTTP/1.1 ")
+)
+
+// ErrResponseTooLarge is returned when the server's mask response never terminates.
+var ErrResponseTooLarge = errors.New("http mask response header too large")
+
+// WebSocketAccept computes the Sec-WebSocket-Accept value for a Sec-WebSocket-Key.
+func WebSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// WriteResponseHeader writes a response matching the request header consumed by
+// ConsumeHeader: 101 Switching Protocols for a WebSocket upgrade, otherwise 200 OK.
+func WriteResponseHeader(w io.Writer, requestHeader []byte) error {
+	r := rngPool.Get().(*rand.Rand)
+	defer rngPool.Put(r)
+
+	buf := make([]byte, 0, 256)
+	if key := headerValue(requestHeader, "Sec-WebSocket-Key"); key != "" &&
+		strings.EqualFold(headerValue(requestHeader, "Upgrade"), "websocket") {
+		buf = append(buf, "HTTP/1.1 101 Switching Protocols\r\nServer: "...)
+		buf = append(buf, serverNames[r.Intn(len(serverNames))]...)
+		buf = append(buf, "\r\nDate: "...)
+		buf = append(buf, time.Now().UTC().Format(http.TimeFormat)...)
+		buf = append(buf, "\r\nConnection: upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: "...)
+		buf = append(buf, WebSocketAccept(key)...)
+		buf = append(buf, "\r\n\r\n"...)
+	} else {
+		const minCL = int64(4 * 1024)
+		const maxCL = int64(10 * 1024 * 1024)
+
+		buf = append(buf, "HTTP/1.1 200 OK\r\nServer: "...)
+		buf = append(buf, serverNames[r.Intn(len(serverNames))]...)
+		buf = append(buf, "\r\nDate: "...)
+		buf = append(buf, time.Now().UTC().Format(http.TimeFormat)...)
+		buf = append(buf, "\r\nContent-Type: "...)
+		buf = append(buf, responseContentTypes[r.Intn(len(responseContentTypes))]...)
+		buf = append(buf, "\r\nContent-Length: "...)
+		buf = strconv.AppendInt(buf, minCL+r.Int63n(maxCL-minCL+1), 10)
+		buf = append(buf, "\r\nConnection: keep-alive\r\nCache-Control: no-store"...)
+		if r.Intn(2) == 0 {
+			buf = append(buf, "\r\nVary: Accept-Encoding"...)
+		}
+		buf = append(buf, "\r\n\r\n"...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// headerValue returns the first value of name in a raw HTTP header block.
+func headerValue(header []byte, name string) string {
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		k, v, ok := bytes.Cut(line, []byte(":"))
+		if ok && strings.EqualFold(string(bytes.TrimSpace(k)), name) {
+			return string(bytes.TrimSpace(v))
+		}
+	}
+	return ""
+}
+
+// NewResponseConn wraps the client side of a masked connection and drops the
+// HTTP response header the server sends before tunnel data. Servers that predate
+// the response mask send tunnel data straight away, which is passed through.
+func NewResponseConn(conn net.Conn) net.Conn {
+	return &responseConn{Conn: conn}
+}
+
+type responseConn struct {
+	net.Conn
+	stripped bool
+	pending  []byte
+}
+
+func (c *responseConn) Read(p []byte) (int, error) {
+	if !c.stripped {
+		if err := c.strip(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *responseConn) strip() error {
+	buf := c.pending
+	tmp := make([]byte, 1024)
+	for {
+		n, err := c.Conn.Read(tmp)
+		buf = append(buf, tmp[:n]...)
+
+		m := min(len(buf), len(responsePrefix))
+		if !bytes.Equal(buf[:m], responsePrefix[:m]) {
+			// 旧版服务端：直接是隧道数据
+			c.stripped = true
+			c.pending = buf
+			return nil
+		}
+		if m == len(responsePrefix) {
+			if end := bytes.Index(buf, []byte("\r\n\r\n")); end >= 0 {
+				c.stripped = true
+				c.pending = buf[end+4:]
+				return nil
+			}
+			if len(buf) > maxResponseHeader {
+				return ErrResponseTooLarge
+			}
+		}
+		if err != nil {
+			// 保留已读部分，超时等可重试的错误之后继续解析
+			c.pending = buf
+			return err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package httpmask
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// RFC 6455 §1.3 example
+	if got := WebSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept: %s", got)
+	}
+}
+
+func TestWriteResponseHeaderMatchesRequest(t *testing.T) {
+	seenWS, seenPost := false, false
+	for i := 0; i < 200 && !(seenWS && seenPost); i++ {
+		var req bytes.Buffer
+		if err := WriteRandomRequestHeader(&req, "example.com:443"); err != nil {
+			t.Fatalf("write request: %v", err)
+		}
+		consumed, err := ConsumeHeader(bufio.NewReader(&req))
+		if err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+		parsedReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(consumed)))
+		if err != nil {
+			t.Fatalf("parse request: %v", err)
+		}
+
+		var resp bytes.Buffer
+		if err := WriteResponseHeader(&resp, consumed); err != nil {
+			t.Fatalf("write response: %v", err)
+		}
+		parsed, err := http.ReadResponse(bufio.NewReader(&resp), parsedReq)
+		if err != nil {
+			t.Fatalf("parse response: %v\n%s", err, resp.String())
+		}
+		if key := parsedReq.Header.Get("Sec-WebSocket-Key"); key != "" {
+			seenWS = true
+			if parsed.StatusCode != http.StatusSwitchingProtocols || parsed.Header.Get("Sec-WebSocket-Accept") != WebSocketAccept(key) {
+				t.Fatalf("bad upgrade response: %d %v", parsed.StatusCode, parsed.Header)
+			}
+		} else {
+			seenPost = true
+			if parsed.StatusCode != http.StatusOK || parsed.ContentLength <= 0 {
+				t.Fatalf("bad post response: %d %d", parsed.StatusCode, parsed.ContentLength)
+			}
+		}
+	}
+	if !seenWS || !seenPost {
+		t.Fatalf("templates not exercised: ws=%v post=%v", seenWS, seenPost)
+	}
+}
+
+func TestResponseConnStripsHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"single write", []string{"HTTP/1.1 200 OK\r\nServer: nginx\r\n\r\ntunnel"}, "tunnel"},
+		{"split header", []string{"HT", "TP/1.1 101 Switching", " Protocols\r\nUpgrade: websocket\r\n\r", "\ndata"}, "data"},
+		{"legacy server", []string{"\x41\x42tunnel"}, "\x41\x42tunnel"},
+		{"legacy server http-like prefix", []string{"HTTX", "abc"}, "HTTXabc"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				for _, chunk := range c.chunks {
+					server.Write([]byte(chunk))
+				}
+				server.Close()
+			}()
+			got, err := io.ReadAll(NewResponseConn(client))
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(got) != c.want {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package httpmask
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Template describes one user-supplied request shape for the HTTP mask.
+type Template struct {
+	Method    string            `json:"method,omitempty"`    // 默认 POST；WebSocket 模板固定为 GET
+	Paths     []string          `json:"paths"`               // 每次随机取一条
+	Headers   map[string]string `json:"headers,omitempty"`   // 额外请求头；未提供 User-Agent 时随机补充
+	Host      string            `json:"host,omitempty"`      // 覆盖 Host 头，默认使用服务器地址
+	WebSocket bool              `json:"websocket,omitempty"` // 生成 WebSocket 升级请求
+	Weight    int               `json:"weight,omitempty"`    // 选择权重，默认 1
+}
+
+// Options customises the request mask on the client and the requests accepted
+// by the server. A nil *Options keeps the built-in templates and accepts any mask.
+type Options struct {
+	Templates      []Template        `json:"templates,omitempty"`       // 客户端请求模板，留空使用内置模板
+	RequirePath    string            `json:"require_path,omitempty"`    // 服务端：请求路径（不含查询串）必须等于此值
+	RequireHeaders map[string]string `json:"require_headers,omitempty"` // 服务端：必须携带且取值相同的请求头；客户端：WebSocket 与分离传输的请求携带
+}
+
+// ErrMaskRejected reports a request that does not carry the path or header secret the server requires.
+var ErrMaskRejected = errors.New("http mask rejected by server policy")
+
+var bodyMethods = map[string]bool{"POST": true, "PUT": true, "PATCH": true}
+
+// Validate renders every template path and checks that the server side of
+// the mask (LooksLikeHTTPRequestStart + ConsumeHeader) accepts it.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	for i, t := range o.Templates {
+		if len(t.Paths) == 0 {
+			return fmt.Errorf("template %d: paths cannot be empty", i)
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("template %d: weight must be >= 0", i)
+		}
+		if t.WebSocket && t.Method != "" && !strings.EqualFold(t.Method, "GET") {
+			return fmt.Errorf("template %d: websocket requires method GET", i)
+		}
+		for name, value := range t.Headers {
+			if !validToken(name) || strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("template %d: invalid header %q", i, name)
+			}
+			if t.rendersHeader(name) {
+				return fmt.Errorf("template %d: header %q is written by the mask itself", i, name)
+			}
+		}
+		if strings.ContainsAny(t.Host, " \r\n") {
+			return fmt.Errorf("template %d: invalid host %q", i, t.Host)
+		}
+		for _, p := range t.Paths {
+			if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, " \r\n") {
+				return fmt.Errorf("template %d: invalid path %q", i, p)
+			}
+			var buf bytes.Buffer
+			r := rngPool.Get().(*rand.Rand)
+			buf.Write(t.render(nil, p, "example.com", r))
+			rngPool.Put(r)
+			if !LooksLikeHTTPRequestStart(buf.Bytes()[:4]) {
+				return fmt.Errorf("template %d: method %q is not accepted by the server", i, t.method())
+			}
+			if _, err := ConsumeHeader(bufio.NewReader(&buf)); err != nil {
+				return fmt.Errorf("template %d: %w", i, err)
+			}
+		}
+	}
+	if o.RequirePath != "" && !strings.HasPrefix(o.RequirePath, "/") {
+		return fmt.Errorf("require_path must start with /")
+	}
+	for name, value := range o.RequireHeaders {
+		if !validToken(name) || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid require_headers entry %q", name)
+		}
+	}
+	return nil
+}
+
+// Required reports whether the server only accepts masked requests carrying a secret.
+func (o *Options) Required() bool {
+	return o != nil && (o.RequirePath != "" || len(o.RequireHeaders) > 0)
+}
+
+// UsesPath reports whether the client mask may send a request for path: one of
+// the template paths, or a built-in path when no templates are configured.
+func (o *Options) UsesPath(path string) bool {
+	if o == nil || len(o.Templates) == 0 {
+		for _, p := range paths {
+			if p == path {
+				return true
+			}
+		}
+		return false
+	}
+	for _, t := range o.Templates {
+		for _, p := range t.Paths {
+			if p == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check verifies a header consumed by ConsumeHeader against RequirePath and RequireHeaders.
+func (o *Options) Check(header []byte) error {
+	if !o.Required() {
+		return nil
+	}
+	if o.RequirePath != "" {
+		line, _, _ := bytes.Cut(header, []byte("\n"))
+		fields := strings.Fields(string(line))
+		if len(fields) < 2 {
+			return ErrMaskRejected
+		}
+		path, _, _ := strings.Cut(fields[1], "?")
+		if subtle.ConstantTimeCompare([]byte(path), []byte(o.RequirePath)) != 1 {
+			return ErrMaskRejected
+		}
+	}
+	return o.CheckHeaders(header)
+}
+
+// CheckHeaders verifies only RequireHeaders. Transports served on a dedicated
+// path of their own use it in place of Check.
+func (o *Options) CheckHeaders(header []byte) error {
+	if o == nil {
+		return nil
+	}
+	for name, want := range o.RequireHeaders {
+		if subtle.ConstantTimeCompare([]byte(headerValue(header, name)), []byte(want)) != 1 {
+			return ErrMaskRejected
+		}
+	}
+	return nil
+}
+
+// WriteRequest writes a request from the configured templates, falling back
+// to WriteRandomRequestHeader when none are configured.
+func (o *Options) WriteRequest(w io.Writer, host string) error {
+	if o == nil || len(o.Templates) == 0 {
+		return WriteRandomRequestHeader(w, host)
+	}
+	r := rngPool.Get().(*rand.Rand)
+	defer rngPool.Put(r)
+
+	t := o.pick(r)
+	path := t.Paths[r.Intn(len(t.Paths))]
+	_, err := w.Write(t.render(make([]byte, 0, 512), path, host, r))
+	return err
+}
+
+func (o *Options) pick(r *rand.Rand) *Template {
+	total := 0
+	for i := range o.Templates {
+		total += o.Templates[i].weight()
+	}
+	if total == 0 {
+		return &o.Templates[r.Intn(len(o.Templates))]
+	}
+	n := r.Intn(total)
+	for i := range o.Templates {
+		if n -= o.Templates[i].weight(); n < 0 {
+			return &o.Templates[i]
+		}
+	}
+	return &o.Templates[len(o.Templates)-1]
+}
+
+func (t *Template) weight() int {
+	if t.Weight == 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+func (t *Template) method() string {
+	if t.WebSocket {
+		return "GET"
+	}
+	if t.Method == "" {
+		return "POST"
+	}
+	return strings.ToUpper(t.Method)
+}
+
+// rendersHeader reports whether render always writes the header name itself,
+// so a template header of that name would be sent twice.
+func (t *Template) rendersHeader(name string) bool {
+	fixed := []string{"Host"}
+	if t.WebSocket {
+		fixed = append(fixed, "Upgrade", "Connection", "Sec-WebSocket-Version", "Sec-WebSocket-Key")
+	}
+	for _, f := range fixed {
+		if strings.EqualFold(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Template) render(buf []byte, path, host string, r *rand.Rand) []byte {
+	if t.Host != "" {
+		host = t.Host
+	}
+	method := t.method()
+
+	buf = append(buf, method...)
+	buf = append(buf, ' ')
+	buf = append(buf, path...)
+	buf = append(buf, " HTTP/1.1\r\nHost: "...)
+	buf = append(buf, host...)
+	buf = append(buf, "\r\n"...)
+
+	// 固定顺序输出，同一模板的请求头顺序保持稳定
+	names := make([]string, 0, len(t.Headers))
+	for name := range t.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	has := func(name string) bool {
+		for _, n := range names {
+			if strings.EqualFold(n, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !has("User-Agent") {
+		buf = append(buf, "User-Agent: "...)
+		buf = append(buf, userAgents[r.Intn(len(userAgents))]...)
+		buf = append(buf, "\r\n"...)
+	}
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, ": "...)
+		buf = append(buf, t.Headers[name]...)
+		buf = append(buf, "\r\n"...)
+	}
+
+	switch {
+	case t.WebSocket:
+		var key [16]byte
+		r.Read(key[:])
+		buf = append(buf, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "...)
+		buf = append(buf, base64.StdEncoding.EncodeToString(key[:])...)
+		buf = append(buf, "\r\n"...)
+	default:
+		if bodyMethods[method] && !has("Content-Length") {
+			const minCL = int64(4 * 1024)
+			const maxCL = int64(10 * 1024 * 1024)
+			buf = append(buf, "Content-Length: "...)
+			buf = strconv.AppendInt(buf, minCL+r.Int63n(maxCL-minCL+1), 10)
+			buf = append(buf, "\r\n"...)
+		}
+		if !has("Connection") {
+			buf = append(buf, "Connection: keep-alive\r\n"...)
+		}
+	}
+	return append(buf, "\r\n"...)
+}
+
+// validToken reports whether s is a valid HTTP header field name (RFC 9110 token).
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
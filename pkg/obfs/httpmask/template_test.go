@@ -0,0 +1,100 @@
+package httpmask
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	bad := []Options{
+		{Templates: []Template{{Method: "POST"}}},
+		{Templates: []Template{{Method: "BREW", Paths: []string{"/a"}}}},
+		{Templates: []Template{{Method: "POST", Paths: []string{"/a"}, WebSocket: true}}},
+		{Templates: []Template{{Paths: []string{"no-slash"}}}},
+		{Templates: []Template{{Paths: []string{"/a"}, Headers: map[string]string{"X-A": "b\r\nEvil: 1"}}}},
+		{Templates: []Template{{Paths: []string{"/a"}, Headers: map[string]string{"Bad Name": "v"}}}},
+		{RequirePath: "secret"},
+		{Templates: []Template{{Paths: []string{"/a"}, Headers: map[string]string{"host": "cdn.example.com"}}}},
+		{Templates: []Template{{WebSocket: true, Paths: []string{"/ws"}, Headers: map[string]string{"Upgrade": "h2c"}}}},
+		{Templates: []Template{{WebSocket: true, Paths: []string{"/ws"}, Headers: map[string]string{"Sec-WebSocket-Key": "AAAA"}}}},
+	}
+	for i, o := range bad {
+		if err := o.Validate(); err == nil {
+			t.Errorf("case %d: expected validation error", i)
+		}
+	}
+
+	good := &Options{Templates: []Template{
+		{Method: "put", Paths: []string{"/upload"}, Headers: map[string]string{"Content-Type": "application/json"}},
+		{WebSocket: true, Paths: []string{"/ws"}, Host: "cdn.example.com"},
+		{Method: "DELETE", Paths: []string{"/x"}, Headers: map[string]string{"Connection": "close"}},
+	}}
+	if err := good.Validate(); err != nil {
+		t.Fatalf("valid options rejected: %v", err)
+	}
+}
+
+func TestOptionsWriteRequestUsesTemplates(t *testing.T) {
+	o := &Options{Templates: []Template{
+		{Method: "POST", Paths: []string{"/a", "/b"}, Headers: map[string]string{"X-Token": "t1", "User-Agent": "custom/1.0"}, Weight: 3},
+		{WebSocket: true, Paths: []string{"/ws"}, Host: "front.example.com", Weight: 1},
+	}}
+	counts := map[string]int{}
+	for i := 0; i < 400; i++ {
+		var buf bytes.Buffer
+		if err := o.WriteRequest(&buf, "origin.example.com:443"); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		counts[req.URL.Path]++
+		switch req.URL.Path {
+		case "/a", "/b":
+			if req.Method != "POST" || req.Host != "origin.example.com:443" || req.Header.Get("X-Token") != "t1" ||
+				req.UserAgent() != "custom/1.0" || req.ContentLength <= 0 {
+				t.Fatalf("bad post request: %+v", req)
+			}
+		case "/ws":
+			if req.Host != "front.example.com" || req.Header.Get("Upgrade") != "websocket" || req.Header.Get("Sec-WebSocket-Key") == "" {
+				t.Fatalf("bad websocket request: %+v", req)
+			}
+		default:
+			t.Fatalf("unexpected path %q", req.URL.Path)
+		}
+	}
+	if counts["/ws"] == 0 || counts["/a"]+counts["/b"] < 2*counts["/ws"] {
+		t.Fatalf("weights not applied: %v", counts)
+	}
+}
+
+func TestOptionsCheck(t *testing.T) {
+	o := &Options{RequirePath: "/secret", RequireHeaders: map[string]string{"X-Auth": "s3"}}
+	cases := []struct {
+		req string
+		ok  bool
+	}{
+		{"POST /secret?x=1 HTTP/1.1\r\nHost: a\r\nx-auth: s3\r\n\r\n", true},
+		{"POST /secret HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"POST /other HTTP/1.1\r\nHost: a\r\nX-Auth: s3\r\n\r\n", false},
+		{"POST /secret HTTP/1.1\r\nHost: a\r\nX-Auth: wrong\r\n\r\n", false},
+	}
+	for _, c := range cases {
+		header, err := ConsumeHeader(bufio.NewReader(strings.NewReader(c.req)))
+		if err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+		if err := o.Check(header); (err == nil) != c.ok {
+			t.Errorf("%q: ok=%v err=%v", c.req, c.ok, err)
+		}
+	}
+
+	var none *Options
+	if none.Required() || none.Check([]byte("GET / HTTP/1.1\r\n\r\n")) != nil {
+		t.Fatalf("nil options must accept everything")
+	}
+}
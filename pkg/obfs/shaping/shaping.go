@@ -0,0 +1,316 @@
+// Package shaping reshapes the obfuscated byte stream before it reaches the
+// socket. Writes are split and coalesced into segments whose sizes are drawn
+// from a histogram, short tails are topped up with filler bytes and optional
+// filler-only segments are interleaved. It sits beneath the Sudoku codecs,
+// whose decoders skip filler bytes, so the receiving side needs no changes.
+package shaping
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSegment bounds bucket sizes so a segment fits comfortably in one write.
+const MaxSegment = 64 * 1024
+
+const closeFlushTimeout = time.Second
+
+// Bucket is one histogram bin: segment sizes in [Min, Max] with a relative Weight.
+type Bucket struct {
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Weight float64 `json:"weight"`
+}
+
+// Direction configures shaping for one write direction.
+type Direction struct {
+	Profile    string   `json:"profile,omitempty"`     // 内置分布："https-download"、"video-stream"、"web-browsing"
+	Buckets    []Bucket `json:"buckets,omitempty"`     // 自定义直方图，设置后忽略 profile
+	CoalesceMs int      `json:"coalesce_ms,omitempty"` // 不足一个分段的尾部最多等待多少毫秒以合并后续写入，0 表示立即补齐发送
+	Cover      float64  `json:"cover,omitempty"`       // 每次写入后追加一个纯填充分段的概率 (0-1)
+}
+
+// Options holds per-direction shaping. Uplink is applied by the client, Downlink by the server.
+type Options struct {
+	Uplink   *Direction `json:"uplink,omitempty"`
+	Downlink *Direction `json:"downlink,omitempty"`
+}
+
+// Sizes measured on the wire (after Sudoku expansion); they stay below a
+// typical MSS so one segment maps to one TCP packet with Nagle disabled.
+var profiles = map[string][]Bucket{
+	"https-download": {
+		{Min: 1300, Max: 1448, Weight: 0.70},
+		{Min: 500, Max: 1299, Weight: 0.15},
+		{Min: 60, Max: 499, Weight: 0.15},
+	},
+	"video-stream": {
+		{Min: 1380, Max: 1448, Weight: 0.85},
+		{Min: 200, Max: 1379, Weight: 0.10},
+		{Min: 40, Max: 199, Weight: 0.05},
+	},
+	"web-browsing": {
+		{Min: 40, Max: 200, Weight: 0.45},
+		{Min: 201, Max: 700, Weight: 0.30},
+		{Min: 701, Max: 1448, Weight: 0.25},
+	},
+}
+
+// Profiles lists the built-in profile names.
+func Profiles() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks both directions. A nil receiver is valid.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if err := o.Uplink.Validate(); err != nil {
+		return fmt.Errorf("uplink: %w", err)
+	}
+	if err := o.Downlink.Validate(); err != nil {
+		return fmt.Errorf("downlink: %w", err)
+	}
+	return nil
+}
+
+// Validate checks the direction. A nil receiver is valid (shaping disabled).
+func (d *Direction) Validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.CoalesceMs < 0 || d.CoalesceMs > 1000 {
+		return fmt.Errorf("coalesce_ms must be within [0, 1000]")
+	}
+	if d.Cover < 0 || d.Cover > 1 {
+		return fmt.Errorf("cover must be within [0, 1]")
+	}
+	if len(d.Buckets) == 0 {
+		if _, ok := profiles[strings.ToLower(d.Profile)]; !ok {
+			return fmt.Errorf("unknown profile %q (want one of %s, or set buckets)", d.Profile, strings.Join(Profiles(), ", "))
+		}
+		return nil
+	}
+	var total float64
+	for i, b := range d.Buckets {
+		if b.Min < 1 || b.Max < b.Min || b.Max > MaxSegment {
+			return fmt.Errorf("bucket %d: need 1 <= min <= max <= %d", i, MaxSegment)
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("bucket %d: negative weight", i)
+		}
+		total += b.Weight
+	}
+	if total <= 0 {
+		return errors.New("bucket weights sum to zero")
+	}
+	return nil
+}
+
+func (d *Direction) buckets() []Bucket {
+	if len(d.Buckets) > 0 {
+		return d.Buckets
+	}
+	return profiles[strings.ToLower(d.Profile)]
+}
+
+// histogram samples segment sizes from weighted buckets.
+type histogram struct {
+	buckets []Bucket
+}
+
+func (h *histogram) pick(rng *rand.Rand, atLeast int) (Bucket, bool) {
+	var total float64
+	for _, b := range h.buckets {
+		if b.Max >= atLeast {
+			total += b.Weight
+		}
+	}
+	if total <= 0 {
+		return Bucket{}, false
+	}
+	x := rng.Float64() * total
+	var last Bucket
+	for _, b := range h.buckets {
+		if b.Max < atLeast || b.Weight <= 0 {
+			continue
+		}
+		last = b
+		if x < b.Weight {
+			return b, true
+		}
+		x -= b.Weight
+	}
+	return last, true
+}
+
+// sample draws a segment size.
+func (h *histogram) sample(rng *rand.Rand) int {
+	return h.sampleAtLeast(rng, 1)
+}
+
+// sampleAtLeast draws a size >= n from the distribution conditioned on that
+// bound; it returns n when no bucket reaches it.
+func (h *histogram) sampleAtLeast(rng *rand.Rand, n int) int {
+	b, ok := h.pick(rng, n)
+	if !ok {
+		return n
+	}
+	lo := b.Min
+	if lo < n {
+		lo = n
+	}
+	return lo + rng.Intn(b.Max-lo+1)
+}
+
+// Conn shapes writes to the wrapped connection; reads pass through.
+type Conn struct {
+	net.Conn
+	hist     histogram
+	filler   []byte
+	coalesce time.Duration
+	cover    float64
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	target  int
+	pending []byte
+	timer   *time.Timer
+	err     error
+	closed  bool
+}
+
+// Wrap returns c shaped according to d, or c itself when d is nil. filler must
+// hold bytes the peer's decoder ignores (see sudoku.Table.FillerBytes).
+func Wrap(c net.Conn, d *Direction, filler []byte) net.Conn {
+	if d == nil || len(filler) == 0 {
+		return c
+	}
+	var seedBytes [8]byte
+	if _, err := crypto_rand.Read(seedBytes[:]); err != nil {
+		binary.BigEndian.PutUint64(seedBytes[:], uint64(time.Now().UnixNano()))
+	}
+	sc := &Conn{
+		Conn:     c,
+		hist:     histogram{buckets: d.buckets()},
+		filler:   append([]byte(nil), filler...),
+		coalesce: time.Duration(d.CoalesceMs) * time.Millisecond,
+		cover:    d.Cover,
+		rng:      rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seedBytes[:])))),
+	}
+	sc.target = sc.hist.sample(sc.rng)
+	return sc
+}
+
+// Write queues p and emits every complete segment. The remaining tail is either
+// held for the coalescing window or topped up with filler and sent at once.
+func (c *Conn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.pending = append(c.pending, p...)
+	for len(c.pending) >= c.target {
+		if err := c.emit(c.pending[:c.target]); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[c.target:]
+		c.target = c.hist.sample(c.rng)
+	}
+	if len(c.pending) > 0 {
+		if c.coalesce > 0 {
+			if c.timer == nil {
+				c.timer = time.AfterFunc(c.coalesce, c.flushTimer)
+			}
+		} else if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.cover > 0 && c.rng.Float64() < c.cover {
+		if err := c.emit(c.fill(nil, c.hist.sample(c.rng))); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close sends any held tail before closing the underlying connection. When a
+// Write is blocked on the socket the tail is dropped so Close can unblock it.
+func (c *Conn) Close() error {
+	if c.mu.TryLock() {
+		if !c.closed {
+			c.closed = true
+			if c.timer != nil {
+				c.timer.Stop()
+				c.timer = nil
+			}
+			if c.err == nil && len(c.pending) > 0 {
+				_ = c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+				_ = c.flushLocked()
+			}
+		}
+		c.mu.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+func (c *Conn) flushTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if c.closed || c.err != nil || len(c.pending) == 0 {
+		return
+	}
+	_ = c.flushLocked()
+}
+
+// flushLocked tops the pending tail up to a sampled size and sends it.
+func (c *Conn) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	size := c.hist.sampleAtLeast(c.rng, len(c.pending))
+	seg := c.fill(append(make([]byte, 0, size), c.pending...), size)
+	c.pending = c.pending[:0:0]
+	c.target = c.hist.sample(c.rng)
+	return c.emit(seg)
+}
+
+func (c *Conn) fill(seg []byte, size int) []byte {
+	for len(seg) < size {
+		seg = append(seg, c.filler[c.rng.Intn(len(c.filler))])
+	}
+	return seg
+}
+
+func (c *Conn) emit(seg []byte) error {
+	if _, err := c.Conn.Write(seg); err != nil {
+		c.err = err
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package shaping
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+)
+
+// segmentConn records the size of every Write it receives.
+type segmentConn struct {
+	net.Conn
+	mu    sync.Mutex
+	sizes []int
+	data  bytes.Buffer
+}
+
+func (c *segmentConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizes = append(c.sizes, len(p))
+	c.data.Write(p)
+	return len(p), nil
+}
+
+func (c *segmentConn) Close() error { return nil }
+
+func (c *segmentConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *segmentConn) snapshot() ([]int, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.sizes...), append([]byte(nil), c.data.Bytes()...)
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		d    *Direction
+		ok   bool
+	}{
+		{"nil", nil, true},
+		{"profile", &Direction{Profile: "video-stream"}, true},
+		{"unknown profile", &Direction{Profile: "nope"}, false},
+		{"buckets", &Direction{Buckets: []Bucket{{Min: 100, Max: 200, Weight: 1}}}, true},
+		{"inverted bucket", &Direction{Buckets: []Bucket{{Min: 200, Max: 100, Weight: 1}}}, false},
+		{"zero weights", &Direction{Buckets: []Bucket{{Min: 1, Max: 2}}}, false},
+		{"cover range", &Direction{Profile: "web-browsing", Cover: 1.5}, false},
+		{"coalesce range", &Direction{Profile: "web-browsing", CoalesceMs: -1}, false},
+	}
+	for _, tc := range cases {
+		err := tc.d.Validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: Validate() = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+	if err := (&Options{Downlink: &Direction{}}).Validate(); err == nil {
+		t.Fatalf("expected error for empty downlink")
+	}
+}
+
+func TestSegmentsFollowHistogram(t *testing.T) {
+	rec := &segmentConn{}
+	d := &Direction{Buckets: []Bucket{{Min: 300, Max: 400, Weight: 1}, {Min: 900, Max: 1000, Weight: 1}}}
+	c := Wrap(rec, d, []byte{0xEE})
+
+	payload := bytes.Repeat([]byte{0x01}, 50000)
+	for off := 0; off < len(payload); off += 777 {
+		end := off + 777
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if n, err := c.Write(payload[off:end]); err != nil || n != end-off {
+			t.Fatalf("write: n=%d err=%v", n, err)
+		}
+	}
+
+	sizes, data := rec.snapshot()
+	for i, n := range sizes {
+		if !(n >= 300 && n <= 400) && !(n >= 900 && n <= 1000) {
+			t.Fatalf("segment %d has size %d outside the histogram", i, n)
+		}
+	}
+	if got := bytes.Count(data, []byte{0x01}); got != len(payload) {
+		t.Fatalf("payload bytes on the wire = %d, want %d", got, len(payload))
+	}
+	if stripped := bytes.ReplaceAll(data, []byte{0xEE}, nil); !bytes.Equal(stripped, payload) {
+		t.Fatalf("payload order changed")
+	}
+}
+
+func TestCoalesceMergesSmallWrites(t *testing.T) {
+	rec := &segmentConn{}
+	d := &Direction{Buckets: []Bucket{{Min: 1000, Max: 1000, Weight: 1}}, CoalesceMs: 50}
+	c := Wrap(rec, d, []byte{0xEE})
+
+	for i := 0; i < 10; i++ {
+		c.Write(bytes.Repeat([]byte{0x01}, 30))
+	}
+	if sizes, _ := rec.snapshot(); len(sizes) != 0 {
+		t.Fatalf("small writes sent before the window: %v", sizes)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sizes, data := rec.snapshot()
+		if len(sizes) > 0 {
+			if len(sizes) != 1 || sizes[0] != 1000 || bytes.Count(data, []byte{0x01}) != 300 {
+				t.Fatalf("unexpected flush: sizes=%v", sizes)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("held tail never flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseFlushesHeldTail(t *testing.T) {
+	rec := &segmentConn{}
+	c := Wrap(rec, &Direction{Profile: "https-download", CoalesceMs: 1000}, []byte{0xEE})
+	c.Write([]byte("tail"))
+	c.Close()
+	if _, data := rec.snapshot(); !bytes.Contains(data, []byte("tail")) {
+		t.Fatalf("tail lost on close")
+	}
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Fatalf("write after close should fail")
+	}
+}
+
+func TestCodecsDecodeShapedStream(t *testing.T) {
+	table := sudoku.NewTable("shaping-key", "prefer_entropy")
+	d := &Direction{Profile: "web-browsing", Cover: 0.5}
+	payload := bytes.Repeat([]byte("shaped-stream-"), 4000)
+
+	for _, packed := range []bool{false, true} {
+		a, b := net.Pipe()
+		shaped := Wrap(a, d, table.FillerBytes())
+
+		var w io.Writer
+		var flush func() error
+		if packed {
+			pc := sudoku.NewPackedConn(shaped, table, 10, 30)
+			w, flush = pc, pc.Flush
+		} else {
+			w = sudoku.NewConn(shaped, table, 10, 30, false)
+		}
+		var r io.Reader
+		if packed {
+			r = sudoku.NewPackedConn(b, table, 10, 30)
+		} else {
+			r = sudoku.NewConn(b, table, 10, 30, false)
+		}
+
+		go func() {
+			for off := 0; off < len(payload); off += 1000 {
+				end := off + 1000
+				if end > len(payload) {
+					end = len(payload)
+				}
+				w.Write(payload[off:end])
+			}
+			if flush != nil {
+				flush()
+			}
+		}()
+
+		got := make([]byte, len(payload))
+		b.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("packed=%v read: %v", packed, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("packed=%v payload mismatch", packed)
+		}
+		shaped.Close()
+		b.Close()
+	}
+}
@@ -55,6 +55,9 @@ type Conn struct {
 
 	rng         *rand.Rand
 	paddingRate float32
+	padMin      int
+	padMax      int
+	padding     *paddingSchedule
 }
 
 func NewConn(c net.Conn, table *Table, pMin, pMax int, record bool) *Conn {
@@ -78,6 +81,8 @@ func NewConn(c net.Conn, table *Table, pMin, pMax int, record bool) *Conn {
 		hintBuf:     make([]byte, 0, 4),
 		rng:         localRng,
 		paddingRate: rate,
+		padMin:      pMin,
+		padMax:      pMax,
 	}
 	if record {
 		sc.recorder = new(bytes.Buffer)
@@ -86,6 +91,18 @@ func NewConn(c net.Conn, table *Table, pMin, pMax int, record bool) *Conn {
 	return sc
 }
 
+// SetPaddingStrategy switches how the padding rate evolves over the connection
+// (see PaddingStrategies). It must be called before the first Write.
+func (sc *Conn) SetPaddingStrategy(name string) error {
+	s, err := newPaddingSchedule(name, sc.padMin, sc.padMax, sc.rng)
+	if err != nil {
+		return err
+	}
+	sc.padding = s
+	sc.paddingRate = s.rate
+	return nil
+}
+
 func (sc *Conn) StopRecording() {
 	sc.recordLock.Lock()
 	sc.recording = false
@@ -122,6 +139,10 @@ func (sc *Conn) Write(p []byte) (n int, err error) {
 		return 0, nil
 	}
 
+	if sc.padding != nil {
+		sc.paddingRate = sc.padding.next(len(p), sc.rng)
+	}
+
 	outCapacity := len(p) * 6
 	out := make([]byte, 0, outCapacity)
 	pads := sc.table.PaddingPool
@@ -42,6 +42,9 @@ type PackedConn struct {
 	paddingRate float32 // 与 Conn 保持一致的随机概率模型
 	padMarker   byte
 	padPool     []byte
+	padMin      int
+	padMax      int
+	padding     *paddingSchedule
 }
 
 func NewPackedConn(c net.Conn, table *Table, pMin, pMax int) *PackedConn {
@@ -66,6 +69,8 @@ func NewPackedConn(c net.Conn, table *Table, pMin, pMax int) *PackedConn {
 		writeBuf:    make([]byte, 0, 4096),
 		rng:         localRng,
 		paddingRate: rate,
+		padMin:      pMin,
+		padMax:      pMax,
 	}
 
 	pc.padMarker = table.layout.padMarker
@@ -80,6 +85,19 @@ func NewPackedConn(c net.Conn, table *Table, pMin, pMax int) *PackedConn {
 	return pc
 }
 
+// SetPaddingStrategy 切换填充率随连接进程变化的方式（见 PaddingStrategies），须在首次 Write 之前调用
+func (pc *PackedConn) SetPaddingStrategy(name string) error {
+	s, err := newPaddingSchedule(name, pc.padMin, pc.padMax, pc.rng)
+	if err != nil {
+		return err
+	}
+	pc.writeMu.Lock()
+	pc.padding = s
+	pc.paddingRate = s.rate
+	pc.writeMu.Unlock()
+	return nil
+}
+
 // maybeAddPadding 内联辅助：根据浮点概率插入 padding
 func (pc *PackedConn) maybeAddPadding(out []byte) []byte {
 	if pc.rng.Float32() < pc.paddingRate {
@@ -97,6 +115,10 @@ func (pc *PackedConn) Write(p []byte) (int, error) {
 	pc.writeMu.Lock()
 	defer pc.writeMu.Unlock()
 
+	if pc.padding != nil {
+		pc.paddingRate = pc.padding.next(len(p), pc.rng)
+	}
+
 	// 1. 预分配内存，避免 append 导致的多次扩容
 	// 预估：原数据 * 1.5 (4/3 + padding 余量)
 	needed := len(p)*3/2 + 32
@@ -0,0 +1,165 @@
+package sudoku
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// ErrTruncatedPacket 表示数据报末尾存在不完整的编码组
+var ErrTruncatedPacket = errors.New("truncated sudoku packet")
+
+// PacketCodec 以数据报为单位编解码：每个包独立完整，不依赖前后包的状态。
+// 纯 Sudoku 模式与 Conn 相同（每字节 4 个提示 + 随机 padding）；
+// packed 模式与 PackedConn 相同（6 bit 一组，尾部用 padMarker 截断）。
+type PacketCodec struct {
+	table  *Table
+	packed bool
+
+	mu          sync.Mutex
+	rng         *rand.Rand
+	paddingRate float32
+	padPool     []byte // packed 模式下不含 padMarker
+}
+
+// NewPacketCodec creates a codec; pMin/pMax are padding percentages as in NewConn.
+func NewPacketCodec(table *Table, pMin, pMax int, packed bool) *PacketCodec {
+	var seedBytes [8]byte
+	if _, err := crypto_rand.Read(seedBytes[:]); err != nil {
+		binary.BigEndian.PutUint64(seedBytes[:], uint64(rand.Int63()))
+	}
+	localRng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seedBytes[:]))))
+
+	min := float32(pMin) / 100.0
+	span := float32(pMax-pMin) / 100.0
+
+	c := &PacketCodec{
+		table:       table,
+		packed:      packed,
+		rng:         localRng,
+		paddingRate: min + localRng.Float32()*span,
+	}
+	for _, b := range table.PaddingPool {
+		if !packed || b != table.layout.padMarker {
+			c.padPool = append(c.padPool, b)
+		}
+	}
+	if len(c.padPool) == 0 {
+		c.padPool = append(c.padPool, table.layout.padMarker)
+	}
+	return c
+}
+
+// Encode appends the encoded form of p to dst.
+func (c *PacketCodec) Encode(dst, p []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.packed {
+		return c.encodePacked(dst, p)
+	}
+	return c.encodePure(dst, p)
+}
+
+func (c *PacketCodec) maybePad(out []byte) []byte {
+	if c.rng.Float32() < c.paddingRate {
+		out = append(out, c.padPool[c.rng.Intn(len(c.padPool))])
+	}
+	return out
+}
+
+func (c *PacketCodec) encodePure(out, p []byte) []byte {
+	for _, b := range p {
+		out = c.maybePad(out)
+		puzzles := c.table.EncodeTable[b]
+		puzzle := puzzles[c.rng.Intn(len(puzzles))]
+		for _, idx := range perm4[c.rng.Intn(len(perm4))] {
+			out = c.maybePad(out)
+			out = append(out, puzzle[idx])
+		}
+	}
+	return c.maybePad(out)
+}
+
+func (c *PacketCodec) encodePacked(out, p []byte) []byte {
+	layout := c.table.layout
+	var bitBuf uint64
+	bitCount := 0
+	for _, b := range p {
+		bitBuf = (bitBuf << 8) | uint64(b)
+		bitCount += 8
+		for bitCount >= 6 {
+			bitCount -= 6
+			group := byte(bitBuf>>bitCount) & 0x3F
+			bitBuf &= (1 << bitCount) - 1
+			out = c.maybePad(out)
+			out = append(out, layout.encodeGroup(group))
+		}
+	}
+	if bitCount > 0 {
+		out = c.maybePad(out)
+		out = append(out, layout.encodeGroup(byte(bitBuf<<(6-bitCount))&0x3F))
+		out = append(out, layout.padMarker)
+	}
+	return c.maybePad(out)
+}
+
+// Decode appends the decoded form of pkt to dst.
+func (c *PacketCodec) Decode(dst, pkt []byte) ([]byte, error) {
+	if c.packed {
+		return c.decodePacked(dst, pkt)
+	}
+	return c.decodePure(dst, pkt)
+}
+
+func (c *PacketCodec) decodePure(out, pkt []byte) ([]byte, error) {
+	layout := c.table.layout
+	var hints [4]byte
+	n := 0
+	for _, b := range pkt {
+		if !layout.isHint(b) {
+			continue
+		}
+		hints[n] = b
+		n++
+		if n == 4 {
+			val, ok := c.table.DecodeMap[packHintsToKey(hints)]
+			if !ok {
+				return nil, ErrInvalidSudokuMapMiss
+			}
+			out = append(out, val)
+			n = 0
+		}
+	}
+	if n != 0 {
+		return nil, ErrTruncatedPacket
+	}
+	return out, nil
+}
+
+func (c *PacketCodec) decodePacked(out, pkt []byte) ([]byte, error) {
+	layout := c.table.layout
+	var bitBuf uint64
+	bits := 0
+	for _, b := range pkt {
+		if !layout.isHint(b) {
+			if b == layout.padMarker {
+				bitBuf, bits = 0, 0
+			}
+			continue
+		}
+		group, ok := layout.decodeGroup(b)
+		if !ok {
+			return nil, ErrInvalidSudokuMapMiss
+		}
+		bitBuf = (bitBuf << 6) | uint64(group)
+		bits += 6
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(bitBuf>>bits))
+			bitBuf &= (1 << bits) - 1
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,38 @@
+package sudoku
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestPacketCodecRoundTrip(t *testing.T) {
+	for _, mode := range []string{"prefer_entropy", "prefer_ascii"} {
+		table := NewTable("packet-key", mode)
+		for _, packed := range []bool{false, true} {
+			codec := NewPacketCodec(table, 10, 30, packed)
+			for _, size := range []int{0, 1, 2, 3, 11, 12, 13, 1400} {
+				payload := make([]byte, size)
+				rand.Read(payload)
+
+				encoded := codec.Encode(nil, payload)
+				decoded, err := codec.Decode(nil, encoded)
+				if err != nil {
+					t.Fatalf("%s packed=%v size=%d: decode: %v", mode, packed, size, err)
+				}
+				if !bytes.Equal(decoded, payload) {
+					t.Fatalf("%s packed=%v size=%d: mismatch", mode, packed, size)
+				}
+			}
+		}
+	}
+}
+
+func TestPacketCodecRejectsTruncated(t *testing.T) {
+	table := NewTable("packet-key", "prefer_entropy")
+	codec := NewPacketCodec(table, 0, 0, false)
+	encoded := codec.Encode(nil, []byte("hello"))
+	if _, err := codec.Decode(nil, encoded[:len(encoded)-1]); err == nil {
+		t.Fatalf("expected error for truncated packet")
+	}
+}
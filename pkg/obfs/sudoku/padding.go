@@ -0,0 +1,125 @@
+package sudoku
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Padding strategies decide how the padding probability evolves over a
+// connection, so the per-connection padding density is not a stable feature.
+// All of them stay within [padding_min, padding_max].
+const (
+	PaddingFixed      = "fixed"       // 建连时在区间内取一个固定值（默认，与旧版一致）
+	PaddingFront      = "front"       // 握手与前若干 KB 使用上限，之后回落到区间内的固定值
+	PaddingDecay      = "decay"       // 从上限按指数衰减到下限，半衰期按连接随机
+	PaddingRandomWalk = "random-walk" // 在区间内随机游走
+	PaddingBurst      = "burst"       // 平时接近下限，按随机时间表短暂升到上限
+)
+
+const (
+	frontBytes      = 8 * 1024
+	walkStep        = 0.08 // 每次写入的最大步长，占区间宽度的比例
+	burstMinPeriod  = 5 * time.Second
+	burstMaxPeriod  = 15 * time.Second
+	burstMinLength  = 500 * time.Millisecond
+	burstMaxLength  = 2 * time.Second
+	decayMinHalf    = 16 * 1024
+	decayMaxHalf    = 256 * 1024
+	burstBaseWeight = 0.2 // 非突发期的取值在区间下方 20% 内
+)
+
+// PaddingStrategies lists the accepted strategy names.
+func PaddingStrategies() []string {
+	return []string{PaddingFixed, PaddingFront, PaddingDecay, PaddingRandomWalk, PaddingBurst}
+}
+
+// ValidatePaddingStrategy reports whether name is a known strategy. Empty means fixed.
+func ValidatePaddingStrategy(name string) error {
+	if name == "" {
+		return nil
+	}
+	for _, s := range PaddingStrategies() {
+		if strings.EqualFold(name, s) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown padding strategy %q (want one of %s)", name, strings.Join(PaddingStrategies(), ", "))
+}
+
+// paddingSchedule yields the padding probability for each write.
+type paddingSchedule struct {
+	kind     string
+	min, max float32
+	rate     float32
+	written  int64
+
+	half       float64   // decay
+	burstAt    time.Time // burst: next burst start
+	burstUntil time.Time
+}
+
+func newPaddingSchedule(name string, pMin, pMax int, rng *rand.Rand) (*paddingSchedule, error) {
+	if err := ValidatePaddingStrategy(name); err != nil {
+		return nil, err
+	}
+	s := &paddingSchedule{
+		kind: strings.ToLower(name),
+		min:  float32(pMin) / 100.0,
+		max:  float32(pMax) / 100.0,
+	}
+	span := s.max - s.min
+	s.rate = s.min + rng.Float32()*span
+	switch s.kind {
+	case PaddingDecay:
+		s.half = decayMinHalf + rng.Float64()*(decayMaxHalf-decayMinHalf)
+	case PaddingBurst:
+		s.rate = s.min + rng.Float32()*span*burstBaseWeight
+		s.burstAt = time.Now().Add(randDuration(rng, burstMinPeriod, burstMaxPeriod))
+	}
+	return s, nil
+}
+
+// next returns the probability to use for a write of n bytes.
+func (s *paddingSchedule) next(n int, rng *rand.Rand) float32 {
+	written := s.written
+	s.written += int64(n)
+	span := s.max - s.min
+
+	switch s.kind {
+	case PaddingFront:
+		if written < frontBytes {
+			return s.max
+		}
+	case PaddingDecay:
+		return s.min + span*float32(math.Exp2(-float64(written)/s.half))
+	case PaddingRandomWalk:
+		s.rate += (rng.Float32()*2 - 1) * span * walkStep
+		// 越界时反射回区间内
+		if s.rate < s.min {
+			s.rate = 2*s.min - s.rate
+		}
+		if s.rate > s.max {
+			s.rate = 2*s.max - s.rate
+		}
+		if s.rate < s.min {
+			s.rate = s.min
+		}
+	case PaddingBurst:
+		now := time.Now()
+		if now.After(s.burstAt) {
+			s.burstUntil = now.Add(randDuration(rng, burstMinLength, burstMaxLength))
+			s.burstAt = s.burstUntil.Add(randDuration(rng, burstMinPeriod, burstMaxPeriod))
+		}
+		if now.Before(s.burstUntil) {
+			return s.max
+		}
+	}
+	return s.rate
+}
+
+func randDuration(rng *rand.Rand, lo, hi time.Duration) time.Duration {
+	return lo + time.Duration(rng.Int63n(int64(hi-lo)+1))
+}
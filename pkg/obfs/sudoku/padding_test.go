@@ -0,0 +1,129 @@
+package sudoku
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidatePaddingStrategy(t *testing.T) {
+	for _, name := range append(PaddingStrategies(), "", "Random-Walk") {
+		if err := ValidatePaddingStrategy(name); err != nil {
+			t.Fatalf("%q rejected: %v", name, err)
+		}
+	}
+	if err := ValidatePaddingStrategy("sawtooth"); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
+
+func TestPaddingSchedulesStayInRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, name := range PaddingStrategies() {
+		s, err := newPaddingSchedule(name, 10, 40, rng)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := 0; i < 5000; i++ {
+			r := s.next(1024, rng)
+			if r < 0.10-1e-6 || r > 0.40+1e-6 {
+				t.Fatalf("%s: rate %.4f outside [0.10, 0.40] at write %d", name, r, i)
+			}
+		}
+	}
+}
+
+func TestPaddingScheduleShapes(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	front, _ := newPaddingSchedule(PaddingFront, 10, 40, rng)
+	if r := front.next(1024, rng); r != 0.40 {
+		t.Fatalf("front: first write rate = %.3f, want max", r)
+	}
+	front.next(frontBytes, rng)
+	if r := front.next(1024, rng); r != front.rate {
+		t.Fatalf("front: rate after the first KB = %.3f, want base %.3f", r, front.rate)
+	}
+
+	decay, _ := newPaddingSchedule(PaddingDecay, 10, 40, rng)
+	prev := decay.next(0, rng)
+	for i := 0; i < 100; i++ {
+		r := decay.next(16*1024, rng)
+		if r > prev {
+			t.Fatalf("decay: rate rose from %.4f to %.4f", prev, r)
+		}
+		prev = r
+	}
+	if prev > 0.11 {
+		t.Fatalf("decay: rate %.4f did not approach the minimum", prev)
+	}
+
+	walk, _ := newPaddingSchedule(PaddingRandomWalk, 10, 40, rng)
+	seen := map[float32]bool{}
+	for i := 0; i < 50; i++ {
+		seen[walk.next(100, rng)] = true
+	}
+	if len(seen) < 10 {
+		t.Fatalf("random-walk: only %d distinct rates", len(seen))
+	}
+
+	burst, _ := newPaddingSchedule(PaddingBurst, 10, 40, rng)
+	if r := burst.next(100, rng); r == 0.40 {
+		t.Fatalf("burst: started inside a burst")
+	}
+	burst.burstAt = time.Now().Add(-time.Millisecond)
+	if r := burst.next(100, rng); r != 0.40 {
+		t.Fatalf("burst: scheduled burst not applied, rate %.3f", r)
+	}
+}
+
+func TestPaddingStrategiesRoundTrip(t *testing.T) {
+	table := NewTable("padding-strategy-key", "prefer_entropy")
+	payload := bytes.Repeat([]byte("adaptive-padding-"), 3000)
+
+	for _, name := range PaddingStrategies() {
+		for _, packed := range []bool{false, true} {
+			a, b := net.Pipe()
+			var w io.Writer
+			var r io.Reader
+			var flush func() error
+			if packed {
+				pc := NewPackedConn(a, table, 5, 60)
+				if err := pc.SetPaddingStrategy(name); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				w, flush = pc, pc.Flush
+				r = NewPackedConn(b, table, 5, 60)
+			} else {
+				c := NewConn(a, table, 5, 60, false)
+				if err := c.SetPaddingStrategy(name); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				w = c
+				r = NewConn(b, table, 5, 60, false)
+			}
+
+			go func() {
+				for off := 0; off < len(payload); off += 700 {
+					end := off + 700
+					if end > len(payload) {
+						end = len(payload)
+					}
+					w.Write(payload[off:end])
+				}
+				if flush != nil {
+					flush()
+				}
+			}()
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("%s packed=%v: round trip failed: %v", name, packed, err)
+			}
+			a.Close()
+			b.Close()
+		}
+	}
+}
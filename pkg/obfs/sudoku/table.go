@@ -152,3 +152,19 @@ func packHintsToKey(hints [4]byte) uint32 {
 
 	return uint32(hints[0])<<24 | uint32(hints[1])<<16 | uint32(hints[2])<<8 | uint32(hints[3])
 }
+
+// FillerBytes returns padding bytes that both the pure and the packed decoder skip
+// without side effects (the packed pad marker is excluded). Layers beneath the codec
+// can insert them anywhere in the stream.
+func (t *Table) FillerBytes() []byte {
+	out := make([]byte, 0, len(t.PaddingPool))
+	for _, b := range t.PaddingPool {
+		if b != t.layout.padMarker {
+			out = append(out, b)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, t.PaddingPool...)
+	}
+	return out
+}
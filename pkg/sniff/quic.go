@@ -0,0 +1,265 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	quicVersion1          = 0x00000001
+	maxQUICInitialPackets = 4
+	maxQUICCryptoData     = 64 * 1024
+)
+
+// RFC 9001 §5.2
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var errQUICMalformed = errors.New("sniff: malformed quic packet")
+
+// QUICSniffer reassembles the ClientHello from the CRYPTO frames of one
+// connection's client Initial packets (QUIC v1), which may span several
+// datagrams when the ClientHello is large. The zero value is ready to use.
+type QUICSniffer struct {
+	dcid    []byte
+	keys    *quicInitialKeys
+	crypto  map[uint64][]byte
+	size    int
+	packets int
+}
+
+// Add feeds one client datagram. It returns ErrIncomplete while more Initial
+// packets are needed, and gives up with ErrNoServerName after a few packets.
+func (s *QUICSniffer) Add(datagram []byte) (string, error) {
+	matched := false
+	for len(datagram) > 0 {
+		n, err := s.addPacket(datagram)
+		if err != nil {
+			if matched {
+				break
+			}
+			return "", err
+		}
+		matched = true
+		datagram = datagram[n:]
+	}
+	s.packets++
+
+	name, err := clientHelloServerName(s.assemble())
+	if err == ErrIncomplete && s.packets >= maxQUICInitialPackets {
+		return "", ErrNoServerName
+	}
+	return name, err
+}
+
+// addPacket decrypts one Initial packet and returns its length within the datagram.
+func (s *QUICSniffer) addPacket(p []byte) (int, error) {
+	if len(p) < 7 || p[0]&0x80 == 0 || binary.BigEndian.Uint32(p[1:5]) != quicVersion1 || (p[0]>>4)&0x03 != 0 {
+		return 0, ErrNotMatched
+	}
+	r := reader(p[5:])
+	dcid, ok1 := r.vector(1)
+	_, ok2 := r.vector(1) // scid
+	if !ok1 || !ok2 || len(dcid) > 20 {
+		return 0, errQUICMalformed
+	}
+	tokenLen, ok1 := r.varint()
+	if !ok1 || !r.skip(int(tokenLen)) {
+		return 0, errQUICMalformed
+	}
+	length, ok := r.varint()
+	if !ok {
+		return 0, errQUICMalformed
+	}
+	pnOffset := len(p) - len(r)
+	end := pnOffset + int(length)
+	if length > uint64(len(p)) || end > len(p) || pnOffset+4+16 > end {
+		return 0, errQUICMalformed
+	}
+
+	if s.keys == nil {
+		s.dcid = append([]byte(nil), dcid...)
+		keys, err := newQUICInitialKeys(s.dcid)
+		if err != nil {
+			return 0, err
+		}
+		s.keys = keys
+	} else if string(dcid) != string(s.dcid) {
+		return 0, ErrNotMatched
+	}
+
+	plain, err := s.keys.open(p[:end], pnOffset)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.collectFrames(plain); err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+func (s *QUICSniffer) collectFrames(f reader) error {
+	for len(f) > 0 {
+		typ, ok := f.varint()
+		if !ok {
+			return errQUICMalformed
+		}
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			var n [4]uint64
+			for i := range n {
+				if n[i], ok = f.varint(); !ok {
+					return errQUICMalformed
+				}
+			}
+			extra := 2 * n[2]
+			if typ == 0x03 {
+				extra += 3
+			}
+			for ; extra > 0; extra-- {
+				if _, ok := f.varint(); !ok {
+					return errQUICMalformed
+				}
+			}
+		case 0x06: // CRYPTO
+			offset, ok1 := f.varint()
+			length, ok2 := f.varint()
+			if !ok1 || !ok2 || length > uint64(len(f)) {
+				return errQUICMalformed
+			}
+			if s.size+int(length) > maxQUICCryptoData {
+				return ErrNoServerName
+			}
+			if s.crypto == nil {
+				s.crypto = make(map[uint64][]byte)
+			}
+			s.crypto[offset] = append([]byte(nil), f[:length]...)
+			s.size += int(length)
+			f = f[length:]
+		default:
+			// Client Initials carry nothing else we need.
+			return nil
+		}
+	}
+	return nil
+}
+
+// assemble returns the contiguous CRYPTO stream from offset 0.
+func (s *QUICSniffer) assemble() []byte {
+	var buf []byte
+	for progress := true; progress; {
+		progress = false
+		for off, data := range s.crypto {
+			pos := uint64(len(buf))
+			if off <= pos && off+uint64(len(data)) > pos {
+				buf = append(buf, data[pos-off:]...)
+				progress = true
+			}
+		}
+	}
+	return buf
+}
+
+type quicInitialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// quicClientInitialSecret derives client_initial_secret from the original DCID.
+func quicClientInitialSecret(dcid []byte) ([]byte, error) {
+	initial, err := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	if err != nil {
+		return nil, err
+	}
+	return hkdfExpandLabel(initial, "client in", 32)
+}
+
+func newQUICInitialKeys(dcid []byte) (*quicInitialKeys, error) {
+	client, err := quicClientInitialSecret(dcid)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdfExpandLabel(client, "quic key", 16)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdfExpandLabel(client, "quic iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	hpKey, err := hkdfExpandLabel(client, "quic hp", 16)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	return &quicInitialKeys{aead: aead, iv: iv, hp: hp}, nil
+}
+
+// hkdfExpandLabel implements TLS 1.3 HKDF-Expand-Label with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// open removes header protection and decrypts the packet payload.
+func (k *quicInitialKeys) open(p []byte, pnOffset int) ([]byte, error) {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, p[pnOffset+4:pnOffset+4+16])
+
+	hdr := append([]byte(nil), p[:pnOffset+4]...)
+	hdr[0] ^= mask[0] & 0x0f
+	pnLen := int(hdr[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		hdr[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(hdr[pnOffset+i])
+	}
+
+	nonce := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return k.aead.Open(nil, nonce, p[pnOffset+pnLen:], hdr[:pnOffset+pnLen])
+}
+
+// varint reads a QUIC variable-length integer (RFC 9000 §16).
+func (r *reader) varint() (uint64, bool) {
+	if len(*r) == 0 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	if len(*r) < n {
+		return 0, false
+	}
+	v := uint64((*r)[0] & 0x3f)
+	for _, b := range (*r)[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
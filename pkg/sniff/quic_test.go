@@ -0,0 +1,104 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestQUICInitialKeys(t *testing.T) {
+	// RFC 9001 Appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	keys, err := newQUICInitialKeys(dcid)
+	if err != nil {
+		t.Fatalf("derive: %v", err)
+	}
+	if got := hex.EncodeToString(keys.iv); got != "fa044b2f42a3fd3b46fb255c" {
+		t.Fatalf("iv: %s", got)
+	}
+
+	client, _ := quicClientInitialSecret(dcid)
+	key, _ := hkdfExpandLabel(client, "quic key", 16)
+	hp, _ := hkdfExpandLabel(client, "quic hp", 16)
+	if hex.EncodeToString(key) != "1f369613dd76d5467730efcbe3b1a22d" {
+		t.Fatalf("key: %x", key)
+	}
+	if hex.EncodeToString(hp) != "9f50449e04a0e810283a1e9933adedd2" {
+		t.Fatalf("hp: %x", hp)
+	}
+}
+
+func TestQUICSnifferAcrossPackets(t *testing.T) {
+	records := captureClientHello(t, "quic.example.org")
+	// 去掉 TLS 记录头，QUIC 在 CRYPTO 帧中直接承载握手消息
+	hs := records[5:]
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	keys, err := newQUICInitialKeys(dcid)
+	if err != nil {
+		t.Fatalf("derive: %v", err)
+	}
+
+	half := len(hs) / 2
+	var s QUICSniffer
+	// 第二段先到：乱序也应能拼出完整 ClientHello
+	p2 := sealInitial(t, keys, dcid, 1, cryptoFrame(uint64(half), hs[half:]))
+	if _, err := s.Add(p2); err != ErrIncomplete {
+		t.Fatalf("first datagram: expected ErrIncomplete, got %v", err)
+	}
+	p1 := sealInitial(t, keys, dcid, 0, cryptoFrame(0, hs[:half]))
+	name, err := s.Add(p1)
+	if err != nil || name != "quic.example.org" {
+		t.Fatalf("got %q, %v", name, err)
+	}
+
+	var other QUICSniffer
+	if _, err := other.Add([]byte{0x40, 0x01, 0x02, 0x03}); err != ErrNotMatched {
+		t.Fatalf("short header: expected ErrNotMatched, got %v", err)
+	}
+}
+
+func cryptoFrame(offset uint64, data []byte) []byte {
+	f := []byte{0x06}
+	f = appendVarint(f, offset)
+	f = appendVarint(f, uint64(len(data)))
+	f = append(f, data...)
+	// 客户端 Initial 通常带填充
+	return append(f, make([]byte, 32)...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	default:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	}
+}
+
+// sealInitial builds a protected client Initial with a 2-byte packet number.
+func sealInitial(t *testing.T, k *quicInitialKeys, dcid []byte, pn uint16, payload []byte) []byte {
+	t.Helper()
+	hdr := []byte{0xc1, 0, 0, 0, 1, byte(len(dcid))}
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, 0) // scid
+	hdr = append(hdr, 0) // token
+	length := 2 + len(payload) + k.aead.Overhead()
+	hdr = appendVarint(hdr, uint64(length))
+	pnOffset := len(hdr)
+	hdr = binary.BigEndian.AppendUint16(hdr, pn)
+
+	nonce := append([]byte(nil), k.iv...)
+	nonce[len(nonce)-1] ^= byte(pn)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	packet := k.aead.Seal(bytes.Clone(hdr), nonce, payload, hdr)
+
+	mask := make([]byte, 16)
+	k.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+20])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
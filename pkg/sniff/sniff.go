@@ -0,0 +1,102 @@
+// Package sniff extracts the destination domain from the first bytes of a
+// connection: the TLS ClientHello SNI, the HTTP Host header, or the SNI inside
+// a QUIC Initial packet.
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	// ErrIncomplete means the data is a prefix of a recognised protocol; read more and retry.
+	ErrIncomplete = errors.New("sniff: need more data")
+	// ErrNotMatched means the data is not a protocol this package understands.
+	ErrNotMatched = errors.New("sniff: protocol not recognized")
+	// ErrNoServerName means the protocol was recognised but carries no usable domain.
+	ErrNoServerName = errors.New("sniff: no server name")
+)
+
+// maxHTTPHeader bounds how far HTTPHost scans for the end of the request header.
+const maxHTTPHeader = 8 * 1024
+
+// Stream sniffs a TCP stream prefix as TLS or HTTP.
+func Stream(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", ErrIncomplete
+	}
+	if data[0] == recordTypeHandshake {
+		return TLSServerName(data)
+	}
+	return HTTPHost(data)
+}
+
+var httpMethods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE", "CONNECT"}
+
+// HTTPHost returns the host (without port) from an HTTP/1.x request header.
+func HTTPHost(data []byte) (string, error) {
+	sp := bytes.IndexByte(data, ' ')
+	if sp < 0 {
+		if len(data) > len("OPTIONS") {
+			return "", ErrNotMatched
+		}
+		for _, m := range httpMethods {
+			if strings.HasPrefix(m, string(data)) {
+				return "", ErrIncomplete
+			}
+		}
+		return "", ErrNotMatched
+	}
+	known := false
+	for _, m := range httpMethods {
+		if string(data[:sp]) == m {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return "", ErrNotMatched
+	}
+
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	header := data
+	if end >= 0 {
+		header = data[:end]
+	}
+	lines := bytes.Split(header, []byte("\r\n"))
+	for i, line := range lines {
+		if i == 0 || (end < 0 && i == len(lines)-1) {
+			// Skip the request line and a possibly truncated last line.
+			continue
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(bytes.TrimSpace(name)), "Host") {
+			continue
+		}
+		return normalizeDomain(string(bytes.TrimSpace(value)))
+	}
+	if end < 0 && len(data) < maxHTTPHeader {
+		return "", ErrIncomplete
+	}
+	return "", ErrNoServerName
+}
+
+// normalizeDomain strips a port and trailing dot and rejects IP literals.
+func normalizeDomain(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if host == "" || net.ParseIP(host) != nil {
+		return "", ErrNoServerName
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return "", ErrNoServerName
+		}
+	}
+	return host, nil
+}
@@ -0,0 +1,73 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the first TLS records a crypto/tls client sends.
+func captureClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		defer c.Close()
+		_ = tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+
+	var data []byte
+	buf := make([]byte, 4096)
+	_ = s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := s.Read(buf)
+		data = append(data, buf[:n]...)
+		if _, serr := TLSServerName(data); serr != ErrIncomplete || err != nil {
+			return data
+		}
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	hello := captureClientHello(t, "Example.COM")
+	name, err := Stream(hello)
+	if err != nil || name != "example.com" {
+		t.Fatalf("got %q, %v", name, err)
+	}
+
+	for _, n := range []int{1, 5, 40, len(hello) - 1} {
+		if _, err := TLSServerName(hello[:n]); err != ErrIncomplete {
+			t.Fatalf("prefix %d: expected ErrIncomplete, got %v", n, err)
+		}
+	}
+
+	// 按 IP 连接时 crypto/tls 不发送 SNI
+	if _, err := TLSServerName(captureClientHello(t, "10.0.0.1")); err != ErrNoServerName {
+		t.Fatalf("expected ErrNoServerName, got %v", err)
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	cases := []struct {
+		in   string
+		host string
+		err  error
+	}{
+		{"GET / HTTP/1.1\r\nHost: Example.com:8080\r\nAccept: */*\r\n\r\n", "example.com", nil},
+		{"POST /x HTTP/1.1\r\nUser-Agent: t\r\nhost:a.b\r\n\r\n", "a.b", nil},
+		{"GET / HTTP/1.1\r\nHost: 1.2.3.4\r\n\r\n", "", ErrNoServerName},
+		{"GET / HTTP/1.1\r\n\r\n", "", ErrNoServerName},
+		{"GET / HTTP/1.1\r\nHost: exam", "", ErrIncomplete},
+		{"PO", "", ErrIncomplete},
+		{"SSH-2.0-OpenSSH\r\n", "", ErrNotMatched},
+		{"\x00\x01\x02", "", ErrNotMatched},
+	}
+	for _, c := range cases {
+		host, err := Stream([]byte(c.in))
+		if host != c.host || !errors.Is(err, c.err) {
+			t.Errorf("%q: got %q, %v; want %q, %v", c.in, host, err, c.host, c.err)
+		}
+	}
+}
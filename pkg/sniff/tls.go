@@ -0,0 +1,158 @@
+package sniff
+
+import "encoding/binary"
+
+const (
+	recordTypeHandshake    = 0x16
+	handshakeClientHello   = 0x01
+	extensionServerName    = 0x0000
+	serverNameTypeHostName = 0x00
+
+	maxClientHello = 64 * 1024
+)
+
+// TLSServerName returns the SNI from a TLS ClientHello, which may span several records.
+func TLSServerName(data []byte) (string, error) {
+	var hs []byte
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return "", ErrIncomplete
+		}
+		if data[0] != recordTypeHandshake || data[1] != 0x03 {
+			if hs == nil {
+				return "", ErrNotMatched
+			}
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			hs = append(hs, data[5:]...)
+			break
+		}
+		hs = append(hs, data[5:5+n]...)
+		data = data[5+n:]
+		if len(hs) >= 4 && len(hs) >= 4+handshakeLen(hs) {
+			break
+		}
+	}
+	name, err := clientHelloServerName(hs)
+	if err == ErrIncomplete && len(hs) >= maxClientHello {
+		return "", ErrNoServerName
+	}
+	return name, err
+}
+
+func handshakeLen(hs []byte) int {
+	return int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+}
+
+// clientHelloServerName parses a handshake message (without record framing),
+// as carried in TLS records or QUIC CRYPTO frames.
+func clientHelloServerName(hs []byte) (string, error) {
+	if len(hs) < 4 {
+		return "", ErrIncomplete
+	}
+	if hs[0] != handshakeClientHello {
+		return "", ErrNotMatched
+	}
+	n := handshakeLen(hs)
+	if n > maxClientHello {
+		return "", ErrNotMatched
+	}
+	if len(hs) < 4+n {
+		return "", ErrIncomplete
+	}
+	r := reader(hs[4 : 4+n])
+
+	// legacy_version, random
+	if !r.skip(2 + 32) {
+		return "", ErrNotMatched
+	}
+	// session_id, cipher_suites, compression_methods
+	if !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", ErrNotMatched
+	}
+	if len(r) == 0 {
+		return "", ErrNoServerName
+	}
+	exts, ok := r.vector(2)
+	if !ok {
+		return "", ErrNotMatched
+	}
+	for len(exts) > 0 {
+		typ, ok1 := exts.uint16()
+		body, ok2 := exts.vector(2)
+		if !ok1 || !ok2 {
+			return "", ErrNotMatched
+		}
+		if typ != extensionServerName {
+			continue
+		}
+		list, ok := body.vector(2)
+		if !ok {
+			return "", ErrNotMatched
+		}
+		for len(list) > 0 {
+			nameType, ok1 := list.uint8()
+			name, ok2 := list.vector(2)
+			if !ok1 || !ok2 {
+				return "", ErrNotMatched
+			}
+			if nameType == serverNameTypeHostName {
+				return normalizeDomain(string(name))
+			}
+		}
+	}
+	return "", ErrNoServerName
+}
+
+// reader is a minimal big-endian cursor over TLS vectors.
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (byte, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a length-prefixed byte string with a lenSize-byte length.
+func (r *reader) vector(lenSize int) (reader, bool) {
+	if len(*r) < lenSize {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:lenSize] {
+		n = n<<8 | int(b)
+	}
+	if len(*r) < lenSize+n {
+		return nil, false
+	}
+	v := (*r)[lenSize : lenSize+n]
+	*r = (*r)[lenSize+n:]
+	return v, true
+}
+
+func (r *reader) skipVector(lenSize int) bool {
+	_, ok := r.vector(lenSize)
+	return ok
+}
@@ -0,0 +1,278 @@
+// Package httpstream carries a byte stream over plain HTTP/1.1 requests that
+// survive buffering intermediaries: the uplink is a sequence of size-bounded
+// POSTs and the downlink a single long-lived chunked GET response. Requests of
+// one stream are correlated by a random session token in the query string.
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+)
+
+const (
+	// DefaultMaxPost bounds one uplink POST body when ClientOptions.MaxPost is unset.
+	DefaultMaxPost = 64 * 1024
+	// MaxPostLimit is the largest POST body a server accepts.
+	MaxPostLimit = 1 << 20
+
+	tokenLen          = 32 // hex characters
+	uplinkIdleTimeout = 2 * time.Minute
+	sessionWait       = 10 * time.Second // how long a POST waits for its GET to arrive
+)
+
+var (
+	// ErrUplinkServed is returned by Server.Serve once an uplink connection has
+	// been fully served; the connection carries no stream of its own.
+	ErrUplinkServed = errors.New("httpstream: uplink connection finished")
+	ErrBadRequest   = errors.New("httpstream: malformed request")
+	ErrNoSession    = errors.New("httpstream: unknown session")
+	ErrRejected     = errors.New("httpstream: request rejected by server")
+)
+
+// Match reports whether a raw request header belongs to a stream on path:
+// a GET or POST whose path (query ignored) equals path.
+func Match(header []byte, path string) bool {
+	line, _, _ := bytes.Cut(header, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 || (fields[0] != http.MethodGet && fields[0] != http.MethodPost) {
+		return false
+	}
+	p, _, _ := strings.Cut(fields[1], "?")
+	return p == path
+}
+
+// ClientOptions describes the client side of a stream.
+type ClientOptions struct {
+	Host    string                   // Host header
+	Path    string                   // request path shared by the GET and the POSTs
+	MaxPost int                      // largest POST body, DefaultMaxPost when <= 0, at most MaxPostLimit
+	Dial    func() (net.Conn, error) // opens connections for uplink POSTs
+	Headers map[string]string        // extra headers sent on the GET and every POST
+}
+
+// Client sends the downlink GET on conn and returns the stream without waiting
+// for the response: the server answers only after the handshake carried by the
+// first POSTs checks out, so the response header is read on the first Read.
+// Uplink POSTs are sent on connections obtained from opts.Dial and reused while
+// the server keeps them alive.
+func Client(conn net.Conn, opts ClientOptions) (net.Conn, error) {
+	if opts.MaxPost <= 0 {
+		opts.MaxPost = DefaultMaxPost
+	}
+	opts.MaxPost = min(opts.MaxPost, MaxPostLimit)
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	var raw [tokenLen / 2]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, err
+	}
+	c := &clientConn{down: conn, opts: opts, token: hex.EncodeToString(raw[:]), ua: httpmask.RandomUserAgent()}
+	names := make([]string, 0, len(opts.Headers))
+	for name := range opts.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.extra += name + ": " + opts.Headers[name] + "\r\n"
+	}
+
+	req := fmt.Sprintf("GET %s?s=%s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\n%sAccept: */*\r\nCache-Control: no-cache\r\nConnection: keep-alive\r\n\r\n",
+		opts.Path, c.token, opts.Host, c.ua, c.extra)
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type clientConn struct {
+	down     net.Conn
+	respOnce sync.Once
+	body     io.ReadCloser
+	respErr  error
+	opts     ClientOptions
+	token    string
+	ua       string
+	extra    string // opts.Headers rendered as header lines
+
+	mu       sync.Mutex // serialises uplink POSTs
+	upReader *bufio.Reader
+	seq      uint64
+
+	stateMu       sync.Mutex // guards up and writeDeadline; never held across I/O
+	up            net.Conn
+	writeDeadline time.Time
+	closed        bool
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	c.respOnce.Do(c.readResponse)
+	if c.respErr != nil {
+		return 0, c.respErr
+	}
+	return c.body.Read(p)
+}
+
+func (c *clientConn) readResponse() {
+	resp, err := http.ReadResponse(bufio.NewReader(c.down), &http.Request{Method: http.MethodGet})
+	if err != nil {
+		c.respErr = err
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		c.respErr = fmt.Errorf("%w: downlink status %s", ErrRejected, resp.Status)
+		return
+	}
+	c.body = resp.Body
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > c.opts.MaxPost {
+			chunk = chunk[:c.opts.MaxPost]
+		}
+		reused := c.upReader != nil
+		err := c.post(chunk)
+		if err != nil && reused && !errors.Is(err, ErrRejected) {
+			// 复用的连接可能已被服务端或中间代理关闭；换新连接重发一次，服务端按序号去重
+			err = c.post(chunk)
+		}
+		if err != nil {
+			return written, err
+		}
+		c.seq++
+		written += len(chunk)
+	}
+	return len(p), nil
+}
+
+// post sends one uplink chunk. The uplink connection is dropped after any error.
+func (c *clientConn) post(body []byte) error {
+	up, deadline, err := c.uplink()
+	if err != nil {
+		return err
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			c.dropUplink(up)
+		}
+	}()
+
+	up.SetDeadline(deadline)
+	req := make([]byte, 0, 256+len(body))
+	req = fmt.Appendf(req, "POST %s?s=%s&n=%d HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\n%sContent-Type: application/octet-stream\r\nContent-Length: %d\r\nConnection: keep-alive\r\n\r\n",
+		c.opts.Path, c.token, c.seq, c.opts.Host, c.ua, c.extra, len(body))
+	req = append(req, body...)
+	if _, err := up.Write(req); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(c.upReader, &http.Request{Method: http.MethodPost})
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return &rejectedError{status: resp.Status}
+	}
+	keep = !resp.Close
+	return nil
+}
+
+// uplink returns the current uplink connection, dialing a new one if needed.
+func (c *clientConn) uplink() (net.Conn, time.Time, error) {
+	c.stateMu.Lock()
+	up, deadline, closed := c.up, c.writeDeadline, c.closed
+	c.stateMu.Unlock()
+	if closed {
+		return nil, deadline, net.ErrClosed
+	}
+	if up != nil {
+		return up, deadline, nil
+	}
+
+	up, err := c.opts.Dial()
+	if err != nil {
+		return nil, deadline, err
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.closed {
+		up.Close()
+		return nil, deadline, net.ErrClosed
+	}
+	c.up, c.upReader = up, bufio.NewReader(up)
+	return up, c.writeDeadline, nil
+}
+
+func (c *clientConn) dropUplink(up net.Conn) {
+	up.Close()
+	c.stateMu.Lock()
+	if c.up == up {
+		c.up = nil
+	}
+	c.stateMu.Unlock()
+	c.upReader = nil
+}
+
+type rejectedError struct{ status string }
+
+func (e *rejectedError) Error() string { return "httpstream: uplink status " + e.status }
+func (e *rejectedError) Unwrap() error { return ErrRejected }
+
+func (c *clientConn) Close() error {
+	c.stateMu.Lock()
+	if c.closed {
+		c.stateMu.Unlock()
+		return nil
+	}
+	c.closed = true
+	up := c.up
+	c.stateMu.Unlock()
+
+	if up != nil {
+		up.Close()
+	}
+	return c.down.Close()
+}
+
+func (c *clientConn) LocalAddr() net.Addr  { return c.down.LocalAddr() }
+func (c *clientConn) RemoteAddr() net.Addr { return c.down.RemoteAddr() }
+
+func (c *clientConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.down.SetReadDeadline(t)
+}
+
+func (c *clientConn) SetReadDeadline(t time.Time) error { return c.down.SetReadDeadline(t) }
+
+// SetWriteDeadline applies to the POST in flight as well as later ones.
+func (c *clientConn) SetWriteDeadline(t time.Time) error {
+	c.stateMu.Lock()
+	c.writeDeadline = t
+	up := c.up
+	c.stateMu.Unlock()
+	if up != nil {
+		up.SetDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+)
+
+func startServer(t *testing.T) (string, <-chan net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	srv := NewServer()
+	srv.sessionWait = time.Second
+	streams := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				br := bufio.NewReader(c)
+				header, err := httpmask.ConsumeHeader(br)
+				if err != nil || !Match(header, "/s") {
+					c.Close()
+					return
+				}
+				stream, err := srv.Serve(c, header, br)
+				if err != nil {
+					c.Close()
+					return
+				}
+				streams <- stream
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), streams
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	addr, streams := startServer(t)
+	dial := func() (net.Conn, error) { return net.Dial("tcp", addr) }
+
+	down, _ := dial()
+	client, err := Client(down, ClientOptions{Host: "example.com", Path: "/s", MaxPost: 1000, Dial: dial})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	defer client.Close()
+	server := <-streams
+	defer server.Close()
+
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	go client.Write(payload)
+	got := make([]byte, len(payload))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("uplink mismatch: %v", err)
+	}
+
+	// 重传的 POST 被确认但不会重复写入
+	c := client.(*clientConn)
+	c.mu.Lock()
+	c.seq--
+	if err := c.post([]byte("dup")); err != nil {
+		t.Fatalf("retransmit rejected: %v", err)
+	}
+	c.seq++
+	c.mu.Unlock()
+
+	go server.Write([]byte("downlink"))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "downlink" {
+		t.Fatalf("downlink: %q %v", buf, err)
+	}
+	go client.Write([]byte("next"))
+	buf = buf[:4]
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "next" {
+		t.Fatalf("after retransmit: %q %v", buf, err)
+	}
+}
+
+func TestUnknownSessionLeavesRestUnread(t *testing.T) {
+	srv := NewServer()
+	srv.sessionWait = 50 * time.Millisecond
+	header := "POST /s?s=00112233445566778899aabbccddeeff&n=0 HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\n\r\n"
+	if _, err := srv.Serve(nil, []byte(header), failReader{t}); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("expected ErrNoSession, got %v", err)
+	}
+}
+
+func TestClientSendsExtraHeaders(t *testing.T) {
+	downClient, downServer := net.Pipe()
+	defer downServer.Close()
+	posts := make(chan net.Conn, 1)
+	dial := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		posts <- s
+		return c, nil
+	}
+	headers := make(chan string, 1)
+	go func() {
+		header, _ := httpmask.ConsumeHeader(bufio.NewReader(downServer))
+		headers <- string(header)
+	}()
+
+	client, err := Client(downClient, ClientOptions{Host: "example.com", Path: "/s", Dial: dial, Headers: map[string]string{"X-Token": "secret"}})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	defer client.Close()
+	if get := <-headers; !strings.Contains(get, "\r\nX-Token: secret\r\n") {
+		t.Fatalf("GET lacks the extra header: %q", get)
+	}
+
+	go client.Write([]byte("x"))
+	up := <-posts
+	defer up.Close()
+	post, err := httpmask.ConsumeHeader(bufio.NewReader(up))
+	if err != nil || !strings.Contains(string(post), "\r\nX-Token: secret\r\n") {
+		t.Fatalf("POST lacks the extra header: %q %v", post, err)
+	}
+}
+
+func TestBrokenPostRetransmitDeliveredOnce(t *testing.T) {
+	addr, streams := startServer(t)
+	dial := func() (net.Conn, error) { return net.Dial("tcp", addr) }
+
+	down, _ := dial()
+	client, err := Client(down, ClientOptions{Host: "example.com", Path: "/s", Dial: dial})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	defer client.Close()
+	server := <-streams
+	defer server.Close()
+
+	// 请求体只发出一半就断开：服务端不能把这半截写进流
+	broken, _ := dial()
+	fmt.Fprintf(broken, "POST /s?s=%s&n=0 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\n01234", client.(*clientConn).token)
+	time.Sleep(100 * time.Millisecond)
+	broken.Close()
+
+	go client.Write([]byte("0123456789next"))
+	got := make([]byte, 14)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "0123456789next" {
+		t.Fatalf("uplink after broken POST: %q %v", got, err)
+	}
+}
+
+type failReader struct{ t *testing.T }
+
+func (r failReader) Read([]byte) (int, error) {
+	r.t.Error("rest read for a malformed request")
+	return 0, io.EOF
+}
+
+func TestMalformedRequestLeavesRestUnread(t *testing.T) {
+	srv := NewServer()
+	for _, header := range []string{
+		"PUT /s?s=00112233445566778899aabbccddeeff HTTP/1.1\r\nHost: x\r\n\r\n",
+		"GET /s?s=short HTTP/1.1\r\nHost: x\r\n\r\n",
+		"POST /s?s=00112233445566778899aabbccddeeff&n=x HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\n\r\n",
+	} {
+		if _, err := srv.Serve(nil, []byte(header), failReader{t}); !errors.Is(err, ErrBadRequest) {
+			t.Fatalf("%q: expected ErrBadRequest, got %v", header, err)
+		}
+	}
+}
+
+func TestRejectedStreamSendsNoResponse(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	srv := NewServer()
+
+	go func() {
+		br := bufio.NewReader(serverSide)
+		header, err := httpmask.ConsumeHeader(br)
+		if err != nil {
+			return
+		}
+		stream, err := srv.Serve(serverSide, header, br)
+		if err != nil {
+			return
+		}
+		down, ok := Reject(stream)
+		if !ok {
+			serverSide.Close()
+			return
+		}
+		// 已拒绝的流不会再应答
+		if err := Accept(stream); err == nil {
+			t.Error("accept after reject succeeded")
+		}
+		io.WriteString(down, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	stream, err := Client(clientSide, ClientOptions{Host: "example.com", Path: "/s", Dial: func() (net.Conn, error) { return nil, errors.New("unused") }})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	clientSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected the fallback's 404, got %v", err)
+	}
+}
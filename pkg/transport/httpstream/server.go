@@ -0,0 +1,315 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Server tracks open streams so that uplink POSTs arriving on any connection
+// reach the stream opened by the matching GET.
+type Server struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	changed  chan struct{} // closed and replaced whenever a session registers
+
+	sessionWait time.Duration
+}
+
+// NewServer returns an empty stream registry.
+func NewServer() *Server {
+	return &Server{sessions: make(map[string]*session), changed: make(chan struct{}), sessionWait: sessionWait}
+}
+
+// Serve handles a connection whose first request header has already been read
+// into header; rest holds the bytes that follow it. A downlink GET returns the
+// stream, which the caller owns and must settle with Accept or Reject. Uplink
+// POSTs are served until the connection closes, after which ErrUplinkServed is
+// returned. A malformed request yields ErrBadRequest, and a POST whose stream
+// does not open within the session wait ErrNoSession, both before rest is read,
+// so the connection can still be handed to a fallback.
+func (s *Server) Serve(conn net.Conn, header []byte, rest io.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	query := req.URL.Query()
+	token := query.Get("s")
+	if _, err := hex.DecodeString(token); err != nil || len(token) != tokenLen {
+		return nil, ErrBadRequest
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		return s.openStream(conn, token)
+	case http.MethodPost:
+		if _, err := strconv.ParseUint(query.Get("n"), 10, 64); err != nil {
+			return nil, ErrBadRequest
+		}
+		if s.await(token) == nil {
+			return nil, ErrNoSession
+		}
+		br := bufio.NewReader(io.MultiReader(bytes.NewReader(header), rest))
+		if req, err = http.ReadRequest(br); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		s.serveUplink(conn, br, req)
+		return nil, ErrUplinkServed
+	default:
+		return nil, ErrBadRequest
+	}
+}
+
+// openStream registers the session without answering the GET; the response
+// is sent by Accept (or the first Write) once the caller trusts the stream.
+func (s *Server) openStream(conn net.Conn, token string) (net.Conn, error) {
+	up, upWriter := net.Pipe()
+	sess := &session{server: s, token: token, down: conn, up: up, upWriter: upWriter}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[token]; exists {
+		return nil, fmt.Errorf("%w: duplicate session", ErrBadRequest)
+	}
+	s.sessions[token] = sess
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return sess, nil
+}
+
+// Accept answers the downlink GET of a stream returned by Serve.
+func Accept(stream net.Conn) error {
+	sess, ok := stream.(*session)
+	if !ok {
+		return fmt.Errorf("httpstream: not a server stream")
+	}
+	sess.downMu.Lock()
+	defer sess.downMu.Unlock()
+	return sess.respond()
+}
+
+// Reject abandons a stream returned by Serve whose GET has not been answered
+// yet and returns the downlink connection, untouched after the request header,
+// for the caller to hand elsewhere. ok is false once the GET has been answered
+// or the stream closed.
+func Reject(stream net.Conn) (down net.Conn, ok bool) {
+	sess, isSession := stream.(*session)
+	if !isSession {
+		return nil, false
+	}
+	sess.downMu.Lock()
+	if sess.responded || sess.detached {
+		sess.downMu.Unlock()
+		return nil, false
+	}
+	sess.detached = true
+	sess.downMu.Unlock()
+
+	sess.closeOnce.Do(func() {
+		sess.unregister()
+		sess.up.Close()
+		sess.upWriter.Close()
+		ok = true
+	})
+	if !ok {
+		return nil, false
+	}
+	sess.down.SetDeadline(time.Time{})
+	return sess.down, true
+}
+
+func (s *Server) lookup(token string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[token]
+}
+
+// await looks up a session, waiting up to sessionWait for it to register:
+// the first POSTs of a stream may overtake its GET on the way through a proxy.
+func (s *Server) await(token string) *session {
+	timer := time.NewTimer(s.sessionWait)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		sess, changed := s.sessions[token], s.changed
+		s.mu.Unlock()
+		if sess != nil {
+			return sess
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func (s *Server) serveUplink(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	path := req.URL.Path
+	for {
+		status := http.StatusNoContent
+		seq, err := strconv.ParseUint(req.URL.Query().Get("n"), 10, 64)
+		var sess *session
+		if err == nil && req.Method == http.MethodPost && req.URL.Path == path {
+			sess = s.await(req.URL.Query().Get("s"))
+		}
+		switch {
+		case err != nil || req.Method != http.MethodPost || req.URL.Path != path:
+			status = http.StatusBadRequest
+		case sess == nil:
+			status = http.StatusNotFound
+		default:
+			status = sess.deliver(seq, req.Body)
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+
+		keepAlive := status == http.StatusNoContent && !req.Close
+		resp := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\nDate: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n"
+		if keepAlive {
+			resp += "\r\n"
+		} else {
+			resp += "Content-Length: 0\r\nConnection: close\r\n\r\n"
+		}
+		if _, err := io.WriteString(conn, resp); err != nil || !keepAlive {
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(uplinkIdleTimeout))
+		if req, err = http.ReadRequest(br); err != nil {
+			return
+		}
+	}
+}
+
+// session is the server end of one stream: reads come from uplink POST bodies
+// through a pipe, writes go out as chunks of the downlink GET response.
+type session struct {
+	server   *Server
+	token    string
+	down     net.Conn
+	up       net.Conn // read side of the uplink pipe
+	upWriter net.Conn
+
+	upMu      sync.Mutex // orders POST bodies
+	next      uint64
+	downMu    sync.Mutex
+	responded bool // GET answered; guarded by downMu
+	detached  bool // handed back by Reject; guarded by downMu
+
+	closeOnce sync.Once
+}
+
+// deliver copies one POST body into the stream if it carries the next sequence
+// number. Retransmissions of an already delivered body are acknowledged and dropped.
+func (s *session) deliver(seq uint64, body io.Reader) int {
+	// 先完整读入请求体再写入流：中途断开的 POST 若已写入一部分，客户端按同一序号重发时会重复写入
+	data, err := io.ReadAll(io.LimitReader(body, MaxPostLimit+1))
+	switch {
+	case err != nil:
+		return http.StatusBadRequest
+	case len(data) > MaxPostLimit:
+		return http.StatusRequestEntityTooLarge
+	}
+
+	s.upMu.Lock()
+	defer s.upMu.Unlock()
+	switch {
+	case seq < s.next:
+		return http.StatusNoContent
+	case seq > s.next:
+		return http.StatusConflict
+	}
+	if _, err := s.upWriter.Write(data); err != nil {
+		return http.StatusGone
+	}
+	s.next++
+	return http.StatusNoContent
+}
+
+// respond sends the downlink response header once. downMu must be held.
+func (s *session) respond() error {
+	if s.detached {
+		return net.ErrClosed
+	}
+	if s.responded {
+		return nil
+	}
+	const resp = "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nCache-Control: no-store\r\nX-Accel-Buffering: no\r\nTransfer-Encoding: chunked\r\n\r\n"
+	if _, err := io.WriteString(s.down, resp); err != nil {
+		return err
+	}
+	s.responded = true
+	// 客户端不会在下行连接上再发数据；读到 EOF 即视为会话结束
+	go func() {
+		io.Copy(io.Discard, s.down)
+		s.Close()
+	}()
+	return nil
+}
+
+func (s *session) Read(p []byte) (int, error) { return s.up.Read(p) }
+
+func (s *session) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.downMu.Lock()
+	defer s.downMu.Unlock()
+	if err := s.respond(); err != nil {
+		return 0, err
+	}
+
+	chunk := make([]byte, 0, len(p)+16)
+	chunk = strconv.AppendInt(chunk, int64(len(p)), 16)
+	chunk = append(chunk, "\r\n"...)
+	chunk = append(chunk, p...)
+	chunk = append(chunk, "\r\n"...)
+	if _, err := s.down.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *session) unregister() {
+	s.server.mu.Lock()
+	if s.server.sessions[s.token] == s {
+		delete(s.server.sessions, s.token)
+	}
+	s.server.mu.Unlock()
+}
+
+func (s *session) Close() error {
+	s.closeOnce.Do(func() {
+		s.unregister()
+
+		s.downMu.Lock()
+		if s.responded {
+			s.down.SetWriteDeadline(time.Now().Add(time.Second))
+			io.WriteString(s.down, "0\r\n\r\n")
+		}
+		s.downMu.Unlock()
+		s.down.Close()
+		s.up.Close()
+		s.upWriter.Close()
+	})
+	return nil
+}
+
+func (s *session) LocalAddr() net.Addr  { return s.down.LocalAddr() }
+func (s *session) RemoteAddr() net.Addr { return s.down.RemoteAddr() }
+
+func (s *session) SetDeadline(t time.Time) error {
+	s.up.SetReadDeadline(t)
+	return s.down.SetWriteDeadline(t)
+}
+
+func (s *session) SetReadDeadline(t time.Time) error  { return s.up.SetReadDeadline(t) }
+func (s *session) SetWriteDeadline(t time.Time) error { return s.down.SetWriteDeadline(t) }
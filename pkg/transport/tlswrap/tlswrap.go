@@ -0,0 +1,304 @@
+// Package tlswrap provides the optional TLS layer beneath the HTTP mask. The
+// server side loads a certificate or generates a self-signed one; the client
+// side supports SNI override, certificate pinning, ALPN and a ClientHello that
+// mimics a common browser, built with uTLS.
+package tlswrap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// ErrPinMismatch is returned when the server certificate does not match PinSHA256.
+var ErrPinMismatch = errors.New("tls: server certificate does not match pinned hash")
+
+// NotTLSError is returned by Server when the peer does not speak TLS at all
+// (e.g. a plain HTTP probe). Recorded holds every byte read from it so the
+// caller can replay them to a fallback.
+type NotTLSError struct {
+	Err      error
+	Recorded []byte
+}
+
+func (e *NotTLSError) Error() string { return "not a tls client: " + e.Err.Error() }
+func (e *NotTLSError) Unwrap() error { return e.Err }
+
+// Options configures the TLS layer. Fields marked 服务端 or 客户端 only apply to that side.
+type Options struct {
+	CertFile    string   `json:"cert_file,omitempty"`   // 服务端：PEM 证书；与 key_file 都留空时生成自签名证书
+	KeyFile     string   `json:"key_file,omitempty"`    // 服务端：PEM 私钥
+	ServerName  string   `json:"server_name,omitempty"` // 客户端：SNI 与校验用的主机名，默认取服务器地址；服务端：自签名证书的主机名
+	PinSHA256   string   `json:"pin_sha256,omitempty"`  // 客户端：服务器证书 (DER) 的 SHA-256 十六进制，设置后不再做 CA 校验
+	Insecure    bool     `json:"insecure,omitempty"`    // 客户端：跳过证书校验（仅测试用）
+	ALPN        []string `json:"alpn,omitempty"`        // 协商的应用层协议；默认客户端随 fingerprint，服务端为 http/1.1
+	Fingerprint string   `json:"fingerprint,omitempty"` // 客户端 ClientHello 形态："go"（默认）、"chrome"、"firefox"、"safari"、"edge"
+
+	mu     sync.Mutex
+	server *tls.Config
+}
+
+// fingerprints maps a fingerprint name to the browser ClientHello uTLS sends
+// for it. "go" keeps crypto/tls's own handshake.
+var fingerprints = map[string]*utls.ClientHelloID{
+	"go":      nil,
+	"chrome":  &utls.HelloChrome_Auto,
+	"firefox": &utls.HelloFirefox_Auto,
+	"safari":  &utls.HelloSafari_Auto,
+	"edge":    &utls.HelloEdge_Auto,
+}
+
+// Validate checks option values that do not depend on the side.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if o.PinSHA256 != "" {
+		if _, err := o.pin(); err != nil {
+			return err
+		}
+	}
+	if _, ok := fingerprints[o.fingerprint()]; !ok {
+		return fmt.Errorf("unknown fingerprint %q", o.Fingerprint)
+	}
+	return nil
+}
+
+func (o *Options) fingerprint() string {
+	if o.Fingerprint == "" {
+		return "go"
+	}
+	return strings.ToLower(o.Fingerprint)
+}
+
+func (o *Options) pin() ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(o.PinSHA256, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("pin_sha256 must be a hex SHA-256 digest")
+	}
+	return pin, nil
+}
+
+// ClientConfig builds the client tls.Config for a server at serverAddr (host:port).
+// Browser fingerprints take their ALPN from the ClientHello unless ALPN is set.
+func (o *Options) ClientConfig(serverAddr string) (*tls.Config, error) {
+	serverName := o.ServerName
+	if serverName == "" {
+		serverName = serverAddr
+		if host, _, err := net.SplitHostPort(serverAddr); err == nil {
+			serverName = host
+		}
+	}
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         o.ALPN,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.Insecure,
+	}
+	if o.PinSHA256 != "" {
+		pin, err := o.pin()
+		if err != nil {
+			return nil, err
+		}
+		// 固定证书时由摘要代替 CA 链校验
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrPinMismatch
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(sum[:], pin) != 1 {
+				return ErrPinMismatch
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+// Client runs the TLS client handshake on conn, sending the ClientHello of the
+// configured fingerprint.
+func (o *Options) Client(ctx context.Context, conn net.Conn, serverAddr string) (net.Conn, error) {
+	id, ok := fingerprints[o.fingerprint()]
+	if !ok {
+		return nil, fmt.Errorf("unknown fingerprint %q", o.Fingerprint)
+	}
+	cfg, err := o.ClientConfig(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	spec, err := utls.UTLSIdToSpec(*id)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.ALPN) > 0 {
+		// 只替换 ALPN 扩展的内容，扩展顺序与其余字段保持浏览器原样
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = o.ALPN
+			}
+		}
+	}
+	uconn := utls.UClient(conn, &utls.Config{
+		ServerName:            cfg.ServerName,
+		InsecureSkipVerify:    cfg.InsecureSkipVerify,
+		VerifyPeerCertificate: cfg.VerifyPeerCertificate,
+		MinVersion:            cfg.MinVersion,
+	}, utls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// ServerConfig returns the server tls.Config, loading or generating the
+// certificate on first use.
+func (o *Options) ServerConfig() (*tls.Config, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.server != nil {
+		return o.server, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if o.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	} else {
+		cert, err = selfSigned(o.ServerName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	alpn := o.ALPN
+	if len(alpn) == 0 {
+		alpn = []string{"http/1.1"}
+	}
+	o.server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   alpn,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return o.server, nil
+}
+
+// Server runs the TLS server handshake on conn. A peer that is not a TLS
+// client yields a *NotTLSError.
+func (o *Options) Server(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	cfg, err := o.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	rec := &recordingConn{Conn: conn, recording: true}
+	tlsConn := tls.Server(rec, cfg)
+	err = tlsConn.HandshakeContext(ctx)
+	recorded := rec.stop()
+	if err != nil {
+		var rhe tls.RecordHeaderError
+		if errors.As(err, &rhe) {
+			return nil, &NotTLSError{Err: err, Recorded: recorded}
+		}
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// recordingConn 在握手期间记录读到的原始字节，供回落重放
+type recordingConn struct {
+	net.Conn
+	mu        sync.Mutex
+	recording bool
+	buf       []byte
+}
+
+func (r *recordingConn) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.mu.Lock()
+	if r.recording {
+		r.buf = append(r.buf, p[:n]...)
+	}
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *recordingConn) stop() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recording = false
+	out := r.buf
+	r.buf = nil
+	return out
+}
+
+// CertificateSHA256 returns the hex digest clients use as pin_sha256 for cfg's certificate.
+func CertificateSHA256(cfg *tls.Config) string {
+	if cfg == nil || len(cfg.Certificates) == 0 || len(cfg.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cfg.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// selfSigned generates an ECDSA P-256 certificate valid for one year.
+func selfSigned(name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if name == "" {
+		name = "localhost"
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,176 @@
+package tlswrap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func handshake(t *testing.T, server, client *Options) (net.Conn, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan net.Conn, 1)
+	t.Cleanup(func() {
+		if s := <-accepted; s != nil {
+			s.Close()
+		}
+	})
+	go func() {
+		s, _ := ln.Accept()
+		accepted <- s
+		if s != nil {
+			server.Server(ctx, s)
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return client.Client(ctx, c, "127.0.0.1:443")
+}
+
+func TestPinnedSelfSigned(t *testing.T) {
+	server := &Options{ServerName: "tunnel.example.com", ALPN: []string{"http/1.1"}}
+	cfg, err := server.ServerConfig()
+	if err != nil {
+		t.Fatalf("server config: %v", err)
+	}
+	pin := CertificateSHA256(cfg)
+
+	for _, fp := range []string{"", "chrome", "firefox", "safari", "edge"} {
+		conn, err := handshake(t, server, &Options{ServerName: "tunnel.example.com", PinSHA256: pin, Fingerprint: fp})
+		if err != nil {
+			t.Fatalf("fingerprint %q: %v", fp, err)
+		}
+		// 浏览器 ClientHello 自带 h2 与 http/1.1，服务端选择 http/1.1
+		if fp != "" && negotiatedProtocol(conn) != "http/1.1" {
+			t.Fatalf("fingerprint %q: alpn %q", fp, negotiatedProtocol(conn))
+		}
+	}
+	conn, err := handshake(t, server, &Options{PinSHA256: pin, Fingerprint: "chrome", ALPN: []string{"http/1.1"}})
+	if err != nil || negotiatedProtocol(conn) != "http/1.1" {
+		t.Fatalf("alpn override: %v", err)
+	}
+
+	wrong := "00" + pin[2:]
+	if _, err := handshake(t, server, &Options{PinSHA256: wrong}); !errors.Is(err, ErrPinMismatch) {
+		t.Fatalf("expected pin mismatch, got %v", err)
+	}
+	if _, err := handshake(t, server, &Options{ServerName: "tunnel.example.com"}); err == nil {
+		t.Fatalf("self-signed certificate accepted without pin")
+	}
+}
+
+func negotiatedProtocol(conn net.Conn) string {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().NegotiatedProtocol
+	case *utls.UConn:
+		return c.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
+
+// TestClientHelloMimicsBrowser compares the cipher suites of the ClientHello on
+// the wire with those of the browser uTLS parrots.
+func TestClientHelloMimicsBrowser(t *testing.T) {
+	for fp, id := range map[string]utls.ClientHelloID{"chrome": utls.HelloChrome_Auto, "firefox": utls.HelloFirefox_Auto} {
+		c, s := net.Pipe()
+		hello := make(chan []byte, 1)
+		go func() {
+			defer s.Close()
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(s, header); err != nil {
+				hello <- nil
+				return
+			}
+			body := make([]byte, int(header[3])<<8|int(header[4]))
+			io.ReadFull(s, body)
+			hello <- body
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		(&Options{Fingerprint: fp, Insecure: true}).Client(ctx, c, "example.com:443")
+		cancel()
+		c.Close()
+
+		spec, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			t.Fatalf("%s: spec: %v", fp, err)
+		}
+		got := helloCipherSuites(<-hello)
+		if len(got) != len(spec.CipherSuites) {
+			t.Fatalf("%s: %d cipher suites on the wire, browser sends %d", fp, len(got), len(spec.CipherSuites))
+		}
+		for i, want := range spec.CipherSuites {
+			if want != utls.GREASE_PLACEHOLDER && got[i] != want {
+				t.Fatalf("%s: cipher suite %d is %#04x, browser sends %#04x", fp, i, got[i], want)
+			}
+		}
+	}
+}
+
+// helloCipherSuites extracts the cipher suite list from a ClientHello handshake message.
+func helloCipherSuites(msg []byte) []uint16 {
+	const fixed = 4 + 2 + 32 // 握手头、版本、随机数
+	if len(msg) < fixed+1 {
+		return nil
+	}
+	p := msg[fixed:]
+	p = p[1+int(p[0]):] // session id
+	n := int(p[0])<<8 | int(p[1])
+	p = p[2:]
+	suites := make([]uint16, 0, n/2)
+	for i := 0; i+1 < n && i+1 < len(p); i += 2 {
+		suites = append(suites, uint16(p[i])<<8|uint16(p[i+1]))
+	}
+	return suites
+}
+
+func TestValidate(t *testing.T) {
+	for _, o := range []*Options{
+		{CertFile: "cert.pem"},
+		{PinSHA256: "abcd"},
+		{Fingerprint: "netscape"},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Fatalf("expected error for %+v", o)
+		}
+	}
+	if err := (&Options{Fingerprint: "Chrome"}).Validate(); err != nil {
+		t.Fatalf("valid options rejected: %v", err)
+	}
+}
+
+func TestServerRecordsNonTLSPeer(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	const probe = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	go io.WriteString(c, probe)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := (&Options{}).Server(ctx, s)
+	var notTLS *NotTLSError
+	if !errors.As(err, &notTLS) {
+		t.Fatalf("expected NotTLSError, got %v", err)
+	}
+	if len(notTLS.Recorded) < 5 || !strings.HasPrefix(probe, string(notTLS.Recorded)) {
+		t.Fatalf("recorded %q", notTLS.Recorded)
+	}
+}
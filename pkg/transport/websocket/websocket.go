@@ -0,0 +1,302 @@
+// Package websocket carries a byte stream inside RFC 6455 WebSocket frames so
+// that CDNs and reverse proxies can relay it. It implements just enough of the
+// protocol for a tunnel: the opening handshake, masked client frames, binary or
+// text data frames, and ping/pong/close handling.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	maxControlPayload = 125
+	maxFramePayload   = 1 << 20 // 远超隧道单次写入，防止恶意长度耗尽内存
+)
+
+var (
+	ErrBadHandshake   = errors.New("websocket: bad handshake")
+	ErrProtocol       = errors.New("websocket: protocol error")
+	ErrFrameTooLarge  = errors.New("websocket: frame too large")
+	errUnmaskedClient = errors.New("websocket: client frame not masked")
+)
+
+// Options describes the client side of the opening handshake.
+type Options struct {
+	Host    string            // Host header
+	Path    string            // request target, e.g. "/tunnel"
+	Text    bool              // send text frames instead of binary; the stream must be valid UTF-8
+	Headers map[string]string // extra request headers
+}
+
+// Client performs the opening handshake on conn and returns a connection that
+// frames writes and unframes reads.
+func Client(conn net.Conn, opts Options) (net.Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	path := opts.Path
+	if path == "" {
+		path = "/"
+	}
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "GET %s HTTP/1.1\r\nHost: %s\r\n", path, opts.Host)
+	names := make([]string, 0, len(opts.Headers))
+	for name := range opts.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&req, "%s: %s\r\n", name, opts.Headers[name])
+	}
+	fmt.Fprintf(&req, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadHandshake, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != httpmask.WebSocketAccept(key) {
+		return nil, fmt.Errorf("%w: status %s", ErrBadHandshake, resp.Status)
+	}
+	return newConn(conn, br, true, opts.Text), nil
+}
+
+// IsUpgrade reports whether a raw request header is a WebSocket upgrade for path
+// (query ignored). It returns the Sec-WebSocket-Key on success.
+func IsUpgrade(header []byte, path string) (string, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil || req.Method != http.MethodGet || req.URL.Path != path {
+		return "", false
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return "", false
+	}
+	return key, true
+}
+
+// Server answers an upgrade request accepted by IsUpgrade, whose header has
+// already been read, and returns the framed connection. r holds any bytes
+// buffered after the header. The 101 carries the same Server/Date headers as
+// the HTTP mask response.
+func Server(conn net.Conn, r io.Reader, requestHeader []byte, text bool) (net.Conn, error) {
+	if err := httpmask.WriteResponseHeader(conn, requestHeader); err != nil {
+		return nil, err
+	}
+	return newConn(conn, r, false, text), nil
+}
+
+// Conn is a net.Conn whose payload travels in WebSocket data frames.
+type Conn struct {
+	net.Conn
+	r        io.Reader
+	isClient bool
+	opcode   byte
+
+	readMu    sync.Mutex
+	remaining uint64 // unread payload bytes of the current data frame
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	closed    bool
+
+	writeMu sync.Mutex
+	wbuf    []byte
+}
+
+func newConn(conn net.Conn, r io.Reader, isClient, text bool) *Conn {
+	op := byte(opBinary)
+	if text {
+		op = opText
+	}
+	return &Conn{Conn: conn, r: r, isClient: isClient, opcode: op}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with payload starts,
+// answering control frames along the way.
+func (c *Conn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7F)
+	if hdr[0]&0x70 != 0 {
+		return ErrProtocol // 未协商扩展时 RSV 位必须为 0
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !c.isClient && !masked {
+		return errUnmaskedClient
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opContinuation, opText, opBinary:
+		if length > maxFramePayload {
+			return ErrFrameTooLarge
+		}
+		c.remaining, c.mask, c.masked, c.maskPos = length, mask, masked, 0
+		return nil
+	case opClose, opPing, opPong:
+		if length > maxControlPayload || hdr[0]&0x80 == 0 {
+			return ErrProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+		}
+		switch op {
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		case opClose:
+			c.closed = true
+			_ = c.writeFrame(opClose, payload)
+		}
+		return nil
+	default:
+		return ErrProtocol
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > maxFramePayload {
+			chunk = chunk[:maxFramePayload]
+		}
+		if err := c.writeFrame(c.opcode, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	buf := c.wbuf[:0]
+	buf = append(buf, 0x80|op)
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.isClient {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i&3]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	if cap(buf) <= 64*1024 {
+		c.wbuf = buf
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// Close sends a close frame before closing the underlying connection.
+func (c *Conn) Close() error {
+	_ = c.writeFrame(opClose, []byte{0x03, 0xE8}) // 1000 normal closure
+	return c.Conn.Close()
+}
@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+)
+
+func TestClientServerFrames(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		br := bufio.NewReader(s)
+		header, err := httpmask.ConsumeHeader(br)
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+		if _, ok := IsUpgrade(header, "/tunnel"); !ok {
+			accepted <- result{err: ErrBadHandshake}
+			return
+		}
+		conn, err := Server(s, br, header, false)
+		accepted <- result{conn, err}
+	}()
+
+	client, err := Client(c, Options{Host: "example.com", Path: "/tunnel?x=1"})
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	res := <-accepted
+	if res.err != nil {
+		t.Fatalf("server handshake: %v", res.err)
+	}
+	server := res.conn
+
+	// 客户端帧必须带掩码：原始字节中不应出现明文
+	payload := bytes.Repeat([]byte("sudoku"), 100)
+	raw := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 4+len(payload)+8)
+		n, _ := io.ReadAtLeast(server.(*Conn).r, buf, 1)
+		raw <- buf[:n]
+	}()
+	go client.Write(payload)
+	frame := <-raw
+	if frame[0] != 0x82 || frame[1]&0x80 == 0 || bytes.Contains(frame, []byte("sudoku")) {
+		t.Fatalf("unexpected client frame header % x", frame[:2])
+	}
+
+	// 服务端应答 ping 后继续传输数据
+	go io.Copy(io.Discard, server) // net.Pipe 是同步的，需要读走客户端回应的 pong
+	go func() {
+		server.(*Conn).writeFrame(opPing, []byte("hi"))
+		server.Write([]byte("downlink"))
+	}()
+	buf := make([]byte, len("downlink"))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "downlink" {
+		t.Fatalf("client read: %q %v", buf, err)
+	}
+
+	if _, ok := IsUpgrade([]byte("POST /tunnel HTTP/1.1\r\nHost: a\r\n\r\n"), "/tunnel"); ok {
+		t.Fatalf("POST must not be treated as an upgrade")
+	}
+}
+
+func TestServerResponseMatchesMask(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	header := []byte("GET /tunnel HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	go Server(s, s, header, false)
+
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected upgrade response: %s %v", resp.Status, resp.Header)
+	}
+	if resp.Header.Get("Server") == "" || resp.Header.Get("Date") == "" {
+		t.Fatalf("101 lacks the web server headers: %v", resp.Header)
+	}
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/saba-futai/sudoku/apis"
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+)
+
+// TestAPIHTTPHandlerSharesPort serves a web site and the tunnel from one
+// net/http server: mask requests on the mounted path are hijacked, everything
+// else reaches the site.
+func TestAPIHTTPHandlerSharesPort(t *testing.T) {
+	table := sudoku.NewTable("handler-seed", "prefer_ascii")
+	serverCfg := &apis.ProtocolConfig{
+		Key:                     "handler-key",
+		AEADMethod:              "chacha20-poly1305",
+		Table:                   table,
+		PaddingMin:              5,
+		PaddingMax:              10,
+		EnablePureDownlink:      true,
+		HandshakeTimeoutSeconds: 5,
+	}
+	if err := serverCfg.Validate(); err != nil {
+		t.Fatalf("config: %v", err)
+	}
+
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "site:"+r.URL.Path+":"+string(body))
+	})
+	targets := make(chan string, 4)
+	mux := http.NewServeMux()
+	mux.Handle("/api/upload", &apis.HTTPHandler{
+		Config: serverCfg,
+		Next:   site,
+		Serve: func(tunnel net.Conn, target string) {
+			defer tunnel.Close()
+			targets <- target
+			io.Copy(tunnel, tunnel)
+		},
+	})
+	mux.Handle("/", site)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dial := func(t *testing.T, tmpl httpmask.Template) {
+		t.Helper()
+		conn, err := apis.Dial(context.Background(), &apis.ProtocolConfig{
+			ServerAddress:      strings.TrimPrefix(srv.URL, "http://"),
+			TargetAddress:      "example.com:443",
+			Key:                "handler-key",
+			AEADMethod:         "chacha20-poly1305",
+			Table:              table,
+			PaddingMin:         5,
+			PaddingMax:         10,
+			EnablePureDownlink: true,
+			HTTPMask:           &httpmask.Options{Templates: []httpmask.Template{tmpl}},
+		})
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		msg := bytes.Repeat([]byte("hijacked "), 100)
+		go conn.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+			t.Fatalf("echo failed: %v", err)
+		}
+		if got := <-targets; got != "example.com:443" {
+			t.Fatalf("target %q", got)
+		}
+	}
+
+	t.Run("PostMask", func(t *testing.T) {
+		dial(t, httpmask.Template{Paths: []string{"/api/upload"}})
+	})
+	t.Run("WebSocketMask", func(t *testing.T) {
+		dial(t, httpmask.Template{WebSocket: true, Paths: []string{"/api/upload"}})
+	})
+
+	t.Run("RealRequestsReachSite", func(t *testing.T) {
+		for path, body := range map[string]string{"/api/upload": `{"file":"report.pdf"}`, "/index.html": ""} {
+			resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("post %s: %v", path, err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if want := "site:" + path + ":" + body; string(got) != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		}
+	})
+}
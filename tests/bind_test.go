@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/internal/protocol"
+)
+
+// socks5Bind sends a BIND request and returns the control conn and the first reply.
+func socks5Bind(t *testing.T, clientPort int) (net.Conn, byte, string) {
+	t.Helper()
+	ctrl, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+	if err != nil {
+		t.Fatalf("dial client: %v", err)
+	}
+	ctrl.Write([]byte{0x05, 0x01, 0x00})
+	methodResp := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, methodResp); err != nil {
+		t.Fatalf("read method: %v", err)
+	}
+	ctrl.Write([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	rep, addr := readSocks5Reply(t, ctrl)
+	return ctrl, rep, addr
+}
+
+func readSocks5Reply(t *testing.T, conn net.Conn) (byte, string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	addr, _, _, err := protocol.ReadAddress(conn)
+	if err != nil {
+		t.Fatalf("read reply address: %v", err)
+	}
+	return hdr[1], addr
+}
+
+func startBindPair(t *testing.T, bind *config.BindConfig) int {
+	t.Helper()
+	ports, _ := getFreePorts(2)
+	startSudokuServer(&config.Config{
+		Mode:         "server",
+		LocalPort:    ports[0],
+		Key:          "bindkey",
+		AEAD:         "chacha20-poly1305",
+		ASCII:        "prefer_entropy",
+		FallbackAddr: "127.0.0.1:80",
+		Bind:         bind,
+	})
+	startSudokuClient(&config.Config{
+		Mode:          "client",
+		LocalPort:     ports[1],
+		ServerAddress: fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		Key:           "bindkey",
+		AEAD:          "chacha20-poly1305",
+		ASCII:         "prefer_entropy",
+		ProxyMode:     "global",
+	})
+	return ports[1]
+}
+
+func TestSocks5Bind(t *testing.T) {
+	clientPort := startBindPair(t, &config.BindConfig{Enabled: true, ListenIP: "127.0.0.1"})
+
+	ctrl, rep, bound := socks5Bind(t, clientPort)
+	defer ctrl.Close()
+	if rep != 0x00 {
+		t.Fatalf("bind rejected: %d", rep)
+	}
+
+	peer, err := net.Dial("tcp", bound)
+	if err != nil {
+		t.Fatalf("dial bound address %s: %v", bound, err)
+	}
+	defer peer.Close()
+
+	rep, from := readSocks5Reply(t, ctrl)
+	if rep != 0x00 || from != peer.LocalAddr().String() {
+		t.Fatalf("second reply rep=%d from=%s, want %s", rep, from, peer.LocalAddr())
+	}
+
+	peer.Write([]byte("inbound"))
+	buf := make([]byte, 7)
+	ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(ctrl, buf); err != nil || string(buf) != "inbound" {
+		t.Fatalf("peer->client: %q %v", buf, err)
+	}
+	ctrl.Write([]byte("outbound"))
+	buf = make([]byte, 8)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "outbound" {
+		t.Fatalf("client->peer: %q %v", buf, err)
+	}
+}
+
+func TestSocks5BindDisabledByPolicy(t *testing.T) {
+	clientPort := startBindPair(t, nil)
+
+	ctrl, rep, _ := socks5Bind(t, clientPort)
+	defer ctrl.Close()
+	if rep != 0x02 {
+		t.Fatalf("expected rep 0x02 (not allowed), got %d", rep)
+	}
+}
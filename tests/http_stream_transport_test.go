@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+)
+
+// TestHTTPStreamTransportThroughBufferingProxy runs the split-stream transport
+// through a reverse proxy that reads every request body in full before
+// forwarding it, like the corporate proxies that break one long POST.
+func TestHTTPStreamTransportThroughBufferingProxy(t *testing.T) {
+	ports, _ := getFreePorts(3)
+	echoPort, serverPort, clientPort := ports[0], ports[1], ports[2]
+	startEchoServer(echoPort)
+
+	stream := &config.HTTPStreamConfig{Path: "/api/stream", Host: "cdn.example.com", MaxPost: 4096}
+	startSudokuServer(&config.Config{
+		Mode:               "server",
+		LocalPort:          serverPort,
+		Key:                "stream-key",
+		AEAD:               "aes-128-gcm",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: false,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		HTTPStream:         stream,
+	})
+
+	backend, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", serverPort))
+	rp := httputil.NewSingleHostReverseProxy(backend)
+	var posts atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			posts.Add(1)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+		rp.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	startSudokuClient(&config.Config{
+		Mode:               "client",
+		LocalPort:          clientPort,
+		ServerAddress:      strings.TrimPrefix(proxy.URL, "http://"),
+		Key:                "stream-key",
+		AEAD:               "aes-128-gcm",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: false,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		ProxyMode:          "global",
+		HTTPStream:         stream,
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+	if err != nil {
+		t.Fatalf("connect client: %v", err)
+	}
+	defer conn.Close()
+	sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+
+	payload := bytes.Repeat([]byte("split-stream-"), 5000)
+	go conn.Write(payload)
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if !bytes.Equal(echo, payload) {
+		t.Fatalf("echo mismatch")
+	}
+	if posts.Load() < 2 {
+		t.Fatalf("expected the uplink to be split into several POSTs, got %d", posts.Load())
+	}
+}
+
+// TestHTTPStreamProbesReachFallback checks that the stream path gives a prober
+// nothing of its own: malformed requests and downlink GETs whose handshake
+// fails are answered by the fallback web server.
+func TestHTTPStreamProbesReachFallback(t *testing.T) {
+	ports, _ := getFreePorts(2)
+	serverPort, webPort := ports[0], ports[1]
+	startWebServer(webPort)
+	startSudokuServer(&config.Config{
+		Mode:               "server",
+		LocalPort:          serverPort,
+		Key:                "stream-key",
+		AEAD:               "aes-128-gcm",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		FallbackAddr:       fmt.Sprintf("127.0.0.1:%d", webPort),
+		HTTPStream:         &config.HTTPStreamConfig{Path: "/api/stream"},
+	})
+	base := fmt.Sprintf("http://127.0.0.1:%d/api/stream", serverPort)
+
+	expectFallback := func(resp *http.Response, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "Hello Fallback" {
+			t.Fatalf("expected the fallback page, got %d %q", resp.StatusCode, body)
+		}
+	}
+
+	// 会话不存在的 POST 在等待 GET 超时后同样交给回落；与其余探测并行，避免拖慢测试
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	unknown := make(chan result, 1)
+	go func() {
+		resp, err := http.Post(base+"?s=0123456789abcdef0123456789abcdef&n=0", "application/octet-stream", strings.NewReader("x"))
+		unknown <- result{resp, err}
+	}()
+
+	expectFallback(http.Get(base + "?s=not-a-token"))
+	expectFallback(http.Post(base+"?s=00112233445566778899aabbccddeeff&n=x", "application/octet-stream", strings.NewReader("x")))
+
+	// 令牌合法但上行不是有效握手：GET 交给回落应答
+	const token = "ffeeddccbbaa99887766554433221100"
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(base + "?s=" + token)
+		got <- result{resp, err}
+	}()
+	garbage := strings.Repeat("GET /index.html HTTP/1.1\r\n", 64)
+	if resp, err := http.Post(base+"?s="+token+"&n=0", "application/octet-stream", strings.NewReader(garbage)); err == nil {
+		resp.Body.Close()
+	}
+	r := <-got
+	expectFallback(r.resp, r.err)
+	r = <-unknown
+	expectFallback(r.resp, r.err)
+}
+
+// TestHTTPStreamTransportWithMaskSecret runs the split stream against a server
+// that requires the mask secret: the stream path stands in for require_path,
+// and every GET and POST carries the secret headers.
+func TestHTTPStreamTransportWithMaskSecret(t *testing.T) {
+	ports, _ := getFreePorts(3)
+	echoPort, serverPort, clientPort := ports[0], ports[1], ports[2]
+	startEchoServer(echoPort)
+
+	stream := &config.HTTPStreamConfig{Path: "/api/stream"}
+	secret := map[string]string{"X-Token": "stream-secret"}
+	startSudokuServer(&config.Config{
+		Mode:               "server",
+		LocalPort:          serverPort,
+		Key:                "stream-key",
+		AEAD:               "aes-128-gcm",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		HTTPMask:           &httpmask.Options{RequirePath: "/feed", RequireHeaders: secret},
+		HTTPStream:         stream,
+	})
+	startSudokuClient(&config.Config{
+		Mode:               "client",
+		LocalPort:          clientPort,
+		ServerAddress:      fmt.Sprintf("127.0.0.1:%d", serverPort),
+		Key:                "stream-key",
+		AEAD:               "aes-128-gcm",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		ProxyMode:          "global",
+		HTTPMask:           &httpmask.Options{RequireHeaders: secret},
+		HTTPStream:         stream,
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+	if err != nil {
+		t.Fatalf("connect client: %v", err)
+	}
+	defer conn.Close()
+	sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+
+	payload := []byte("split-stream-with-secret")
+	go conn.Write(payload)
+	echo := make([]byte, len(payload))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, payload) {
+		t.Fatalf("echo through the stream: %q %v", echo, err)
+	}
+}
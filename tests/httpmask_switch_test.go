@@ -2,11 +2,15 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/saba-futai/sudoku/apis"
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
 	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
 )
 
@@ -118,4 +122,220 @@ func TestHTTPMaskSwitch(t *testing.T) {
 			t.Fatalf("expected %s, got %s", msg, buf)
 		}
 	})
+	// Test Case 3: the server answers the mask request before tunnel data
+	t.Run("ServerAnswersMask", func(t *testing.T) {
+		relay, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("relay listen: %v", err)
+		}
+		defer relay.Close()
+		downlink := make(chan []byte, 1)
+		go func() {
+			c, err := relay.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			up, err := net.Dial("tcp", serverAddr)
+			if err != nil {
+				return
+			}
+			defer up.Close()
+			go io.Copy(up, c)
+			buf := make([]byte, 32)
+			n, _ := io.ReadFull(up, buf)
+			downlink <- buf[:n]
+			c.Write(buf[:n])
+			io.Copy(c, up)
+		}()
+
+		clientCfg := &apis.ProtocolConfig{
+			ServerAddress:      relay.Addr().String(),
+			TargetAddress:      "example.com:80",
+			Key:                key,
+			AEADMethod:         "chacha20-poly1305",
+			Table:              table,
+			PaddingMin:         10,
+			PaddingMax:         20,
+			EnablePureDownlink: true,
+		}
+		conn, err := apis.Dial(context.Background(), clientCfg)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+
+		msg := []byte("hello response")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != string(msg) {
+			t.Fatalf("echo failed: %q %v", buf, err)
+		}
+		first := string(<-downlink)
+		if !strings.HasPrefix(first, "HTTP/1.1 101 ") && !strings.HasPrefix(first, "HTTP/1.1 200 ") {
+			t.Fatalf("server did not answer the mask request: %q", first)
+		}
+	})
+
+	// Test Case 4: a client from before the response mask sends the request
+	// but never strips a response; the server must not answer it
+	t.Run("OldClientAgainstNewServer", func(t *testing.T) {
+		relay, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("relay listen: %v", err)
+		}
+		defer relay.Close()
+		downlink := make(chan []byte, 1)
+		go func() {
+			c, err := relay.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			up, err := net.Dial("tcp", serverAddr)
+			if err != nil {
+				return
+			}
+			defer up.Close()
+			// 旧客户端：先写伪装请求，之后直接是隧道数据，模式字节不带响应标志
+			if err := httpmask.WriteRandomRequestHeader(up, serverAddr); err != nil {
+				return
+			}
+			go io.Copy(up, c)
+			buf := make([]byte, 9)
+			n, _ := io.ReadFull(up, buf)
+			downlink <- buf[:n]
+			c.Write(buf[:n])
+			io.Copy(c, up)
+		}()
+
+		clientCfg := &apis.ProtocolConfig{
+			ServerAddress:      relay.Addr().String(),
+			TargetAddress:      "example.com:80",
+			Key:                key,
+			AEADMethod:         "chacha20-poly1305",
+			Table:              table,
+			PaddingMin:         10,
+			PaddingMax:         20,
+			EnablePureDownlink: true,
+			DisableHTTPMask:    true,
+		}
+		conn, err := apis.Dial(context.Background(), clientCfg)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+
+		msg := []byte("hello old client")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		buf := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != string(msg) {
+			t.Fatalf("echo failed: %q %v", buf, err)
+		}
+		if first := string(<-downlink); strings.HasPrefix(first, "HTTP/1.1 ") {
+			t.Fatalf("server answered a client that cannot strip the response: %q", first)
+		}
+	})
+}
+
+func TestHTTPMaskTemplatesAndSecret(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	table := sudoku.NewTable("template-seed", "prefer_entropy")
+	key := "template-key"
+	serverCfg := &apis.ProtocolConfig{
+		Key:                     key,
+		AEADMethod:              "chacha20-poly1305",
+		Table:                   table,
+		PaddingMin:              5,
+		PaddingMax:              10,
+		EnablePureDownlink:      true,
+		HandshakeTimeoutSeconds: 5,
+		HTTPMask: &httpmask.Options{
+			RequirePath:    "/api/stream",
+			RequireHeaders: map[string]string{"X-Client-Token": "opensesame"},
+		},
+	}
+
+	rejected := make(chan *apis.HandshakeError, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tunnelConn, _, err := apis.ServerHandshake(c, serverCfg)
+				if err != nil {
+					var hsErr *apis.HandshakeError
+					if errors.As(err, &hsErr) {
+						rejected <- hsErr
+					}
+					return
+				}
+				defer tunnelConn.Close()
+				io.Copy(tunnelConn, tunnelConn)
+			}(conn)
+		}
+	}()
+
+	clientCfg := func(mask *httpmask.Options) *apis.ProtocolConfig {
+		return &apis.ProtocolConfig{
+			ServerAddress:      ln.Addr().String(),
+			TargetAddress:      "example.com:80",
+			Key:                key,
+			AEADMethod:         "chacha20-poly1305",
+			Table:              table,
+			PaddingMin:         5,
+			PaddingMax:         10,
+			EnablePureDownlink: true,
+			HTTPMask:           mask,
+		}
+	}
+
+	t.Run("MatchingTemplate", func(t *testing.T) {
+		mask := &httpmask.Options{Templates: []httpmask.Template{{
+			WebSocket: true,
+			Paths:     []string{"/api/stream?v=2"},
+			Headers:   map[string]string{"X-Client-Token": "opensesame"},
+			Host:      "cdn.example.com",
+		}}}
+		conn, err := apis.Dial(context.Background(), clientCfg(mask))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+		msg := []byte("templated")
+		conn.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != string(msg) {
+			t.Fatalf("echo failed: %q %v", buf, err)
+		}
+	})
+
+	t.Run("BuiltinTemplatesRejected", func(t *testing.T) {
+		conn, err := apis.Dial(context.Background(), clientCfg(nil))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+		select {
+		case hsErr := <-rejected:
+			if !strings.Contains(string(hsErr.HTTPHeaderData), "HTTP/1.1") || len(hsErr.ReadData) == 0 {
+				t.Fatalf("fallback data incomplete: header=%q read=%d", hsErr.HTTPHeaderData, len(hsErr.ReadData))
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("server accepted a request without the secret")
+		}
+	})
 }
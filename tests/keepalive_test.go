@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/apis"
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/control"
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+)
+
+func TestKeepAliveTunnelWithCoverTraffic(t *testing.T) {
+	ports, _ := getFreePorts(3)
+	echoPort, serverPort, clientPort := ports[0], ports[1], ports[2]
+	startEchoServer(echoPort)
+
+	cover := &control.Cover{IdleMs: 50, MinGapMs: 20, MaxGapMs: 60}
+	startSudokuServer(&config.Config{
+		Mode:               "server",
+		LocalPort:          serverPort,
+		Key:                "keepalive-key",
+		AEAD:               "aes-128-gcm",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: false,
+		FallbackAddr:       "127.0.0.1:80",
+		KeepAlive:          &control.Options{Interval: 200, Cover: cover},
+	})
+	startSudokuClient(&config.Config{
+		Mode:               "client",
+		LocalPort:          clientPort,
+		ServerAddress:      fmt.Sprintf("127.0.0.1:%d", serverPort),
+		Key:                "keepalive-key",
+		AEAD:               "aes-128-gcm",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: false,
+		ProxyMode:          "global",
+		KeepAlive:          &control.Options{Interval: 200, Cover: cover},
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+	if err != nil {
+		t.Fatalf("connect client: %v", err)
+	}
+	defer conn.Close()
+	sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+
+	// 中间留出空闲期，期间双方发送掩护帧与心跳，应用层不应收到任何额外数据
+	for i := 0; i < 3; i++ {
+		msg := []byte(fmt.Sprintf("keepalive-%d", i))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		echo := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, msg) {
+			t.Fatalf("echo %d = %q, %v", i, echo, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// frozenConn stops delivering reads once frozen, like a peer that hung
+// without closing the connection.
+type frozenConn struct {
+	net.Conn
+	frozen atomic.Bool
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func (c *frozenConn) Read(p []byte) (int, error) {
+	if c.frozen.Load() {
+		<-c.stop
+		return 0, io.EOF
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *frozenConn) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	return c.Conn.Close()
+}
+
+func TestAPIKeepAliveDetectsDeadPeer(t *testing.T) {
+	table := sudoku.NewTable("api-keepalive-seed", "prefer_entropy")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	serverCfg := &apis.ProtocolConfig{
+		Key:                     "api-keepalive-key",
+		AEADMethod:              "chacha20-poly1305",
+		Table:                   table,
+		EnablePureDownlink:      true,
+		HandshakeTimeoutSeconds: 5,
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// 完成握手后冻结服务端的读取：心跳得不到回应
+		fc := &frozenConn{Conn: c, stop: make(chan struct{})}
+		tun, _, err := apis.ServerHandshake(fc, serverCfg)
+		if err != nil {
+			c.Close()
+			return
+		}
+		fc.frozen.Store(true)
+		accepted <- tun
+	}()
+
+	clientCfg := *serverCfg
+	clientCfg.ServerAddress = l.Addr().String()
+	clientCfg.TargetAddress = "example.com:80"
+	clientCfg.KeepAlive = &control.Options{Interval: 100, MaxMissed: 2}
+	conn, err := apis.Dial(context.Background(), &clientCfg)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	select {
+	case tun := <-accepted:
+		defer tun.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server handshake did not finish")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, control.ErrPeerDead) {
+			t.Fatalf("read error = %v, want ErrPeerDead", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dead peer not detected")
+	}
+}
@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/saba-futai/sudoku/apis"
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+)
+
+func TestPackedUplinkTunnel(t *testing.T) {
+	tables := []string{"xpxvvpvv", "vxpvxvvp"}
+	for _, pure := range []bool{true, false} {
+		t.Run(fmt.Sprintf("pure=%v", pure), func(t *testing.T) {
+			ports, _ := getFreePorts(4)
+			echoPort, serverPort, packedPort, plainPort := ports[0], ports[1], ports[2], ports[3]
+			startEchoServer(echoPort)
+
+			startSudokuServer(&config.Config{
+				Mode:               "server",
+				LocalPort:          serverPort,
+				Key:                "packed-uplink-key",
+				AEAD:               "chacha20-poly1305",
+				ASCII:              "prefer_entropy",
+				CustomTables:       tables,
+				EnablePureDownlink: pure,
+				FallbackAddr:       "127.0.0.1:80",
+			})
+			// 同一服务端同时接入打包上行与纯数独上行的客户端
+			for _, c := range []struct {
+				port   int
+				packed bool
+			}{{packedPort, true}, {plainPort, false}} {
+				startSudokuClient(&config.Config{
+					Mode:               "client",
+					LocalPort:          c.port,
+					ServerAddress:      fmt.Sprintf("127.0.0.1:%d", serverPort),
+					Key:                "packed-uplink-key",
+					AEAD:               "chacha20-poly1305",
+					ASCII:              "prefer_entropy",
+					CustomTables:       tables,
+					EnablePureDownlink: pure,
+					EnablePackedUplink: c.packed,
+					ProxyMode:          "global",
+				})
+			}
+
+			for _, port := range []int{packedPort, plainPort} {
+				conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				if err != nil {
+					t.Fatalf("connect client: %v", err)
+				}
+				sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+
+				msg := []byte("small-uplink-write")
+				conn.Write(msg)
+				echo := make([]byte, len(msg))
+				if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, msg) {
+					t.Fatalf("port %d: small echo failed: %v", port, err)
+				}
+
+				payload := bytes.Repeat([]byte("packed-uplink-"), 8000)
+				go conn.Write(payload)
+				echo = make([]byte, len(payload))
+				if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, payload) {
+					t.Fatalf("port %d: bulk echo failed: %v", port, err)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestAPIPackedUplinkEcho(t *testing.T) {
+	table := sudoku.NewTable("api-packed-uplink-seed", "prefer_ascii")
+	cfg := &apis.ProtocolConfig{
+		Key:                     "api-packed-uplink-key",
+		AEADMethod:              "aes-128-gcm",
+		Table:                   table,
+		PaddingMin:              8,
+		PaddingMax:              16,
+		EnablePureDownlink:      true,
+		HandshakeTimeoutSeconds: 5,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	serverCfg := *cfg
+	serverCfg.ServerAddress = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tun, _, err := apis.ServerHandshake(c, &serverCfg)
+				if err != nil {
+					return
+				}
+				defer tun.Close()
+				io.Copy(tun, tun)
+			}(conn)
+		}
+	}()
+
+	clientCfg := *cfg
+	clientCfg.ServerAddress = l.Addr().String()
+	clientCfg.TargetAddress = "example.com:80"
+	clientCfg.EnablePackedUplink = true
+
+	conn, err := apis.Dial(context.Background(), &clientCfg)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	payload := bytes.Repeat([]byte("api packed uplink "), 2000)
+	go conn.Write(payload)
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, payload) {
+		t.Fatalf("echo failed: %v", err)
+	}
+
+	clientCfg.AEADMethod = "none"
+	if err := clientCfg.Validate(); err == nil {
+		t.Fatalf("expected validation error for packed uplink without AEAD")
+	}
+}
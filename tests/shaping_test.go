@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/obfs/shaping"
+)
+
+func TestWriteShapingTunnel(t *testing.T) {
+	shape := &shaping.Options{
+		Uplink:   &shaping.Direction{Profile: "web-browsing", CoalesceMs: 5, Cover: 0.2},
+		Downlink: &shaping.Direction{Buckets: []shaping.Bucket{{Min: 400, Max: 600, Weight: 1}, {Min: 1300, Max: 1448, Weight: 3}}, Cover: 0.1},
+	}
+	for _, pure := range []bool{true, false} {
+		t.Run(fmt.Sprintf("pure=%v", pure), func(t *testing.T) {
+			ports, _ := getFreePorts(3)
+			echoPort, serverPort, clientPort := ports[0], ports[1], ports[2]
+			startEchoServer(echoPort)
+
+			startSudokuServer(&config.Config{
+				Mode:               "server",
+				LocalPort:          serverPort,
+				Key:                "shaping-key",
+				AEAD:               "chacha20-poly1305",
+				ASCII:              "prefer_entropy",
+				EnablePureDownlink: pure,
+				FallbackAddr:       "127.0.0.1:80",
+				Shaping:            shape,
+			})
+			startSudokuClient(&config.Config{
+				Mode:               "client",
+				LocalPort:          clientPort,
+				ServerAddress:      fmt.Sprintf("127.0.0.1:%d", serverPort),
+				Key:                "shaping-key",
+				AEAD:               "chacha20-poly1305",
+				ASCII:              "prefer_entropy",
+				EnablePureDownlink: pure,
+				ProxyMode:          "global",
+				Shaping:            shape,
+			})
+
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+			if err != nil {
+				t.Fatalf("connect client: %v", err)
+			}
+			defer conn.Close()
+			sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+
+			// 小块往返：每次都要等回显，验证合并窗口不会卡住交互式流量
+			for i := 0; i < 20; i++ {
+				msg := []byte(fmt.Sprintf("ping-%02d", i))
+				if _, err := conn.Write(msg); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				echo := make([]byte, len(msg))
+				if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, msg) {
+					t.Fatalf("small echo %d failed: %v", i, err)
+				}
+			}
+
+			payload := bytes.Repeat([]byte("shaped-bulk-"), 8000)
+			go conn.Write(payload)
+			echo := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, payload) {
+				t.Fatalf("bulk echo failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/apis"
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/obfs/sudoku"
+	"github.com/saba-futai/sudoku/pkg/transport/tlswrap"
+)
+
+func TestTLSOuterLayer(t *testing.T) {
+	ports, _ := getFreePorts(4)
+	echoPort, webPort, serverPort, clientPort := ports[0], ports[1], ports[2], ports[3]
+	startEchoServer(echoPort)
+	startWebServer(webPort)
+
+	serverTLS := &tlswrap.Options{ServerName: "tunnel.example.com"}
+	startSudokuServer(&config.Config{
+		Mode:               "server",
+		LocalPort:          serverPort,
+		Key:                "tls-key",
+		AEAD:               "chacha20-poly1305",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		FallbackAddr:       fmt.Sprintf("127.0.0.1:%d", webPort),
+		TLS:                serverTLS,
+	})
+	serverTLSCfg, err := serverTLS.ServerConfig()
+	if err != nil {
+		t.Fatalf("server tls config: %v", err)
+	}
+	pin := tlswrap.CertificateSHA256(serverTLSCfg)
+
+	startSudokuClient(&config.Config{
+		Mode:               "client",
+		LocalPort:          clientPort,
+		ServerAddress:      fmt.Sprintf("127.0.0.1:%d", serverPort),
+		Key:                "tls-key",
+		AEAD:               "chacha20-poly1305",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		ProxyMode:          "global",
+		TLS:                &tlswrap.Options{ServerName: "tunnel.example.com", PinSHA256: pin, Fingerprint: "chrome"},
+	})
+
+	t.Run("Tunnel", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+		if err != nil {
+			t.Fatalf("connect client: %v", err)
+		}
+		defer conn.Close()
+		sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+
+		payload := bytes.Repeat([]byte("tls-outer-"), 2000)
+		go conn.Write(payload)
+		echo := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, payload) {
+			t.Fatalf("echo failed: %v", err)
+		}
+	})
+
+	t.Run("HTTPSProbeFallsBack", func(t *testing.T) {
+		client := &http.Client{
+			Timeout:   10 * time.Second, // 伪装请求被接受后，服务端要等握手超时才回落
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+		resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/", serverPort))
+		if err != nil {
+			t.Fatalf("https probe: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "Hello Fallback" {
+			t.Fatalf("expected fallback site over TLS, got %q", body)
+		}
+	})
+
+	t.Run("PlainHTTPProbeFallsBack", func(t *testing.T) {
+		resp, err := (&http.Client{Timeout: 5 * time.Second}).Get(fmt.Sprintf("http://127.0.0.1:%d/", serverPort))
+		if err != nil {
+			t.Fatalf("http probe: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "Hello Fallback" {
+			t.Fatalf("expected fallback site, got %q", body)
+		}
+	})
+}
+
+func TestAPITLSOuterLayer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	table := sudoku.NewTable("api-tls-seed", "prefer_entropy")
+	serverCfg := &apis.ProtocolConfig{
+		Key:                     "api-tls-key",
+		AEADMethod:              "aes-128-gcm",
+		Table:                   table,
+		PaddingMin:              5,
+		PaddingMax:              10,
+		EnablePureDownlink:      true,
+		HandshakeTimeoutSeconds: 5,
+		TLS:                     &tlswrap.Options{},
+	}
+	tlsCfg, err := serverCfg.TLS.ServerConfig()
+	if err != nil {
+		t.Fatalf("server tls config: %v", err)
+	}
+
+	rejected := make(chan *apis.HandshakeError, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tunnelConn, _, err := apis.ServerHandshake(c, serverCfg)
+				if err != nil {
+					var hsErr *apis.HandshakeError
+					if errors.As(err, &hsErr) {
+						rejected <- hsErr
+					}
+					return
+				}
+				defer tunnelConn.Close()
+				io.Copy(tunnelConn, tunnelConn)
+			}(conn)
+		}
+	}()
+
+	clientCfg := &apis.ProtocolConfig{
+		ServerAddress:      ln.Addr().String(),
+		TargetAddress:      "example.com:80",
+		Key:                "api-tls-key",
+		AEADMethod:         "aes-128-gcm",
+		Table:              table,
+		PaddingMin:         5,
+		PaddingMax:         10,
+		EnablePureDownlink: true,
+		TLS:                &tlswrap.Options{PinSHA256: tlswrap.CertificateSHA256(tlsCfg), Fingerprint: "firefox"},
+	}
+	conn, err := apis.Dial(context.Background(), clientCfg)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	msg := []byte("over tls")
+	conn.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("echo failed: %q %v", buf, err)
+	}
+
+	// 未启用 TLS 的客户端被当作可回落的握手失败，已读数据完整保留
+	clientCfg.TLS = nil
+	plain, err := apis.Dial(context.Background(), clientCfg)
+	if err == nil {
+		defer plain.Close()
+	}
+	select {
+	case hsErr := <-rejected:
+		if !bytes.HasPrefix(hsErr.ReadData, []byte("POST ")) && !bytes.HasPrefix(hsErr.ReadData, []byte("GET ")) {
+			t.Fatalf("expected the plain mask request in ReadData, got %q", hsErr.ReadData[:min(16, len(hsErr.ReadData))])
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("plain client was not rejected")
+	}
+}
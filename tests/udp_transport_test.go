@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+)
+
+func TestNativeUDPTransport(t *testing.T) {
+	ports, _ := getFreePorts(2)
+	serverPort := ports[0]
+	clientPort := ports[1]
+
+	udpConn, udpPortReal, err := startUDPEchoServer()
+	if err != nil {
+		t.Fatalf("failed to start udp echo: %v", err)
+	}
+	defer udpConn.Close()
+
+	serverCfg := &config.Config{
+		Mode:               "server",
+		Transport:          "udp",
+		LocalPort:          serverPort,
+		Key:                "testkey",
+		AEAD:               "chacha20-poly1305",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: false,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		FallbackAddr:       "127.0.0.1:80",
+	}
+	startSudokuServer(serverCfg)
+
+	clientCfg := &config.Config{
+		Mode:               "client",
+		Transport:          "udp",
+		LocalPort:          clientPort,
+		ServerAddress:      fmt.Sprintf("127.0.0.1:%d", serverPort),
+		Key:                "testkey",
+		AEAD:               "chacha20-poly1305",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: false,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		ProxyMode:          "global",
+	}
+	startSudokuClient(clientCfg)
+
+	ctrlConn, udpRelay := performUDPAssociate(t, clientPort)
+	defer ctrlConn.Close()
+
+	relayConn, err := net.DialUDP("udp", nil, udpRelay)
+	if err != nil {
+		t.Fatalf("failed to dial udp relay: %v", err)
+	}
+	defer relayConn.Close()
+
+	targetAddr := fmt.Sprintf("127.0.0.1:%d", udpPortReal)
+	for i := 0; i < 5; i++ {
+		payload := bytes.Repeat([]byte{byte(i)}, 200+i)
+		if _, err := relayConn.Write(buildSocksUDPRequest(t, targetAddr, payload)); err != nil {
+			t.Fatalf("failed to send udp packet: %v", err)
+		}
+
+		respBuf := make([]byte, 2048)
+		relayConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := relayConn.Read(respBuf)
+		if err != nil {
+			t.Fatalf("failed to read udp response %d: %v", i, err)
+		}
+		addr, data := parseSocksUDPResponse(t, respBuf[:n])
+		if addr != targetAddr || !bytes.Equal(data, payload) {
+			t.Fatalf("unexpected response %d: addr=%s size=%d", i, addr, len(data))
+		}
+	}
+}
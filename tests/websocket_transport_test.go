@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saba-futai/sudoku/internal/config"
+	"github.com/saba-futai/sudoku/pkg/obfs/httpmask"
+)
+
+// TestWebSocketTransportThroughReverseProxy relays the tunnel through a stock
+// net/http reverse proxy, standing in for a CDN that only forwards WebSocket.
+func TestWebSocketTransportThroughReverseProxy(t *testing.T) {
+	for _, text := range []bool{false, true} {
+		t.Run(fmt.Sprintf("text=%v", text), func(t *testing.T) {
+			ports, _ := getFreePorts(3)
+			echoPort, serverPort, clientPort := ports[0], ports[1], ports[2]
+			startEchoServer(echoPort)
+
+			ascii := "prefer_entropy"
+			if text {
+				ascii = "prefer_ascii"
+			}
+			ws := &config.WebSocketConfig{Path: "/tunnel", Host: "cdn.example.com", Text: text}
+
+			startSudokuServer(&config.Config{
+				Mode:               "server",
+				LocalPort:          serverPort,
+				Key:                "ws-key",
+				AEAD:               "chacha20-poly1305",
+				ASCII:              ascii,
+				EnablePureDownlink: true,
+				PaddingMin:         5,
+				PaddingMax:         15,
+				WebSocket:          ws,
+			})
+
+			backend, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", serverPort))
+			mux := http.NewServeMux()
+			mux.Handle("/tunnel", httputil.NewSingleHostReverseProxy(backend))
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "site")
+			})
+			proxy := httptest.NewServer(mux)
+			defer proxy.Close()
+
+			startSudokuClient(&config.Config{
+				Mode:               "client",
+				LocalPort:          clientPort,
+				ServerAddress:      strings.TrimPrefix(proxy.URL, "http://"),
+				Key:                "ws-key",
+				AEAD:               "chacha20-poly1305",
+				ASCII:              ascii,
+				EnablePureDownlink: true,
+				PaddingMin:         5,
+				PaddingMax:         15,
+				ProxyMode:          "global",
+				WebSocket:          ws,
+			})
+
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+			if err != nil {
+				t.Fatalf("connect client: %v", err)
+			}
+			defer conn.Close()
+			sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+
+			payload := bytes.Repeat([]byte("websocket-transport-"), 4096)
+			go conn.Write(payload)
+			echo := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatalf("read echo: %v", err)
+			}
+			if !bytes.Equal(echo, payload) {
+				t.Fatalf("echo mismatch")
+			}
+		})
+	}
+}
+
+// TestWebSocketTransportWithMaskSecret runs the WebSocket transport against a
+// server that requires the mask secret: the upgrade path stands in for
+// require_path, while the secret header must still be present.
+func TestWebSocketTransportWithMaskSecret(t *testing.T) {
+	ports, _ := getFreePorts(4)
+	echoPort, serverPort, clientPort, webPort := ports[0], ports[1], ports[2], ports[3]
+	startEchoServer(echoPort)
+	startWebServer(webPort)
+
+	ws := &config.WebSocketConfig{Path: "/tunnel"}
+	secret := map[string]string{"X-Token": "ws-secret"}
+	startSudokuServer(&config.Config{
+		Mode:               "server",
+		LocalPort:          serverPort,
+		Key:                "ws-key",
+		AEAD:               "chacha20-poly1305",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		FallbackAddr:       fmt.Sprintf("127.0.0.1:%d", webPort),
+		HTTPMask:           &httpmask.Options{RequirePath: "/feed", RequireHeaders: secret},
+		WebSocket:          ws,
+	})
+	startSudokuClient(&config.Config{
+		Mode:               "client",
+		LocalPort:          clientPort,
+		ServerAddress:      fmt.Sprintf("127.0.0.1:%d", serverPort),
+		Key:                "ws-key",
+		AEAD:               "chacha20-poly1305",
+		ASCII:              "prefer_entropy",
+		EnablePureDownlink: true,
+		PaddingMin:         5,
+		PaddingMax:         15,
+		ProxyMode:          "global",
+		HTTPMask:           &httpmask.Options{RequireHeaders: secret},
+		WebSocket:          ws,
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+	if err != nil {
+		t.Fatalf("connect client: %v", err)
+	}
+	defer conn.Close()
+	sendHTTPConnect(t, conn, fmt.Sprintf("127.0.0.1:%d", echoPort))
+	payload := []byte("websocket-with-secret")
+	go conn.Write(payload)
+	echo := make([]byte, len(payload))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, payload) {
+		t.Fatalf("echo through websocket: %q %v", echo, err)
+	}
+
+	// 不带暗号的升级请求交给回落，而不是得到 101
+	probe, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	if err != nil {
+		t.Fatalf("dial server: %v", err)
+	}
+	defer probe.Close()
+	io.WriteString(probe, "GET /tunnel HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	probe.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(probe), nil)
+	if err != nil {
+		t.Fatalf("read probe response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "Hello Fallback" {
+		t.Fatalf("expected the fallback page, got %d %q", resp.StatusCode, body)
+	}
+}